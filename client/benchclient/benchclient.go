@@ -19,13 +19,14 @@
 package benchclient
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"time"
 
 	"github.com/nymtech/nym-mixnet/client"
 	"github.com/nymtech/nym-mixnet/config"
-	"github.com/nymtech/nym-mixnet/flags"
+	"github.com/nymtech/nym-mixnet/helpers"
 )
 
 const (
@@ -131,12 +132,15 @@ func (bc *BenchClient) RunBench() error {
 }
 
 func (bc *BenchClient) pregeneratePacket(message string, recipient config.ClientConfig) error {
-	sphinxPacket, err := bc.EncodeMessage([]byte(message), recipient)
+	sphinxPackets, err := bc.EncodeMessage([]byte(message), recipient)
 	if err != nil {
 		return err
 	}
+	if len(sphinxPackets) != 1 {
+		return errors.New("the pregenerated message does not fit into a single packet")
+	}
 
-	packetBytes, err := config.WrapWithFlag(flags.CommFlag, sphinxPacket)
+	packetBytes, err := helpers.WrapSphinxPacket(sphinxPackets[0])
 	if err != nil {
 		return err
 	}
@@ -153,8 +157,9 @@ func NewBenchClient(nc *client.NetClient, numMsgs int, interval time.Duration, p
 			Id:   "BenchmarkClientRecipient",
 			Host: "localhost",
 			Port: "9998",
-			PubKey: []byte{21, 103, 130, 37, 105, 58, 162, 113, 91, 198, 76, 156, 194, 36, 45,
-				219, 121, 158, 255, 247, 44, 159, 243, 155, 215, 90, 67, 103, 64, 242, 95, 45},
+			// the benchmark provider knows the corresponding private key to read the encrypted messages
+			PubKey: []byte{173, 243, 212, 122, 163, 90, 95, 133, 178, 169, 1, 1, 37, 137, 157,
+				134, 171, 147, 212, 0, 218, 197, 25, 234, 69, 114, 254, 225, 26, 58, 156, 65},
 			Provider: &config.MixConfig{
 				Id:   "BenchmarkProvider",
 				Host: "localhost",
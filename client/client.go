@@ -21,7 +21,6 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"math"
 	"net"
 	"os"
@@ -40,11 +39,16 @@ import (
 	"github.com/nymtech/nym-mixnet/logger"
 	"github.com/nymtech/nym-mixnet/networker"
 	"github.com/nymtech/nym-mixnet/sphinx"
+	"github.com/nymtech/nym-mixnet/telemetry"
 	"github.com/sirupsen/logrus"
 )
 
 const (
 	loopLoad = "LoopCoverMessage"
+
+	// kinds of the packets sent by the client, as reported by its metrics
+	packetKindReal  = "real"
+	packetKindCover = "cover"
 )
 
 // TODO: what is the point of this interface currently?
@@ -75,6 +79,35 @@ type NetClient struct {
 	haltOnce         sync.Once
 	log              *logrus.Logger
 	receivedMessages ReceivedMessages
+	reassembler      *clientcore.Reassembler
+	pool             *networker.ConnectionPool
+	metrics          *clientMetrics
+}
+
+// clientMetrics are the metrics of the traffic of the client.
+type clientMetrics struct {
+	registry *telemetry.Registry
+	// server serves the metrics of the registry, if enabled in the config
+	server                  *telemetry.Server
+	sentPackets             *telemetry.CounterVec
+	receivedMessages        *telemetry.Counter
+	topologyRefreshFailures *telemetry.Counter
+}
+
+func newClientMetrics(pool func() networker.PoolStats) *clientMetrics {
+	registry := telemetry.NewRegistry()
+	registry.NewGaugeFunc("nym_client_open_connections",
+		"Number of pooled connections to the provider.",
+		func() float64 { return float64(pool().Open) })
+	return &clientMetrics{
+		registry: registry,
+		sentPackets: registry.NewCounterVec("nym_client_packets_sent_total",
+			"Number of sphinx packets sent by the client.", "kind"),
+		receivedMessages: registry.NewCounter("nym_client_messages_received_total",
+			"Number of messages received by the client, excluding its loop cover messages."),
+		topologyRefreshFailures: registry.NewCounter("nym_client_topology_refresh_failures_total",
+			"Number of unsuccessful attempts to obtain the network topology from the directory server."),
+	}
 }
 
 func (c *NetClient) GetReceivedMessages() [][]byte {
@@ -115,6 +148,15 @@ func (c *NetClient) Start() error {
 
 	c.outQueue = make(chan []byte)
 
+	if len(c.cfg.Client.MetricsAddress) > 0 {
+		metricsServer, err := telemetry.ListenAndServe(c.cfg.Client.MetricsAddress, c.metrics.registry)
+		if err != nil {
+			return err
+		}
+		c.log.Infof("Serving metrics on %s", metricsServer.Addr())
+		c.metrics.server = metricsServer
+	}
+
 	initialTopology, err := topology.GetNetworkTopology(c.cfg.Client.DirectoryServerTopologyEndpoint)
 	if err != nil {
 		return err
@@ -127,7 +169,7 @@ func (c *NetClient) Start() error {
 	if providerPresence, err = getProvider(initialTopology.MixProviderNodes, c.cfg.Client.ProviderID); err != nil {
 		return fmt.Errorf("specified provider does not seem to be online: %v", c.cfg.Client.ProviderID)
 	}
-	provider, err := topology.ProviderPresenceToConfig(providerPresence)
+	provider, err := topology.ProviderPresenceToConfig(providerPresence, initialTopology.PacketVersions)
 	// provider, err := providerFromTopology(initialTopology)
 	if err != nil {
 		return err
@@ -172,7 +214,6 @@ func (c *NetClient) Wait() {
 }
 
 // Shutdown cleanly shuts down a given client instance.
-// TODO: create daemon to call this upon sigterm or something
 func (c *NetClient) Shutdown() {
 	c.haltOnce.Do(func() { c.halt() })
 }
@@ -181,6 +222,12 @@ func (c *NetClient) Shutdown() {
 func (c *NetClient) halt() {
 	c.log.Infof("Starting graceful shutdown")
 	// close any listeners, free resources, etc
+	c.pool.Close()
+	if c.metrics.server != nil {
+		if err := c.metrics.server.Close(); err != nil {
+			c.log.Errorf("Failed to stop serving metrics: %v", err)
+		}
+	}
 
 	close(c.haltedCh)
 }
@@ -188,10 +235,12 @@ func (c *NetClient) halt() {
 func (c *NetClient) UpdateNetworkView() error {
 	newTopology, err := topology.GetNetworkTopology(c.cfg.Client.DirectoryServerTopologyEndpoint)
 	if err != nil {
+		c.metrics.topologyRefreshFailures.Inc()
 		c.log.Errorf("error while reading network topology: %v", err)
 		return err
 	}
 	if err := c.ReadInNetworkFromTopology(newTopology); err != nil {
+		c.metrics.topologyRefreshFailures.Inc()
 		c.log.Errorf("error while trying to update topology: %v", err)
 		return err
 	}
@@ -232,54 +281,55 @@ func (c *NetClient) SendMessage(message []byte, recipient config.ClientConfig) e
 		c.log.Errorf("error in updating topology: %v", err)
 		return err
 	}
-	packet, err := c.encodeMessage(message, recipient)
+	packets, err := c.encodeMessage(message, recipient)
 	if err != nil {
 		c.log.Errorf("Error in sending message - encode message returned error: %v", err)
 		return err
 	}
-	c.outQueue <- packet
+	for _, packet := range packets {
+		c.outQueue <- packet
+	}
 	return nil
 }
 
-// encodeMessage encapsulates the given message into a sphinx packet destinated for recipient
-// and wraps with the flag pointing that it is the communication packet
-func (c *NetClient) encodeMessage(message []byte, recipient config.ClientConfig) ([]byte, error) {
-	sphinxPacket, err := c.EncodeMessage(message, recipient)
+// encodeMessage encapsulates the given message into sphinx packets, one for each of its fragments,
+// destinated for recipient and wraps them with the flag pointing that they are communication packets
+func (c *NetClient) encodeMessage(message []byte, recipient config.ClientConfig) ([][]byte, error) {
+	sphinxPackets, err := c.EncodeMessage(message, recipient)
 	if err != nil {
 		c.log.Errorf("Error in sending message - create sphinx packet returned an error: %v", err)
 		return nil, err
 	}
 
-	packetBytes, err := config.WrapWithFlag(flags.CommFlag, sphinxPacket)
-	if err != nil {
-		c.log.Errorf("Error in sending message - wrap with flag returned an error: %v", err)
-		return nil, err
+	packets := make([][]byte, len(sphinxPackets))
+	for i, sphinxPacket := range sphinxPackets {
+		packets[i], err = helpers.WrapSphinxPacket(sphinxPacket)
+		if err != nil {
+			c.log.Errorf("Error in sending message - wrap with flag returned an error: %v", err)
+			return nil, err
+		}
 	}
-	return packetBytes, nil
+	return packets, nil
 }
 
-// Send opens a connection with selected network address
-// and send the passed packet. If connection failed or
+// Send sends the passed packet over the pooled link
+// to the selected node, authenticated with its public key. If connection failed or
 // the packet could not be send, an error is returned
-// Otherwise it returns the response sent by server
-func (c *NetClient) send(packet []byte, host string, port string) (config.ProviderResponse, error) {
-
-	conn, err := net.Dial("tcp", net.JoinHostPort(host, port))
-
-	if err != nil {
-		c.log.Errorf("Error in send - dial returned an error: %v", err)
-		return config.ProviderResponse{}, err
-	}
-	defer conn.Close()
-
-	if _, err := conn.Write(packet); err != nil {
-		c.log.Errorf("Failed to write to connection: %v", err)
-		return config.ProviderResponse{}, err
+func (c *NetClient) send(packet []byte, node config.MixConfig) error {
+	if err := c.pool.Send(net.JoinHostPort(node.Host, node.Port), node.PubKey, packet); err != nil {
+		c.log.Errorf("Error in send - sending the packet returned an error: %v", err)
+		return err
 	}
+	return nil
+}
 
-	buff, err := ioutil.ReadAll(conn)
+// Request sends the passed request packet over the pooled link
+// to the selected node and returns the response sent by server.
+// If the request could not be send or the response is invalid, an error is returned.
+func (c *NetClient) request(packet []byte, node config.MixConfig) (config.ProviderResponse, error) {
+	buff, err := c.pool.Request(net.JoinHostPort(node.Host, node.Port), node.PubKey, packet)
 	if err != nil {
-		c.log.Errorf("Failed to read response: %v", err)
+		c.log.Errorf("Error in request - sending the request returned an error: %v", err)
 		return config.ProviderResponse{}, err
 	}
 
@@ -300,15 +350,16 @@ func (c *NetClient) registerToken(token []byte) {
 
 // ProcessPacket processes the received sphinx packet and returns the
 // encapsulated message or error in case the processing
-// was unsuccessful.
+// was unsuccessful. The packet can either be a reply sent using one of our reply blocks
+// or a forward message encrypted to our key. If the packet carried a fragment of a message,
+// which was not fully received yet, processPacket returns nil.
+// The client does not reply to the received messages, so the reply blocks attached to them are ignored.
 func (c *NetClient) processPacket(packet []byte) ([]byte, error) {
-
-	// c.log.Debugf(" Processing packet")
-	// c.log.Tracef("Removing first 37 bytes of the message")
-	if len(packet) > 38 {
-		return packet[38:], nil
+	fragment, _, err := c.DecodeMessage(packet)
+	if err != nil {
+		return nil, err
 	}
-	return packet, nil
+	return c.reassembler.AddFragment(fragment)
 }
 
 func (c *NetClient) startTraffic() {
@@ -348,7 +399,7 @@ func (c *NetClient) sendRegisterMessageToProvider() error {
 		return err
 	}
 
-	response, err := c.send(pktBytes, c.Provider.Host, c.Provider.Port)
+	response, err := c.request(pktBytes, c.Provider)
 	if err != nil {
 		c.log.Errorf("Error in register provider - send registration packet returned an error: %v", err)
 		return err
@@ -381,7 +432,7 @@ func (c *NetClient) getMessagesFromProvider() error {
 		return err
 	}
 
-	response, err := c.send(pktBytes, c.Provider.Host, c.Provider.Port)
+	response, err := c.request(pktBytes, c.Provider)
 	if err != nil {
 		return err
 	}
@@ -394,6 +445,11 @@ func (c *NetClient) getMessagesFromProvider() error {
 		packetData, err := c.processPacket(packet.Data)
 		if err != nil {
 			c.log.Errorf("Error in processing received packet: %v", err)
+			continue
+		}
+		if packetData == nil {
+			c.log.Debugf("Received fragment of an incomplete message")
+			continue
 		}
 		packetDataStr := string(packetData)
 		switch packetDataStr {
@@ -401,6 +457,7 @@ func (c *NetClient) getMessagesFromProvider() error {
 			c.log.Debugf("Received loop cover message %v", packetDataStr)
 		default:
 			c.log.Infof("Received new message: %v", packetDataStr)
+			c.metrics.receivedMessages.Inc()
 			c.addNewMessage(packetData)
 		}
 	}
@@ -419,24 +476,24 @@ func (c *NetClient) controlOutQueue() error {
 			c.log.Infof("Halting controlOutQueue")
 			return nil
 		case realPacket := <-c.outQueue:
-			response, err := c.send(realPacket, c.Provider.Host, c.Provider.Port)
-			if err != nil {
+			if err := c.send(realPacket, c.Provider); err != nil {
 				c.log.Errorf("Could not send real packet: %v", err)
+			} else {
+				c.metrics.sentPackets.WithLabel(packetKindReal).Inc()
 			}
 			c.log.Debugf("Real packet was sent")
-			c.log.Debugf("Received response: %v", response)
 		default:
 			if !c.cfg.Debug.RateCompliantCoverMessagesDisabled {
 				dummyPacket, err := c.createLoopCoverMessage()
 				if err != nil {
 					return err
 				}
-				response, err := c.send(dummyPacket, c.Provider.Host, c.Provider.Port)
-				if err != nil {
+				if err := c.send(dummyPacket, c.Provider); err != nil {
 					c.log.Errorf("Could not send dummy packet: %v", err)
+				} else {
+					c.metrics.sentPackets.WithLabel(packetKindCover).Inc()
 				}
 				c.log.Debugf("Dummy packet was sent")
-				c.log.Debugf("Received response: %v", response)
 			}
 		}
 		err := delayBeforeContinue(c.cfg.Debug.MessageSendingRate)
@@ -472,11 +529,11 @@ func (c *NetClient) controlMessagingFetching() {
 // a sphinx packet. The loop message is destinated back to the sender
 // createLoopCoverMessage returns a byte representation of the encapsulated packet and an error
 func (c *NetClient) createLoopCoverMessage() ([]byte, error) {
-	sphinxPacket, err := c.EncodeMessage([]byte(loopLoad), c.config)
+	sphinxPackets, err := c.EncodeMessage([]byte(loopLoad), c.config)
 	if err != nil {
 		return nil, err
 	}
-	packetBytes, err := config.WrapWithFlag(flags.CommFlag, sphinxPacket)
+	packetBytes, err := helpers.WrapSphinxPacket(sphinxPackets[0])
 	if err != nil {
 		return nil, err
 	}
@@ -498,13 +555,12 @@ func (c *NetClient) runLoopCoverTrafficStream() error {
 			if err != nil {
 				return err
 			}
-			response, err := c.send(loopPacket, c.Provider.Host, c.Provider.Port)
-			if err != nil {
+			if err := c.send(loopPacket, c.Provider); err != nil {
 				c.log.Errorf("Could not send loop cover traffic message: %v", err)
 				return err
 			}
+			c.metrics.sentPackets.WithLabel(packetKindCover).Inc()
 			c.log.Debugf("Loop message sent")
-			c.log.Debugf("Received response: %v", response)
 
 			if err := delayBeforeContinue(c.cfg.Debug.LoopCoverTrafficRate); err != nil {
 				return err
@@ -536,15 +592,15 @@ func (c *NetClient) turnOnLoopCoverTraffic() {
 // from the topology and stores them locally. In case
 // the connection or fetching data from the PKI went wrong,
 // an error is returned.
-func (c *NetClient) ReadInNetworkFromTopology(topologyData *models.Topology) error {
+func (c *NetClient) ReadInNetworkFromTopology(topologyData *topology.Topology) error {
 	c.log.Debugf("Reading network information from the PKI")
 
-	mixes, err := topology.GetMixesPKI(topologyData.MixNodes)
+	mixes, err := topology.GetMixesPKI(topologyData.MixNodes, topologyData.PacketVersions)
 	if err != nil {
 		c.log.Errorf("error while reading mixes from PKI: %v", err)
 		return err
 	}
-	clients, err := topology.GetClientPKI(topologyData.MixProviderNodes)
+	clients, err := topology.GetClientPKI(topologyData.MixProviderNodes, topologyData.PacketVersions)
 	if err != nil {
 		c.log.Errorf("error while reading clients from PKI: %v", err)
 		return err
@@ -557,14 +613,14 @@ func (c *NetClient) ReadInNetworkFromTopology(topologyData *models.Topology) err
 
 // TODO: make it variable, perhaps choose provider with least number of clients? or by preference?
 // But for now just get the first provider on the list
-func providerFromTopology(initialTopology *models.Topology) (config.MixConfig, error) {
+func providerFromTopology(initialTopology *topology.Topology) (config.MixConfig, error) {
 	if initialTopology == nil || initialTopology.MixProviderNodes == nil || len(initialTopology.MixProviderNodes) == 0 {
 		return config.MixConfig{}, errors.New("invalid topology")
 	}
 
 	for _, v := range initialTopology.MixProviderNodes {
 		// get the first entry
-		return topology.ProviderPresenceToConfig(v)
+		return topology.ProviderPresenceToConfig(v, initialTopology.PacketVersions)
 	}
 	return config.MixConfig{}, errors.New("unknown state")
 }
@@ -594,6 +650,7 @@ func NewClient(cfg *clientConfig.Config) (*NetClient, error) {
 		clientcore.NetworkPKI{},
 		baseLogger.GetLogger("cryptoClient "+cfg.Client.ID),
 	)
+	core.RedundancyRatio = cfg.Reliability.RedundancyRatio
 
 	log := baseLogger.GetLogger(cfg.Client.ID)
 
@@ -604,8 +661,12 @@ func NewClient(cfg *clientConfig.Config) (*NetClient, error) {
 		receivedMessages: ReceivedMessages{
 			messages: make([][]byte, 0, 20),
 		},
+		reassembler: clientcore.NewReassembler(clientcore.DefaultReassemblyTimeout, clientcore.DefaultReassemblyMemory),
+		pool:        networker.NewConnectionPool(networker.DefaultIdleTimeout, networker.StaticLinkKeys(prvKey, pubKey)),
 	}
 
+	c.metrics = newClientMetrics(c.pool.Stats)
+
 	c.log.Infof("Logging level set to %v", c.cfg.Logging.Level)
 
 	b64Key := base64.URLEncoding.EncodeToString(c.GetPublicKey().Bytes())
@@ -645,12 +706,16 @@ func NewTestClient(cfg *clientConfig.Config, prvKey *sphinx.PrivateKey, pubKey *
 		clientcore.NetworkPKI{},
 		disabledLog,
 	)
+	core.RedundancyRatio = cfg.Reliability.RedundancyRatio
 
 	c := NetClient{CryptoClient: core,
-		cfg:      cfg,
-		haltedCh: make(chan struct{}),
-		log:      disabledLog,
+		cfg:         cfg,
+		haltedCh:    make(chan struct{}),
+		log:         disabledLog,
+		reassembler: clientcore.NewReassembler(clientcore.DefaultReassemblyTimeout, clientcore.DefaultReassemblyMemory),
+		pool:        networker.NewConnectionPool(networker.DefaultIdleTimeout, networker.StaticLinkKeys(prvKey, pubKey)),
 	}
+	c.metrics = newClientMetrics(c.pool.Stats)
 
 	b64Key := base64.URLEncoding.EncodeToString(c.GetPublicKey().Bytes())
 
@@ -17,6 +17,7 @@ package config
 import (
 	"errors"
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
 
@@ -40,6 +41,8 @@ const (
 	defaultFetchMessageRate     = 10.0
 	defaultMessageSendingRate   = 10.0
 
+	defaultRedundancyRatio = 0.0
+
 	defaultDirectoryServerTopologyEndpoint      = mainConfig.DirectoryServerTopology
 	DefaultLocalDirectoryServerTopologyEndpoint = mainConfig.LocalDirectoryServerTopology
 )
@@ -97,6 +100,10 @@ type Client struct {
 	// ProviderID specifies ID of the provider to which the client should send messages.
 	// If initially omitted, a random provider will be chosen from the available topology.
 	ProviderID string `toml:"provider_id"`
+
+	// MetricsAddress specifies the address, in the form of host:port, on which the metrics of the client
+	// are served over HTTP in the Prometheus text format. If omitted, the metrics are not served.
+	MetricsAddress string `toml:"metrics_address"`
 }
 
 // DefaultClientConfig returns default Client config for provided clientID.
@@ -153,6 +160,12 @@ func (cfg *Client) validateAndApplyDefaults() error {
 		return errors.New("config: client ID was not specified")
 	}
 
+	if len(cfg.MetricsAddress) > 0 {
+		if _, _, err := net.SplitHostPort(cfg.MetricsAddress); err != nil {
+			return fmt.Errorf("config: invalid metrics address: %s (%v)", cfg.MetricsAddress, err)
+		}
+	}
+
 	// for the rest, if left unspecified, use defaults
 	if len(cfg.DirectoryServerTopologyEndpoint) == 0 {
 		cfg.DirectoryServerTopologyEndpoint = defaultDirectoryServerTopologyEndpoint
@@ -250,11 +263,35 @@ func DefaultDebugConfig() *Debug {
 	}
 }
 
+// Reliability is the Nym Client configuration of the forward error correction of the sent messages.
+type Reliability struct {
+	// RedundancyRatio defines the number of parity fragments sent along with every message,
+	// relative to the number of its data fragments. The message can be reconstructed as long as
+	// the number of its lost fragments does not exceed the number of the parity fragments.
+	// If set to zero, no parity fragments are sent.
+	RedundancyRatio float64 `toml:"redundancy_ratio"`
+}
+
+func (rCfg *Reliability) validate() error {
+	if rCfg.RedundancyRatio < 0.0 {
+		return fmt.Errorf("config: invalid redundancy ratio: %v", rCfg.RedundancyRatio)
+	}
+	return nil
+}
+
+// DefaultReliabilityConfig returns default reliability configuration.
+func DefaultReliabilityConfig() *Reliability {
+	return &Reliability{
+		RedundancyRatio: defaultRedundancyRatio,
+	}
+}
+
 // Config is the top level Nym Client configuration.
 type Config struct {
-	Client  *Client  `toml:"client"`
-	Logging *Logging `toml:"logging"`
-	Debug   *Debug   `toml:"debug"`
+	Client      *Client      `toml:"client"`
+	Logging     *Logging     `toml:"logging"`
+	Debug       *Debug       `toml:"debug"`
+	Reliability *Reliability `toml:"reliability"`
 }
 
 // DefaultConfig returns full default config for given clientID
@@ -264,9 +301,10 @@ func DefaultConfig(clientID string) (*Config, error) {
 	}
 	defaultClientConfig, _ := DefaultClientConfig(clientID)
 	return &Config{
-		Client:  defaultClientConfig,
-		Logging: DefaultLoggingConfig(clientID),
-		Debug:   DefaultDebugConfig(),
+		Client:      defaultClientConfig,
+		Logging:     DefaultLoggingConfig(clientID),
+		Debug:       DefaultDebugConfig(),
+		Reliability: DefaultReliabilityConfig(),
 	}, nil
 }
 
@@ -284,6 +322,14 @@ func (cfg *Config) validateAndApplyDefaults() error {
 	}
 	cfg.Debug.applyDefaults()
 
+	if cfg.Reliability == nil {
+		cfg.Reliability = DefaultReliabilityConfig()
+	}
+
+	if err := cfg.Reliability.validate(); err != nil {
+		return err
+	}
+
 	if cfg.Logging == nil {
 		cfg.Logging = DefaultLoggingConfig(cfg.Client.ID)
 	}
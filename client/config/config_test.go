@@ -129,6 +129,13 @@ func TestValidateClientBlock(t *testing.T) {
 
 	fullCfg.Client.ID = ""
 	assert.Error(t, fullCfg.validateAndApplyDefaults())
+
+	fullCfg, err = DefaultConfig(someID)
+	assert.NotNil(t, fullCfg)
+	assert.Nil(t, err)
+
+	fullCfg.Client.MetricsAddress = "missing.port"
+	assert.Error(t, fullCfg.validateAndApplyDefaults())
 }
 
 func TestValidateLogging(t *testing.T) {
@@ -182,6 +189,19 @@ func TestValidateLogging(t *testing.T) {
 	}
 }
 
+func TestValidateReliability(t *testing.T) {
+	someID := "foo"
+	fullCfg, err := DefaultConfig(someID)
+	assert.NotNil(t, fullCfg)
+	assert.Nil(t, err)
+
+	fullCfg.Reliability.RedundancyRatio = 0.5
+	assert.Nil(t, fullCfg.validateAndApplyDefaults())
+
+	fullCfg.Reliability.RedundancyRatio = -1.0
+	assert.Error(t, fullCfg.validateAndApplyDefaults())
+}
+
 func TestLoadBinary(t *testing.T) {
 	cfg, err := LoadBinary([]byte(""))
 	assert.Nil(t, cfg)
@@ -247,12 +267,14 @@ func TestWriteConfig(t *testing.T) {
 
 	fullCfg.Client.HomeDirectory = "/foomp/.nym"
 	fullCfg.Client.DirectoryServerTopologyEndpoint = "localhost:8080"
+	fullCfg.Client.MetricsAddress = "127.0.0.1:9100"
 
 	// set some nondefault values
 	fullCfg.Logging.Disable = true
 	fullCfg.Logging.Level = "panic"
 
 	fullCfg.Debug.FetchMessageRate = 42.0
+	fullCfg.Reliability.RedundancyRatio = 0.25
 
 	assert.Nil(t, WriteConfigFile(outFilePath, fullCfg))
 
@@ -108,6 +108,10 @@ provider_id = "{{ .Client.ProviderID }}"
 # directory for mixapps, such as a chat client, to store their app-specific data.
 mixapps_directory = "{{ .Client.MixAppsDirectory }}"
 
+# Address, in the form of host:port, on which the metrics of the client are served over HTTP
+# in the Prometheus text format at /metrics. If left empty, the metrics are not served.
+metrics_address = "{{ .Client.MetricsAddress }}"
+
 ##### advanced configuration options #####
 
 # Absolute path to the home Nym Clients directory.
@@ -156,5 +160,13 @@ message_sending_rate = {{FormatFloats .Debug.MessageSendingRate }}
 # thus decreasing the anonymity.
 rate_compliant_cover_messages_disabled = {{ .Debug.RateCompliantCoverMessagesDisabled }}
 
+##### reliability configuration options #####
+[reliability]
+
+# The number of parity fragments sent along with every message, relative to the number of its data fragments.
+# The message can be reconstructed as long as the number of its lost fragments does not exceed
+# the number of the parity fragments. If set to zero, no parity fragments are sent.
+redundancy_ratio = {{FormatFloats .Reliability.RedundancyRatio }}
+
 
 `
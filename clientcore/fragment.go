@@ -0,0 +1,378 @@
+// Copyright 2019 The Nym Mixnet Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clientcore
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/nymtech/nym-mixnet/erasure"
+	"github.com/nymtech/nym-mixnet/sphinx"
+)
+
+const (
+	// fragmentIDSize is the size of the random identifier shared by all the fragments of a message.
+	fragmentIDSize = 16
+
+	// fragmentHeaderSize is the size of the identifier, the index, the total count and the parity count
+	// preceding the fragment data.
+	fragmentHeaderSize = fragmentIDSize + 2 + 2 + 2
+
+	// messageLengthSize is the size of the length of the message, which is prepended to the messages
+	// sent with parity fragments, so that the padding of their last data fragment can be removed.
+	messageLengthSize = 4
+
+	// MaxFragmentDataSize is the maximum number of bytes of the message carried by a single fragment,
+	// so that the encrypted fragment fits into a single forward packet.
+	MaxFragmentDataSize = sphinx.MaxMessageSize - sphinx.EnvelopeOverhead - fragmentHeaderSize
+
+	// MaxFragments is the maximum number of fragments a single message can be split into.
+	MaxFragments = math.MaxUint16
+
+	// DefaultReassemblyTimeout is the time after which the fragments of an incomplete message are discarded.
+	DefaultReassemblyTimeout = 5 * time.Minute
+
+	// DefaultReassemblyMemory is the maximum number of bytes of fragments buffered while waiting
+	// for the rest of their messages.
+	DefaultReassemblyMemory = 16 * 1024 * 1024
+
+	// maximumPendingMessages is the maximum number of messages, including the already reassembled ones,
+	// the reassembler keeps track of. If it is exceeded, the oldest messages are discarded.
+	maximumPendingMessages = 4096
+
+	// fragmentSlotSize is the memory taken by the slot of a single fragment of the pending message,
+	// which is allocated for all of its fragments as soon as the first one arrives.
+	fragmentSlotSize = 24
+)
+
+var (
+	// ErrMessageTooLong defines an error when the message cannot be split into at most MaxFragments fragments.
+	ErrMessageTooLong = errors.New("message is too long to be fragmented")
+	// ErrInvalidFragment defines an error when the received fragment is malformed
+	// or inconsistent with the other fragments of its message.
+	ErrInvalidFragment = errors.New("invalid message fragment")
+	// ErrMessageTooLarge defines an error when the message announced by the fragment
+	// could not be reassembled within the memory limit.
+	ErrMessageTooLarge = errors.New("fragmented message is too large to be reassembled")
+)
+
+// Fragment is a part of a message sent in a single packet. The message is reassembled by the recipient
+// once all Total fragments sharing the same ID were received. If Parity is non-zero, the last Parity
+// of the fragments are the Reed-Solomon parity of the others and any Total-Parity fragments suffice.
+type Fragment struct {
+	ID     [fragmentIDSize]byte
+	Index  uint16
+	Total  uint16
+	Parity uint16
+	Data   []byte
+}
+
+// Bytes encodes the fragment as its identifier, index, total count and parity count,
+// followed by the fragment data.
+func (f *Fragment) Bytes() []byte {
+	b := make([]byte, fragmentHeaderSize+len(f.Data))
+	copy(b, f.ID[:])
+	binary.BigEndian.PutUint16(b[fragmentIDSize:], f.Index)
+	binary.BigEndian.PutUint16(b[fragmentIDSize+2:], f.Total)
+	binary.BigEndian.PutUint16(b[fragmentIDSize+4:], f.Parity)
+	copy(b[fragmentHeaderSize:], f.Data)
+	return b
+}
+
+// ParseFragment decodes the fragment encoded with Bytes.
+// It returns ErrInvalidFragment if the fragment is malformed.
+func ParseFragment(b []byte) (*Fragment, error) {
+	if len(b) < fragmentHeaderSize || len(b)-fragmentHeaderSize > MaxFragmentDataSize {
+		return nil, ErrInvalidFragment
+	}
+
+	f := &Fragment{
+		Index:  binary.BigEndian.Uint16(b[fragmentIDSize:]),
+		Total:  binary.BigEndian.Uint16(b[fragmentIDSize+2:]),
+		Parity: binary.BigEndian.Uint16(b[fragmentIDSize+4:]),
+		Data:   b[fragmentHeaderSize:],
+	}
+	copy(f.ID[:], b)
+	if f.Total == 0 || f.Index >= f.Total || f.Parity >= f.Total {
+		return nil, ErrInvalidFragment
+	}
+	if f.Parity > 0 && int(f.Total) > erasure.MaxShards {
+		return nil, ErrInvalidFragment
+	}
+	return f, nil
+}
+
+// fragmentMessage splits the message into fragments of at most MaxFragmentDataSize bytes,
+// identified by an identifier read from the given source of randomness.
+// Even an empty message is sent as a single fragment. If the redundancy is positive, the data fragments
+// are followed by the parity fragments, redundancy times as many as the data fragments, rounded up.
+// The parity is limited so that the fragments do not exceed the erasure.MaxShards and is omitted
+// altogether for the messages which are too long to be protected.
+func fragmentMessage(random io.Reader, message []byte, redundancy float64) ([]*Fragment, error) {
+	var id [fragmentIDSize]byte
+	if _, err := io.ReadFull(random, id[:]); err != nil {
+		return nil, err
+	}
+
+	if redundancy > 0 {
+		payload := make([]byte, messageLengthSize+len(message))
+		binary.BigEndian.PutUint32(payload, uint32(len(message)))
+		copy(payload[messageLengthSize:], message)
+
+		data := fragmentCount(len(payload))
+		parity := int(math.Ceil(float64(data) * redundancy))
+		if data+parity > erasure.MaxShards {
+			parity = erasure.MaxShards - data
+		}
+		if parity > 0 {
+			return parityFragments(id, payload, data, parity)
+		}
+	}
+
+	total := fragmentCount(len(message))
+	if total > MaxFragments {
+		return nil, ErrMessageTooLong
+	}
+
+	fragments := make([]*Fragment, total)
+	for i := range fragments {
+		end := (i + 1) * MaxFragmentDataSize
+		if end > len(message) {
+			end = len(message)
+		}
+		fragments[i] = &Fragment{ID: id,
+			Index: uint16(i),
+			Total: uint16(total),
+			Data:  message[i*MaxFragmentDataSize : end],
+		}
+	}
+	return fragments, nil
+}
+
+// parityFragments splits the payload into data fragments of equal size, padding the last of them with zeros,
+// and appends the given number of parity fragments.
+func parityFragments(id [fragmentIDSize]byte, payload []byte, data int, parity int) ([]*Fragment, error) {
+	size := (len(payload) + data - 1) / data
+	padded := make([]byte, data*size)
+	copy(padded, payload)
+
+	shards := make([][]byte, data+parity)
+	for i := 0; i < data; i++ {
+		shards[i] = padded[i*size : (i+1)*size]
+	}
+	encoder, err := erasure.NewEncoder(data, parity)
+	if err != nil {
+		return nil, err
+	}
+	if err := encoder.Encode(shards); err != nil {
+		return nil, err
+	}
+
+	fragments := make([]*Fragment, len(shards))
+	for i := range fragments {
+		fragments[i] = &Fragment{ID: id,
+			Index:  uint16(i),
+			Total:  uint16(len(shards)),
+			Parity: uint16(parity),
+			Data:   shards[i],
+		}
+	}
+	return fragments, nil
+}
+
+// fragmentCount returns the number of fragments required to carry the given number of bytes.
+func fragmentCount(length int) int {
+	if length == 0 {
+		return 1
+	}
+	return (length + MaxFragmentDataSize - 1) / MaxFragmentDataSize
+}
+
+// pendingMessage holds the fragments of a message which was not fully received yet.
+// Once the message is reassembled, its fragments are released, but it is kept until the timeout
+// to ignore its remaining fragments.
+type pendingMessage struct {
+	fragments [][]byte
+	parity    uint16
+	received  int
+	size      int
+	// memory is the memory taken by the fragments, including their slots, charged to the reassembler
+	memory    int
+	firstSeen time.Time
+	done      bool
+}
+
+// reassemble joins the data fragments of the message, reconstructing the missing ones
+// from the parity fragments if needed.
+func (m *pendingMessage) reassemble() ([]byte, error) {
+	data := len(m.fragments) - int(m.parity)
+	if m.parity > 0 {
+		encoder, err := erasure.NewEncoder(data, int(m.parity))
+		if err != nil {
+			return nil, err
+		}
+		if err := encoder.ReconstructData(m.fragments); err != nil {
+			return nil, ErrInvalidFragment
+		}
+	}
+
+	message := make([]byte, 0, m.size)
+	for _, fragment := range m.fragments[:data] {
+		message = append(message, fragment...)
+	}
+	if m.parity == 0 {
+		return message, nil
+	}
+
+	if len(message) < messageLengthSize {
+		return nil, ErrInvalidFragment
+	}
+	length := binary.BigEndian.Uint32(message)
+	if uint64(length) > uint64(len(message)-messageLengthSize) {
+		return nil, ErrInvalidFragment
+	}
+	return message[messageLengthSize : messageLengthSize+int(length)], nil
+}
+
+// Reassembler buffers the received fragments until all the fragments of their message arrive.
+// Messages which are not completed within the timeout are discarded and, if the fragments exceed
+// the memory limit or too many messages are tracked, the oldest messages are discarded first.
+type Reassembler struct {
+	sync.Mutex
+	timeout   time.Duration
+	maxMemory int
+	memory    int
+	pending   map[[fragmentIDSize]byte]*pendingMessage
+	// order holds identifiers of the pending messages in the order their first fragments arrived
+	order [][fragmentIDSize]byte
+}
+
+// AddFragment adds the received fragment to its message. If the message can be reassembled
+// with this fragment, it is returned, otherwise AddFragment returns nil.
+// Duplicated fragments and fragments of already reassembled messages are ignored.
+// AddFragment returns ErrMessageTooLarge if the message could never fit within the memory limit
+// and ErrInvalidFragment if the fragment of a message split into multiple fragments carries no data.
+func (r *Reassembler) AddFragment(f *Fragment) ([]byte, error) {
+	if f.Total == 1 {
+		return f.Data, nil
+	}
+	if len(f.Data) == 0 {
+		return nil, ErrInvalidFragment
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	now := time.Now()
+	r.expire(now)
+
+	needed := int(f.Total) - int(f.Parity)
+	if needed*MaxFragmentDataSize+int(f.Total)*fragmentSlotSize > r.maxMemory {
+		return nil, ErrMessageTooLarge
+	}
+
+	msg, ok := r.pending[f.ID]
+	if !ok {
+		for len(r.pending) >= maximumPendingMessages {
+			r.remove(r.order[0])
+		}
+		msg = &pendingMessage{fragments: make([][]byte, f.Total),
+			parity:    f.Parity,
+			memory:    int(f.Total) * fragmentSlotSize,
+			firstSeen: now,
+		}
+		r.pending[f.ID] = msg
+		r.order = append(r.order, f.ID)
+		r.memory += msg.memory
+	}
+	if msg.done {
+		return nil, nil
+	}
+	if len(msg.fragments) != int(f.Total) || msg.parity != f.Parity {
+		return nil, ErrInvalidFragment
+	}
+	if msg.fragments[f.Index] != nil {
+		return nil, nil
+	}
+
+	msg.fragments[f.Index] = append(make([]byte, 0, len(f.Data)), f.Data...)
+	msg.received++
+	msg.size += len(f.Data)
+	msg.memory += len(f.Data)
+	r.memory += len(f.Data)
+
+	if msg.received == needed {
+		message, err := msg.reassemble()
+		r.memory -= msg.memory
+		msg.fragments, msg.size, msg.memory, msg.done = nil, 0, 0, true
+		return message, err
+	}
+
+	for r.memory > r.maxMemory {
+		r.remove(r.order[0])
+	}
+	return nil, nil
+}
+
+// Pending returns the number of messages, which were only partially received.
+func (r *Reassembler) Pending() int {
+	r.Lock()
+	defer r.Unlock()
+	pending := 0
+	for _, msg := range r.pending {
+		if !msg.done {
+			pending++
+		}
+	}
+	return pending
+}
+
+// expire discards the messages, which were not completed within the timeout,
+// and forgets the messages reassembled before the timeout.
+func (r *Reassembler) expire(now time.Time) {
+	for len(r.order) > 0 && now.Sub(r.pending[r.order[0]].firstSeen) > r.timeout {
+		r.remove(r.order[0])
+	}
+}
+
+// remove discards the pending message with the given identifier.
+func (r *Reassembler) remove(id [fragmentIDSize]byte) {
+	msg, ok := r.pending[id]
+	if !ok {
+		return
+	}
+	r.memory -= msg.memory
+	delete(r.pending, id)
+	for i := range r.order {
+		if r.order[i] == id {
+			r.order = append(r.order[:i], r.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// NewReassembler creates a reassembler discarding the incomplete messages after the given timeout
+// and buffering at most maxMemory bytes of fragments.
+func NewReassembler(timeout time.Duration, maxMemory int) *Reassembler {
+	return &Reassembler{
+		timeout:   timeout,
+		maxMemory: maxMemory,
+		pending:   make(map[[fragmentIDSize]byte]*pendingMessage),
+	}
+}
@@ -0,0 +1,265 @@
+// Copyright 2019 The Nym Mixnet Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clientcore
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/nymtech/nym-mixnet/erasure"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFragmentMessage(t *testing.T) {
+	message := make([]byte, 2*MaxFragmentDataSize+10)
+	_, err := rand.Read(message)
+	assert.Nil(t, err)
+
+	fragments, err := fragmentMessage(rand.Reader, message, 0)
+	assert.Nil(t, err)
+	assert.Len(t, fragments, 3)
+
+	var joined []byte
+	for i, fragment := range fragments {
+		assert.Equal(t, fragments[0].ID, fragment.ID)
+		assert.Equal(t, uint16(i), fragment.Index)
+		assert.Equal(t, uint16(3), fragment.Total)
+
+		parsed, err := ParseFragment(fragment.Bytes())
+		assert.Nil(t, err)
+		assert.Equal(t, fragment, parsed)
+		joined = append(joined, parsed.Data...)
+	}
+	assert.Equal(t, message, joined)
+
+	fragments, err = fragmentMessage(rand.Reader, nil, 0)
+	assert.Nil(t, err)
+	assert.Len(t, fragments, 1)
+
+	_, err = fragmentMessage(rand.Reader, make([]byte, MaxFragments*MaxFragmentDataSize+1), 0)
+	assert.Equal(t, ErrMessageTooLong, err)
+
+	_, err = fragmentMessage(bytes.NewReader(nil), message, 0)
+	assert.Error(t, err)
+}
+
+func TestFragmentMessageWithParity(t *testing.T) {
+	message := make([]byte, 3*MaxFragmentDataSize)
+	_, err := rand.Read(message)
+	assert.Nil(t, err)
+
+	// the prepended length of the message requires an additional data fragment
+	fragments, err := fragmentMessage(rand.Reader, message, 0.5)
+	assert.Nil(t, err)
+	assert.Len(t, fragments, 6)
+	for i, fragment := range fragments {
+		assert.Equal(t, uint16(i), fragment.Index)
+		assert.Equal(t, uint16(6), fragment.Total)
+		assert.Equal(t, uint16(2), fragment.Parity)
+		assert.Len(t, fragment.Data, len(fragments[0].Data))
+
+		parsed, err := ParseFragment(fragment.Bytes())
+		assert.Nil(t, err)
+		assert.Equal(t, fragment, parsed)
+	}
+
+	// any four of the fragments are sufficient
+	reassembler := NewReassembler(DefaultReassemblyTimeout, DefaultReassemblyMemory)
+	for _, i := range []int{5, 1, 4} {
+		reassembled, err := reassembler.AddFragment(fragments[i])
+		assert.Nil(t, err)
+		assert.Nil(t, reassembled)
+	}
+	reassembled, err := reassembler.AddFragment(fragments[2])
+	assert.Nil(t, err)
+	assert.Equal(t, message, reassembled)
+
+	// the remaining fragments of the reassembled message are ignored
+	reassembled, err = reassembler.AddFragment(fragments[0])
+	assert.Nil(t, err)
+	assert.Nil(t, reassembled)
+	assert.Equal(t, 0, reassembler.Pending())
+
+	// even a short message is protected
+	fragments, err = fragmentMessage(rand.Reader, []byte("Short"), 0.5)
+	assert.Nil(t, err)
+	assert.Len(t, fragments, 2)
+	reassembled, err = NewReassembler(DefaultReassemblyTimeout, DefaultReassemblyMemory).AddFragment(fragments[1])
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("Short"), reassembled)
+
+	// the parity is limited by the maximum number of shards of the code
+	fragments, err = fragmentMessage(rand.Reader, make([]byte, 200*MaxFragmentDataSize), 1)
+	assert.Nil(t, err)
+	assert.Len(t, fragments, erasure.MaxShards)
+	assert.Equal(t, uint16(erasure.MaxShards-201), fragments[0].Parity)
+
+	fragments, err = fragmentMessage(rand.Reader, make([]byte, 300*MaxFragmentDataSize), 1)
+	assert.Nil(t, err)
+	assert.Len(t, fragments, 300)
+	assert.Zero(t, fragments[0].Parity)
+}
+
+func TestParseFragmentInvalid(t *testing.T) {
+	_, err := ParseFragment(make([]byte, fragmentHeaderSize-1))
+	assert.Equal(t, ErrInvalidFragment, err)
+
+	_, err = ParseFragment((&Fragment{Index: 0, Total: 0}).Bytes())
+	assert.Equal(t, ErrInvalidFragment, err)
+
+	_, err = ParseFragment((&Fragment{Index: 2, Total: 2}).Bytes())
+	assert.Equal(t, ErrInvalidFragment, err)
+
+	_, err = ParseFragment((&Fragment{Total: 1, Data: make([]byte, MaxFragmentDataSize+1)}).Bytes())
+	assert.Equal(t, ErrInvalidFragment, err)
+
+	_, err = ParseFragment((&Fragment{Index: 0, Total: 2, Parity: 2}).Bytes())
+	assert.Equal(t, ErrInvalidFragment, err)
+
+	_, err = ParseFragment((&Fragment{Index: 0, Total: erasure.MaxShards + 1, Parity: 1}).Bytes())
+	assert.Equal(t, ErrInvalidFragment, err)
+}
+
+func TestReassemblerAddFragment(t *testing.T) {
+	message := bytes.Repeat([]byte("Fragmented message "), MaxFragmentDataSize/5)
+	fragments, err := fragmentMessage(rand.Reader, message, 0)
+	assert.Nil(t, err)
+	assert.Len(t, fragments, 4)
+
+	reassembler := NewReassembler(DefaultReassemblyTimeout, DefaultReassemblyMemory)
+	for _, i := range []int{2, 0, 2, 3} {
+		reassembled, err := reassembler.AddFragment(fragments[i])
+		assert.Nil(t, err)
+		assert.Nil(t, reassembled)
+	}
+	assert.Equal(t, 1, reassembler.Pending())
+
+	reassembled, err := reassembler.AddFragment(fragments[1])
+	assert.Nil(t, err)
+	assert.Equal(t, message, reassembled)
+	assert.Equal(t, 0, reassembler.Pending())
+	assert.Zero(t, reassembler.memory)
+
+	single := &Fragment{Total: 1, Data: []byte("Single")}
+	reassembled, err = reassembler.AddFragment(single)
+	assert.Nil(t, err)
+	assert.Equal(t, single.Data, reassembled)
+}
+
+func TestReassemblerInconsistentFragment(t *testing.T) {
+	reassembler := NewReassembler(DefaultReassemblyTimeout, DefaultReassemblyMemory)
+	_, err := reassembler.AddFragment(&Fragment{Index: 0, Total: 2, Data: []byte("a")})
+	assert.Nil(t, err)
+
+	_, err = reassembler.AddFragment(&Fragment{Index: 1, Total: 3, Data: []byte("b")})
+	assert.Equal(t, ErrInvalidFragment, err)
+
+	_, err = reassembler.AddFragment(&Fragment{Index: 1, Total: 2, Parity: 1, Data: []byte("b")})
+	assert.Equal(t, ErrInvalidFragment, err)
+
+	// parity fragments of different sizes cannot be decoded
+	id := [fragmentIDSize]byte{1}
+	_, err = reassembler.AddFragment(&Fragment{ID: id, Index: 0, Total: 3, Parity: 1, Data: []byte("a")})
+	assert.Nil(t, err)
+	_, err = reassembler.AddFragment(&Fragment{ID: id, Index: 2, Total: 3, Parity: 1, Data: []byte("bc")})
+	assert.Equal(t, ErrInvalidFragment, err)
+}
+
+func TestReassemblerTimeout(t *testing.T) {
+	reassembler := NewReassembler(10*time.Millisecond, DefaultReassemblyMemory)
+	_, err := reassembler.AddFragment(&Fragment{Index: 0, Total: 2, Data: []byte("a")})
+	assert.Nil(t, err)
+
+	time.Sleep(20 * time.Millisecond)
+
+	// the first fragment was discarded, so the message is not complete
+	reassembled, err := reassembler.AddFragment(&Fragment{Index: 1, Total: 2, Data: []byte("b")})
+	assert.Nil(t, err)
+	assert.Nil(t, reassembled)
+	assert.Equal(t, 1, reassembler.Pending())
+}
+
+func TestReassemblerMemoryLimit(t *testing.T) {
+	// the limit fits the data of three fragments, together with the slots of five fragments
+	limit := 3*MaxFragmentDataSize + 5*fragmentSlotSize
+	reassembler := NewReassembler(DefaultReassemblyTimeout, limit)
+
+	_, err := reassembler.AddFragment(&Fragment{Index: 0, Total: 4, Data: []byte("a")})
+	assert.Equal(t, ErrMessageTooLarge, err)
+
+	data := make([]byte, MaxFragmentDataSize)
+	oldest := &Fragment{ID: [fragmentIDSize]byte{1}, Index: 0, Total: 2, Data: data}
+	long := &Fragment{ID: [fragmentIDSize]byte{2}, Index: 0, Total: 3, Data: data}
+	for _, fragment := range []*Fragment{oldest, long, {ID: long.ID, Index: 1, Total: 3, Data: data}} {
+		_, err := reassembler.AddFragment(fragment)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, 2, reassembler.Pending())
+
+	// exceeding the limit discards the oldest message
+	_, err = reassembler.AddFragment(&Fragment{ID: [fragmentIDSize]byte{3}, Index: 0, Total: 2, Data: data})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, reassembler.Pending())
+	assert.Equal(t, limit, reassembler.memory)
+	_, ok := reassembler.pending[oldest.ID]
+	assert.False(t, ok)
+
+	reassembled, err := reassembler.AddFragment(&Fragment{ID: long.ID, Index: 2, Total: 3, Data: data})
+	assert.Nil(t, err)
+	assert.Len(t, reassembled, 3*MaxFragmentDataSize)
+}
+
+func TestReassemblerEmptyFragment(t *testing.T) {
+	reassembler := NewReassembler(DefaultReassemblyTimeout, DefaultReassemblyMemory)
+	_, err := reassembler.AddFragment(&Fragment{Index: 0, Total: 2})
+	assert.Equal(t, ErrInvalidFragment, err)
+	assert.Empty(t, reassembler.pending)
+
+	// an empty message is sent in a single fragment
+	reassembled, err := reassembler.AddFragment(&Fragment{Total: 1})
+	assert.Nil(t, err)
+	assert.Empty(t, reassembled)
+}
+
+func TestReassemblerFloodOfMessages(t *testing.T) {
+	reassembler := NewReassembler(DefaultReassemblyTimeout, DefaultReassemblyMemory)
+	for i := 0; i < 3*maximumPendingMessages; i++ {
+		var id [fragmentIDSize]byte
+		binary.BigEndian.PutUint32(id[:], uint32(i))
+
+		// the first fragments of the messages announcing as many fragments as possible, of which only two are needed
+		_, err := reassembler.AddFragment(&Fragment{ID: id,
+			Index:  0,
+			Total:  erasure.MaxShards,
+			Parity: erasure.MaxShards - 2,
+			Data:   []byte("a"),
+		})
+		assert.Nil(t, err)
+		assert.True(t, reassembler.memory <= DefaultReassemblyMemory)
+		assert.True(t, len(reassembler.pending) <= maximumPendingMessages)
+
+		// and the reassembled messages
+		id[fragmentIDSize-1] = 1
+		for index := uint16(0); index < 2; index++ {
+			_, err := reassembler.AddFragment(&Fragment{ID: id, Index: index, Total: 2, Data: []byte("a")})
+			assert.Nil(t, err)
+		}
+		assert.True(t, len(reassembler.pending) <= maximumPendingMessages)
+	}
+	assert.Len(t, reassembler.order, len(reassembler.pending))
+}
@@ -20,11 +20,13 @@
 package clientcore
 
 import (
+	"crypto/rand"
 	"errors"
 	"fmt"
+	"io"
+	"sync"
 	"time"
 
-	"github.com/golang/protobuf/proto"
 	"github.com/nymtech/nym-mixnet/config"
 	"github.com/nymtech/nym-mixnet/helpers"
 	"github.com/nymtech/nym-mixnet/helpers/topology"
@@ -34,11 +36,17 @@ import (
 
 const (
 	maximumTopologyAge = 1 * time.Minute
+
+	// maximumPendingSURBs is the maximum number of reply blocks, created by the client,
+	// for which decryption keys are kept. If it is exceeded, the keys of the oldest blocks are discarded.
+	maximumPendingSURBs = 1000
 )
 
 var (
 	// ErrInvalidMixes defines an error when either the mix map is nil or contains insufficient number of entries
 	ErrInvalidMixes = errors.New("insufficient number of mixes provided")
+	// ErrInvalidRecipientKey defines an error when the public key of the recipient of a message is malformed
+	ErrInvalidRecipientKey = errors.New("invalid public key of the recipient")
 )
 
 // NetworkPKI holds PKI data about the current network topology.
@@ -73,6 +81,16 @@ type CryptoClient struct {
 	Provider config.MixConfig
 	Network  NetworkPKI
 	log      *logrus.Logger
+
+	// RedundancyRatio is the number of the parity fragments sent along with every message,
+	// relative to the number of its data fragments. If zero, no parity fragments are sent.
+	RedundancyRatio float64
+
+	surbsMu sync.Mutex
+	// surbKeys holds decryption keys of created reply blocks, indexed by the identifiers of their replies
+	surbKeys map[string]sphinx.SURBDecryptionKeys
+	// surbOrder holds identifiers of the created reply blocks in the order they were created
+	surbOrder []string
 }
 
 const (
@@ -83,38 +101,50 @@ const (
 // CreateSphinxPacket responsible for sending a real message. Takes as input the message string
 // and the public information about the destination.
 // The function generates a random path and a set of random values from exponential distribution.
-// Given those values it triggers the encode function, which packs the message into the
+// The message is encrypted to the public key of the recipient, so that only the recipient can read it.
+// Given those values it triggers the encode function, which packs the encrypted message into the
 // sphinx cryptographic packet format. Next, the encoded packet is combined with a
 // flag signalling that this is a usual network packet, and passed to be send.
+// All of the randomness is read from the given source.
 // The function returns an error if any issues occurred.
-func (c *CryptoClient) createSphinxPacket(message []byte, recipient config.ClientConfig) ([]byte, error) {
+func (c *CryptoClient) createSphinxPacket(random io.Reader, message []byte, recipient config.ClientConfig) ([]byte, error) {
+	if len(recipient.PubKey) != sphinx.PublicKeySize {
+		c.log.Errorf("error in CreateSphinxPacket - the recipient has invalid public key")
+		return nil, ErrInvalidRecipientKey
+	}
 
-	path, err := c.buildPath(recipient)
+	path, err := c.buildPath(random, recipient)
 	if err != nil {
 		c.log.Errorf("error in CreateSphinxPacket - generating random path failed: %v", err)
 		return nil, err
 	}
 
-	delays, err := c.generateDelaySequence(desiredRateParameter, path.Len())
+	delays, err := c.generateDelaySequence(random, desiredRateParameter, path.Len())
 	if err != nil {
 		c.log.Errorf("error in CreateSphinxPacket - generating sequence of delays failed: %v", err)
 		return nil, err
 	}
 
-	sphinxPacket, err := sphinx.PackForwardMessage(path, delays, message)
+	envelope, err := sphinx.SealMessage(random, sphinx.BytesToPublicKey(recipient.PubKey), message)
+	if err != nil {
+		c.log.Errorf("error in CreateSphinxPacket - the end-to-end encryption failed: %v", err)
+		return nil, err
+	}
+
+	sphinxPacket, err := sphinx.PackForwardMessageFrom(random, path, delays, envelope, nil)
 	if err != nil {
 		c.log.Errorf("error in CreateSphinxPacket - the pack procedure failed: %v", err)
 		return nil, err
 	}
 
-	return proto.Marshal(&sphinxPacket)
+	return sphinx.EncodePacket(&sphinxPacket)
 }
 
 // buildPath builds a path containing the sender's provider,
 // a sequence (of length pre-defined in a config file) of randomly
 // selected mixes and the recipient's provider
-func (c *CryptoClient) buildPath(recipient config.ClientConfig) (config.E2EPath, error) {
-	mixSeq, err := c.getRandomMixSequence(c.Network.Mixes, pathLength)
+func (c *CryptoClient) buildPath(random io.Reader, recipient config.ClientConfig) (config.E2EPath, error) {
+	mixSeq, err := c.getRandomMixSequence(random, c.Network.Mixes, pathLength)
 	if err != nil {
 		c.log.Errorf("error in buildPath - generating random mix path failed: %v", err)
 		return config.E2EPath{}, err
@@ -134,33 +164,44 @@ func (c *CryptoClient) buildPath(recipient config.ClientConfig) (config.E2EPath,
 	return path, nil
 }
 
-// getRandomMixSequence generates a random sequence of given length from all possible mixes.
+// getRandomMixSequence generates a random sequence of given length from all possible mixes,
+// using the given source of randomness.
 // If the list of all active mixes is empty or the given length is larger than the set of active mixes,
 // an error is returned.
-func (c *CryptoClient) getRandomMixSequence(mixes topology.LayeredMixes, length int) ([]config.MixConfig, error) {
+func (c *CryptoClient) getRandomMixSequence(random io.Reader,
+	mixes topology.LayeredMixes,
+	length int,
+) ([]config.MixConfig, error) {
 	if mixes == nil || len(mixes) < length {
 		return nil, ErrInvalidMixes
 	}
 
 	mixSequence := make([]config.MixConfig, length)
 	for i := 1; i <= length; i++ {
-		if layerMixes, ok := mixes[uint(i)]; ok {
-			mixSequence[i-1] = helpers.RandomMix(layerMixes)
-		} else {
+		layerMixes, ok := mixes[uint(i)]
+		if !ok {
 			return nil, fmt.Errorf("no valid mixes for layer: %v", i)
 		}
+		mix, err := helpers.RandomMixFrom(random, layerMixes)
+		if err != nil {
+			return nil, fmt.Errorf("error in getRandomMixSequence - choosing mix for layer %v failed: %v", i, err)
+		}
+		mixSequence[i-1] = mix
 	}
 
 	return mixSequence, nil
 }
 
 // generateDelaySequence generates a given length sequence of float64 values. Values are generated
-// following the exponential distribution. generateDelaySequence returnes a sequence or an error
-// if any of the values could not be generate.
-func (c *CryptoClient) generateDelaySequence(desiredRateParameter float64, length int) ([]float64, error) {
+// following the exponential distribution, using the given source of randomness.
+// generateDelaySequence returnes a sequence or an error if any of the values could not be generate.
+func (c *CryptoClient) generateDelaySequence(random io.Reader,
+	desiredRateParameter float64,
+	length int,
+) ([]float64, error) {
 	var delays []float64
 	for i := 0; i < length; i++ {
-		d, err := helpers.RandomExponential(desiredRateParameter)
+		d, err := helpers.RandomExponentialFrom(random, desiredRateParameter)
 		if err != nil {
 			c.log.Errorf("Error in generateDelaySequence - generating random exponential sample failed: %v", err)
 			return nil, err
@@ -171,22 +212,172 @@ func (c *CryptoClient) generateDelaySequence(desiredRateParameter float64, lengt
 }
 
 // EncodeMessage encodes given message into the Sphinx packet format. EncodeMessage takes as inputs
-// the message and the recipient's public configuration.
-// EncodeMessage returns the byte representation of the packet or an error if the packet could not be created.
-func (c *CryptoClient) EncodeMessage(message []byte, recipient config.ClientConfig) ([]byte, error) {
+// the message and the recipient's public configuration. Messages which do not fit into a single packet
+// are split into fragments, each of which is sent in its own packet over an independently chosen path.
+// If the RedundancyRatio is set, the parity fragments are sent as well, so that the message
+// can be reassembled even if some of its packets are lost.
+// EncodeMessage returns the byte representations of the packets or an error if they could not be created.
+func (c *CryptoClient) EncodeMessage(message []byte, recipient config.ClientConfig) ([][]byte, error) {
+	return c.EncodeMessageFrom(rand.Reader, message, recipient)
+}
 
-	packet, err := c.createSphinxPacket(message, recipient)
+// EncodeMessageFrom works like EncodeMessage, but reads all the randomness, used both to choose the paths
+// and the delays and to create the packets themselves, from the given source instead of crypto/rand.
+// Given the same source it always creates exactly the same packets, which allows to reproduce them in tests.
+func (c *CryptoClient) EncodeMessageFrom(random io.Reader, message []byte, recipient config.ClientConfig) ([][]byte, error) {
+	fragments, err := fragmentMessage(random, message, c.RedundancyRatio)
 	if err != nil {
-		c.log.Errorf("Error in EncodeMessage - the pack procedure failed: %v", err)
+		c.log.Errorf("Error in EncodeMessage - fragmenting the message failed: %v", err)
 		return nil, err
 	}
-	return packet, err
+
+	packets := make([][]byte, len(fragments))
+	for i, fragment := range fragments {
+		packets[i], err = c.createSphinxPacket(random, fragment.Bytes(), recipient)
+		if err != nil {
+			c.log.Errorf("Error in EncodeMessage - the pack procedure failed: %v", err)
+			return nil, err
+		}
+	}
+	return packets, nil
+}
+
+// DecodeMessage decodes the received sphinx packet, fully decrypted by the provider of this client,
+// and returns the message fragment it carries. The packet can either be a reply sent using one of the reply blocks
+// created by this client, which is returned as a complete, single fragment message, or a forward message,
+// which is decrypted with the private key of this client and authenticated.
+// If the forward message had a reply block attached, it is returned as well.
+// DecodeMessage returns sphinx.ErrEnvelopeAuthentication if the message was not encrypted
+// for this client or was modified on its way.
+func (c *CryptoClient) DecodeMessage(packet []byte) (*Fragment, *sphinx.SURB, error) {
+	sphinxPacket, err := sphinx.DecodePacket(packet)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	reply, err := c.DecodeReply(sphinxPacket)
+	if err == nil {
+		return &Fragment{Total: 1, Data: reply}, nil, nil
+	}
+	if err != sphinx.ErrNotReply {
+		return nil, nil, err
+	}
+
+	envelope, surb, err := sphinx.UnpackForwardMessage(sphinxPacket.Pld)
+	if err != nil {
+		return nil, nil, err
+	}
+	message, err := sphinx.OpenMessage(c.prvKey, envelope)
+	if err != nil {
+		return nil, nil, err
+	}
+	fragment, err := ParseFragment(message)
+	if err != nil {
+		return nil, nil, err
+	}
+	return fragment, surb, nil
+}
+
+// CreateSURB creates a single use reply block, which the replier can use to respond to this client
+// without learning its identity. The reply travels from the replier's provider, through a random sequence of mixes,
+// to the provider of this client. As an argument CreateSURB takes the public configuration of this client,
+// to which the reply should be delivered, and of the replier.
+// CreateSURB keeps the keys required to decrypt the reply and returns the reply block or an error.
+func (c *CryptoClient) CreateSURB(sender config.ClientConfig, replier config.ClientConfig) (sphinx.SURB, error) {
+	return c.CreateSURBFrom(rand.Reader, sender, replier)
 }
 
-// DecodeMessage decodes the received sphinx packet.
-// TODO: this function is finished yet.
-func (c *CryptoClient) DecodeMessage(packet sphinx.SphinxPacket) (sphinx.SphinxPacket, error) {
-	return packet, nil
+// CreateSURBFrom works like CreateSURB, but reads all the randomness from the given source instead of crypto/rand.
+func (c *CryptoClient) CreateSURBFrom(random io.Reader,
+	sender config.ClientConfig,
+	replier config.ClientConfig,
+) (sphinx.SURB, error) {
+	if replier.Provider == nil || len(replier.Provider.PubKey) == 0 {
+		err := fmt.Errorf("error in CreateSURB - could not create reply path," +
+			" the provider of the replier has invalid configuration")
+		c.log.Error(err.Error())
+		return sphinx.SURB{}, err
+	}
+
+	mixSeq, err := c.getRandomMixSequence(random, c.Network.Mixes, pathLength)
+	if err != nil {
+		c.log.Errorf("error in CreateSURB - generating random mix path failed: %v", err)
+		return sphinx.SURB{}, err
+	}
+
+	path := config.E2EPath{IngressProvider: *replier.Provider,
+		Mixes:          mixSeq,
+		EgressProvider: c.Provider,
+		Recipient:      sender,
+	}
+
+	delays, err := c.generateDelaySequence(random, desiredRateParameter, path.Len())
+	if err != nil {
+		c.log.Errorf("error in CreateSURB - generating sequence of delays failed: %v", err)
+		return sphinx.SURB{}, err
+	}
+
+	surb, keys, err := sphinx.CreateSURBFrom(random, path, delays)
+	if err != nil {
+		c.log.Errorf("error in CreateSURB - the create procedure failed: %v", err)
+		return sphinx.SURB{}, err
+	}
+
+	c.storeSURBKeys(string(keys.ID), keys)
+	return surb, nil
+}
+
+// storeSURBKeys saves the decryption keys of the reply block. If there are too many
+// pending reply blocks, keys of the oldest one are discarded.
+func (c *CryptoClient) storeSURBKeys(id string, keys sphinx.SURBDecryptionKeys) {
+	c.surbsMu.Lock()
+	defer c.surbsMu.Unlock()
+
+	if c.surbKeys == nil {
+		c.surbKeys = make(map[string]sphinx.SURBDecryptionKeys)
+	}
+
+	// the order still contains the blocks whose replies were already received, so it is compacted
+	// once it gets considerably longer than the number of pending blocks
+	if len(c.surbOrder) >= 2*maximumPendingSURBs {
+		pending := make([]string, 0, len(c.surbKeys))
+		for _, pendingID := range c.surbOrder {
+			if _, ok := c.surbKeys[pendingID]; ok {
+				pending = append(pending, pendingID)
+			}
+		}
+		c.surbOrder = pending
+	}
+
+	for len(c.surbKeys) >= maximumPendingSURBs {
+		delete(c.surbKeys, c.surbOrder[0])
+		c.surbOrder = c.surbOrder[1:]
+	}
+
+	c.surbKeys[id] = keys
+	c.surbOrder = append(c.surbOrder, id)
+}
+
+// DecodeReply decrypts the received packet as a reply sent using one of the reply blocks created by this client.
+// The reply block is identified by the header of the packet, so its keys are found without trying to decrypt
+// the payload with any other keys. As each reply block can be used only once, its keys are discarded
+// after being found. DecodeReply returns the reply message, or sphinx.ErrNotReply if the packet does not match
+// any pending reply block.
+func (c *CryptoClient) DecodeReply(packet sphinx.SphinxPacket) ([]byte, error) {
+	if len(packet.Pld) != sphinx.PayloadSize {
+		return nil, sphinx.ErrInvalidPayloadSize
+	}
+
+	id := string(sphinx.ReplyID(&packet))
+	c.surbsMu.Lock()
+	keys, ok := c.surbKeys[id]
+	delete(c.surbKeys, id)
+	c.surbsMu.Unlock()
+
+	if !ok {
+		return nil, sphinx.ErrNotReply
+	}
+	return sphinx.ProcessReplyPayload(keys, packet.Pld)
 }
 
 // GetPublicKey returns the public key for this CryptoClient
@@ -207,5 +398,6 @@ func NewCryptoClient(privKey *sphinx.PrivateKey,
 		Provider: provider,
 		Network:  network,
 		log:      log,
+		surbKeys: make(map[string]sphinx.SURBDecryptionKeys),
 	}
 }
@@ -15,6 +15,8 @@
 package clientcore
 
 import (
+	"bytes"
+	"crypto/rand"
 	"errors"
 	"fmt"
 	"os"
@@ -131,23 +133,162 @@ func TestCryptoClient_EncodeMessage(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	assert.Equal(t, reflect.TypeOf([]byte{}), reflect.TypeOf(encoded))
+	assert.Equal(t, reflect.TypeOf([][]byte{}), reflect.TypeOf(encoded))
+	assert.Len(t, encoded, 1)
 
+	encoded, err = client.EncodeMessage(make([]byte, 2*MaxFragmentDataSize+1), recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, encoded, 3)
+
+}
+
+func TestCryptoClient_EncodeMessageFrom(t *testing.T) {
+	_, pubP, err := sphinx.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := config.MixConfig{Id: "Provider", Host: "localhost", Port: "3331", PubKey: pubP.Bytes()}
+	recipient := config.ClientConfig{Id: "Recipient",
+		Host:     "localhost",
+		Port:     "9999",
+		PubKey:   pubP.Bytes(),
+		Provider: &provider,
+	}
+	client.Provider = provider
+
+	random := bytes.Repeat([]byte("deterministic randomness"), 100)
+	encoded, err := client.EncodeMessageFrom(bytes.NewReader(random), []byte("Hello world"), recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encodedAgain, err := client.EncodeMessageFrom(bytes.NewReader(random), []byte("Hello world"), recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, encoded, encodedAgain)
+
+	_, err = client.EncodeMessageFrom(bytes.NewReader(nil), []byte("Hello world"), recipient)
+	assert.Error(t, err)
+
+	recipient.PubKey = nil
+	_, err = client.EncodeMessageFrom(bytes.NewReader(random), []byte("Hello world"), recipient)
+	assert.Equal(t, ErrInvalidRecipientKey, err)
 }
 
 func TestCryptoClient_DecodeMessage(t *testing.T) {
-	packet := sphinx.SphinxPacket{Hdr: &sphinx.Header{}, Pld: []byte("Message")}
+	privP, pubP, err := sphinx.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := config.MixConfig{Id: "Provider", Host: "localhost", Port: "3331", PubKey: pubP.Bytes()}
+
+	// each layer has a single mix, so the path is known in advance
+	privs := []*sphinx.PrivateKey{privP}
+	pathMixes := make(topology.LayeredMixes)
+	for layer := uint(1); layer <= pathLength; layer++ {
+		priv, pub, err := sphinx.GenerateKeyPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		privs = append(privs, priv)
+		pathMixes[layer] = []config.MixConfig{
+			config.NewMixConfig(fmt.Sprintf("PathMix%d", layer), "localhost", "3340", pub.Bytes(), layer),
+		}
+	}
+	privs = append(privs, privP)
 
-	decoded, err := client.DecodeMessage(packet)
+	privR, pubR, err := sphinx.GenerateKeyPair()
 	if err != nil {
 		t.Fatal(err)
 	}
-	expected := packet
-	assert.Equal(t, expected, decoded)
+	sender := NewCryptoClient(client.prvKey, client.pubKey, provider, NetworkPKI{Mixes: pathMixes}, client.log)
+	recipient := NewCryptoClient(privR, pubR, provider, NetworkPKI{}, client.log)
+	recipientConfig := config.ClientConfig{Id: "Recipient",
+		Host:     "localhost",
+		Port:     "9999",
+		PubKey:   pubR.Bytes(),
+		Provider: &provider,
+	}
+
+	processPath := func(packetBytes []byte) []byte {
+		for _, priv := range privs {
+			_, _, packetBytes, err = sphinx.ProcessSphinxPacket(packetBytes, priv)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return packetBytes
+	}
+
+	message := []byte("Hello world")
+	packets, err := sender.EncodeMessage(message, recipientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, packets, 1)
+	packetBytes := processPath(packets[0])
+
+	// the provider, which removed the last layer of the sphinx encryption, sees only the ciphertext
+	assert.False(t, bytes.Contains(packetBytes, message))
+
+	fragment, surb, err := recipient.DecodeMessage(packetBytes)
+	assert.Nil(t, err)
+	assert.Nil(t, surb)
+	assert.Equal(t, uint16(1), fragment.Total)
+	assert.Equal(t, message, fragment.Data)
+
+	_, _, err = sender.DecodeMessage(packetBytes)
+	assert.Equal(t, sphinx.ErrEnvelopeAuthentication, err)
+
+	_, _, err = recipient.DecodeMessage([]byte("Message"))
+	assert.Error(t, err)
+
+	// fragments of a long message are delivered in separate packets and reassembled in any order
+	message = bytes.Repeat([]byte("Long message "), MaxFragmentDataSize/4)
+	packets, err = sender.EncodeMessage(message, recipientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, packets, 4)
+
+	reassembler := NewReassembler(DefaultReassemblyTimeout, DefaultReassemblyMemory)
+	for i := len(packets) - 1; i >= 0; i-- {
+		fragment, _, err := recipient.DecodeMessage(processPath(packets[i]))
+		assert.Nil(t, err)
+		assert.Equal(t, uint16(i), fragment.Index)
+
+		reassembled, err := reassembler.AddFragment(fragment)
+		assert.Nil(t, err)
+		if i > 0 {
+			assert.Nil(t, reassembled)
+		} else {
+			assert.Equal(t, message, reassembled)
+		}
+	}
+
+	// with the parity fragments the message survives the loss of some of its packets
+	sender.RedundancyRatio = 0.5
+	packets, err = sender.EncodeMessage(message, recipientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, packets, 6)
+
+	var reassembled []byte
+	for _, i := range []int{5, 0, 3, 2} {
+		fragment, _, err := recipient.DecodeMessage(processPath(packets[i]))
+		assert.Nil(t, err)
+		assert.Nil(t, reassembled)
+		reassembled, err = reassembler.AddFragment(fragment)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, message, reassembled)
 }
 
 func TestCryptoClient_GenerateDelaySequence_Pass(t *testing.T) {
-	delays, err := client.generateDelaySequence(100, 5)
+	delays, err := client.generateDelaySequence(rand.Reader, 100, 5)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -156,13 +297,13 @@ func TestCryptoClient_GenerateDelaySequence_Pass(t *testing.T) {
 }
 
 func TestCryptoClient_GenerateDelaySequence_Fail(t *testing.T) {
-	_, err := client.generateDelaySequence(0, 5)
+	_, err := client.generateDelaySequence(rand.Reader, 0, 5)
 	// TODO: make the error string a constant
 	assert.EqualError(t, errors.New("the parameter of exponential distribution has to be larger than zero"), err.Error())
 }
 
 func Test_GetRandomMixSequence_TooFewMixes(t *testing.T) {
-	_, err := client.getRandomMixSequence(mixes, 20)
+	_, err := client.getRandomMixSequence(rand.Reader, mixes, 20)
 	assert.Error(t, err)
 
 	// Original assertion:
@@ -178,7 +319,7 @@ func Test_GetRandomMixSequence_TooFewMixes(t *testing.T) {
 
 func Test_GetRandomMixSequence_MoreMixes(t *testing.T) {
 
-	sequence, err := client.getRandomMixSequence(mixes, 3)
+	sequence, err := client.getRandomMixSequence(rand.Reader, mixes, 3)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -192,11 +333,105 @@ func Test_GetRandomMixSequence_MoreMixes(t *testing.T) {
 }
 
 func Test_GetRandomMixSequence_FailEmptyList(t *testing.T) {
-	_, err := client.getRandomMixSequence(topology.LayeredMixes{}, 6)
+	_, err := client.getRandomMixSequence(rand.Reader, topology.LayeredMixes{}, 6)
 	assert.EqualError(t, ErrInvalidMixes, err.Error(), "")
 }
 
 func Test_GetRandomMixSequence_FailNonList(t *testing.T) {
-	_, err := client.getRandomMixSequence(nil, 6)
+	_, err := client.getRandomMixSequence(rand.Reader, nil, 6)
 	assert.EqualError(t, ErrInvalidMixes, err.Error(), "")
 }
+
+func TestCryptoClient_CreateSURBAndDecodeReply(t *testing.T) {
+	privP, pubP, err := sphinx.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := config.MixConfig{Id: "Provider", Host: "localhost", Port: "3331", PubKey: pubP.Bytes()}
+
+	// each node of the reply path is a single mix in its layer, so the path is known in advance
+	privs := []*sphinx.PrivateKey{privP}
+	replyMixes := make(topology.LayeredMixes)
+	for layer := uint(1); layer <= pathLength; layer++ {
+		priv, pub, err := sphinx.GenerateKeyPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		privs = append(privs, priv)
+		replyMixes[layer] = []config.MixConfig{
+			config.NewMixConfig(fmt.Sprintf("ReplyMix%d", layer), "localhost", "3340", pub.Bytes(), layer),
+		}
+	}
+	privs = append(privs, privP)
+
+	replyClient := NewCryptoClient(client.prvKey, client.pubKey, provider, NetworkPKI{Mixes: replyMixes}, client.log)
+
+	sender := config.ClientConfig{Id: "Sender", Host: "localhost", Port: "9998", Provider: &provider}
+	replier := config.ClientConfig{Id: "Replier", Host: "localhost", Port: "9999", Provider: &provider}
+
+	surb, err := replyClient.CreateSURB(sender, replier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reply, err := sphinx.PackReplyMessage(&surb, []byte("Reply"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the payload was not processed by any node yet, so it is not a valid reply
+	_, err = replyClient.DecodeReply(reply)
+	assert.Equal(t, sphinx.ErrNotReply, err)
+
+	packetBytes, err := sphinx.EncodePacket(&reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, priv := range privs {
+		_, _, packetBytes, err = sphinx.ProcessSphinxPacket(packetBytes, priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	received, err := sphinx.DecodePacket(packetBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := replyClient.DecodeReply(received)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("Reply"), decoded)
+
+	// reply blocks can be used only once
+	_, err = replyClient.DecodeReply(received)
+	assert.Equal(t, sphinx.ErrNotReply, err)
+
+	_, err = replyClient.DecodeReply(sphinx.SphinxPacket{Hdr: received.Hdr, Pld: []byte("Reply")})
+	assert.Equal(t, sphinx.ErrInvalidPayloadSize, err)
+}
+
+func TestCryptoClient_CreateSURBInvalidReplier(t *testing.T) {
+	_, err := client.CreateSURB(config.ClientConfig{}, config.ClientConfig{Id: "Replier"})
+	assert.Error(t, err)
+}
+
+func TestCryptoClient_StoreSURBKeysEviction(t *testing.T) {
+	c := &CryptoClient{}
+	for i := 0; i < maximumPendingSURBs; i++ {
+		c.storeSURBKeys(fmt.Sprintf("surb%d", i), sphinx.SURBDecryptionKeys{})
+	}
+	// the replies to most of the blocks are received
+	for i := 1; i < maximumPendingSURBs; i++ {
+		delete(c.surbKeys, fmt.Sprintf("surb%d", i))
+	}
+	for i := maximumPendingSURBs; i < 3*maximumPendingSURBs; i++ {
+		c.storeSURBKeys(fmt.Sprintf("surb%d", i), sphinx.SURBDecryptionKeys{})
+	}
+
+	assert.Len(t, c.surbKeys, maximumPendingSURBs)
+	assert.True(t, len(c.surbOrder) < 2*maximumPendingSURBs)
+	_, ok := c.surbKeys["surb0"]
+	assert.False(t, ok, "the keys of the oldest block should be discarded")
+	_, ok = c.surbKeys[fmt.Sprintf("surb%d", 3*maximumPendingSURBs-1)]
+	assert.True(t, ok)
+}
@@ -21,6 +21,7 @@ import (
 	"github.com/nymtech/nym-mixnet/client"
 	"github.com/nymtech/nym-mixnet/client/benchclient"
 	clientConfig "github.com/nymtech/nym-mixnet/client/config"
+	"github.com/nymtech/nym-mixnet/helpers"
 	"github.com/nymtech/nym-mixnet/helpers/topology"
 	"github.com/nymtech/nym-mixnet/sphinx"
 	"github.com/tav/golly/optparse"
@@ -88,6 +89,11 @@ func cmdRun(args []string, usage string) {
 		panic(err)
 	}
 
+	// the interrupted benchmark does not produce the summary
+	helpers.ShutdownOnSignal(func() {
+		benchClient.Shutdown()
+		os.Exit(1)
+	})
 	if err := benchClient.RunBench(); err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to spawn client instance: %v\n", err)
 		os.Exit(-1)
@@ -17,9 +17,14 @@ package main
 import (
 	"encoding/base64"
 	"fmt"
+	"net"
 	"os"
+	"path/filepath"
 
+	"github.com/nymtech/nym-mixnet/constants"
+	"github.com/nymtech/nym-mixnet/helpers"
 	"github.com/nymtech/nym-mixnet/server/provider"
+	providerConfig "github.com/nymtech/nym-mixnet/server/provider/config"
 	"github.com/nymtech/nym-mixnet/sphinx"
 	"github.com/tav/golly/optparse"
 )
@@ -42,26 +47,43 @@ func cmdRun(args []string, usage string) {
 		os.Exit(1)
 	}
 
-	if err := os.RemoveAll("inboxes/AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="); err != nil {
-		fmt.Fprintf(os.Stderr, "failed to empty bench inbox: %v", err)
-		os.Exit(1)
-	}
-
 	// have constant keys to simplify the procedure so that pki/database would not need to be reset every run
 	privP := sphinx.BytesToPrivateKey([]byte{191, 43, 90, 175, 50, 224, 156, 22, 204, 173, 87, 255, 64, 152, 17,
 		30, 48, 162, 36, 95, 57, 34, 187, 183, 203, 215, 25, 172, 55, 199, 211, 59})
 	pubP := sphinx.BytesToPublicKey([]byte{17, 170, 15, 150, 155, 75, 240, 66, 54, 100, 131, 127, 193, 10,
 		133, 32, 62, 155, 9, 46, 200, 55, 60, 125, 223, 76, 170, 167, 100, 34, 176, 117})
 
-	baseProviderServer, err := provider.NewProviderServer(defaultBenchmarkProviderID,
-		defaultBenchmarkProviderHost,
-		*port,
-		privP,
-		pubP,
+	cfg, err := providerConfig.DefaultConfig(defaultBenchmarkProviderID,
+		net.JoinHostPort(defaultBenchmarkProviderHost, *port),
 	)
 	if err != nil {
 		panic(err)
 	}
+	cfg.Provider.DirectoryServerPresenceEndpoint = providerConfig.DefaultLocalDirectoryServerPresenceEndpoint
+
+	if err := os.RemoveAll(filepath.Join(cfg.Provider.InboxesDir(), "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=")); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to empty bench inbox: %v", err)
+		os.Exit(1)
+	}
+
+	keysDir, _ := filepath.Split(cfg.Provider.PrivateKeyFile())
+	if err := helpers.EnsureDir(keysDir, 0700); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create bench provider directory: %v", err)
+		os.Exit(1)
+	}
+	if err := helpers.ToPEMFile(privP, cfg.Provider.PrivateKeyFile(), constants.PrivateKeyPEMType); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to save private key: %v", err)
+		os.Exit(1)
+	}
+	if err := helpers.ToPEMFile(pubP, cfg.Provider.PublicKeyFile(), constants.PublicKeyPEMType); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to save public key: %v", err)
+		os.Exit(1)
+	}
+
+	baseProviderServer, err := provider.NewProviderServer(cfg)
+	if err != nil {
+		panic(err)
+	}
 
 	b64Key := base64.URLEncoding.EncodeToString(pubP.Bytes())
 	fmt.Println(b64Key)
@@ -71,6 +93,11 @@ func cmdRun(args []string, usage string) {
 		panic(err)
 	}
 
+	// the interrupted benchmark does not produce the summary
+	helpers.ShutdownOnSignal(func() {
+		benchmarkProviderServer.Shutdown()
+		os.Exit(1)
+	})
 	err = benchmarkProviderServer.RunBench()
 	if err != nil {
 		panic(err)
@@ -72,6 +72,7 @@ func RunCmd(args []string, usage string) {
 		fmt.Fprintf(os.Stderr, "Failed to spawn client instance: %v\n", err)
 		os.Exit(-1)
 	}
+	helpers.ShutdownOnSignal(client.Shutdown)
 
 	client.Wait()
 }
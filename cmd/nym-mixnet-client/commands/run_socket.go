@@ -85,6 +85,7 @@ func RunSocketCmd(args []string, usage string) {
 		fmt.Fprintf(os.Stderr, "Failed to start socket listener instance: %v\n", err)
 		os.Exit(-1)
 	}
+	helpers.ShutdownOnSignal(socketListener.Shutdown)
 
 	socketListener.Wait()
 }
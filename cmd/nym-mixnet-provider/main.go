@@ -28,10 +28,12 @@ func main() {
 (mixnet-provider)
 `
 	cmds := map[string]func([]string, string){
-		"run": cmdRun,
+		"init": cmdInit,
+		"run":  cmdRun,
 	}
 	info := map[string]string{
-		"run": "Run a Nym mixnet provider for offline storage",
+		"init": "Initialise a Nym mixnet provider",
+		"run":  "Run a Nym mixnet provider for offline storage",
 	}
 	optparse.Commands("nym-provider", "0.4.0", cmds, info, logo)
 }
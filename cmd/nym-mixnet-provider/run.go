@@ -18,64 +18,21 @@ import (
 	"fmt"
 	"os"
 
-	"github.com/nymtech/nym-mixnet/constants"
 	"github.com/nymtech/nym-mixnet/helpers"
 	"github.com/nymtech/nym-mixnet/server/provider"
-	"github.com/nymtech/nym-mixnet/sphinx"
+	providerConfig "github.com/nymtech/nym-mixnet/server/provider/config"
 	"github.com/tav/golly/optparse"
 )
 
 const (
-	defaultHost           = ""
-	defaultID             = "Provider"
-	defaultPort           = "1789"
-	defaultPrivateKeyFile = "privateKey.key"
-	defaultPublicKeyFile  = "publicKey.key"
+	defaultID = "Provider"
 )
 
-func loadKeys() (*sphinx.PrivateKey, *sphinx.PublicKey, error) {
-	prvKey := new(sphinx.PrivateKey)
-	pubKey := new(sphinx.PublicKey)
-
-	if _, err := os.Stat(defaultPrivateKeyFile); os.IsNotExist(err) {
-		return nil, nil, err
-	}
-
-	if _, err := os.Stat(defaultPublicKeyFile); os.IsNotExist(err) {
-		return nil, nil, err
-	}
-
-	if err := helpers.FromPEMFile(prvKey, defaultPrivateKeyFile, constants.PrivateKeyPEMType); err != nil {
-		return nil, nil, fmt.Errorf("Failed to load the private key: %v", err)
-	}
-
-	if err := helpers.FromPEMFile(pubKey, defaultPublicKeyFile, constants.PublicKeyPEMType); err != nil {
-		return nil, nil, fmt.Errorf("Failed to load the public key: %v", err)
-	}
-
-	fmt.Fprintf(os.Stdout, "Loaded existing keys\n")
-	return prvKey, pubKey, nil
-}
-
-func saveKeys(privP *sphinx.PrivateKey, pubP *sphinx.PublicKey) {
-	if err := helpers.ToPEMFile(privP, defaultPrivateKeyFile, constants.PrivateKeyPEMType); err != nil {
-		fmt.Fprintf(os.Stderr, "failed to save private key: %v", err)
-		os.Exit(1)
-	}
-	fmt.Fprintf(os.Stdout, "Saved generated private key to %v\n", defaultPrivateKeyFile)
-
-	if err := helpers.ToPEMFile(pubP, defaultPublicKeyFile, constants.PublicKeyPEMType); err != nil {
-		fmt.Fprintf(os.Stderr, "failed to save public key: %v", err)
-		os.Exit(1)
-	}
-	fmt.Fprintf(os.Stdout, "Saved generated public key to %v\n", defaultPublicKeyFile)
-}
-
 func cmdRun(args []string, usage string) {
 	opts := newOpts("run [OPTIONS]", usage)
 	id := opts.Flags("--id").Label("ID").String("Id of the nym-mixnet-provider we want to run", defaultID)
-	host := opts.Flags("--host").Label("HOST").String("The host on which the nym-mixnet-provider is running", defaultHost)
-	port := opts.Flags("--port").Label("PORT").String("Port on which nym-mixnet-provider listens", defaultPort)
+	customConfigPath := opts.Flags("--customCfg").Label("CUSTOMCFG").String(
+		"Path to custom configuration file of the provider", "")
 
 	params := opts.Parse(args)
 	if len(params) != 0 {
@@ -83,38 +40,43 @@ func cmdRun(args []string, usage string) {
 		os.Exit(1)
 	}
 
-	ip, err := helpers.GetLocalIP()
-	if err != nil {
-		panic(err)
+	var configPath string
+	var err error
+	if len(*customConfigPath) > 0 {
+		configPath = *customConfigPath
+	} else {
+		configPath, err = providerConfig.DefaultConfigPath(*id)
+		if err != nil {
+			panic(err)
+		}
 	}
 
-	if host == nil || len(*host) < 7 {
-		host = &ip
+	cfgExists, err := helpers.DirExists(configPath)
+	if !cfgExists || err != nil {
+		fmt.Fprintf(os.Stderr, "The configuration file at %v does not seem to exist. "+
+			"Create it first with the init command\n", configPath)
+		os.Exit(1)
 	}
 
-	privP, pubP, err := loadKeys()
+	cfg, err := providerConfig.LoadFile(configPath)
 	if err != nil {
-		privP, pubP, err = sphinx.GenerateKeyPair()
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "failed to generate new keypair: %v", err)
-			os.Exit(1)
-		}
-
-		saveKeys(privP, pubP)
+		fmt.Fprintf(os.Stderr, "Could not load the config file: %v\n", err)
+		os.Exit(1)
 	}
 
-	providerServer, err := provider.NewProviderServer(*id, *host, *port, privP, pubP)
+	providerServer, err := provider.NewProviderServer(cfg)
 	if err != nil {
 		panic(err)
 	}
 
-	err = providerServer.Start()
-	if err != nil {
-		panic(err)
+	// Start blocks until the provider is shut down
+	helpers.ShutdownOnSignal(providerServer.Shutdown)
+	if err := providerServer.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to spawn provider instance: %v\n", err)
+		os.Exit(-1)
 	}
 
-	wait := make(chan struct{})
-	<-wait
+	providerServer.Wait()
 }
 
 func newOpts(command string, usage string) *optparse.Parser {
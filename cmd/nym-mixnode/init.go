@@ -0,0 +1,135 @@
+// Copyright 2019 The Nym Mixnet Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/nymtech/nym-mixnet/constants"
+	"github.com/nymtech/nym-mixnet/helpers"
+	mixConfig "github.com/nymtech/nym-mixnet/server/mixnode/config"
+	"github.com/nymtech/nym-mixnet/sphinx"
+)
+
+func cmdInit(args []string, usage string) {
+	opts := newOpts("init [OPTIONS]", usage)
+	id := opts.Flags("--id").Label("ID").String("Id of the nym-mixnode we want to create config for", "")
+	layer := opts.Flags("--layer").Label("LAYER").Int("Mixnet layer of this particular node", 0)
+	host := opts.Flags("--host").Label("HOST").String("The host on which the nym-mixnode is going to listen. "+
+		"If left empty, the local IP address will be used", "")
+	port := opts.Flags("--port").Label("PORT").String("Port on which nym-mixnode is going to listen",
+		mixConfig.DefaultListenPort)
+	announce := opts.Flags("--announce").Label("ANNOUNCE").String("The host:port address announced "+
+		"to the directory server. If left empty, the listening address will be used", "")
+	local := opts.Flags("--local").Label("LOCAL").Bool("Flag to indicate whether the mixnode is expected " +
+		"to run on the local mixnet deployment")
+
+	params := opts.Parse(args)
+	if len(params) != 0 {
+		opts.PrintUsage()
+		os.Exit(1)
+	}
+
+	if *layer <= 0 {
+		fmt.Fprintf(os.Stderr, "a positive mixnet layer of the mixnode must be provided\n")
+		os.Exit(1)
+	}
+
+	var mixnodeID string
+	if len(*id) == 0 {
+		randomID := helpers.RandomString(8)
+		fmt.Fprintf(os.Stdout, "No mixnodeID provided. Random string will be used instead: %v.\n", randomID)
+		mixnodeID = randomID
+	} else {
+		mixnodeID = *id
+	}
+
+	listenHost := *host
+	if len(listenHost) == 0 {
+		ip, err := helpers.GetLocalIP()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to obtain the local IP address: %v\n", err)
+			os.Exit(1)
+		}
+		listenHost = ip
+	}
+
+	defaultCfg, err := mixConfig.DefaultConfig(mixnodeID, *layer, net.JoinHostPort(listenHost, *port))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create config: %v\n", err)
+		os.Exit(1)
+	}
+
+	if len(*announce) > 0 {
+		if _, _, err := net.SplitHostPort(*announce); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid announce address: %v\n", err)
+			os.Exit(1)
+		}
+		defaultCfg.Mixnode.AnnounceAddress = *announce
+	}
+
+	if *local {
+		fmt.Fprintf(os.Stdout, "Using the local directory server\n")
+		defaultCfg.Mixnode.DirectoryServerPresenceEndpoint = mixConfig.DefaultLocalDirectoryServerPresenceEndpoint
+		defaultCfg.Mixnode.DirectoryServerMetricsEndpoint = mixConfig.DefaultLocalDirectoryServerMetricsEndpoint
+		defaultCfg.Mixnode.DirectoryServerTopologyEndpoint = mixConfig.DefaultLocalDirectoryServerTopologyEndpoint
+	}
+
+	configPath, err := mixConfig.DefaultConfigPath(mixnodeID)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to get default config path for %v: %v\n", mixnodeID, err)
+		os.Exit(1)
+	}
+
+	if exists, _ := helpers.DirExists(configPath); exists {
+		fmt.Fprintf(os.Stderr, "config file at %v already exists. Refusing to overwrite the identity of the mixnode\n",
+			configPath)
+		os.Exit(1)
+	}
+
+	configDir, _ := filepath.Split(configPath)
+	if err := helpers.EnsureDir(configDir, 0700); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create mixnode directory: %v\n", err)
+		os.Exit(1)
+	}
+
+	priv, pub, err := sphinx.GenerateKeyPair()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to generate sphinx keypair: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := helpers.ToPEMFile(priv, defaultCfg.Mixnode.PrivateKeyFile(), constants.PrivateKeyPEMType); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to save private key: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stdout, "Saved generated private key to %v\n", defaultCfg.Mixnode.PrivateKeyFile())
+
+	if err := helpers.ToPEMFile(pub, defaultCfg.Mixnode.PublicKeyFile(), constants.PublicKeyPEMType); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to save public key: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stdout, "Saved generated public key to %v\n", defaultCfg.Mixnode.PublicKeyFile())
+
+	if err := mixConfig.WriteConfigFile(configPath, defaultCfg); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write config to a file: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Fprintf(os.Stdout, "Saved generated config to %v\n", configPath)
+}
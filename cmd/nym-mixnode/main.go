@@ -28,10 +28,12 @@ func main() {
 (mixnode)
 `
 	cmds := map[string]func([]string, string){
-		"run": cmdRun,
+		"init": cmdInit,
+		"run":  cmdRun,
 	}
 	info := map[string]string{
-		"run": "Run a Nym mixnode",
+		"init": "Initialise a Nym mixnode",
+		"run":  "Run a persistent Nym mixnode",
 	}
 	optparse.Commands("nym-mixnode", "0.4.0", cmds, info, logo)
 }
@@ -15,29 +15,24 @@
 package main
 
 import (
+	"fmt"
 	"os"
 
 	"github.com/nymtech/nym-mixnet/helpers"
 	"github.com/nymtech/nym-mixnet/server/mixnode"
-	"github.com/nymtech/nym-mixnet/sphinx"
+	mixConfig "github.com/nymtech/nym-mixnet/server/mixnode/config"
 	"github.com/tav/golly/optparse"
 )
 
 const (
-	// PkiDb is the location of the database file, relative to the project root. TODO: move this to homedir.
-	PkiDb        = "pki/database.db"
-	defaultHost  = ""
-	defaultID    = "Mix1"
-	defaultPort  = "1789"
-	defaultLayer = -1
+	defaultID = "Mix1"
 )
 
 func cmdRun(args []string, usage string) {
 	opts := newOpts("run [OPTIONS]", usage)
 	id := opts.Flags("--id").Label("ID").String("Id of the nym-mixnode we want to run", defaultID)
-	host := opts.Flags("--host").Label("HOST").String("The host on which the nym-mixnode is running", defaultHost)
-	port := opts.Flags("--port").Label("PORT").String("Port on which nym-mixnode listens", defaultPort)
-	layer := opts.Flags("--layer").Label("Layer").Int("Mixnet layer of this particular node", defaultLayer)
+	customConfigPath := opts.Flags("--customCfg").Label("CUSTOMCFG").String(
+		"Path to custom configuration file of the mixnode", "")
 
 	params := opts.Parse(args)
 	if len(params) != 0 {
@@ -45,27 +40,40 @@ func cmdRun(args []string, usage string) {
 		os.Exit(1)
 	}
 
-	ip, err := helpers.GetLocalIP()
-	if err != nil {
-		panic(err)
+	var configPath string
+	var err error
+	if len(*customConfigPath) > 0 {
+		configPath = *customConfigPath
+	} else {
+		configPath, err = mixConfig.DefaultConfigPath(*id)
+		if err != nil {
+			panic(err)
+		}
 	}
 
-	if host == nil || len(*host) < 7 {
-		host = &ip
+	cfgExists, err := helpers.DirExists(configPath)
+	if !cfgExists || err != nil {
+		fmt.Fprintf(os.Stderr, "The configuration file at %v does not seem to exist. "+
+			"Create it first with the init command\n", configPath)
+		os.Exit(1)
 	}
 
-	pubM, privM, err := sphinx.GenerateKeyPair()
+	cfg, err := mixConfig.LoadFile(configPath)
 	if err != nil {
-		panic(err)
+		fmt.Fprintf(os.Stderr, "Could not load the config file: %v\n", err)
+		os.Exit(1)
 	}
 
-	mixServer, err := mixnode.NewMixServer(*id, *host, *port, pubM, privM, *layer)
+	mixServer, err := mixnode.NewMixServer(cfg)
 	if err != nil {
 		panic(err)
 	}
 
+	// Start blocks until the mixnode is shut down
+	helpers.ShutdownOnSignal(mixServer.Shutdown)
 	if err := mixServer.Start(); err != nil {
-		panic(err)
+		fmt.Fprintf(os.Stderr, "Failed to spawn mixnode instance: %v\n", err)
+		os.Exit(-1)
 	}
 
 	mixServer.Wait()
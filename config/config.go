@@ -58,7 +58,14 @@ func NewClientConfig(clientID, host, port string, pubKey []byte, providerInfo Mi
 // WrapWithFlag packs the given byte information together with a specified flag into the
 // packet.
 func WrapWithFlag(flag flags.PacketTypeFlag, data []byte) ([]byte, error) {
-	m := GeneralPacket{Flag: flag.Bytes(), Data: data}
+	return WrapWithFlagAndVersion(flag, 0, data)
+}
+
+// WrapWithFlagAndVersion packs the given byte information together with a specified flag
+// and the version of the format of the data into the packet. It allows the receiver to reject
+// the data it does not support before attempting to process it.
+func WrapWithFlagAndVersion(flag flags.PacketTypeFlag, version uint32, data []byte) ([]byte, error) {
+	m := GeneralPacket{Flag: flag.Bytes(), Data: data, Version: version}
 	mBytes, err := proto.Marshal(&m)
 	if err != nil {
 		return nil, err
@@ -26,6 +26,7 @@ type MixConfig struct {
 	Port                 string   `protobuf:"bytes,3,opt,name=Port,json=port,proto3" json:"Port,omitempty"`
 	PubKey               []byte   `protobuf:"bytes,4,opt,name=PubKey,json=pubKey,proto3" json:"PubKey,omitempty"`
 	Layer                uint64   `protobuf:"varint,5,opt,name=Layer,json=layer,proto3" json:"Layer,omitempty"`
+	PacketVersions       []uint32 `protobuf:"varint,6,rep,packed,name=PacketVersions,json=packetVersions,proto3" json:"PacketVersions,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -91,6 +92,13 @@ func (m *MixConfig) GetLayer() uint64 {
 	return 0
 }
 
+func (m *MixConfig) GetPacketVersions() []uint32 {
+	if m != nil {
+		return m.PacketVersions
+	}
+	return nil
+}
+
 type ClientConfig struct {
 	Id                   string     `protobuf:"bytes,1,opt,name=Id,json=id,proto3" json:"Id,omitempty"`
 	Host                 string     `protobuf:"bytes,2,opt,name=Host,json=host,proto3" json:"Host,omitempty"`
@@ -165,6 +173,7 @@ func (m *ClientConfig) GetProvider() *MixConfig {
 type GeneralPacket struct {
 	Flag                 []byte   `protobuf:"bytes,1,opt,name=Flag,json=flag,proto3" json:"Flag,omitempty"`
 	Data                 []byte   `protobuf:"bytes,2,opt,name=Data,json=data,proto3" json:"Data,omitempty"`
+	Version              uint32   `protobuf:"varint,3,opt,name=Version,json=version,proto3" json:"Version,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -209,6 +218,13 @@ func (m *GeneralPacket) GetData() []byte {
 	return nil
 }
 
+func (m *GeneralPacket) GetVersion() uint32 {
+	if m != nil {
+		return m.Version
+	}
+	return 0
+}
+
 type ProviderResponse struct {
 	NumberOfPackets      uint64   `protobuf:"varint,1,opt,name=NumberOfPackets,json=numberOfPackets,proto3" json:"NumberOfPackets,omitempty"`
 	Packets              [][]byte `protobuf:"bytes,2,rep,name=Packets,json=packets,proto3" json:"Packets,omitempty"`
@@ -314,25 +330,29 @@ func init() {
 func init() { proto.RegisterFile("config/structs.proto", fileDescriptor_f9a12e0597d01ddf) }
 
 var fileDescriptor_f9a12e0597d01ddf = []byte{
-	// 317 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xb4, 0x91, 0xcb, 0x4e, 0xf3, 0x30,
-	0x10, 0x85, 0x95, 0xd4, 0x49, 0xdb, 0x69, 0xfe, 0xbf, 0x60, 0x55, 0x28, 0xcb, 0x28, 0xab, 0x6c,
-	0x28, 0x12, 0x2c, 0x78, 0x80, 0x22, 0x2e, 0x82, 0x42, 0x64, 0x21, 0xf6, 0x4e, 0xe2, 0x96, 0xa8,
-	0x26, 0x4e, 0x7d, 0x41, 0xf4, 0x21, 0x78, 0x67, 0x64, 0xbb, 0x45, 0xea, 0x03, 0xb0, 0x3c, 0x9f,
-	0x46, 0x73, 0xce, 0x9c, 0x81, 0x59, 0x2d, 0xba, 0x55, 0xbb, 0xbe, 0x50, 0x5a, 0x9a, 0x5a, 0xab,
-	0x79, 0x2f, 0x85, 0x16, 0x38, 0xf6, 0x34, 0xdf, 0xc2, 0x78, 0xd9, 0x7e, 0x2d, 0x9c, 0xc0, 0xff,
-	0x21, 0x7c, 0x68, 0xd2, 0x20, 0x0b, 0x8a, 0x31, 0x09, 0xdb, 0x06, 0x63, 0x40, 0xf7, 0x42, 0xe9,
-	0x34, 0x74, 0x04, 0xbd, 0x0b, 0xa5, 0x2d, 0x2b, 0x85, 0xd4, 0xe9, 0xc0, 0xb3, 0x5e, 0x48, 0x8d,
-	0xcf, 0x20, 0x2e, 0x4d, 0xf5, 0xc8, 0x76, 0x29, 0xca, 0x82, 0x22, 0x21, 0x71, 0xef, 0x14, 0x9e,
-	0x41, 0xf4, 0x44, 0x77, 0x4c, 0xa6, 0x51, 0x16, 0x14, 0x88, 0x44, 0xdc, 0x8a, 0xfc, 0x3b, 0x80,
-	0x64, 0xc1, 0x5b, 0xd6, 0xe9, 0x3f, 0xb2, 0x3d, 0x87, 0x51, 0x29, 0xc5, 0x67, 0xdb, 0xec, 0x9d,
-	0x27, 0x97, 0xa7, 0x73, 0x7f, 0xee, 0xfc, 0xf7, 0x56, 0x32, 0xea, 0xf7, 0x23, 0xf9, 0x35, 0xfc,
-	0xbb, 0x63, 0x1d, 0x93, 0x94, 0x97, 0xb4, 0xde, 0x30, 0xe7, 0x75, 0xcb, 0xe9, 0xda, 0x25, 0x4a,
-	0x08, 0x5a, 0x71, 0xba, 0xb6, 0xec, 0x86, 0x6a, 0xea, 0x32, 0x25, 0x04, 0x35, 0x54, 0xd3, 0xfc,
-	0x0d, 0x4e, 0x0e, 0x3e, 0x84, 0xa9, 0x5e, 0x74, 0x8a, 0xe1, 0x02, 0xa6, 0xcf, 0xe6, 0xa3, 0x62,
-	0xf2, 0x65, 0xe5, 0xb7, 0x29, 0xb7, 0x06, 0x91, 0x69, 0x77, 0x8c, 0x71, 0x0a, 0xc3, 0xc3, 0x44,
-	0x98, 0x0d, 0x8a, 0x84, 0x0c, 0x7b, 0x2f, 0xf3, 0x25, 0x4c, 0x4a, 0xc3, 0x39, 0x61, 0x5b, 0xc3,
-	0x94, 0xb6, 0x2d, 0xbe, 0x8a, 0x0d, 0xeb, 0xf6, 0x79, 0x22, 0x6d, 0x85, 0x35, 0xf2, 0x25, 0x96,
-	0xa6, 0xe2, 0x6d, 0x6d, 0x5b, 0xf0, 0xd9, 0xa6, 0xf5, 0x31, 0xae, 0x62, 0xf7, 0xf1, 0xab, 0x9f,
-	0x00, 0x00, 0x00, 0xff, 0xff, 0x17, 0xe5, 0x0a, 0x17, 0x09, 0x02, 0x00, 0x00,
+	// 379 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xb4, 0x92, 0xdf, 0x6e, 0x9b, 0x30,
+	0x1c, 0x85, 0x05, 0x01, 0xd2, 0xba, 0x24, 0xd9, 0xac, 0x6a, 0xe2, 0x12, 0xa1, 0xa9, 0xe2, 0xa6,
+	0x44, 0xda, 0xde, 0x60, 0x9d, 0xf6, 0x47, 0x5b, 0x37, 0x66, 0x4d, 0xbd, 0xd8, 0x9d, 0x01, 0x87,
+	0x58, 0x35, 0x36, 0xb3, 0x7f, 0x54, 0xc9, 0x43, 0xec, 0x01, 0xf6, 0xb6, 0x93, 0x6d, 0x32, 0x29,
+	0x0f, 0xd0, 0x2b, 0x74, 0x3e, 0x59, 0x9c, 0x8f, 0x83, 0xd1, 0x75, 0xab, 0xe4, 0x8e, 0xf7, 0x5b,
+	0x03, 0x7a, 0x6a, 0xc1, 0x54, 0xa3, 0x56, 0xa0, 0x70, 0xe2, 0x69, 0xf1, 0x37, 0x40, 0x97, 0xf7,
+	0xfc, 0x70, 0xe7, 0x12, 0x5e, 0xa3, 0xf0, 0x73, 0x97, 0x05, 0x79, 0x50, 0x5e, 0x92, 0x90, 0x77,
+	0x18, 0xa3, 0xe8, 0x93, 0x32, 0x90, 0x85, 0x8e, 0x44, 0x7b, 0x65, 0xc0, 0xb2, 0x5a, 0x69, 0xc8,
+	0x16, 0x9e, 0x8d, 0x4a, 0x03, 0x7e, 0x85, 0x92, 0x7a, 0x6a, 0xbe, 0xb0, 0x63, 0x16, 0xe5, 0x41,
+	0x99, 0x92, 0x64, 0x74, 0x09, 0x5f, 0xa3, 0xf8, 0x2b, 0x3d, 0x32, 0x9d, 0xc5, 0x79, 0x50, 0x46,
+	0x24, 0x16, 0x36, 0xe0, 0x1b, 0xb4, 0xae, 0x69, 0xfb, 0xc8, 0xe0, 0x81, 0x69, 0xc3, 0x95, 0x34,
+	0x59, 0x92, 0x2f, 0xca, 0x15, 0x59, 0x8f, 0x67, 0xb4, 0xf8, 0x13, 0xa0, 0xf4, 0x4e, 0x70, 0x26,
+	0xe1, 0x99, 0xf4, 0x6e, 0xd1, 0x45, 0xad, 0xd5, 0x13, 0xef, 0x66, 0xc3, 0xab, 0x37, 0x2f, 0x2b,
+	0xbf, 0x4b, 0xf5, 0x7f, 0x13, 0x72, 0x31, 0xce, 0x47, 0x8a, 0x1f, 0x68, 0xf5, 0x91, 0x49, 0xa6,
+	0xa9, 0xf0, 0xfa, 0xb6, 0xeb, 0x83, 0xa0, 0xbd, 0x33, 0x4a, 0x49, 0xb4, 0x13, 0xb4, 0xb7, 0xec,
+	0x3d, 0x05, 0xea, 0x9c, 0x52, 0x12, 0x75, 0x14, 0x28, 0xce, 0xd0, 0x72, 0xfe, 0x28, 0xa7, 0xb5,
+	0x22, 0xcb, 0x27, 0x1f, 0x8b, 0x07, 0xf4, 0xe2, 0x64, 0x40, 0x98, 0x19, 0x95, 0x34, 0x0c, 0x97,
+	0x68, 0xf3, 0x6d, 0x1a, 0x1a, 0xa6, 0xbf, 0xef, 0x7c, 0x8f, 0x71, 0x05, 0x11, 0xd9, 0xc8, 0x73,
+	0x6c, 0xdf, 0x7b, 0x3a, 0x11, 0xe6, 0x8b, 0x32, 0x25, 0x4b, 0xbf, 0xa0, 0x29, 0xee, 0xd1, 0x55,
+	0x3d, 0x09, 0x41, 0xd8, 0xef, 0x89, 0x19, 0xb0, 0xff, 0xe1, 0xa7, 0x7a, 0x64, 0x72, 0x36, 0x8d,
+	0xc1, 0x06, 0x5b, 0xe4, 0xe7, 0xad, 0xa7, 0x46, 0xf0, 0xd6, 0xee, 0xe3, 0xad, 0x37, 0xed, 0x39,
+	0x7e, 0x77, 0xf3, 0xeb, 0x75, 0xcf, 0x61, 0x3f, 0x35, 0x55, 0xab, 0x86, 0xad, 0x3c, 0x0e, 0xc0,
+	0xda, 0xbd, 0x7d, 0xde, 0x0e, 0xfc, 0x20, 0x19, 0x6c, 0xfd, 0x6a, 0x4d, 0xe2, 0x2e, 0xd7, 0xdb,
+	0x7f, 0x03, 0x00, 0x11, 0x4f, 0xd9, 0xd8, 0x74, 0x02, 0x00, 0x00,
 }
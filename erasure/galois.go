@@ -0,0 +1,157 @@
+// Copyright 2019 The Nym Mixnet Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package erasure
+
+import "errors"
+
+// primitivePolynomial is the irreducible polynomial x^8 + x^4 + x^3 + x^2 + 1 defining GF(2^8),
+// in which 2 generates the multiplicative group of the field.
+const primitivePolynomial = 0x11d
+
+var (
+	// ErrSingularMatrix defines an error when the matrix over the field has no inverse.
+	ErrSingularMatrix = errors.New("matrix is singular")
+)
+
+var (
+	// expTable holds the powers of the generator, doubled so that the sum of two logarithms can index it directly.
+	expTable [2 * 255]byte
+	// logTable holds the discrete logarithms of the non-zero field elements.
+	logTable [256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		expTable[i] = byte(x)
+		expTable[i+255] = byte(x)
+		logTable[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= primitivePolynomial
+		}
+	}
+}
+
+// galMul multiplies two elements of GF(2^8).
+func galMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return expTable[int(logTable[a])+int(logTable[b])]
+}
+
+// galInv returns the multiplicative inverse of the non-zero element of GF(2^8).
+func galInv(a byte) byte {
+	return expTable[255-int(logTable[a])]
+}
+
+// galPow raises the element of GF(2^8) to the given power.
+func galPow(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return expTable[int(logTable[a])*n%255]
+}
+
+// galMulAdd adds the input multiplied by the coefficient to the output.
+func galMulAdd(c byte, in, out []byte) {
+	if c == 0 {
+		return
+	}
+	logC := int(logTable[c])
+	for i, b := range in {
+		if b != 0 {
+			out[i] ^= expTable[logC+int(logTable[b])]
+		}
+	}
+}
+
+// matrix is a matrix over GF(2^8), stored as a slice of its rows.
+type matrix [][]byte
+
+// newMatrix creates a zero matrix of the given dimensions.
+func newMatrix(rows, cols int) matrix {
+	m := make(matrix, rows)
+	for r := range m {
+		m[r] = make([]byte, cols)
+	}
+	return m
+}
+
+// vandermonde creates the matrix, whose element in row r and column c is r^c.
+// Any of its square submatrices made of full rows is invertible.
+func vandermonde(rows, cols int) matrix {
+	m := newMatrix(rows, cols)
+	for r := range m {
+		for c := range m[r] {
+			m[r][c] = galPow(byte(r), c)
+		}
+	}
+	return m
+}
+
+// multiply returns the product of the two matrices.
+func (m matrix) multiply(other matrix) matrix {
+	result := newMatrix(len(m), len(other[0]))
+	for r := range m {
+		for k, c := range m[r] {
+			galMulAdd(c, other[k], result[r])
+		}
+	}
+	return result
+}
+
+// invert returns the inverse of the square matrix computed with the Gauss-Jordan elimination.
+// It returns ErrSingularMatrix if the matrix is not invertible.
+func (m matrix) invert() (matrix, error) {
+	size := len(m)
+	// work on the matrix augmented with the identity matrix
+	work := newMatrix(size, 2*size)
+	for r := range m {
+		copy(work[r], m[r])
+		work[r][size+r] = 1
+	}
+
+	for c := 0; c < size; c++ {
+		pivot := c
+		for pivot < size && work[pivot][c] == 0 {
+			pivot++
+		}
+		if pivot == size {
+			return nil, ErrSingularMatrix
+		}
+		work[c], work[pivot] = work[pivot], work[c]
+
+		scale := galInv(work[c][c])
+		for i := range work[c] {
+			work[c][i] = galMul(work[c][i], scale)
+		}
+		for r := range work {
+			if r != c && work[r][c] != 0 {
+				galMulAdd(work[r][c], work[c], work[r])
+			}
+		}
+	}
+
+	inverse := make(matrix, size)
+	for r := range work {
+		inverse[r] = work[r][size:]
+	}
+	return inverse, nil
+}
@@ -0,0 +1,159 @@
+// Copyright 2019 The Nym Mixnet Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package erasure implements the systematic Reed-Solomon erasure code over GF(2^8), which allows
+// to recover the data split into shards from any subset of the shards as large as the data itself.
+package erasure
+
+import "errors"
+
+// MaxShards is the maximum total number of the data and parity shards of a single encoder.
+const MaxShards = 256
+
+var (
+	// ErrInvalidShardCount defines an error when the encoder cannot be created for the given number of shards,
+	// or when the number of the provided shards does not match the encoder.
+	ErrInvalidShardCount = errors.New("invalid number of shards")
+	// ErrInvalidShardSize defines an error when the provided shards are empty or differ in size.
+	ErrInvalidShardSize = errors.New("shards must be non-empty and of equal size")
+	// ErrTooFewShards defines an error when fewer shards than the data shards are available for the reconstruction.
+	ErrTooFewShards = errors.New("too few shards to reconstruct the data")
+)
+
+// Encoder computes the parity shards of the data shards and reconstructs the data shards
+// from any subset of dataShards shards.
+type Encoder struct {
+	dataShards   int
+	parityShards int
+	// matrix is the encoding matrix, whose top dataShards rows form the identity matrix,
+	// so that the data shards are included in the encoded shards unchanged
+	matrix matrix
+}
+
+// NewEncoder creates an encoder for the given number of data and parity shards,
+// which together cannot exceed MaxShards.
+func NewEncoder(dataShards, parityShards int) (*Encoder, error) {
+	if dataShards <= 0 || parityShards < 0 || dataShards+parityShards > MaxShards {
+		return nil, ErrInvalidShardCount
+	}
+
+	v := vandermonde(dataShards+parityShards, dataShards)
+	topInverse, err := v[:dataShards].invert()
+	if err != nil {
+		return nil, err
+	}
+	return &Encoder{
+		dataShards:   dataShards,
+		parityShards: parityShards,
+		matrix:       v.multiply(topInverse),
+	}, nil
+}
+
+// Encode computes the parity shards of the data shards. The shards slice must have the length
+// of the total number of shards, with the data shards at its beginning. The parity shards are
+// allocated by Encode and stored in the remaining elements of the slice.
+func (e *Encoder) Encode(shards [][]byte) error {
+	if len(shards) != e.dataShards+e.parityShards {
+		return ErrInvalidShardCount
+	}
+	size, err := shardSize(shards[:e.dataShards])
+	if err != nil {
+		return err
+	}
+	for _, shard := range shards[:e.dataShards] {
+		if shard == nil {
+			return ErrInvalidShardSize
+		}
+	}
+
+	for i := e.dataShards; i < len(shards); i++ {
+		shards[i] = make([]byte, size)
+		for j, data := range shards[:e.dataShards] {
+			galMulAdd(e.matrix[i][j], data, shards[i])
+		}
+	}
+	return nil
+}
+
+// ReconstructData recovers the missing data shards, marked as nil in the slice of all the shards,
+// given that at least as many shards as the data shards are present. The missing parity shards
+// are not recovered.
+func (e *Encoder) ReconstructData(shards [][]byte) error {
+	if len(shards) != e.dataShards+e.parityShards {
+		return ErrInvalidShardCount
+	}
+	size, err := shardSize(shards)
+	if err != nil {
+		return err
+	}
+
+	missingData := false
+	for _, shard := range shards[:e.dataShards] {
+		if shard == nil {
+			missingData = true
+			break
+		}
+	}
+	if !missingData {
+		return nil
+	}
+
+	// any dataShards rows of the encoding matrix form an invertible matrix, which maps
+	// the data shards into the corresponding present shards
+	present := make([]int, 0, e.dataShards)
+	for i := 0; i < len(shards) && len(present) < e.dataShards; i++ {
+		if shards[i] != nil {
+			present = append(present, i)
+		}
+	}
+	if len(present) < e.dataShards {
+		return ErrTooFewShards
+	}
+
+	sub := make(matrix, e.dataShards)
+	for r, i := range present {
+		sub[r] = e.matrix[i]
+	}
+	decoding, err := sub.invert()
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < e.dataShards; i++ {
+		if shards[i] != nil {
+			continue
+		}
+		shard := make([]byte, size)
+		for j, k := range present {
+			galMulAdd(decoding[i][j], shards[k], shard)
+		}
+		shards[i] = shard
+	}
+	return nil
+}
+
+// shardSize returns the common size of the present shards.
+func shardSize(shards [][]byte) (int, error) {
+	size := 0
+	for _, shard := range shards {
+		if shard == nil {
+			continue
+		}
+		if len(shard) == 0 || (size != 0 && len(shard) != size) {
+			return 0, ErrInvalidShardSize
+		}
+		size = len(shard)
+	}
+	return size, nil
+}
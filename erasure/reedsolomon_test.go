@@ -0,0 +1,116 @@
+// Copyright 2019 The Nym Mixnet Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package erasure
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGaloisField(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		assert.Equal(t, byte(1), galMul(byte(a), galInv(byte(a))))
+		assert.Equal(t, galMul(byte(a), byte(a)), galPow(byte(a), 2))
+	}
+	// 0x80 * 2 overflows the byte and is reduced by the polynomial
+	assert.Equal(t, byte(0x1d), galMul(0x80, 2))
+}
+
+func TestMatrixInvert(t *testing.T) {
+	m := vandermonde(5, 5)
+	inverse, err := m.invert()
+	assert.Nil(t, err)
+	identity := m.multiply(inverse)
+	for r := range identity {
+		for c := range identity[r] {
+			if r == c {
+				assert.Equal(t, byte(1), identity[r][c])
+			} else {
+				assert.Zero(t, identity[r][c])
+			}
+		}
+	}
+
+	_, err = matrix{{1, 2}, {2, 4}}.invert()
+	assert.Equal(t, ErrSingularMatrix, err)
+}
+
+func randomShards(t *testing.T, count, size int) [][]byte {
+	shards := make([][]byte, count)
+	for i := range shards {
+		shards[i] = make([]byte, size)
+		_, err := rand.Read(shards[i])
+		assert.Nil(t, err)
+	}
+	return shards
+}
+
+func TestEncodeReconstructData(t *testing.T) {
+	encoder, err := NewEncoder(4, 3)
+	assert.Nil(t, err)
+
+	data := randomShards(t, 4, 100)
+	shards := append(append([][]byte{}, data...), nil, nil, nil)
+	assert.Nil(t, encoder.Encode(shards))
+	// the code is systematic
+	assert.Equal(t, data, shards[:4])
+
+	// every combination of three lost shards can be recovered
+	for a := 0; a < 7; a++ {
+		for b := a + 1; b < 7; b++ {
+			for c := b + 1; c < 7; c++ {
+				received := append([][]byte{}, shards...)
+				received[a], received[b], received[c] = nil, nil, nil
+				assert.Nil(t, encoder.ReconstructData(received))
+				assert.Equal(t, data, received[:4])
+			}
+		}
+	}
+
+	received := append([][]byte{}, shards...)
+	received[0], received[1], received[5], received[6] = nil, nil, nil, nil
+	assert.Equal(t, ErrTooFewShards, encoder.ReconstructData(received))
+}
+
+func TestEncodeMaxShards(t *testing.T) {
+	encoder, err := NewEncoder(MaxShards-16, 16)
+	assert.Nil(t, err)
+
+	data := randomShards(t, MaxShards-16, 8)
+	shards := append(append([][]byte{}, data...), make([][]byte, 16)...)
+	assert.Nil(t, encoder.Encode(shards))
+
+	for i := 0; i < 16; i++ {
+		shards[i*10] = nil
+	}
+	assert.Nil(t, encoder.ReconstructData(shards))
+	assert.Equal(t, data, shards[:MaxShards-16])
+}
+
+func TestEncoderInvalid(t *testing.T) {
+	_, err := NewEncoder(0, 1)
+	assert.Equal(t, ErrInvalidShardCount, err)
+	_, err = NewEncoder(200, MaxShards-199)
+	assert.Equal(t, ErrInvalidShardCount, err)
+
+	encoder, err := NewEncoder(2, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, ErrInvalidShardCount, encoder.Encode(make([][]byte, 2)))
+	assert.Equal(t, ErrInvalidShardSize, encoder.Encode([][]byte{{1, 2}, {3}, nil}))
+	assert.Equal(t, ErrInvalidShardSize, encoder.Encode([][]byte{{1, 2}, nil, nil}))
+	assert.Equal(t, ErrInvalidShardSize, encoder.ReconstructData([][]byte{{1, 2}, nil, {3}}))
+}
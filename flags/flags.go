@@ -19,6 +19,15 @@
 
 package flags
 
+import (
+	"errors"
+)
+
+var (
+	// ErrUnknownPacketTypeFlag defines an error when the packet type flag of a general packet is not recognised.
+	ErrUnknownPacketTypeFlag = errors.New("unknown packet type flag")
+)
+
 // SphinxFlag represents flag present in all sphinx packages to indicate whether the packet has reached
 // its final hop or should be relayed.
 type SphinxFlag byte
@@ -98,3 +107,13 @@ func PacketTypeFlagFromBytes(b []byte) PacketTypeFlag {
 	}
 	return PacketTypeFlagFromByte(b[0])
 }
+
+// ParsePacketTypeFlag returns the packet type flag encoded in b. Unlike PacketTypeFlagFromBytes, it distinguishes
+// flags which are not recognised, for example sent by a newer implementation, by returning ErrUnknownPacketTypeFlag.
+func ParsePacketTypeFlag(b []byte) (PacketTypeFlag, error) {
+	flag := PacketTypeFlagFromBytes(b)
+	if flag == InvalidPacketTypeFlag {
+		return InvalidPacketTypeFlag, ErrUnknownPacketTypeFlag
+	}
+	return flag, nil
+}
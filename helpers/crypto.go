@@ -20,7 +20,10 @@ package helpers
 
 import (
 	"crypto/sha256"
+	"encoding/binary"
 	"errors"
+	"io"
+	"math"
 	"math/rand"
 	"time"
 
@@ -46,6 +49,20 @@ func RandomMix(mixes []config.MixConfig) config.MixConfig {
 	return mixes[rand.Intn(len(mixes))]
 }
 
+// RandomMixFrom returns a single mix chosen from given slice of mixes using the given source of randomness.
+// Unlike RandomMix, the choice is reproducible given the same source.
+func RandomMixFrom(random io.Reader, mixes []config.MixConfig) (config.MixConfig, error) {
+	if len(mixes) == 0 {
+		return config.MixConfig{}, ErrPermEmptyList
+	}
+	v, err := randomUint64(random)
+	if err != nil {
+		return config.MixConfig{}, err
+	}
+	// the bias of the modulo is negligible for any realistic number of mixes
+	return mixes[v%uint64(len(mixes))], nil
+}
+
 // a very dummy implementation of getting "random" string of given length
 // could be improved in number of ways but for the test sake it's good enough
 func RandomString(length int) string {
@@ -64,6 +81,30 @@ func RandomExponential(expParam float64) (float64, error) {
 	return rand.ExpFloat64() / expParam, nil
 }
 
+// RandomExponentialFrom returns a sample of the exponential distribution with the given rate parameter,
+// computed by the inverse transform of a uniform value read from the given source of randomness.
+func RandomExponentialFrom(random io.Reader, expParam float64) (float64, error) {
+	if expParam <= 0.0 {
+		return 0.0, ErrExponentialDistributionParam
+	}
+	v, err := randomUint64(random)
+	if err != nil {
+		return 0.0, err
+	}
+	// uniform value in (0, 1] with the 53 bits of precision of float64
+	u := float64(v>>11+1) / (1 << 53)
+	return -math.Log(u) / expParam, nil
+}
+
+// randomUint64 reads a single big-endian uint64 from the source of randomness.
+func randomUint64(random io.Reader) (uint64, error) {
+	var b [8]byte
+	if _, err := io.ReadFull(random, b[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(b[:]), nil
+}
+
 // SHA256 computes the hash value of a given argument using SHA256 algorithm.
 func SHA256(arg []byte) ([]byte, error) {
 	h := sha256.New()
@@ -15,10 +15,13 @@
 package helpers
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"reflect"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/nymtech/nym-mixnet/config"
 	"github.com/stretchr/testify/assert"
@@ -127,3 +130,43 @@ func TestRandomExponential_Fail_NegativeParam(t *testing.T) {
 		" RandomExponential should return an error if the given parameter is non-positive",
 	)
 }
+
+func TestRandomExponentialFrom(t *testing.T) {
+	random := bytes.Repeat([]byte{0x42}, 16)
+	val, err := RandomExponentialFrom(bytes.NewReader(random), 5.0)
+	assert.Nil(t, err)
+	assert.True(t, val > 0)
+
+	valAgain, err := RandomExponentialFrom(bytes.NewReader(random), 5.0)
+	assert.Nil(t, err)
+	assert.Equal(t, val, valAgain)
+
+	_, err = RandomExponentialFrom(bytes.NewReader(random), 0.0)
+	assert.Equal(t, ErrExponentialDistributionParam, err)
+
+	_, err = RandomExponentialFrom(bytes.NewReader(nil), 5.0)
+	assert.Error(t, err)
+}
+
+func TestRandomMixFrom(t *testing.T) {
+	mixes := []config.MixConfig{{Id: "Mix1"}, {Id: "Mix2"}, {Id: "Mix3"}}
+
+	mix, err := RandomMixFrom(bytes.NewReader([]byte{0, 0, 0, 0, 0, 0, 0, 4}), mixes)
+	assert.Nil(t, err)
+	assert.Equal(t, "Mix2", mix.Id)
+
+	_, err = RandomMixFrom(bytes.NewReader(make([]byte, 8)), nil)
+	assert.Equal(t, ErrPermEmptyList, err)
+}
+
+func TestShutdownOnSignal(t *testing.T) {
+	done := make(chan struct{})
+	ShutdownOnSignal(func() { close(done) })
+
+	assert.Nil(t, syscall.Kill(os.Getpid(), syscall.SIGTERM))
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("shutdown was not called")
+	}
+}
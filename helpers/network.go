@@ -28,6 +28,7 @@ import (
 
 	"github.com/nymtech/nym-directory/models"
 	"github.com/nymtech/nym-mixnet/config"
+	"github.com/nymtech/nym-mixnet/flags"
 	"github.com/nymtech/nym-mixnet/sphinx"
 )
 
@@ -78,18 +79,20 @@ func GetLocalIP() (string, error) {
 	return "", ErrInvalidLocalIP
 }
 
-// RegisterMixNodePresence registers server presence at the directory server.
-func RegisterMixNodePresence(publicKey *sphinx.PublicKey, layer int, host ...string) error {
-	b64Key := base64.URLEncoding.EncodeToString(publicKey.Bytes())
-	values := map[string]interface{}{"pubKey": b64Key, "layer": layer}
-	if len(host) == 1 {
-		values["host"] = host[0]
-	}
-	jsonValue, err := json.Marshal(values)
+// WrapSphinxPacket packs the encoded sphinx packet into the packet with the communication flag,
+// announcing the version of its format.
+func WrapSphinxPacket(sphinxPacket []byte) ([]byte, error) {
+	version, err := sphinx.PacketVersion(sphinxPacket)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return config.WrapWithFlagAndVersion(flags.CommFlag, version, sphinxPacket)
+}
 
+// RegisterMixNodePresence registers server presence at the directory server.
+// The presence includes the versions of the packet format supported by the server, which are ignored
+// by the directory servers not storing them yet.
+func RegisterMixNodePresence(publicKey *sphinx.PublicKey, layer int, host ...string) error {
 	endpoint := config.DirectoryServerMixPresenceURL
 	if len(host) == 1 && len(host[0]) > 0 {
 		ip, _, err := net.SplitHostPort(host[0])
@@ -100,6 +103,20 @@ func RegisterMixNodePresence(publicKey *sphinx.PublicKey, layer int, host ...str
 			endpoint = config.LocalDirectoryServerMixPresenceURL
 		}
 	}
+	return RegisterMixNodePresenceAt(endpoint, publicKey, layer, host...)
+}
+
+// RegisterMixNodePresenceAt registers server presence at the given presence endpoint of the directory server.
+func RegisterMixNodePresenceAt(endpoint string, publicKey *sphinx.PublicKey, layer int, host ...string) error {
+	b64Key := base64.URLEncoding.EncodeToString(publicKey.Bytes())
+	values := map[string]interface{}{"pubKey": b64Key, "layer": layer, "versions": sphinx.SupportedPacketVersions()}
+	if len(host) == 1 {
+		values["host"] = host[0]
+	}
+	jsonValue, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
 
 	resp, err := http.Post(endpoint, "application/json", bytes.NewBuffer(jsonValue))
 	if err != nil {
@@ -120,12 +137,6 @@ func RegisterMixNodePresence(publicKey *sphinx.PublicKey, layer int, host ...str
 
 // SendMixMetrics sends the mixnode related packet metrics to the directory server.
 func SendMixMetrics(metric models.MixMetric, host ...string) error {
-	values := map[string]interface{}{"sent": metric.Sent, "pubKey": metric.PubKey, "received": metric.Received}
-	jsonValue, err := json.Marshal(values)
-	if err != nil {
-		return err
-	}
-
 	endpoint := config.DirectoryServerMetricsURL
 	if len(host) == 1 && len(host[0]) > 0 {
 		ip, _, err := net.SplitHostPort(host[0])
@@ -136,6 +147,16 @@ func SendMixMetrics(metric models.MixMetric, host ...string) error {
 			endpoint = config.LocalDirectoryServerMetricsURL
 		}
 	}
+	return SendMixMetricsTo(endpoint, metric)
+}
+
+// SendMixMetricsTo sends the mixnode related packet metrics to the given metrics endpoint of the directory server.
+func SendMixMetricsTo(endpoint string, metric models.MixMetric) error {
+	values := map[string]interface{}{"sent": metric.Sent, "pubKey": metric.PubKey, "received": metric.Received}
+	jsonValue, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
 
 	resp, err := http.Post(endpoint, "application/json", bytes.NewBuffer(jsonValue))
 	if err != nil {
@@ -155,17 +176,9 @@ func SendMixMetrics(metric models.MixMetric, host ...string) error {
 }
 
 // RegisterMixProviderPresence registers server presence at the directory server.
+// The presence includes the versions of the packet format supported by the server, which are ignored
+// by the directory servers not storing them yet.
 func RegisterMixProviderPresence(publicKey *sphinx.PublicKey, clients []models.RegisteredClient, host ...string) error {
-	b64Key := base64.URLEncoding.EncodeToString(publicKey.Bytes())
-	values := map[string]interface{}{"pubKey": b64Key, "registeredClients": clients}
-	if len(host) == 1 {
-		values["host"] = host[0]
-	}
-	jsonValue, err := json.Marshal(values)
-	if err != nil {
-		return err
-	}
-
 	endpoint := config.DirectoryServerMixProviderPresenceURL
 	if len(host) == 1 && len(host[0]) > 0 {
 		ip, _, err := net.SplitHostPort(host[0])
@@ -176,6 +189,28 @@ func RegisterMixProviderPresence(publicKey *sphinx.PublicKey, clients []models.R
 			endpoint = config.LocalDirectoryServerMixProviderPresenceURL
 		}
 	}
+	return RegisterMixProviderPresenceAt(endpoint, publicKey, clients, host...)
+}
+
+// RegisterMixProviderPresenceAt registers server presence at the given presence endpoint of the directory server.
+func RegisterMixProviderPresenceAt(endpoint string,
+	publicKey *sphinx.PublicKey,
+	clients []models.RegisteredClient,
+	host ...string,
+) error {
+	b64Key := base64.URLEncoding.EncodeToString(publicKey.Bytes())
+	values := map[string]interface{}{
+		"pubKey":            b64Key,
+		"registeredClients": clients,
+		"versions":          sphinx.SupportedPacketVersions(),
+	}
+	if len(host) == 1 {
+		values["host"] = host[0]
+	}
+	jsonValue, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
 
 	resp, err := http.Post(endpoint, "application/json", bytes.NewBuffer(jsonValue))
 	if err != nil {
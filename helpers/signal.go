@@ -0,0 +1,34 @@
+// Copyright 2019 The Nym Mixnet Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helpers
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// ShutdownOnSignal calls the shutdown function in a new goroutine once the process receives SIGINT or SIGTERM.
+// Afterwards the signals are no longer caught, so that another one terminates the process right away
+// if the shutdown takes too long.
+func ShutdownOnSignal(shutdown func()) {
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signalCh
+		signal.Stop(signalCh)
+		shutdown()
+	}()
+}
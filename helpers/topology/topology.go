@@ -40,12 +40,32 @@ type ProviderPresence []models.MixProviderPresence
 // LayeredMixes defines map of list of mix nodes corresponding to particular layer in given topology.
 type LayeredMixes map[uint][]config.MixConfig
 
+// PacketVersions defines map of the packet format versions advertised by the nodes, keyed by their public keys.
+type PacketVersions map[string][]uint32
+
+// Topology holds the network topology obtained from the directory server together with
+// the packet format versions advertised by the nodes, which are not part of the directory models.
+// The current directory server does not store the versions sent in the presence of the nodes,
+// so they are missing from its topology and the nodes are assumed to support only
+// sphinx.LegacyPacketVersion until it does.
+type Topology struct {
+	*models.Topology
+	PacketVersions PacketVersions
+}
+
+// nodeVersions is the part of the node presence advertising its supported packet format versions.
+type nodeVersions struct {
+	PubKey   string   `json:"pubKey"`
+	Versions []uint32 `json:"versions"`
+}
+
 const (
 	DefaultClientHost = "0.0.0.0"
 	DefaultClientPort = "42"
 )
 
-func GetNetworkTopology(endpoint string) (*models.Topology, error) {
+// GetNetworkTopology obtains the current network topology from the directory server at the given endpoint.
+func GetNetworkTopology(endpoint string) (*Topology, error) {
 	resp, err := http.Get(endpoint)
 	if err != nil {
 		return nil, err
@@ -56,16 +76,37 @@ func GetNetworkTopology(endpoint string) (*models.Topology, error) {
 		return nil, err
 	}
 
+	return ParseNetworkTopology(body)
+}
+
+// ParseNetworkTopology parses the network topology returned by the directory server.
+func ParseNetworkTopology(body []byte) (*Topology, error) {
 	model := &models.Topology{}
 	if err := json.Unmarshal(body, model); err != nil {
 		return nil, err
 	}
 
-	return model, nil
+	var advertised struct {
+		MixNodes         []nodeVersions `json:"mixNodes"`
+		MixProviderNodes []nodeVersions `json:"mixProviderNodes"`
+	}
+	if err := json.Unmarshal(body, &advertised); err != nil {
+		return nil, err
+	}
+
+	versions := make(PacketVersions)
+	for _, node := range append(advertised.MixNodes, advertised.MixProviderNodes...) {
+		if len(node.Versions) > 0 {
+			versions[node.PubKey] = node.Versions
+		}
+	}
+
+	return &Topology{Topology: model, PacketVersions: versions}, nil
 }
 
-// GetMixesPKI returns PKI data for mix nodes, grouped by layer
-func GetMixesPKI(mixPresence MixPresence) (LayeredMixes, error) {
+// GetMixesPKI returns PKI data for mix nodes, grouped by layer, including the packet format versions
+// they advertised.
+func GetMixesPKI(mixPresence MixPresence, versions PacketVersions) (LayeredMixes, error) {
 	mixes := make(LayeredMixes)
 	for k, v := range mixPresence {
 		b, err := base64.URLEncoding.DecodeString(v.PubKey)
@@ -77,11 +118,12 @@ func GetMixesPKI(mixPresence MixPresence) (LayeredMixes, error) {
 			continue
 		}
 		newMixEntry := config.MixConfig{
-			Id:     mixPresence[k].PubKey,
-			Host:   host,
-			Port:   port,
-			PubKey: b,
-			Layer:  uint64(v.Layer),
+			Id:             mixPresence[k].PubKey,
+			Host:           host,
+			Port:           port,
+			PubKey:         b,
+			Layer:          uint64(v.Layer),
+			PacketVersions: versions[v.PubKey],
 		}
 		if layerMixes, ok := mixes[v.Layer]; ok {
 			extendedLayer := append(layerMixes, newMixEntry)
@@ -93,7 +135,9 @@ func GetMixesPKI(mixPresence MixPresence) (LayeredMixes, error) {
 	return mixes, nil
 }
 
-func ProviderPresenceToConfig(presence models.MixProviderPresence) (config.MixConfig, error) {
+// ProviderPresenceToConfig converts the provider presence into its configuration, including the packet format
+// versions it advertised.
+func ProviderPresenceToConfig(presence models.MixProviderPresence, versions PacketVersions) (config.MixConfig, error) {
 	b, err := base64.URLEncoding.DecodeString(presence.PubKey)
 	if err != nil {
 		return config.MixConfig{}, errors.New("invalid provider presence")
@@ -103,7 +147,9 @@ func ProviderPresenceToConfig(presence models.MixProviderPresence) (config.MixCo
 		return config.MixConfig{}, err
 	}
 
-	return config.NewMixConfig(presence.Host, host, port, b, config.ProviderLayer), nil
+	providerConfig := config.NewMixConfig(presence.Host, host, port, b, config.ProviderLayer)
+	providerConfig.PacketVersions = versions[presence.PubKey]
+	return providerConfig, nil
 }
 
 func RegisteredClientToConfig(client models.RegisteredClient) (config.ClientConfig, error) {
@@ -121,7 +167,7 @@ func RegisteredClientToConfig(client models.RegisteredClient) (config.ClientConf
 }
 
 // GetClientPKI returns a map of the current client PKI from the PKI database
-func GetClientPKI(providerPresence ProviderPresence) ([]config.ClientConfig, error) {
+func GetClientPKI(providerPresence ProviderPresence, versions PacketVersions) ([]config.ClientConfig, error) {
 	var clientsNum int = 0
 	for _, v := range providerPresence {
 		clientsNum += len(v.RegisteredClients)
@@ -129,7 +175,7 @@ func GetClientPKI(providerPresence ProviderPresence) ([]config.ClientConfig, err
 
 	clients := make([]config.ClientConfig, 0, clientsNum)
 	for _, provider := range providerPresence {
-		providerCfg, err := ProviderPresenceToConfig(provider)
+		providerCfg, err := ProviderPresenceToConfig(provider, versions)
 		if err != nil {
 			continue
 		}
@@ -0,0 +1,48 @@
+// Copyright 2019 The Nym Mixnet Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package topology
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseNetworkTopologyVersions(t *testing.T) {
+	body := []byte(`{
+		"mixNodes": [
+			{"host": "localhost:1789", "pubKey": "bWl4MQ==", "layer": 1, "versions": [2, 3]},
+			{"host": "localhost:1790", "pubKey": "bWl4Mg==", "layer": 2}
+		],
+		"mixProviderNodes": [
+			{"host": "localhost:1791", "pubKey": "cHJvdmlkZXI=", "registeredClients": [], "versions": [3]}
+		]
+	}`)
+
+	topology, err := ParseNetworkTopology(body)
+	assert.Nil(t, err)
+	assert.Len(t, topology.MixNodes, 2)
+	assert.Len(t, topology.MixProviderNodes, 1)
+	assert.Equal(t, PacketVersions{"bWl4MQ==": {2, 3}, "cHJvdmlkZXI=": {3}}, topology.PacketVersions)
+
+	mixes, err := GetMixesPKI(topology.MixNodes, topology.PacketVersions)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint32{2, 3}, mixes[1][0].PacketVersions)
+	assert.Empty(t, mixes[2][0].PacketVersions)
+
+	provider, err := ProviderPresenceToConfig(topology.MixProviderNodes[0], topology.PacketVersions)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint32{3}, provider.PacketVersions)
+}
@@ -0,0 +1,104 @@
+// Copyright 2019 The Nym Mixnet Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package networker
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Layout of the header preceding every frame sent over a connection between the nodes.
+// The header is followed by exactly the number of bytes given by its length field.
+const (
+	frameVersionOffset = 0
+	frameVersionSize   = 1
+	frameLengthOffset  = frameVersionOffset + frameVersionSize
+	frameLengthSize    = 4
+
+	// FrameHeaderSize is the size of the header of every frame.
+	FrameHeaderSize = frameLengthOffset + frameLengthSize
+)
+
+const (
+	// FrameVersion is the version of the framing created by this implementation.
+	FrameVersion = 1
+
+	// MaxFrameSize is the maximum size of the content of any frame. The readers of particular links
+	// can enforce stricter limits, for instance of the frames carrying single packets.
+	MaxFrameSize = 1 << 20
+)
+
+var (
+	// ErrFrameTooLarge defines an error when the content of the frame exceeds the allowed size.
+	ErrFrameTooLarge = errors.New("frame is too large")
+	// ErrUnsupportedFrameVersion defines an error when the received frame is of an unknown version.
+	ErrUnsupportedFrameVersion = errors.New("unsupported frame version")
+	// ErrTruncatedFrame defines an error when the connection is closed in the middle of a frame.
+	ErrTruncatedFrame = errors.New("truncated frame")
+)
+
+// WriteFrame writes the data in a single frame, so that many frames can be sent one after another
+// over a single connection. It returns ErrFrameTooLarge if the data exceeds MaxFrameSize.
+func WriteFrame(w io.Writer, data []byte) error {
+	if len(data) > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+	b := make([]byte, FrameHeaderSize+len(data))
+	b[frameVersionOffset] = FrameVersion
+	binary.BigEndian.PutUint32(b[frameLengthOffset:], uint32(len(data)))
+	copy(b[FrameHeaderSize:], data)
+	_, err := w.Write(b)
+	return err
+}
+
+// ReadFrame reads the content of a single frame written with WriteFrame, which cannot be larger
+// than maxSize bytes. It returns io.EOF if the connection was closed before any part of the frame
+// was received and ErrTruncatedFrame if it was closed before the whole frame was received.
+// The frames larger than maxSize are rejected before their content is read.
+func ReadFrame(r io.Reader, maxSize int) ([]byte, error) {
+	var header [FrameHeaderSize]byte
+	if err := readFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	if header[frameVersionOffset] != FrameVersion {
+		return nil, ErrUnsupportedFrameVersion
+	}
+	length := binary.BigEndian.Uint32(header[frameLengthOffset:])
+	if maxSize > MaxFrameSize {
+		maxSize = MaxFrameSize
+	}
+	if uint64(length) > uint64(maxSize) {
+		return nil, ErrFrameTooLarge
+	}
+
+	data := make([]byte, length)
+	if err := readFull(r, data); err != nil {
+		if err == io.EOF {
+			return nil, ErrTruncatedFrame
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+// readFull reads exactly len(b) bytes, reporting a partial read as ErrTruncatedFrame.
+func readFull(r io.Reader, b []byte) error {
+	_, err := io.ReadFull(r, b)
+	if err == io.ErrUnexpectedEOF {
+		return ErrTruncatedFrame
+	}
+	return err
+}
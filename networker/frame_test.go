@@ -0,0 +1,74 @@
+// Copyright 2019 The Nym Mixnet Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package networker
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteReadFrame(t *testing.T) {
+	var buf bytes.Buffer
+	assert.Nil(t, WriteFrame(&buf, []byte("first")))
+	assert.Nil(t, WriteFrame(&buf, nil))
+	assert.Nil(t, WriteFrame(&buf, []byte("second")))
+	assert.Equal(t, byte(FrameVersion), buf.Bytes()[0])
+	assert.Equal(t, 3*FrameHeaderSize+len("first")+len("second"), buf.Len())
+
+	for _, expected := range [][]byte{[]byte("first"), {}, []byte("second")} {
+		data, err := ReadFrame(&buf, MaxFrameSize)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, data)
+	}
+	_, err := ReadFrame(&buf, MaxFrameSize)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestReadFrameTruncated(t *testing.T) {
+	var buf bytes.Buffer
+	assert.Nil(t, WriteFrame(&buf, []byte("truncated")))
+	frame := buf.Bytes()
+
+	// the connection is closed either within the header or within the content of the frame
+	for _, length := range []int{1, FrameHeaderSize - 1, FrameHeaderSize, len(frame) - 1} {
+		_, err := ReadFrame(bytes.NewReader(frame[:length]), MaxFrameSize)
+		assert.Equal(t, ErrTruncatedFrame, err)
+	}
+}
+
+func TestFrameLimits(t *testing.T) {
+	var buf bytes.Buffer
+	assert.Equal(t, ErrFrameTooLarge, WriteFrame(&buf, make([]byte, MaxFrameSize+1)))
+	assert.Zero(t, buf.Len())
+
+	assert.Nil(t, WriteFrame(&buf, make([]byte, 100)))
+	frame := buf.Bytes()
+	_, err := ReadFrame(bytes.NewReader(frame), 99)
+	assert.Equal(t, ErrFrameTooLarge, err)
+	data, err := ReadFrame(bytes.NewReader(frame), 100)
+	assert.Nil(t, err)
+	assert.Len(t, data, 100)
+
+	// the limit of the reader cannot exceed MaxFrameSize
+	_, err = ReadFrame(bytes.NewReader([]byte{FrameVersion, 0xff, 0xff, 0xff, 0xff}), 1<<32)
+	assert.Equal(t, ErrFrameTooLarge, err)
+
+	frame[0] = FrameVersion + 1
+	_, err = ReadFrame(bytes.NewReader(frame), MaxFrameSize)
+	assert.Equal(t, ErrUnsupportedFrameVersion, err)
+}
@@ -0,0 +1,381 @@
+// Copyright 2019 The Nym Mixnet Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package networker
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"math"
+
+	"github.com/nymtech/nym-mixnet/sphinx"
+	"golang.org/x/crypto/curve25519"
+)
+
+const (
+	// linkProtocolName is the name of the handshake of the links, as defined by the Noise Protocol Framework.
+	// In the IK pattern the initiator knows the static key of the responder in advance and sends its own
+	// static key encrypted in the first message, so both sides are authenticated after a single round trip.
+	linkProtocolName = "Noise_IK_25519_AESGCM_SHA256"
+
+	// linkPrologue binds the handshake to the links of this network.
+	linkPrologue = "nym-mixnet-link"
+
+	// dhSize is the size of the public keys and of the results of the Diffie-Hellman function.
+	dhSize = sphinx.PublicKeySize
+	// tagSize is the size of the authentication tag of every encrypted message.
+	tagSize = 16
+
+	// initiatorMessageSize is the size of the first handshake message: the ephemeral key of the initiator,
+	// its encrypted static key and the authentication tag of the empty payload.
+	initiatorMessageSize = dhSize + dhSize + tagSize + tagSize
+	// responderMessageSize is the size of the second handshake message: the ephemeral key of the responder
+	// and the authentication tag of the empty payload.
+	responderMessageSize = dhSize + tagSize
+)
+
+var (
+	// ErrInvalidLinkKey defines an error when the public key of the peer is malformed or of low order.
+	ErrInvalidLinkKey = errors.New("invalid link key")
+	// ErrLinkDecryption defines an error when the received message cannot be authenticated.
+	ErrLinkDecryption = errors.New("link message authentication failed")
+	// ErrLinkNonceExhausted defines an error when no more messages can be encrypted with the link keys.
+	ErrLinkNonceExhausted = errors.New("link nonce exhausted")
+)
+
+// cipherState encrypts the messages sent in a single direction, with a counter used as the nonce.
+type cipherState struct {
+	aead  cipher.AEAD
+	nonce uint64
+}
+
+func newCipherState(key []byte) (*cipherState, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &cipherState{aead: aead}, nil
+}
+
+// nextNonce returns the encoding of the current nonce and advances the counter.
+func (c *cipherState) nextNonce() ([]byte, error) {
+	if c.nonce == math.MaxUint64 {
+		return nil, ErrLinkNonceExhausted
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], c.nonce)
+	c.nonce++
+	return nonce, nil
+}
+
+func (c *cipherState) encrypt(ad, plaintext []byte) ([]byte, error) {
+	nonce, err := c.nextNonce()
+	if err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(nil, nonce, plaintext, ad), nil
+}
+
+func (c *cipherState) decrypt(ad, ciphertext []byte) ([]byte, error) {
+	nonce, err := c.nextNonce()
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := c.aead.Open(nil, nonce, ciphertext, ad)
+	if err != nil {
+		return nil, ErrLinkDecryption
+	}
+	return plaintext, nil
+}
+
+// symmetricState holds the chaining key and the hash of the handshake transcript.
+type symmetricState struct {
+	ck     []byte
+	h      []byte
+	cipher *cipherState
+}
+
+func newSymmetricState() *symmetricState {
+	h := make([]byte, sha256.Size)
+	copy(h, linkProtocolName)
+	s := &symmetricState{ck: append([]byte{}, h...), h: h}
+	s.mixHash([]byte(linkPrologue))
+	return s
+}
+
+func (s *symmetricState) mixHash(data []byte) {
+	hash := sha256.New()
+	hash.Write(s.h)
+	hash.Write(data)
+	s.h = hash.Sum(nil)
+}
+
+func (s *symmetricState) mixKey(ikm []byte) error {
+	var key []byte
+	s.ck, key = hkdf(s.ck, ikm)
+	cs, err := newCipherState(key)
+	if err != nil {
+		return err
+	}
+	s.cipher = cs
+	return nil
+}
+
+func (s *symmetricState) encryptAndHash(plaintext []byte) ([]byte, error) {
+	ciphertext, err := s.cipher.encrypt(s.h, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	s.mixHash(ciphertext)
+	return ciphertext, nil
+}
+
+func (s *symmetricState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	plaintext, err := s.cipher.decrypt(s.h, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	s.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+// split derives the keys of the messages sent by the initiator and by the responder after the handshake.
+func (s *symmetricState) split() (*cipherState, *cipherState, error) {
+	initiatorKey, responderKey := hkdf(s.ck, nil)
+	initiator, err := newCipherState(initiatorKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	responder, err := newCipherState(responderKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return initiator, responder, nil
+}
+
+// hkdf derives two keys from the chaining key and the input key material.
+func hkdf(ck, ikm []byte) ([]byte, []byte) {
+	mac := hmac.New(sha256.New, ck)
+	mac.Write(ikm)
+	prk := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, prk)
+	mac.Write([]byte{0x01})
+	first := mac.Sum(nil)
+
+	mac.Reset()
+	mac.Write(first)
+	mac.Write([]byte{0x02})
+	return first, mac.Sum(nil)
+}
+
+// dh computes the Diffie-Hellman function of the private key and the public key of the peer.
+// It rejects the keys of low order, for which the result does not depend on the private key.
+func dh(privKey *sphinx.PrivateKey, pubKey []byte) ([]byte, error) {
+	if len(pubKey) != dhSize {
+		return nil, ErrInvalidLinkKey
+	}
+	var priv, pub, shared [dhSize]byte
+	copy(priv[:], privKey.Bytes())
+	copy(pub[:], pubKey)
+	curve25519.ScalarMult(&shared, &priv, &pub)
+
+	var zero [dhSize]byte
+	if subtle.ConstantTimeCompare(shared[:], zero[:]) == 1 {
+		return nil, ErrInvalidLinkKey
+	}
+	return shared[:], nil
+}
+
+// initiatorHandshake is the state of the handshake of the side, which opens the link.
+type initiatorHandshake struct {
+	symmetric *symmetricState
+	privKey   *sphinx.PrivateKey
+	pubKey    *sphinx.PublicKey
+	remoteKey []byte
+	ephemeral *sphinx.PrivateKey
+}
+
+func newInitiatorHandshake(privKey *sphinx.PrivateKey, pubKey *sphinx.PublicKey, remoteKey []byte) *initiatorHandshake {
+	s := newSymmetricState()
+	s.mixHash(remoteKey)
+	return &initiatorHandshake{symmetric: s, privKey: privKey, pubKey: pubKey, remoteKey: remoteKey}
+}
+
+// writeMessage creates the first message of the handshake: -> e, es, s, ss
+func (hs *initiatorHandshake) writeMessage() ([]byte, error) {
+	ephemeral, ephemeralPub, err := sphinx.GenerateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	hs.ephemeral = ephemeral
+	s := hs.symmetric
+
+	message := append([]byte{}, ephemeralPub.Bytes()...)
+	s.mixHash(ephemeralPub.Bytes())
+	es, err := dh(ephemeral, hs.remoteKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.mixKey(es); err != nil {
+		return nil, err
+	}
+	encryptedKey, err := s.encryptAndHash(hs.pubKey.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	message = append(message, encryptedKey...)
+	ss, err := dh(hs.privKey, hs.remoteKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.mixKey(ss); err != nil {
+		return nil, err
+	}
+	payload, err := s.encryptAndHash(nil)
+	if err != nil {
+		return nil, err
+	}
+	return append(message, payload...), nil
+}
+
+// readMessage processes the second message of the handshake: <- e, ee, se
+// and returns the cipher states of the sent and the received messages.
+func (hs *initiatorHandshake) readMessage(message []byte) (*cipherState, *cipherState, error) {
+	if len(message) != responderMessageSize {
+		return nil, nil, ErrLinkDecryption
+	}
+	s := hs.symmetric
+
+	remoteEphemeral := message[:dhSize]
+	s.mixHash(remoteEphemeral)
+	ee, err := dh(hs.ephemeral, remoteEphemeral)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := s.mixKey(ee); err != nil {
+		return nil, nil, err
+	}
+	se, err := dh(hs.privKey, remoteEphemeral)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := s.mixKey(se); err != nil {
+		return nil, nil, err
+	}
+	if _, err := s.decryptAndHash(message[dhSize:]); err != nil {
+		return nil, nil, err
+	}
+
+	initiator, responder, err := s.split()
+	if err != nil {
+		return nil, nil, err
+	}
+	return initiator, responder, nil
+}
+
+// responderHandshake is the state of the handshake of the side, which accepts the link.
+type responderHandshake struct {
+	symmetric       *symmetricState
+	privKey         *sphinx.PrivateKey
+	remoteKey       []byte
+	remoteEphemeral []byte
+}
+
+func newResponderHandshake(privKey *sphinx.PrivateKey, pubKey *sphinx.PublicKey) *responderHandshake {
+	s := newSymmetricState()
+	s.mixHash(pubKey.Bytes())
+	return &responderHandshake{symmetric: s, privKey: privKey}
+}
+
+// readMessage processes the first message of the handshake: -> e, es, s, ss
+// and learns the static key of the initiator.
+func (hs *responderHandshake) readMessage(message []byte) error {
+	if len(message) != initiatorMessageSize {
+		return ErrLinkDecryption
+	}
+	s := hs.symmetric
+
+	hs.remoteEphemeral = message[:dhSize]
+	s.mixHash(hs.remoteEphemeral)
+	es, err := dh(hs.privKey, hs.remoteEphemeral)
+	if err != nil {
+		return err
+	}
+	if err := s.mixKey(es); err != nil {
+		return err
+	}
+	remoteKey, err := s.decryptAndHash(message[dhSize : 2*dhSize+tagSize])
+	if err != nil {
+		return err
+	}
+	ss, err := dh(hs.privKey, remoteKey)
+	if err != nil {
+		return err
+	}
+	if err := s.mixKey(ss); err != nil {
+		return err
+	}
+	if _, err := s.decryptAndHash(message[2*dhSize+tagSize:]); err != nil {
+		return err
+	}
+	hs.remoteKey = remoteKey
+	return nil
+}
+
+// writeMessage creates the second message of the handshake: <- e, ee, se
+// and returns the cipher states of the sent and the received messages.
+func (hs *responderHandshake) writeMessage() ([]byte, *cipherState, *cipherState, error) {
+	ephemeral, ephemeralPub, err := sphinx.GenerateKeyPair()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	s := hs.symmetric
+
+	message := append([]byte{}, ephemeralPub.Bytes()...)
+	s.mixHash(ephemeralPub.Bytes())
+	ee, err := dh(ephemeral, hs.remoteEphemeral)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err := s.mixKey(ee); err != nil {
+		return nil, nil, nil, err
+	}
+	se, err := dh(ephemeral, hs.remoteKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err := s.mixKey(se); err != nil {
+		return nil, nil, nil, err
+	}
+	payload, err := s.encryptAndHash(nil)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	initiator, responder, err := s.split()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return append(message, payload...), responder, initiator, nil
+}
@@ -0,0 +1,208 @@
+// Copyright 2019 The Nym Mixnet Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package networker
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/nymtech/nym-mixnet/sphinx"
+)
+
+const (
+	// handshakeTimeout is the maximum time of establishing the link over a connection.
+	handshakeTimeout = 10 * time.Second
+
+	// MaxLinkFrameSize is the maximum size of the data sent in a single frame over a link.
+	MaxLinkFrameSize = MaxFrameSize - tagSize
+)
+
+var (
+	// ErrUnexpectedLinkKey defines an error when the peer does not prove the possession of the expected key.
+	ErrUnexpectedLinkKey = errors.New("peer does not hold the expected link key")
+	// ErrLinkRejected defines an error when the peer closes the connection during the handshake,
+	// which it does when the link is not established with its current key.
+	ErrLinkRejected = errors.New("link rejected by the peer")
+)
+
+// LinkKeys returns the static key pair, with which the node authenticates itself to its peers.
+// The pair is requested for each new link, so that the keys can be rotated.
+type LinkKeys func() (*sphinx.PrivateKey, *sphinx.PublicKey)
+
+// StaticLinkKeys returns the LinkKeys of a node, which never rotates its keys.
+func StaticLinkKeys(privKey *sphinx.PrivateKey, pubKey *sphinx.PublicKey) LinkKeys {
+	return func() (*sphinx.PrivateKey, *sphinx.PublicKey) {
+		return privKey, pubKey
+	}
+}
+
+// Link is an authenticated and encrypted connection between two parties, over which
+// frames are sent in both directions. The link can be read and written by two different
+// goroutines, but neither the reads nor the writes can be concurrent.
+type Link struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	remoteKey []byte
+	send      *cipherState
+	receive   *cipherState
+}
+
+// ConnectLink establishes the link over the connection opened to the peer, which has to prove
+// the possession of the private key corresponding to remoteKey, as published in the topology.
+// The connection is not closed if the handshake fails.
+func ConnectLink(conn net.Conn, keys LinkKeys, remoteKey []byte) (*Link, error) {
+	if len(remoteKey) != dhSize {
+		return nil, ErrInvalidLinkKey
+	}
+	privKey, pubKey := keys()
+	hs := newInitiatorHandshake(privKey, pubKey, remoteKey)
+	message, err := hs.writeMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	if err := conn.SetDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+		return nil, err
+	}
+	if err := WriteFrame(conn, message); err != nil {
+		return nil, err
+	}
+	response, err := ReadFrame(reader, responderMessageSize)
+	if err == io.EOF {
+		return nil, ErrLinkRejected
+	}
+	if err != nil {
+		return nil, err
+	}
+	send, receive, err := hs.readMessage(response)
+	if err == ErrLinkDecryption {
+		return nil, ErrUnexpectedLinkKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+
+	return &Link{
+		conn:      conn,
+		reader:    reader,
+		remoteKey: append([]byte{}, remoteKey...),
+		send:      send,
+		receive:   receive,
+	}, nil
+}
+
+// AcceptLink establishes the link over the connection accepted from a peer and learns its static key.
+// The connection is not closed if the handshake fails.
+func AcceptLink(conn net.Conn, keys LinkKeys) (*Link, error) {
+	privKey, pubKey := keys()
+	hs := newResponderHandshake(privKey, pubKey)
+
+	reader := bufio.NewReader(conn)
+	if err := conn.SetDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+		return nil, err
+	}
+	message, err := ReadFrame(reader, initiatorMessageSize)
+	if err != nil {
+		return nil, err
+	}
+	if err := hs.readMessage(message); err != nil {
+		return nil, err
+	}
+	response, send, receive, err := hs.writeMessage()
+	if err != nil {
+		return nil, err
+	}
+	if err := WriteFrame(conn, response); err != nil {
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+
+	return &Link{
+		conn:      conn,
+		reader:    reader,
+		remoteKey: hs.remoteKey,
+		send:      send,
+		receive:   receive,
+	}, nil
+}
+
+// WriteFrame encrypts the data and sends it in a single frame. It returns ErrFrameTooLarge
+// if the data exceeds MaxLinkFrameSize.
+func (l *Link) WriteFrame(data []byte) error {
+	if len(data) > MaxLinkFrameSize {
+		return ErrFrameTooLarge
+	}
+	ciphertext, err := l.send.encrypt(nil, data)
+	if err != nil {
+		return err
+	}
+	return WriteFrame(l.conn, ciphertext)
+}
+
+// ReadFrame reads and decrypts the data of a single frame, which cannot be larger than maxSize bytes.
+// Like the unencrypted ReadFrame, it returns io.EOF if the link was closed between the frames.
+func (l *Link) ReadFrame(maxSize int) ([]byte, error) {
+	if maxSize > MaxLinkFrameSize {
+		maxSize = MaxLinkFrameSize
+	}
+	ciphertext, err := ReadFrame(l.reader, maxSize+tagSize)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < tagSize {
+		return nil, ErrLinkDecryption
+	}
+	return l.receive.decrypt(nil, ciphertext)
+}
+
+// RemoteKey returns the static public key of the peer, authenticated during the handshake.
+func (l *Link) RemoteKey() []byte {
+	return l.remoteKey
+}
+
+// HasRemoteKey checks whether the peer was authenticated with the given key.
+func (l *Link) HasRemoteKey(key []byte) bool {
+	return bytes.Equal(l.remoteKey, key)
+}
+
+// RemoteAddr returns the network address of the peer.
+func (l *Link) RemoteAddr() net.Addr {
+	return l.conn.RemoteAddr()
+}
+
+// SetDeadline sets the deadline of both reading from and writing to the link.
+func (l *Link) SetDeadline(t time.Time) error {
+	return l.conn.SetDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline of writing to the link.
+func (l *Link) SetWriteDeadline(t time.Time) error {
+	return l.conn.SetWriteDeadline(t)
+}
+
+// Close closes the underlying connection.
+func (l *Link) Close() error {
+	return l.conn.Close()
+}
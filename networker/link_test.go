@@ -0,0 +1,124 @@
+// Copyright 2019 The Nym Mixnet Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package networker
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// establishTestLinks establishes the link over an in-memory connection and returns both of its sides.
+func establishTestLinks(t *testing.T, initiatorKeys, responderKeys LinkKeys, remoteKey []byte) (*Link, *Link, error, error) {
+	initiatorConn, responderConn := net.Pipe()
+	type result struct {
+		link *Link
+		err  error
+	}
+	accepted := make(chan result)
+	go func() {
+		link, err := AcceptLink(responderConn, responderKeys)
+		if err != nil {
+			responderConn.Close()
+		}
+		accepted <- result{link, err}
+	}()
+	initiator, err := ConnectLink(initiatorConn, initiatorKeys, remoteKey)
+	if err != nil {
+		initiatorConn.Close()
+	}
+	responder := <-accepted
+	return initiator, responder.link, err, responder.err
+}
+
+func TestLinkHandshake(t *testing.T) {
+	initiatorKeys, responderKeys := testLinkKeys(t), testLinkKeys(t)
+	initiator, responder, initiatorErr, responderErr := establishTestLinks(t,
+		initiatorKeys,
+		responderKeys,
+		linkPublicKey(responderKeys),
+	)
+	assert.Nil(t, initiatorErr)
+	assert.Nil(t, responderErr)
+	defer initiator.Close()
+	defer responder.Close()
+
+	assert.Equal(t, linkPublicKey(responderKeys), initiator.RemoteKey())
+	assert.Equal(t, linkPublicKey(initiatorKeys), responder.RemoteKey())
+	assert.True(t, responder.HasRemoteKey(linkPublicKey(initiatorKeys)))
+
+	// the same data is encrypted differently in every frame
+	go func() {
+		assert.Nil(t, initiator.WriteFrame([]byte("request")))
+		assert.Nil(t, initiator.WriteFrame([]byte("request")))
+	}()
+	for i := 0; i < 2; i++ {
+		data, err := responder.ReadFrame(MaxLinkFrameSize)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("request"), data)
+	}
+
+	go func() {
+		assert.Nil(t, responder.WriteFrame([]byte("response")))
+	}()
+	data, err := initiator.ReadFrame(MaxLinkFrameSize)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("response"), data)
+
+	assert.Equal(t, ErrFrameTooLarge, initiator.WriteFrame(make([]byte, MaxLinkFrameSize+1)))
+}
+
+func TestLinkUnexpectedKey(t *testing.T) {
+	responderKeys := testLinkKeys(t)
+	_, _, initiatorErr, responderErr := establishTestLinks(t,
+		testLinkKeys(t),
+		responderKeys,
+		linkPublicKey(testLinkKeys(t)),
+	)
+	assert.Equal(t, ErrLinkRejected, initiatorErr)
+	assert.Equal(t, ErrLinkDecryption, responderErr)
+
+	_, _, initiatorErr, _ = establishTestLinks(t, testLinkKeys(t), responderKeys, make([]byte, dhSize))
+	assert.Equal(t, ErrInvalidLinkKey, initiatorErr)
+
+	_, _, initiatorErr, _ = establishTestLinks(t, testLinkKeys(t), responderKeys, []byte("short"))
+	assert.Equal(t, ErrInvalidLinkKey, initiatorErr)
+}
+
+func TestLinkTamperedFrame(t *testing.T) {
+	responderKeys := testLinkKeys(t)
+	initiatorConn, responderConn := net.Pipe()
+	defer initiatorConn.Close()
+	defer responderConn.Close()
+	accepted := make(chan *Link)
+	go func() {
+		link, err := AcceptLink(responderConn, responderKeys)
+		assert.Nil(t, err)
+		accepted <- link
+	}()
+	initiator, err := ConnectLink(initiatorConn, testLinkKeys(t), linkPublicKey(responderKeys))
+	assert.Nil(t, err)
+	responder := <-accepted
+
+	ciphertext, err := initiator.send.encrypt(nil, []byte("packet"))
+	assert.Nil(t, err)
+	ciphertext[0] ^= 1
+	go func() {
+		assert.Nil(t, WriteFrame(initiatorConn, ciphertext))
+	}()
+	_, err = responder.ReadFrame(MaxLinkFrameSize)
+	assert.Equal(t, ErrLinkDecryption, err)
+}
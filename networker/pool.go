@@ -0,0 +1,324 @@
+// Copyright 2019 The Nym Mixnet Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package networker
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultIdleTimeout is the default time after which the unused connections are closed.
+	DefaultIdleTimeout = time.Minute
+
+	// dialTimeout is the maximum time of establishing a new connection.
+	dialTimeout = 5 * time.Second
+	// writeTimeout is the maximum time of writing a single packet to the connection.
+	writeTimeout = 10 * time.Second
+	// responseTimeout is the maximum time of waiting for the response to a request.
+	responseTimeout = 30 * time.Second
+
+	// minReconnectBackoff and maxReconnectBackoff bound the time, for which a peer is not dialled again
+	// after a failed attempt. The time doubles with every consecutive failure.
+	minReconnectBackoff = 100 * time.Millisecond
+	maxReconnectBackoff = 30 * time.Second
+)
+
+var (
+	// ErrPeerBackoff defines an error when the packet is not sent, because the last attempt
+	// to connect to the peer failed and the pool waits before trying again.
+	ErrPeerBackoff = errors.New("peer is unreachable, waiting before reconnecting")
+	// ErrPoolClosed defines an error when the packet is sent through the closed pool.
+	ErrPoolClosed = errors.New("connection pool is closed")
+)
+
+// PoolStats describes the connections of the pool.
+type PoolStats struct {
+	// Open is the number of currently open connections.
+	Open int
+	// Dials is the total number of connections established to new peers.
+	Dials uint64
+	// Reconnects is the total number of connections re-established to the known peers.
+	Reconnects uint64
+	// FailedDials is the total number of unsuccessful connection attempts.
+	FailedDials uint64
+	// Evictions is the total number of connections closed because of inactivity.
+	Evictions uint64
+}
+
+// peer holds the connection to a single address. Its lock serialises all the packets sent to the peer.
+type peer struct {
+	sync.Mutex
+	address   string
+	link      *Link
+	connected bool
+	lastUsed  time.Time
+	failures  uint
+	retryAt   time.Time
+	// evicted is set once the peer is removed from the pool and should no longer be used
+	evicted bool
+}
+
+// ConnectionPool keeps long-lived links to the peers, over which many packets are sent
+// one after another. Broken connections are re-established, waiting increasingly long after
+// consecutive failures, and connections unused for longer than the idle timeout are closed.
+type ConnectionPool struct {
+	mu          sync.Mutex
+	peers       map[string]*peer
+	idleTimeout time.Duration
+	stats       PoolStats
+	closed      bool
+
+	keys     LinkKeys
+	dial     func(address string) (net.Conn, error)
+	haltedCh chan struct{}
+	haltOnce sync.Once
+}
+
+// Send sends the packet to the given address over the pooled link to the peer holding remoteKey.
+func (p *ConnectionPool) Send(address string, remoteKey []byte, packet []byte) error {
+	return p.withPeer(address, remoteKey, func(pr *peer) error {
+		if err := pr.link.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+			return err
+		}
+		return pr.link.WriteFrame(packet)
+	})
+}
+
+// Request sends the packet to the given address over the pooled link to the peer holding remoteKey
+// and returns the response of the peer.
+func (p *ConnectionPool) Request(address string, remoteKey []byte, packet []byte) ([]byte, error) {
+	var response []byte
+	err := p.withPeer(address, remoteKey, func(pr *peer) error {
+		if err := pr.link.SetDeadline(time.Now().Add(responseTimeout)); err != nil {
+			return err
+		}
+		if err := pr.link.WriteFrame(packet); err != nil {
+			return err
+		}
+		var err error
+		response, err = pr.link.ReadFrame(MaxLinkFrameSize)
+		return err
+	})
+	return response, err
+}
+
+// withPeer runs the operation on the connection to the peer, connecting to it if needed. If the operation
+// on an existing connection fails for any reason other than a timeout, the connection might have been
+// closed by the peer in the meantime, so the operation is retried once over a new connection.
+// The existing connection is also replaced if the peer is now expected to hold a different key.
+func (p *ConnectionPool) withPeer(address string, remoteKey []byte, operation func(pr *peer) error) error {
+	for {
+		pr, err := p.getPeer(address)
+		if err != nil {
+			return err
+		}
+
+		pr.Lock()
+		if pr.evicted {
+			pr.Unlock()
+			continue
+		}
+		err = p.operate(pr, remoteKey, operation)
+		pr.Unlock()
+		return err
+	}
+}
+
+// operate implements withPeer for the locked peer.
+func (p *ConnectionPool) operate(pr *peer, remoteKey []byte, operation func(pr *peer) error) error {
+	if pr.link != nil && !pr.link.HasRemoteKey(remoteKey) {
+		p.disconnect(pr)
+	}
+	for attempt := 0; ; attempt++ {
+		reused := pr.link != nil
+		if !reused {
+			if err := p.connect(pr, remoteKey); err != nil {
+				return err
+			}
+		}
+
+		err := operation(pr)
+		if err == nil {
+			pr.lastUsed = time.Now()
+			return nil
+		}
+		p.disconnect(pr)
+		if netErr, ok := err.(net.Error); !reused || attempt > 0 || (ok && netErr.Timeout()) {
+			return err
+		}
+	}
+}
+
+// getPeer returns the peer of the given address, adding it to the pool if needed.
+func (p *ConnectionPool) getPeer(address string) (*peer, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil, ErrPoolClosed
+	}
+	pr, ok := p.peers[address]
+	if !ok {
+		pr = &peer{address: address, lastUsed: time.Now()}
+		p.peers[address] = pr
+	}
+	return pr, nil
+}
+
+// connect establishes the link to the locked peer, unless the peer is backing off after a failure.
+func (p *ConnectionPool) connect(pr *peer, remoteKey []byte) error {
+	now := time.Now()
+	if now.Before(pr.retryAt) {
+		return ErrPeerBackoff
+	}
+
+	link, err := p.openLink(pr.address, remoteKey)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		p.stats.FailedDials++
+		backoff := maxReconnectBackoff
+		if pr.failures < 16 && minReconnectBackoff<<pr.failures < maxReconnectBackoff {
+			backoff = minReconnectBackoff << pr.failures
+		}
+		pr.failures++
+		pr.retryAt = now.Add(backoff)
+		return err
+	}
+
+	if pr.connected {
+		p.stats.Reconnects++
+	} else {
+		p.stats.Dials++
+	}
+	p.stats.Open++
+	pr.link = link
+	pr.connected = true
+	pr.failures = 0
+	pr.retryAt = time.Time{}
+	return nil
+}
+
+// openLink dials the address and establishes the link to the peer holding remoteKey.
+func (p *ConnectionPool) openLink(address string, remoteKey []byte) (*Link, error) {
+	conn, err := p.dial(address)
+	if err != nil {
+		return nil, err
+	}
+	link, err := ConnectLink(conn, p.keys, remoteKey)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return link, nil
+}
+
+// disconnect closes the link of the locked peer.
+func (p *ConnectionPool) disconnect(pr *peer) {
+	if pr.link == nil {
+		return
+	}
+	_ = pr.link.Close()
+	pr.link = nil
+	p.mu.Lock()
+	p.stats.Open--
+	p.mu.Unlock()
+}
+
+// Stats returns the statistics of the connections of the pool.
+func (p *ConnectionPool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stats
+}
+
+// evictIdle closes the connections, which were not used for longer than the idle timeout,
+// and forgets the peers.
+func (p *ConnectionPool) evictIdle() {
+	p.mu.Lock()
+	peers := make([]*peer, 0, len(p.peers))
+	for _, pr := range p.peers {
+		peers = append(peers, pr)
+	}
+	p.mu.Unlock()
+
+	now := time.Now()
+	for _, pr := range peers {
+		pr.Lock()
+		if now.Sub(pr.lastUsed) > p.idleTimeout && !now.Before(pr.retryAt) {
+			if pr.link != nil {
+				p.mu.Lock()
+				p.stats.Evictions++
+				p.mu.Unlock()
+			}
+			p.disconnect(pr)
+			pr.evicted = true
+			p.mu.Lock()
+			delete(p.peers, pr.address)
+			p.mu.Unlock()
+		}
+		pr.Unlock()
+	}
+}
+
+// startEvicting periodically evicts the idle connections until the pool is closed.
+func (p *ConnectionPool) startEvicting() {
+	ticker := time.NewTicker(p.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.evictIdle()
+		case <-p.haltedCh:
+			return
+		}
+	}
+}
+
+// Close closes all the connections of the pool. The pool cannot be used afterwards.
+func (p *ConnectionPool) Close() {
+	p.haltOnce.Do(func() { close(p.haltedCh) })
+
+	p.mu.Lock()
+	p.closed = true
+	peers := p.peers
+	p.peers = make(map[string]*peer)
+	p.mu.Unlock()
+
+	for _, pr := range peers {
+		pr.Lock()
+		p.disconnect(pr)
+		pr.evicted = true
+		pr.Unlock()
+	}
+}
+
+// NewConnectionPool creates a connection pool, which establishes the links authenticated with the given keys
+// and closes the connections unused for the given time.
+func NewConnectionPool(idleTimeout time.Duration, keys LinkKeys) *ConnectionPool {
+	p := &ConnectionPool{
+		peers:       make(map[string]*peer),
+		idleTimeout: idleTimeout,
+		keys:        keys,
+		dial: func(address string) (net.Conn, error) {
+			return net.DialTimeout("tcp", address, dialTimeout)
+		},
+		haltedCh: make(chan struct{}),
+	}
+	go p.startEvicting()
+	return p
+}
@@ -0,0 +1,196 @@
+// Copyright 2019 The Nym Mixnet Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package networker
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nymtech/nym-mixnet/sphinx"
+	"github.com/stretchr/testify/assert"
+)
+
+func testLinkKeys(t *testing.T) LinkKeys {
+	priv, pub, err := sphinx.GenerateKeyPair()
+	assert.Nil(t, err)
+	return StaticLinkKeys(priv, pub)
+}
+
+func linkPublicKey(keys LinkKeys) []byte {
+	_, pub := keys()
+	return pub.Bytes()
+}
+
+// testServer accepts links established with its keys and passes every received packet to the handler,
+// which can reply to it or close the link.
+func testServer(t *testing.T, keys LinkKeys, handler func(link *Link, packet []byte)) (string, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				link, err := AcceptLink(conn, keys)
+				if err != nil {
+					return
+				}
+				for {
+					packet, err := link.ReadFrame(MaxLinkFrameSize)
+					if err != nil {
+						return
+					}
+					handler(link, packet)
+				}
+			}(conn)
+		}
+	}()
+	return listener.Addr().String(), func() { listener.Close() }
+}
+
+func TestConnectionPoolSend(t *testing.T) {
+	serverKeys, clientKeys := testLinkKeys(t), testLinkKeys(t)
+	received := make(chan []byte, 10)
+	address, stop := testServer(t, serverKeys, func(link *Link, packet []byte) {
+		assert.Equal(t, linkPublicKey(clientKeys), link.RemoteKey())
+		received <- packet
+	})
+	defer stop()
+
+	pool := NewConnectionPool(DefaultIdleTimeout, clientKeys)
+	defer pool.Close()
+	serverKey := linkPublicKey(serverKeys)
+	for i := byte(0); i < 5; i++ {
+		assert.Nil(t, pool.Send(address, serverKey, []byte{i}))
+	}
+	for i := byte(0); i < 5; i++ {
+		assert.Equal(t, []byte{i}, <-received)
+	}
+	assert.Equal(t, PoolStats{Open: 1, Dials: 1}, pool.Stats())
+
+	pool.Close()
+	assert.Equal(t, PoolStats{Dials: 1}, pool.Stats())
+	assert.Equal(t, ErrPoolClosed, pool.Send(address, serverKey, []byte("closed")))
+}
+
+func TestConnectionPoolRequestReconnect(t *testing.T) {
+	serverKeys := testLinkKeys(t)
+	address, stop := testServer(t, serverKeys, func(link *Link, packet []byte) {
+		if string(packet) == "close" {
+			link.Close()
+			return
+		}
+		assert.Nil(t, link.WriteFrame(append([]byte("re: "), packet...)))
+	})
+	defer stop()
+
+	pool := NewConnectionPool(DefaultIdleTimeout, testLinkKeys(t))
+	defer pool.Close()
+	serverKey := linkPublicKey(serverKeys)
+	response, err := pool.Request(address, serverKey, []byte("hello"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("re: hello"), response)
+
+	// the request fails over the connection closed by the server and is not retried,
+	// but the following request is sent over a new connection
+	_, err = pool.Request(address, serverKey, []byte("close"))
+	assert.Error(t, err)
+	response, err = pool.Request(address, serverKey, []byte("again"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("re: again"), response)
+
+	stats := pool.Stats()
+	assert.Equal(t, 1, stats.Open)
+	assert.Equal(t, uint64(1), stats.Dials)
+	assert.True(t, stats.Reconnects >= 1)
+}
+
+func TestConnectionPoolKeyRotation(t *testing.T) {
+	var mu sync.Mutex
+	priv, pub, err := sphinx.GenerateKeyPair()
+	assert.Nil(t, err)
+	serverKeys := func() (*sphinx.PrivateKey, *sphinx.PublicKey) {
+		mu.Lock()
+		defer mu.Unlock()
+		return priv, pub
+	}
+	address, stop := testServer(t, serverKeys, func(link *Link, packet []byte) {
+		assert.Nil(t, link.WriteFrame(packet))
+	})
+	defer stop()
+
+	pool := NewConnectionPool(DefaultIdleTimeout, testLinkKeys(t))
+	defer pool.Close()
+	oldKey := linkPublicKey(serverKeys)
+	_, err = pool.Request(address, oldKey, []byte("old"))
+	assert.Nil(t, err)
+
+	mu.Lock()
+	priv, pub, err = sphinx.GenerateKeyPair()
+	mu.Unlock()
+	assert.Nil(t, err)
+
+	// the established link remains usable, but a link with the new key has to be established,
+	// which the server refuses for its old key
+	_, err = pool.Request(address, oldKey, []byte("old"))
+	assert.Nil(t, err)
+	response, err := pool.Request(address, linkPublicKey(serverKeys), []byte("new"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("new"), response)
+	assert.Equal(t, ErrLinkRejected, pool.Send(address, oldKey, []byte("old")))
+	assert.Equal(t, uint64(1), pool.Stats().Reconnects)
+}
+
+func TestConnectionPoolBackoff(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	address := listener.Addr().String()
+	listener.Close()
+
+	pool := NewConnectionPool(DefaultIdleTimeout, testLinkKeys(t))
+	defer pool.Close()
+	serverKey := linkPublicKey(testLinkKeys(t))
+	assert.Error(t, pool.Send(address, serverKey, []byte("packet")))
+	assert.Equal(t, ErrPeerBackoff, pool.Send(address, serverKey, []byte("packet")))
+	assert.Equal(t, uint64(1), pool.Stats().FailedDials)
+
+	time.Sleep(minReconnectBackoff)
+	assert.Error(t, pool.Send(address, serverKey, []byte("packet")))
+	assert.Equal(t, uint64(2), pool.Stats().FailedDials)
+}
+
+func TestConnectionPoolEvictIdle(t *testing.T) {
+	serverKeys := testLinkKeys(t)
+	address, stop := testServer(t, serverKeys, func(link *Link, packet []byte) {})
+	defer stop()
+
+	pool := NewConnectionPool(20*time.Millisecond, testLinkKeys(t))
+	defer pool.Close()
+	serverKey := linkPublicKey(serverKeys)
+	assert.Nil(t, pool.Send(address, serverKey, []byte("packet")))
+	assert.Equal(t, 1, pool.Stats().Open)
+
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, PoolStats{Dials: 1, Evictions: 1}, pool.Stats())
+
+	// the evicted peer is treated as a new one
+	assert.Nil(t, pool.Send(address, serverKey, []byte("packet")))
+	assert.Equal(t, uint64(2), pool.Stats().Dials)
+}
@@ -0,0 +1,241 @@
+// Copyright 2019 The Nym Mixnet Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"container/heap"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultDelayQueueWorkers is the default number of workers handling the packets released by the delay queue.
+	DefaultDelayQueueWorkers = 16
+
+	// DefaultMaxInFlightPackets is the default limit of the packets held by the delay queue at the same time.
+	DefaultMaxInFlightPackets = 100000
+)
+
+var (
+	// ErrDelayQueueFull defines an error when the packet cannot be accepted, because the delay queue
+	// already holds the maximum number of packets in flight.
+	ErrDelayQueueFull = errors.New("delay queue is full")
+	// ErrDelayQueueStopped defines an error when the packet is pushed into the stopped delay queue.
+	ErrDelayQueueStopped = errors.New("delay queue is stopped")
+	// ErrInvalidDelayQueueLimits defines an error when the number of workers or the limit of packets
+	// in flight is not positive.
+	ErrInvalidDelayQueueLimits = errors.New("delay queue limits have to be positive")
+)
+
+// delayedPacket is a processed packet waiting in the delay queue until its release time.
+type delayedPacket struct {
+	release time.Time
+	result  *PacketProcessingResult
+}
+
+// packetHeap is a min-heap of the delayed packets ordered by their release times.
+type packetHeap []*delayedPacket
+
+func (h packetHeap) Len() int            { return len(h) }
+func (h packetHeap) Less(i, j int) bool  { return h[i].release.Before(h[j].release) }
+func (h packetHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *packetHeap) Push(x interface{}) { *h = append(*h, x.(*delayedPacket)) }
+
+func (h *packetHeap) Pop() interface{} {
+	old := *h
+	packet := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return packet
+}
+
+// DelayQueue holds the processed packets until the delays chosen by their senders elapse and then
+// hands them over to a fixed pool of workers, which call the handler of the queue. The queue is
+// a min-heap of the release times, so a single timer is enough regardless of the number of packets,
+// and the number of accepted, but not yet handled, packets is limited.
+// DelayQueue implements the stop-and-go MixStrategy.
+type DelayQueue struct {
+	mu          sync.Mutex
+	packets     packetHeap
+	inFlight    int
+	maxInFlight int
+	released    uint64
+	rejected    uint64
+	stopped     bool
+	// drainedCh is closed once the last packet in flight is handled while the queue is being drained
+	drainedCh chan struct{}
+
+	workers   int
+	handler   func(*PacketProcessingResult)
+	releaseCh chan *PacketProcessingResult
+	// wakeCh notifies the dispatcher that a packet was pushed and the release timer may have to be shortened
+	wakeCh   chan struct{}
+	haltedCh chan struct{}
+	haltOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// Push adds the processed packet to the queue. It is handled once its delay elapses.
+// Push returns ErrDelayQueueFull if the limit of packets in flight was reached.
+func (q *DelayQueue) Push(res *PacketProcessingResult) error {
+	q.mu.Lock()
+	if q.stopped {
+		q.mu.Unlock()
+		return ErrDelayQueueStopped
+	}
+	if q.inFlight >= q.maxInFlight {
+		q.rejected++
+		q.mu.Unlock()
+		return ErrDelayQueueFull
+	}
+	q.inFlight++
+	heap.Push(&q.packets, &delayedPacket{release: time.Now().Add(res.Delay()), result: res})
+	q.mu.Unlock()
+
+	select {
+	case q.wakeCh <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Stats returns the current state of the queue.
+func (q *DelayQueue) Stats() MixStrategyStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return MixStrategyStats{
+		Queued:   len(q.packets),
+		InFlight: q.inFlight,
+		Released: q.released,
+		Rejected: q.rejected,
+	}
+}
+
+// Start starts the dispatcher of the queue and its workers.
+func (q *DelayQueue) Start() {
+	q.wg.Add(q.workers + 1)
+	go q.dispatch()
+	for i := 0; i < q.workers; i++ {
+		go q.work()
+	}
+}
+
+// Stop stops the queue and waits for the workers to finish handling their current packets.
+// The packets, whose delays have not elapsed yet, are dropped.
+func (q *DelayQueue) Stop() {
+	q.mu.Lock()
+	q.stopped = true
+	q.mu.Unlock()
+	q.haltOnce.Do(func() { close(q.haltedCh) })
+	q.wg.Wait()
+}
+
+// Drain stops accepting new packets and waits until the packets already in the queue are handled,
+// but not past the deadline. The packets are still released only once their delays elapse.
+// It returns false if some packets were still in flight at the deadline.
+func (q *DelayQueue) Drain(deadline time.Time) bool {
+	q.mu.Lock()
+	q.stopped = true
+	if q.inFlight == 0 {
+		q.mu.Unlock()
+		return true
+	}
+	if q.drainedCh == nil {
+		q.drainedCh = make(chan struct{})
+	}
+	drainedCh := q.drainedCh
+	q.mu.Unlock()
+
+	return waitUntilDrained(drainedCh, deadline)
+}
+
+// dispatch releases the packets to the workers as their delays elapse.
+func (q *DelayQueue) dispatch() {
+	defer q.wg.Done()
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		var released *PacketProcessingResult
+		wait := time.Duration(-1)
+		q.mu.Lock()
+		if len(q.packets) > 0 {
+			if wait = time.Until(q.packets[0].release); wait <= 0 {
+				released = heap.Pop(&q.packets).(*delayedPacket).result
+			}
+		}
+		q.mu.Unlock()
+
+		if released != nil {
+			select {
+			case q.releaseCh <- released:
+			case <-q.haltedCh:
+				return
+			}
+			continue
+		}
+
+		var timerCh <-chan time.Time
+		timer.Stop()
+		if wait > 0 {
+			timer.Reset(wait)
+			timerCh = timer.C
+		}
+		select {
+		case <-timerCh:
+		case <-q.wakeCh:
+		case <-q.haltedCh:
+			return
+		}
+	}
+}
+
+// work handles the released packets.
+func (q *DelayQueue) work() {
+	defer q.wg.Done()
+	for {
+		select {
+		case res := <-q.releaseCh:
+			q.handler(res)
+			q.mu.Lock()
+			q.inFlight--
+			q.released++
+			if q.inFlight == 0 && q.drainedCh != nil {
+				close(q.drainedCh)
+				q.drainedCh = nil
+			}
+			q.mu.Unlock()
+		case <-q.haltedCh:
+			return
+		}
+	}
+}
+
+// NewDelayQueue creates a delay queue, in which the given number of workers call the handler
+// for each of the released packets and at most maxInFlight packets are held at the same time.
+func NewDelayQueue(workers int, maxInFlight int, handler func(*PacketProcessingResult)) (*DelayQueue, error) {
+	if workers <= 0 || maxInFlight <= 0 {
+		return nil, ErrInvalidDelayQueueLimits
+	}
+	return &DelayQueue{
+		maxInFlight: maxInFlight,
+		workers:     workers,
+		handler:     handler,
+		releaseCh:   make(chan *PacketProcessingResult),
+		wakeCh:      make(chan struct{}, 1),
+		haltedCh:    make(chan struct{}),
+	}, nil
+}
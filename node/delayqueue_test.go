@@ -0,0 +1,121 @@
+// Copyright 2019 The Nym Mixnet Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPacketDelay(t *testing.T) {
+	assert.Equal(t, 1400*time.Millisecond, packetDelay(1.4))
+	assert.Equal(t, 2*time.Millisecond, packetDelay(0.0015))
+	assert.Zero(t, packetDelay(0.0004))
+	assert.Zero(t, packetDelay(-1))
+	assert.Zero(t, packetDelay(math.NaN()))
+	assert.Equal(t, MaxPacketDelay, packetDelay(1e20))
+}
+
+func TestDelayQueueReleasesInOrder(t *testing.T) {
+	var mu sync.Mutex
+	var released []time.Duration
+	done := make(chan struct{}, 3)
+	queue, err := NewDelayQueue(2, 10, func(res *PacketProcessingResult) {
+		mu.Lock()
+		released = append(released, res.Delay())
+		mu.Unlock()
+		done <- struct{}{}
+	})
+	assert.Nil(t, err)
+	queue.Start()
+	defer queue.Stop()
+
+	start := time.Now()
+	for _, delay := range []time.Duration{60, 20, 40} {
+		assert.Nil(t, queue.Push(&PacketProcessingResult{delay: delay * time.Millisecond}))
+	}
+	for i := 0; i < 3; i++ {
+		<-done
+	}
+	assert.True(t, time.Since(start) >= 60*time.Millisecond)
+
+	mu.Lock()
+	assert.Equal(t, []time.Duration{20 * time.Millisecond, 40 * time.Millisecond, 60 * time.Millisecond}, released)
+	mu.Unlock()
+
+	// the in flight counter is decreased once the handler returns
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, MixStrategyStats{Released: 3}, queue.Stats())
+}
+
+func TestDelayQueueLimit(t *testing.T) {
+	queue, err := NewDelayQueue(1, 2, func(*PacketProcessingResult) {})
+	assert.Nil(t, err)
+
+	assert.Nil(t, queue.Push(&PacketProcessingResult{delay: time.Minute}))
+	assert.Nil(t, queue.Push(&PacketProcessingResult{delay: time.Minute}))
+	assert.Equal(t, ErrDelayQueueFull, queue.Push(&PacketProcessingResult{}))
+	assert.Equal(t, MixStrategyStats{Queued: 2, InFlight: 2, Rejected: 1}, queue.Stats())
+
+	queue.Start()
+	queue.Stop()
+	assert.Equal(t, ErrDelayQueueStopped, queue.Push(&PacketProcessingResult{}))
+}
+
+func TestDelayQueueDrain(t *testing.T) {
+	var handled int
+	var mu sync.Mutex
+	queue, err := NewDelayQueue(2, 10, func(*PacketProcessingResult) {
+		mu.Lock()
+		handled++
+		mu.Unlock()
+	})
+	assert.Nil(t, err)
+	queue.Start()
+	defer queue.Stop()
+
+	assert.Nil(t, queue.Push(&PacketProcessingResult{delay: 20 * time.Millisecond}))
+	assert.Nil(t, queue.Push(&PacketProcessingResult{delay: 40 * time.Millisecond}))
+	assert.True(t, queue.Drain(time.Now().Add(time.Second)))
+	mu.Lock()
+	assert.Equal(t, 2, handled)
+	mu.Unlock()
+	assert.Equal(t, ErrDelayQueueStopped, queue.Push(&PacketProcessingResult{}))
+
+	// an empty queue is drained right away
+	assert.True(t, queue.Drain(time.Now()))
+}
+
+func TestDelayQueueDrainDeadline(t *testing.T) {
+	queue, err := NewDelayQueue(1, 10, func(*PacketProcessingResult) {})
+	assert.Nil(t, err)
+	queue.Start()
+	defer queue.Stop()
+
+	assert.Nil(t, queue.Push(&PacketProcessingResult{delay: time.Minute}))
+	assert.False(t, queue.Drain(time.Now().Add(20*time.Millisecond)))
+	assert.Equal(t, 1, queue.Stats().InFlight)
+}
+
+func TestNewDelayQueueInvalid(t *testing.T) {
+	_, err := NewDelayQueue(0, 1, func(*PacketProcessingResult) {})
+	assert.Equal(t, ErrInvalidDelayQueueLimits, err)
+	_, err = NewDelayQueue(1, 0, func(*PacketProcessingResult) {})
+	assert.Equal(t, ErrInvalidDelayQueueLimits, err)
+}
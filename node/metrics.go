@@ -0,0 +1,119 @@
+// Copyright 2019 The Nym Mixnet Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"github.com/nymtech/nym-mixnet/networker"
+	"github.com/nymtech/nym-mixnet/sphinx"
+	"github.com/nymtech/nym-mixnet/telemetry"
+)
+
+// Reasons for which the nodes drop the received packets, as reported by PacketMetrics.
+const (
+	DropReasonInvalid            = "invalid"
+	DropReasonReplayed           = "replayed"
+	DropReasonUnsupportedVersion = "unsupported_version"
+	DropReasonCover              = "cover"
+	DropReasonQueueFull          = "queue_full"
+	DropReasonShuttingDown       = "shutting_down"
+	DropReasonForwardFailed      = "forward_failed"
+	DropReasonUnexpectedFlag     = "unexpected_flag"
+	DropReasonRateLimited        = "rate_limited"
+	DropReasonUnexpectedSender   = "unexpected_sender"
+	DropReasonUnexpectedNextHop  = "unexpected_next_hop"
+)
+
+// PacketMetrics are the metrics of the packets handled by a mix node or a provider.
+type PacketMetrics struct {
+	// Received counts all the sphinx packets received by the node.
+	Received *telemetry.Counter
+	// Forwarded counts the packets successfully sent to the next hop.
+	Forwarded *telemetry.Counter
+	// Dropped counts the packets, which were not sent further, by the reason of dropping them.
+	Dropped *telemetry.CounterVec
+	// ProcessingTime measures the time of the cryptographic processing of each packet.
+	ProcessingTime *telemetry.Histogram
+	// MixingDelay measures the time for which the packets are held by the mixing strategy.
+	MixingDelay *telemetry.Histogram
+}
+
+// MixingDelayBuckets are the upper bounds, in seconds, of the buckets of the histogram of the time
+// for which the packets are held by the mixing strategy.
+var MixingDelayBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// NewPacketMetrics registers the packet metrics of the node, with the given namespace prefixing their names,
+// along with the metrics describing the state of its mixing strategy and its connection pool.
+func NewPacketMetrics(registry *telemetry.Registry,
+	namespace string,
+	strategy func() MixStrategyStats,
+	pool func() networker.PoolStats,
+) *PacketMetrics {
+	m := &PacketMetrics{
+		Received: registry.NewCounter(namespace+"_packets_received_total",
+			"Number of sphinx packets received by the node."),
+		Forwarded: registry.NewCounter(namespace+"_packets_forwarded_total",
+			"Number of sphinx packets sent to the next hop."),
+		Dropped: registry.NewCounterVec(namespace+"_packets_dropped_total",
+			"Number of sphinx packets dropped by the node.", "reason"),
+		ProcessingTime: registry.NewHistogram(namespace+"_packet_processing_seconds",
+			"Time of the cryptographic processing of a sphinx packet.", telemetry.DefaultLatencyBuckets),
+		MixingDelay: registry.NewHistogram(namespace+"_packet_mixing_delay_seconds",
+			"Time for which a sphinx packet was held by the mixing strategy.", MixingDelayBuckets),
+	}
+
+	registry.NewGaugeFunc(namespace+"_mix_queued_packets",
+		"Number of packets held by the mixing strategy until they are released.",
+		func() float64 { return float64(strategy().Queued) })
+	registry.NewGaugeFunc(namespace+"_mix_in_flight_packets",
+		"Number of accepted packets which were not sent yet.",
+		func() float64 { return float64(strategy().InFlight) })
+	registry.NewCounterFunc(namespace+"_mix_rounds_total",
+		"Number of times the pool or the batch of the mixing strategy was flushed.",
+		func() float64 { return float64(strategy().Rounds) })
+	registry.NewGaugeFunc(namespace+"_mix_last_round_packets",
+		"Number of packets the last released packets were mixed with.",
+		func() float64 { return float64(strategy().LastRoundSize) })
+	registry.NewGaugeFunc(namespace+"_open_connections",
+		"Number of pooled connections to other nodes.",
+		func() float64 { return float64(pool().Open) })
+	registry.NewCounterFunc(namespace+"_failed_dials_total",
+		"Number of unsuccessful connection attempts to other nodes.",
+		func() float64 { return float64(pool().FailedDials) })
+	return m
+}
+
+// DropReason returns the reason, reported by the metrics, of dropping the packet
+// which could not be processed with the given error.
+func DropReason(err error) string {
+	switch err {
+	case sphinx.ErrReplayedPacket:
+		return DropReasonReplayed
+	case sphinx.ErrUnsupportedPacketVersion:
+		return DropReasonUnsupportedVersion
+	default:
+		return DropReasonInvalid
+	}
+}
+
+// PushDropReason returns the reason, reported by the metrics, of dropping the packet
+// which could not be pushed into the mixing strategy with the given error.
+func PushDropReason(err error) string {
+	switch err {
+	case ErrMixStopped, ErrDelayQueueStopped:
+		return DropReasonShuttingDown
+	default:
+		return DropReasonQueueFull
+	}
+}
@@ -17,21 +17,60 @@
 package node
 
 import (
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/golang/protobuf/proto"
+	"github.com/nymtech/nym-mixnet/config"
 	"github.com/nymtech/nym-mixnet/flags"
 	"github.com/nymtech/nym-mixnet/sphinx"
 )
 
+const (
+	// MaxPacketDelay is the longest time a packet is held by the mix, regardless of the delay requested
+	// by its sender, so that the mix cannot be made to hold the packets indefinitely.
+	MaxPacketDelay = time.Hour
+)
+
+var (
+	// MaxPacketFrameSize is the maximum size of a frame received by the nodes from each other and from the clients.
+	// It fits the largest general packet wrapping a Sphinx packet, which is one in the legacy protobuf encoding,
+	// and it is larger than any of the requests sent by the clients.
+	MaxPacketFrameSize = proto.Size(&config.GeneralPacket{
+		Flag:    make([]byte, 1),
+		Data:    make([]byte, sphinx.LegacyPacketSize),
+		Version: math.MaxUint32,
+	})
+)
+
+var (
+	// ErrInvalidPacketSize defines an error when the received packet does not have the size defined for the network.
+	ErrInvalidPacketSize = fmt.Errorf("packet has to be exactly %v bytes long", sphinx.PacketSize)
+)
+
 type Mix struct {
+	// replayedPackets and unsupportedPackets are accessed atomically, so they have to be kept 64-bit aligned
+	replayedPackets    uint64
+	unsupportedPackets uint64
+
+	keysMu sync.RWMutex
 	pubKey *sphinx.PublicKey
 	prvKey *sphinx.PrivateKey
+
+	replayCache     *ReplayCache
+	replayCacheFile string
 }
 
 type PacketProcessingResult struct {
 	packetData []byte
 	nextHop    sphinx.Hop
 	flag       flags.SphinxFlag
+	commands   sphinx.Commands
+	delay      time.Duration
+	processed  time.Time
 	err        error
 }
 
@@ -47,37 +86,169 @@ func (p *PacketProcessingResult) Flag() flags.SphinxFlag {
 	return p.flag
 }
 
+// Commands returns all the commands the sender included in the routing information of this hop,
+// including the hop commands, such as the instruction to drop the cover traffic.
+func (p *PacketProcessingResult) Commands() *sphinx.Commands {
+	return &p.commands
+}
+
+// Delay returns the time for which the packet should be held before it is sent further,
+// as requested by its sender, rounded to milliseconds.
+func (p *PacketProcessingResult) Delay() time.Duration {
+	return p.delay
+}
+
+// ProcessedAt returns the time at which the processing of the packet finished, which is when
+// it was handed over to the mixing strategy.
+func (p *PacketProcessingResult) ProcessedAt() time.Time {
+	return p.processed
+}
+
 func (p *PacketProcessingResult) Err() error {
 	return p.err
 }
 
 // ProcessPacket performs the processing operation on the received packet, including cryptographic operations and
-// extraction of the meta information.
+// extraction of the meta information. Packets of size different than sphinx.PacketSize, or sphinx.LegacyPacketSize
+// for the packets in the legacy protobuf encoding, are rejected without being processed, while packets which
+// were already processed by the mix are dropped with sphinx.ErrReplayedPacket error.
+// Packets of unsupported format versions are dropped with sphinx.ErrUnsupportedPacketVersion error.
+// ProcessPacket does not wait for the delay of the packet, which is returned in the result instead.
 func (m *Mix) ProcessPacket(packet []byte) *PacketProcessingResult {
 	res := new(PacketProcessingResult)
 
-	nextHop, commands, newPacket, err := sphinx.ProcessSphinxPacket(packet, m.prvKey)
-	res.err = err
+	if len(packet) != sphinx.PacketSize && len(packet) != sphinx.LegacyPacketSize {
+		res.err = ErrInvalidPacketSize
+		return res
+	}
+
+	m.keysMu.RLock()
+	prvKey := m.prvKey
+	m.keysMu.RUnlock()
 
-	// rather than sleeping in new gouroutine and waiting for channel data that is sent from it
-	// just sleep in the main goroutine and avoid extra communication overhead
-	time.Sleep(time.Second * time.Duration(commands.Delay))
+	nextHop, commands, newPacket, err := sphinx.ProcessSphinxPacketWithReplayCheck(packet,
+		prvKey,
+		m.replayCache.CheckAndAdd,
+	)
+	if err != nil {
+		switch err {
+		case sphinx.ErrReplayedPacket:
+			atomic.AddUint64(&m.replayedPackets, 1)
+		case sphinx.ErrUnsupportedPacketVersion:
+			atomic.AddUint64(&m.unsupportedPackets, 1)
+		}
+		res.err = err
+		return res
+	}
 
 	res.packetData = newPacket
 	res.nextHop = nextHop
 	res.flag = flags.SphinxFlagFromBytes(commands.Flag)
+	res.commands = commands
+	res.delay = packetDelay(commands.Delay)
+	res.processed = time.Now()
 
 	return res
 }
 
+// NewRelayResult creates the result for the packet created by the mix itself, such as a loop cover packet,
+// which is pushed into the mixing strategy and sent to the next hop after the given delay, in seconds,
+// in the same way as the packets relayed by the mix.
+func NewRelayResult(packet []byte, nextHop sphinx.Hop, delay float64) *PacketProcessingResult {
+	return &PacketProcessingResult{
+		packetData: packet,
+		nextHop:    nextHop,
+		flag:       flags.RelayFlag,
+		commands:   sphinx.Commands{Flag: flags.RelayFlag.Bytes(), Delay: delay},
+		delay:      packetDelay(delay),
+		processed:  time.Now(),
+	}
+}
+
+// packetDelay converts the delay in seconds, as encoded in the routing commands, into the duration
+// rounded to milliseconds and limited to MaxPacketDelay.
+func packetDelay(seconds float64) time.Duration {
+	// also catches NaN
+	if !(seconds > 0) {
+		return 0
+	}
+	if seconds >= MaxPacketDelay.Seconds() {
+		return MaxPacketDelay
+	}
+	return time.Duration(math.Round(seconds*1000)) * time.Millisecond
+}
+
+// ReplayedPackets returns the number of replayed packets dropped by the mix.
+func (m *Mix) ReplayedPackets() uint64 {
+	return atomic.LoadUint64(&m.replayedPackets)
+}
+
+// CheckPacketVersion checks whether the mix supports the packet format version announced by the sender
+// before the packet is processed. Packets of unsupported versions are counted and rejected with
+// sphinx.ErrUnsupportedPacketVersion error. Version 0 is announced by the senders which do not negotiate
+// the version, in which case it is checked only once the packet is decoded.
+func (m *Mix) CheckPacketVersion(version uint32) error {
+	if version == 0 || sphinx.IsSupportedPacketVersion(version) {
+		return nil
+	}
+	atomic.AddUint64(&m.unsupportedPackets, 1)
+	return sphinx.ErrUnsupportedPacketVersion
+}
+
+// UnsupportedPackets returns the number of packets of unsupported format versions dropped by the mix.
+func (m *Mix) UnsupportedPackets() uint64 {
+	return atomic.LoadUint64(&m.unsupportedPackets)
+}
+
+// EnableReplayCachePersistence restores the replay cache of the mix from the given file, if it exists
+// and was created for the current keys of the mix, and makes SaveReplayCache write to that file.
+// It should be called before the mix starts processing packets.
+func (m *Mix) EnableReplayCachePersistence(path string) error {
+	cache, err := LoadReplayCache(path, m.GetPublicKey().Bytes(), DefaultReplayCacheCapacity)
+	if err != nil {
+		return err
+	}
+	m.replayCache = cache
+	m.replayCacheFile = path
+	return nil
+}
+
+// SaveReplayCache persists the replay cache of the mix. If persistence was not enabled, it does nothing.
+func (m *Mix) SaveReplayCache() error {
+	if m.replayCacheFile == "" {
+		return nil
+	}
+	return m.replayCache.Save(m.replayCacheFile)
+}
+
+// UpdateKeys replaces the keys of the mix, starting a new key epoch. As the packets created
+// for the previous keys can no longer be processed, the replay cache is cleared.
+func (m *Mix) UpdateKeys(prvKey *sphinx.PrivateKey, pubKey *sphinx.PublicKey) {
+	m.keysMu.Lock()
+	defer m.keysMu.Unlock()
+	m.prvKey = prvKey
+	m.pubKey = pubKey
+	m.replayCache.Reset(pubKey.Bytes())
+}
+
 // GetPublicKey returns the public key of the mixnode.
 func (m *Mix) GetPublicKey() *sphinx.PublicKey {
+	m.keysMu.RLock()
+	defer m.keysMu.RUnlock()
 	return m.pubKey
 }
 
+// GetKeyPair returns both keys of the mixnode, which are always replaced together.
+func (m *Mix) GetKeyPair() (*sphinx.PrivateKey, *sphinx.PublicKey) {
+	m.keysMu.RLock()
+	defer m.keysMu.RUnlock()
+	return m.prvKey, m.pubKey
+}
+
 // NewMix creates a new instance of Mix struct with given public and private key
 func NewMix(prvKey *sphinx.PrivateKey, pubKey *sphinx.PublicKey) *Mix {
 	return &Mix{prvKey: prvKey,
-		pubKey: pubKey,
+		pubKey:      pubKey,
+		replayCache: NewReplayCache(pubKey.Bytes(), DefaultReplayCacheCapacity),
 	}
 }
@@ -18,8 +18,8 @@ import (
 	"os"
 	"reflect"
 	"testing"
+	"time"
 
-	"github.com/golang/protobuf/proto"
 	"github.com/nymtech/nym-mixnet/config"
 	"github.com/nymtech/nym-mixnet/flags"
 	"github.com/nymtech/nym-mixnet/sphinx"
@@ -108,7 +108,7 @@ func TestMixProcessPacket(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	testPacketBytes, err := proto.Marshal(testPacket)
+	testPacketBytes, err := sphinx.EncodePacket(testPacket)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -127,4 +127,121 @@ func TestMixProcessPacket(t *testing.T) {
 	}, nextHop, "Next hop does not match")
 	assert.Equal(t, reflect.TypeOf([]byte{}), reflect.TypeOf(dePacket))
 	assert.Equal(t, flags.RelayFlag, flag, reflect.TypeOf(dePacket))
+	assert.Equal(t, 1400*time.Millisecond, res.Delay())
+}
+
+func TestMixProcessPacketInvalidSize(t *testing.T) {
+	mix, err := createProviderWorker()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := mix.ProcessPacket(make([]byte, sphinx.PacketSize-1))
+	assert.Equal(t, ErrInvalidPacketSize, res.Err())
+	assert.Nil(t, res.PacketData())
+}
+
+func TestMixProcessPacketReplay(t *testing.T) {
+	providerWorker, err := createProviderWorker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := config.MixConfig{Id: "Provider",
+		Host: "localhost",
+		Port: "3333", PubKey: providerWorker.pubKey.Bytes(),
+	}
+	mixes, err := createTestMixes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := config.E2EPath{IngressProvider: provider,
+		Mixes:          mixes,
+		EgressProvider: provider,
+		Recipient:      config.ClientConfig{Id: "Destination", Host: "localhost", Port: "3334"},
+	}
+	testPacket, err := sphinx.PackForwardMessage(path, []float64{0, 0, 0, 0, 0}, []byte("Test Message"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPacketBytes, err := sphinx.EncodePacket(&testPacket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Nil(t, providerWorker.ProcessPacket(testPacketBytes).Err())
+	assert.Equal(t, sphinx.ErrReplayedPacket, providerWorker.ProcessPacket(testPacketBytes).Err())
+	assert.Equal(t, uint64(1), providerWorker.ReplayedPackets())
+
+	// after the keys are rotated the old packet cannot be processed anymore, but it is no longer a replay
+	privN, pubN, err := sphinx.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	providerWorker.UpdateKeys(privN, pubN)
+	assert.Equal(t, pubN.Bytes(), providerWorker.replayCache.Epoch())
+	res := providerWorker.ProcessPacket(testPacketBytes)
+	assert.Error(t, res.Err())
+	assert.NotEqual(t, sphinx.ErrReplayedPacket, res.Err())
+}
+
+func TestMixUnsupportedPacketVersion(t *testing.T) {
+	mix, err := createProviderWorker()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Nil(t, mix.CheckPacketVersion(0))
+	assert.Nil(t, mix.CheckPacketVersion(sphinx.CurrentPacketVersion))
+	assert.Equal(t, sphinx.ErrUnsupportedPacketVersion, mix.CheckPacketVersion(42))
+	assert.Equal(t, uint64(1), mix.UnsupportedPackets())
+
+	packetBytes := make([]byte, sphinx.PacketSize)
+	packetBytes[0] = 42
+	assert.Equal(t, sphinx.ErrUnsupportedPacketVersion, mix.ProcessPacket(packetBytes).Err())
+	assert.Equal(t, uint64(2), mix.UnsupportedPackets())
+}
+
+func TestMixProcessPacketCommands(t *testing.T) {
+	providerWorker, err := createProviderWorker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := config.MixConfig{Id: "Provider",
+		Host: "localhost",
+		Port: "3333", PubKey: providerWorker.pubKey.Bytes(),
+	}
+	mixes, err := createTestMixes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the commands can be carried only by the packet format versions advertised by all the nodes
+	provider.PacketVersions = sphinx.SupportedPacketVersions()
+	for i := range mixes {
+		mixes[i].PacketVersions = sphinx.SupportedPacketVersions()
+	}
+
+	path := config.E2EPath{IngressProvider: provider,
+		Mixes:          mixes,
+		EgressProvider: provider,
+		Recipient:      config.ClientConfig{Id: "Destination", Host: "localhost", Port: "3334"},
+	}
+	hopCommands := [][]*sphinx.HopCommand{{sphinx.NewDropCoverCommand()}, nil, nil, nil, nil}
+	testPacket, err := sphinx.PackForwardMessageWithCommands(path,
+		[]float64{0, 0, 0, 0, 0},
+		hopCommands,
+		[]byte("Test Message"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPacketBytes, err := sphinx.EncodePacket(&testPacket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := providerWorker.ProcessPacket(testPacketBytes)
+	assert.Nil(t, res.Err())
+	assert.True(t, res.Commands().DropCover())
+	assert.False(t, res.Commands().Loop())
 }
@@ -0,0 +1,325 @@
+// Copyright 2019 The Nym Mixnet Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"crypto/rand"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// batchMix holds the packets in a pool, from which the dispatcher of the particular strategy flushes
+// the packets in random order to a fixed pool of workers, calling the handler of the mix.
+// Unlike DelayQueue, it ignores the delays chosen by the senders of the packets.
+type batchMix struct {
+	mu            sync.Mutex
+	packets       []*PacketProcessingResult
+	inFlight      int
+	maxInFlight   int
+	released      uint64
+	rejected      uint64
+	rounds        uint64
+	lastRoundSize int
+	stopped       bool
+	// drainedCh is closed once the last packet in flight is handled while the mix is being drained
+	drainedCh chan struct{}
+
+	workers   int
+	handler   func(*PacketProcessingResult)
+	releaseCh chan *PacketProcessingResult
+	haltedCh  chan struct{}
+	haltOnce  sync.Once
+	wg        sync.WaitGroup
+}
+
+func newBatchMix(workers int, maxInFlight int, handler func(*PacketProcessingResult)) *batchMix {
+	return &batchMix{
+		maxInFlight: maxInFlight,
+		workers:     workers,
+		handler:     handler,
+		releaseCh:   make(chan *PacketProcessingResult),
+		haltedCh:    make(chan struct{}),
+	}
+}
+
+// add adds the packet to the pool and returns the number of pooled packets.
+func (b *batchMix) add(res *PacketProcessingResult) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.stopped {
+		return 0, ErrMixStopped
+	}
+	if b.inFlight >= b.maxInFlight {
+		b.rejected++
+		return 0, ErrMixFull
+	}
+	b.inFlight++
+	b.packets = append(b.packets, res)
+	return len(b.packets), nil
+}
+
+// Stats returns the current state of the mix.
+func (b *batchMix) Stats() MixStrategyStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return MixStrategyStats{
+		Queued:        len(b.packets),
+		InFlight:      b.inFlight,
+		Released:      b.released,
+		Rejected:      b.rejected,
+		Rounds:        b.rounds,
+		LastRoundSize: b.lastRoundSize,
+	}
+}
+
+// pooled returns the number of the packets in the pool.
+func (b *batchMix) pooled() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.packets)
+}
+
+// start starts the workers of the mix and the given dispatcher.
+func (b *batchMix) start(dispatch func()) {
+	b.wg.Add(b.workers + 1)
+	go func() {
+		defer b.wg.Done()
+		dispatch()
+	}()
+	for i := 0; i < b.workers; i++ {
+		go b.work()
+	}
+}
+
+// Stop stops the mix and waits for the workers to finish handling their current packets.
+// The packets remaining in the pool are dropped.
+func (b *batchMix) Stop() {
+	b.mu.Lock()
+	b.stopped = true
+	b.mu.Unlock()
+	b.haltOnce.Do(func() { close(b.haltedCh) })
+	b.wg.Wait()
+}
+
+// Drain stops accepting new packets, releases all the pooled packets in a single final round,
+// regardless of the pool size or the threshold, and waits until they are handled, but not past the deadline.
+// It returns false if some packets were still in flight at the deadline.
+func (b *batchMix) Drain(deadline time.Time) bool {
+	b.mu.Lock()
+	b.stopped = true
+	if b.inFlight == 0 {
+		b.mu.Unlock()
+		return true
+	}
+	if b.drainedCh == nil {
+		b.drainedCh = make(chan struct{})
+	}
+	drainedCh := b.drainedCh
+	b.mu.Unlock()
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		b.flush(func(pooled int) int { return pooled })
+	}()
+	return waitUntilDrained(drainedCh, deadline)
+}
+
+// flush shuffles the pool and releases the number of packets returned by count, given the number
+// of the pooled packets. The rest of the packets stays in the pool for the next round.
+// It returns false if the mix was stopped while the packets were being released.
+func (b *batchMix) flush(count func(pooled int) int) bool {
+	b.mu.Lock()
+	pooled := len(b.packets)
+	n := count(pooled)
+	if n <= 0 {
+		b.mu.Unlock()
+		return true
+	}
+	if n > pooled {
+		n = pooled
+	}
+	// if the randomness is not available, the packets rather stay in the pool than leave in order
+	if err := shufflePackets(b.packets); err != nil {
+		b.mu.Unlock()
+		return true
+	}
+	batch := b.packets[:n]
+	b.packets = append([]*PacketProcessingResult{}, b.packets[n:]...)
+	b.rounds++
+	b.lastRoundSize = pooled
+	b.mu.Unlock()
+
+	for _, res := range batch {
+		select {
+		case b.releaseCh <- res:
+		case <-b.haltedCh:
+			return false
+		}
+	}
+	return true
+}
+
+// work handles the released packets.
+func (b *batchMix) work() {
+	defer b.wg.Done()
+	for {
+		select {
+		case res := <-b.releaseCh:
+			b.handler(res)
+			b.mu.Lock()
+			b.inFlight--
+			b.released++
+			if b.inFlight == 0 && b.drainedCh != nil {
+				close(b.drainedCh)
+				b.drainedCh = nil
+			}
+			b.mu.Unlock()
+		case <-b.haltedCh:
+			return
+		}
+	}
+}
+
+// shufflePackets puts the packets in a random order, using the cryptographically secure source of randomness,
+// so that the order in which they leave the mix cannot be predicted.
+func shufflePackets(packets []*PacketProcessingResult) error {
+	for i := len(packets) - 1; i > 0; i-- {
+		j, err := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
+		if err != nil {
+			return err
+		}
+		packets[i], packets[j.Int64()] = packets[j.Int64()], packets[i]
+	}
+	return nil
+}
+
+// TimedPoolMix implements the timed pool MixStrategy. Every interval it releases, in random order,
+// all but a fixed number of the pooled packets, chosen at random. The packets which stay in the pool
+// are mixed with the ones received during the next interval.
+type TimedPoolMix struct {
+	*batchMix
+	interval    time.Duration
+	minimumPool int
+}
+
+// Push adds the processed packet to the pool. It returns ErrMixFull if the limit of packets in flight was reached.
+func (p *TimedPoolMix) Push(res *PacketProcessingResult) error {
+	_, err := p.add(res)
+	return err
+}
+
+// Start starts flushing the pool and the workers handling the released packets.
+func (p *TimedPoolMix) Start() {
+	p.start(p.dispatch)
+}
+
+func (p *TimedPoolMix) dispatch() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !p.flush(func(pooled int) int { return pooled - p.minimumPool }) {
+				return
+			}
+		case <-p.haltedCh:
+			return
+		}
+	}
+}
+
+// NewTimedPoolMix creates a timed pool mix, which flushes its pool every interval, keeping minimumPool packets in it.
+// The given number of workers call the handler for each of the released packets and at most maxInFlight
+// packets are held at the same time.
+func NewTimedPoolMix(interval time.Duration,
+	minimumPool int,
+	workers int,
+	maxInFlight int,
+	handler func(*PacketProcessingResult),
+) (*TimedPoolMix, error) {
+	if interval <= 0 || minimumPool < 0 || workers <= 0 || minimumPool >= maxInFlight {
+		return nil, ErrInvalidMixParameters
+	}
+	return &TimedPoolMix{
+		batchMix:    newBatchMix(workers, maxInFlight, handler),
+		interval:    interval,
+		minimumPool: minimumPool,
+	}, nil
+}
+
+// ThresholdMix implements the threshold MixStrategy. It collects the packets until their number reaches
+// the threshold and then releases the whole batch in random order.
+type ThresholdMix struct {
+	*batchMix
+	threshold int
+	// wakeCh notifies the dispatcher that the threshold was reached
+	wakeCh chan struct{}
+}
+
+// Push adds the processed packet to the batch. It returns ErrMixFull if the limit of packets in flight was reached.
+func (t *ThresholdMix) Push(res *PacketProcessingResult) error {
+	pooled, err := t.add(res)
+	if err != nil {
+		return err
+	}
+	if pooled >= t.threshold {
+		select {
+		case t.wakeCh <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Start starts flushing the batches and the workers handling the released packets.
+func (t *ThresholdMix) Start() {
+	t.start(t.dispatch)
+}
+
+func (t *ThresholdMix) dispatch() {
+	for {
+		select {
+		case <-t.wakeCh:
+			// more than one batch might have been collected while the previous one was being released
+			for t.pooled() >= t.threshold {
+				if !t.flush(func(int) int { return t.threshold }) {
+					return
+				}
+			}
+		case <-t.haltedCh:
+			return
+		}
+	}
+}
+
+// NewThresholdMix creates a threshold mix, which releases the packets in batches of the threshold size.
+// The given number of workers call the handler for each of the released packets and at most maxInFlight
+// packets are held at the same time.
+func NewThresholdMix(threshold int,
+	workers int,
+	maxInFlight int,
+	handler func(*PacketProcessingResult),
+) (*ThresholdMix, error) {
+	if threshold <= 0 || workers <= 0 || threshold > maxInFlight {
+		return nil, ErrInvalidMixParameters
+	}
+	return &ThresholdMix{
+		batchMix:  newBatchMix(workers, maxInFlight, handler),
+		threshold: threshold,
+		wakeCh:    make(chan struct{}, 1),
+	}, nil
+}
@@ -0,0 +1,157 @@
+// Copyright 2019 The Nym Mixnet Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimedPoolMixKeepsMinimumPool(t *testing.T) {
+	released := make(chan *PacketProcessingResult, 10)
+	pool, err := NewTimedPoolMix(20*time.Millisecond, 2, 2, 10, func(res *PacketProcessingResult) {
+		released <- res
+	})
+	assert.Nil(t, err)
+
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, pool.Push(&PacketProcessingResult{}))
+	}
+	pool.Start()
+	defer pool.Stop()
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-released:
+		case <-time.After(time.Second):
+			t.Fatal("packets were not released")
+		}
+	}
+
+	// the minimum number of packets stays in the pool for the next round
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, released)
+	stats := pool.Stats()
+	assert.Equal(t, 2, stats.Queued)
+	assert.Equal(t, 2, stats.InFlight)
+	assert.Equal(t, uint64(3), stats.Released)
+	assert.Equal(t, uint64(1), stats.Rounds)
+	assert.Equal(t, 5, stats.LastRoundSize)
+}
+
+func TestThresholdMixReleasesBatches(t *testing.T) {
+	released := make(chan *PacketProcessingResult, 10)
+	batch, err := NewThresholdMix(3, 2, 10, func(res *PacketProcessingResult) {
+		released <- res
+	})
+	assert.Nil(t, err)
+	batch.Start()
+	defer batch.Stop()
+
+	packets := []*PacketProcessingResult{{}, {}, {}}
+	assert.Nil(t, batch.Push(packets[0]))
+	assert.Nil(t, batch.Push(packets[1]))
+	time.Sleep(20 * time.Millisecond)
+	assert.Empty(t, released)
+
+	assert.Nil(t, batch.Push(packets[2]))
+	var got []*PacketProcessingResult
+	for i := 0; i < 3; i++ {
+		select {
+		case res := <-released:
+			got = append(got, res)
+		case <-time.After(time.Second):
+			t.Fatal("batch was not released")
+		}
+	}
+	assert.ElementsMatch(t, packets, got)
+
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, MixStrategyStats{Released: 3, Rounds: 1, LastRoundSize: 3}, batch.Stats())
+}
+
+func TestThresholdMixLimit(t *testing.T) {
+	batch, err := NewThresholdMix(5, 1, 2, func(*PacketProcessingResult) {})
+	assert.Equal(t, ErrInvalidMixParameters, err)
+	assert.Nil(t, batch)
+
+	batch, err = NewThresholdMix(2, 1, 2, func(*PacketProcessingResult) {})
+	assert.Nil(t, err)
+	assert.Nil(t, batch.Push(&PacketProcessingResult{}))
+	assert.Nil(t, batch.Push(&PacketProcessingResult{}))
+	assert.Equal(t, ErrMixFull, batch.Push(&PacketProcessingResult{}))
+	assert.Equal(t, uint64(1), batch.Stats().Rejected)
+
+	batch.Start()
+	batch.Stop()
+	assert.Equal(t, ErrMixStopped, batch.Push(&PacketProcessingResult{}))
+}
+
+func TestThresholdMixDrain(t *testing.T) {
+	released := make(chan *PacketProcessingResult, 10)
+	batch, err := NewThresholdMix(5, 2, 10, func(res *PacketProcessingResult) {
+		released <- res
+	})
+	assert.Nil(t, err)
+	batch.Start()
+	defer batch.Stop()
+
+	// the batch below the threshold is released when the mix is drained
+	assert.Nil(t, batch.Push(&PacketProcessingResult{}))
+	assert.Nil(t, batch.Push(&PacketProcessingResult{}))
+	assert.True(t, batch.Drain(time.Now().Add(time.Second)))
+	assert.Len(t, released, 2)
+	assert.Equal(t, ErrMixStopped, batch.Push(&PacketProcessingResult{}))
+
+	stats := batch.Stats()
+	assert.Equal(t, 0, stats.InFlight)
+	assert.Equal(t, uint64(1), stats.Rounds)
+}
+
+func TestTimedPoolMixDrainDeadline(t *testing.T) {
+	block := make(chan struct{})
+	pool, err := NewTimedPoolMix(time.Hour, 2, 1, 10, func(*PacketProcessingResult) {
+		<-block
+	})
+	assert.Nil(t, err)
+	pool.Start()
+	defer pool.Stop()
+	defer close(block)
+
+	assert.Nil(t, pool.Push(&PacketProcessingResult{}))
+	assert.False(t, pool.Drain(time.Now().Add(20*time.Millisecond)))
+	assert.Equal(t, 1, pool.Stats().InFlight)
+}
+
+func TestNewTimedPoolMixInvalid(t *testing.T) {
+	_, err := NewTimedPoolMix(0, 1, 1, 10, func(*PacketProcessingResult) {})
+	assert.Equal(t, ErrInvalidMixParameters, err)
+	_, err = NewTimedPoolMix(time.Second, 10, 1, 10, func(*PacketProcessingResult) {})
+	assert.Equal(t, ErrInvalidMixParameters, err)
+	_, err = NewTimedPoolMix(time.Second, 1, 0, 10, func(*PacketProcessingResult) {})
+	assert.Equal(t, ErrInvalidMixParameters, err)
+}
+
+func TestShufflePackets(t *testing.T) {
+	packets := make([]*PacketProcessingResult, 10)
+	for i := range packets {
+		packets[i] = &PacketProcessingResult{delay: time.Duration(i)}
+	}
+	shuffled := append([]*PacketProcessingResult{}, packets...)
+	assert.Nil(t, shufflePackets(shuffled))
+	assert.ElementsMatch(t, packets, shuffled)
+}
@@ -0,0 +1,96 @@
+// Copyright 2019 The Nym Mixnet Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrInvalidRateLimit defines an error when the rate or the burst of the rate limiter is not positive.
+	ErrInvalidRateLimit = errors.New("rate limit has to be positive")
+)
+
+// tokenBucket holds the tokens of a single peer, as of the time it was last updated.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter limits the rate of the packets received from each peer. Every peer has its own token bucket,
+// which holds up to burst tokens and is refilled at the given rate per second. Each packet takes one token
+// and the packets arriving when the bucket of their peer is empty should be dropped.
+type RateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+}
+
+// Allow takes a token from the bucket of the given peer and reports whether there was any.
+func (r *RateLimiter) Allow(peer string, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	bucket, ok := r.buckets[peer]
+	if !ok {
+		bucket = &tokenBucket{tokens: r.burst, last: now}
+		r.buckets[peer] = bucket
+	}
+	if elapsed := now.Sub(bucket.last).Seconds(); elapsed > 0 {
+		bucket.tokens = math.Min(r.burst, bucket.tokens+elapsed*r.rate)
+		bucket.last = now
+	}
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// RemoveIdle forgets the peers whose buckets were refilled completely, which is indistinguishable
+// from not knowing them at all, so that the memory used by the limiter does not grow with every peer ever seen.
+func (r *RateLimiter) RemoveIdle(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for peer, bucket := range r.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*r.rate >= r.burst {
+			delete(r.buckets, peer)
+		}
+	}
+}
+
+// Peers returns the number of peers the limiter keeps the buckets of.
+func (r *RateLimiter) Peers() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.buckets)
+}
+
+// NewRateLimiter creates a rate limiter allowing each peer to send the given number of packets per second
+// on average, and up to burst packets at once.
+func NewRateLimiter(rate float64, burst int) (*RateLimiter, error) {
+	if !(rate > 0) || burst <= 0 {
+		return nil, ErrInvalidRateLimit
+	}
+	return &RateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+	}, nil
+}
@@ -0,0 +1,70 @@
+// Copyright 2019 The Nym Mixnet Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter, err := NewRateLimiter(10, 3)
+	assert.Nil(t, err)
+
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		assert.True(t, limiter.Allow("peer", now))
+	}
+	assert.False(t, limiter.Allow("peer", now))
+	// other peers have their own buckets
+	assert.True(t, limiter.Allow("other", now))
+
+	// a token is added every 100ms
+	assert.False(t, limiter.Allow("peer", now.Add(50*time.Millisecond)))
+	assert.True(t, limiter.Allow("peer", now.Add(110*time.Millisecond)))
+	assert.False(t, limiter.Allow("peer", now.Add(110*time.Millisecond)))
+
+	// the bucket never holds more than the burst
+	later := now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		assert.True(t, limiter.Allow("peer", later))
+	}
+	assert.False(t, limiter.Allow("peer", later))
+}
+
+func TestRateLimiterRemoveIdle(t *testing.T) {
+	limiter, err := NewRateLimiter(10, 3)
+	assert.Nil(t, err)
+
+	now := time.Now()
+	assert.True(t, limiter.Allow("idle", now))
+	for i := 0; i < 3; i++ {
+		assert.True(t, limiter.Allow("busy", now.Add(200*time.Millisecond)))
+	}
+	assert.Equal(t, 2, limiter.Peers())
+
+	limiter.RemoveIdle(now.Add(250 * time.Millisecond))
+	assert.Equal(t, 1, limiter.Peers())
+	assert.False(t, limiter.Allow("busy", now.Add(250*time.Millisecond)))
+}
+
+func TestNewRateLimiterInvalid(t *testing.T) {
+	_, err := NewRateLimiter(0, 1)
+	assert.Equal(t, ErrInvalidRateLimit, err)
+	_, err = NewRateLimiter(1, 0)
+	assert.Equal(t, ErrInvalidRateLimit, err)
+}
@@ -0,0 +1,232 @@
+// Copyright 2019 The Nym Mixnet Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	// DefaultReplayCacheCapacity is the number of packets each of the filters of the replay cache holds
+	// before it is rotated. The cache remembers at least that many most recent packets.
+	DefaultReplayCacheCapacity = 1 << 20
+
+	// replayCacheFalsePositiveRate is the desired probability of a fresh packet being considered a replay.
+	replayCacheFalsePositiveRate = 1e-6
+
+	// minimumTagLength is the minimum length of the tags, from which the bit indices are derived.
+	minimumTagLength = 16
+)
+
+var (
+	// ErrInvalidReplayTag defines an error when the tag is too short to be inserted into the replay cache.
+	ErrInvalidReplayTag = errors.New("replay tag is too short")
+)
+
+// bloomFilter is a probabilistic set of replay tags. As the tags are outputs of a hash function,
+// the bit indices are derived from the tags directly, without any further hashing.
+type bloomFilter struct {
+	bits   []uint64
+	hashes uint64
+	count  uint
+}
+
+func newBloomFilter(capacity uint) *bloomFilter {
+	// standard optimal parameters for the given capacity and false positive rate
+	size := uint64(math.Ceil(-float64(capacity) * math.Log(replayCacheFalsePositiveRate) / (math.Ln2 * math.Ln2)))
+	hashes := uint64(math.Ceil(math.Log2(1 / replayCacheFalsePositiveRate)))
+	return &bloomFilter{
+		bits:   make([]uint64, size/64+1),
+		hashes: hashes,
+	}
+}
+
+// indices computes the bit indices of the tag using the double hashing technique.
+func (b *bloomFilter) indices(tag []byte) []uint64 {
+	h1 := binary.BigEndian.Uint64(tag[:8])
+	h2 := binary.BigEndian.Uint64(tag[8:16])
+	size := uint64(len(b.bits)) * 64
+
+	indices := make([]uint64, b.hashes)
+	for i := range indices {
+		indices[i] = (h1 + uint64(i)*h2) % size
+	}
+	return indices
+}
+
+func (b *bloomFilter) contains(tag []byte) bool {
+	for _, idx := range b.indices(tag) {
+		if b.bits[idx/64]&(1<<(idx%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *bloomFilter) add(tag []byte) {
+	for _, idx := range b.indices(tag) {
+		b.bits[idx/64] |= 1 << (idx % 64)
+	}
+	b.count++
+}
+
+// ReplayCache remembers the replay tags of the packets processed by the node in order to detect
+// packets which are sent to it more than once.
+// It consists of two bloom filters: new tags are inserted into the current one and once it reaches its capacity,
+// it replaces the previous one, which is discarded. Hence the memory usage of the cache is bounded,
+// while it still remembers at least the capacity most recent tags.
+// The cache is bound to the key epoch of the node, as after the keys are rotated, the old packets
+// can no longer be processed and the tags can be forgotten.
+type ReplayCache struct {
+	sync.Mutex
+	epoch    []byte
+	capacity uint
+	current  *bloomFilter
+	previous *bloomFilter
+}
+
+// replayCacheState is the persisted form of the ReplayCache.
+type replayCacheState struct {
+	Epoch         []byte
+	Capacity      uint
+	Hashes        uint64
+	Current       []uint64
+	CurrentCount  uint
+	Previous      []uint64
+	PreviousCount uint
+}
+
+// NewReplayCache creates an empty replay cache for the given key epoch,
+// where each of its filters holds up to capacity tags.
+func NewReplayCache(epoch []byte, capacity uint) *ReplayCache {
+	return &ReplayCache{
+		epoch:    epoch,
+		capacity: capacity,
+		current:  newBloomFilter(capacity),
+		previous: newBloomFilter(capacity),
+	}
+}
+
+// CheckAndAdd checks whether the tag was already seen by the cache and if not, inserts it.
+// It returns true if the tag is (probably) a replay. Tags which are too short are always treated as replays.
+func (c *ReplayCache) CheckAndAdd(tag []byte) bool {
+	if len(tag) < minimumTagLength {
+		return true
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.current.contains(tag) || c.previous.contains(tag) {
+		return true
+	}
+
+	if c.current.count >= c.capacity {
+		c.previous = c.current
+		c.current = newBloomFilter(c.capacity)
+	}
+	c.current.add(tag)
+	return false
+}
+
+// Epoch returns the key epoch the cache is bound to.
+func (c *ReplayCache) Epoch() []byte {
+	c.Lock()
+	defer c.Unlock()
+	return c.epoch
+}
+
+// Reset discards all of the remembered tags and binds the cache to the new key epoch.
+func (c *ReplayCache) Reset(epoch []byte) {
+	c.Lock()
+	defer c.Unlock()
+	c.epoch = epoch
+	c.current = newBloomFilter(c.capacity)
+	c.previous = newBloomFilter(c.capacity)
+}
+
+// Save writes the state of the cache to the given file. The file is replaced atomically,
+// so that the previous state is not lost if saving fails.
+func (c *ReplayCache) Save(path string) error {
+	c.Lock()
+	state := replayCacheState{
+		Epoch:         c.epoch,
+		Capacity:      c.capacity,
+		Hashes:        c.current.hashes,
+		Current:       append([]uint64{}, c.current.bits...),
+		CurrentCount:  c.current.count,
+		Previous:      append([]uint64{}, c.previous.bits...),
+		PreviousCount: c.previous.count,
+	}
+	c.Unlock()
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&state); err != nil {
+		return err
+	}
+
+	tmpFile, err := os.OpenFile(filepath.Clean(path+".tmp"), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := tmpFile.Write(buf.Bytes()); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// LoadReplayCache restores the replay cache from the given file. If the file does not exist, or if it was
+// saved for a different key epoch or with different capacity, a new empty cache is returned instead,
+// as the old tags are no longer relevant.
+func LoadReplayCache(path string, epoch []byte, capacity uint) (*ReplayCache, error) {
+	f, err := os.Open(filepath.Clean(path))
+	if os.IsNotExist(err) {
+		return NewReplayCache(epoch, capacity), nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var state replayCacheState
+	if err := gob.NewDecoder(f).Decode(&state); err != nil {
+		return nil, err
+	}
+
+	cache := NewReplayCache(epoch, capacity)
+	if !bytes.Equal(state.Epoch, epoch) || state.Capacity != capacity {
+		return cache, nil
+	}
+
+	if len(state.Current) != len(cache.current.bits) ||
+		len(state.Previous) != len(cache.previous.bits) ||
+		state.Hashes != cache.current.hashes {
+		return nil, errors.New("replay cache file is corrupted")
+	}
+
+	cache.current.bits, cache.current.count = state.Current, state.CurrentCount
+	cache.previous.bits, cache.previous.count = state.Previous, state.PreviousCount
+	return cache, nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2019 The Nym Mixnet Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testTag(i int) []byte {
+	tag := sha256.Sum256([]byte(fmt.Sprintf("tag%d", i)))
+	return tag[:]
+}
+
+func TestReplayCacheCheckAndAdd(t *testing.T) {
+	cache := NewReplayCache([]byte("epoch"), 100)
+
+	assert.False(t, cache.CheckAndAdd(testTag(1)))
+	assert.True(t, cache.CheckAndAdd(testTag(1)))
+	assert.False(t, cache.CheckAndAdd(testTag(2)))
+	assert.True(t, cache.CheckAndAdd([]byte("short")))
+}
+
+func TestReplayCacheRotation(t *testing.T) {
+	capacity := 10
+	cache := NewReplayCache([]byte("epoch"), uint(capacity))
+
+	for i := 0; i < 2*capacity; i++ {
+		assert.False(t, cache.CheckAndAdd(testTag(i)))
+	}
+	// the most recent tags are always remembered
+	for i := capacity; i < 2*capacity; i++ {
+		assert.True(t, cache.CheckAndAdd(testTag(i)))
+	}
+
+	// the oldest tags are forgotten after the filters are rotated twice
+	for i := 2 * capacity; i < 3*capacity+1; i++ {
+		assert.False(t, cache.CheckAndAdd(testTag(i)))
+	}
+	assert.False(t, cache.CheckAndAdd(testTag(0)))
+}
+
+func TestReplayCacheReset(t *testing.T) {
+	cache := NewReplayCache([]byte("epoch1"), 100)
+	assert.False(t, cache.CheckAndAdd(testTag(1)))
+
+	cache.Reset([]byte("epoch2"))
+	assert.Equal(t, []byte("epoch2"), cache.Epoch())
+	assert.False(t, cache.CheckAndAdd(testTag(1)))
+}
+
+func TestReplayCachePersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replaycache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "replayCache.db")
+
+	cache := NewReplayCache([]byte("epoch"), 100)
+	assert.False(t, cache.CheckAndAdd(testTag(1)))
+	assert.Nil(t, cache.Save(path))
+
+	loaded, err := LoadReplayCache(path, []byte("epoch"), 100)
+	assert.Nil(t, err)
+	assert.True(t, loaded.CheckAndAdd(testTag(1)))
+	assert.False(t, loaded.CheckAndAdd(testTag(2)))
+
+	// tags from a different key epoch are discarded
+	otherEpoch, err := LoadReplayCache(path, []byte("epoch2"), 100)
+	assert.Nil(t, err)
+	assert.False(t, otherEpoch.CheckAndAdd(testTag(1)))
+
+	missing, err := LoadReplayCache(filepath.Join(dir, "missing.db"), []byte("epoch"), 100)
+	assert.Nil(t, err)
+	assert.False(t, missing.CheckAndAdd(testTag(1)))
+}
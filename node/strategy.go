@@ -0,0 +1,89 @@
+// Copyright 2019 The Nym Mixnet Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"errors"
+	"time"
+)
+
+// Names of the mixing strategies, as used in the configuration of the mix nodes.
+const (
+	// StopAndGoStrategy is the name of the strategy of the continuous-time mix, in which each packet
+	// is delayed independently for the time chosen by its sender, implemented by DelayQueue.
+	StopAndGoStrategy = "stop-and-go"
+	// TimedPoolStrategy is the name of the strategy of the timed pool mix, implemented by TimedPoolMix.
+	TimedPoolStrategy = "timed-pool"
+	// ThresholdStrategy is the name of the strategy of the threshold mix, implemented by ThresholdMix.
+	ThresholdStrategy = "threshold"
+)
+
+var (
+	// ErrMixFull defines an error when the packet cannot be accepted, because the mix already holds
+	// the maximum number of packets in flight.
+	ErrMixFull = errors.New("mix is full")
+	// ErrMixStopped defines an error when the packet is pushed into the stopped mix.
+	ErrMixStopped = errors.New("mix is stopped")
+	// ErrInvalidMixParameters defines an error when the parameters of the mixing strategy are not valid.
+	ErrInvalidMixParameters = errors.New("invalid parameters of the mixing strategy")
+)
+
+// MixStrategy decides when the processed packets are sent further by the mix. The strategy holds
+// the packets pushed into it and passes them to its handler once they are released.
+type MixStrategy interface {
+	// Push adds the processed packet to the strategy. It returns an error if the packet cannot be accepted.
+	Push(res *PacketProcessingResult) error
+	// Start starts releasing the packets.
+	Start()
+	// Drain stops accepting new packets and waits until the packets already accepted are handled,
+	// but not past the deadline. It returns false if some packets were still in flight at the deadline.
+	// The strategy has to be stopped afterwards.
+	Drain(deadline time.Time) bool
+	// Stop stops the strategy and waits for its handlers to return. The packets not released yet are dropped.
+	Stop()
+	// Stats returns the current state of the strategy.
+	Stats() MixStrategyStats
+}
+
+// MixStrategyStats describes the current state of the mixing strategy.
+type MixStrategyStats struct {
+	// Queued is the number of packets held by the strategy until they are released.
+	Queued int
+	// InFlight is the number of accepted packets, which were not handled yet.
+	InFlight int
+	// Released is the total number of packets handled after their release.
+	Released uint64
+	// Rejected is the total number of packets rejected because of the limit of packets in flight.
+	Rejected uint64
+	// Rounds is the total number of times the pool or the batch was flushed.
+	// It is always zero for the stop-and-go strategy, which releases every packet independently.
+	Rounds uint64
+	// LastRoundSize is the number of packets the last released packets were mixed with,
+	// that is the size of the pool or of the batch when it was last flushed.
+	LastRoundSize int
+}
+
+// waitUntilDrained waits until the drainedCh is closed or the deadline passes, whichever comes first.
+// It returns false if the deadline passed.
+func waitUntilDrained(drainedCh <-chan struct{}, deadline time.Time) bool {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-drainedCh:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
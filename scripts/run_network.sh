@@ -32,16 +32,24 @@ NUMMIXES=${1:-3} # Set $NUMMIXES to default of 3, but allow the user to set othe
 
 for (( j=0; j<$NUMMIXES; j++ ))
 
-# Note: to disable logging (or direct it to another output) modify the constant on top of mixnode or provider; 
-# Will make it later either configurable by flags or config file.
+# Note: the identity and the settings, including logging, of each node are kept in its config file
+# under $HOME/.nym, which is created by the init command on the first run.
 do
     let layer=j%MAX_LAYERS+1
-    $PWD/build/nym-mixnode run --id "Mix$j" --port $((9980+$j)) --host "localhost" --layer $layer &
+    if [ ! -f "$HOME/.nym/mixnodes/Mix$j/config/config.toml" ]
+    then
+        $PWD/build/nym-mixnode init --id "Mix$j" --port $((9980+$j)) --host "localhost" --layer $layer --local
+    fi
+    $PWD/build/nym-mixnode run --id "Mix$j" &
     sleep 1
 done
 
 sleep 1
-$PWD/build/nym-mixnet-provider run --id Provider --host "localhost" --port 9997
+if [ ! -f "$HOME/.nym/providers/Provider/config/config.toml" ]
+then
+    $PWD/build/nym-mixnet-provider init --id Provider --host "localhost" --port 9997 --local
+fi
+$PWD/build/nym-mixnet-provider run --id Provider
 
 # trap call ctrl_c()
 trap ctrl_c SIGINT SIGTERM SIGTSTP
@@ -0,0 +1,583 @@
+// Copyright 2019 The Nym Mixnet Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	mainConfig "github.com/nymtech/nym-mixnet/config"
+	"github.com/nymtech/nym-mixnet/node"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultNymDirectory         = ".nym"
+	defaultNymMixnodesDirectory = "mixnodes"
+	defaultConfigDirectory      = "config"
+	defaultConfigFileName       = "config.toml"
+
+	defaultLogLevel = "info"
+
+	defaultPrivateKeyFileName  = "private_key.pem"
+	defaultPublicKeyFileName   = "public_key.pem"
+	defaultReplayCacheFileName = "replay_cache.dat"
+
+	// DefaultListenPort is the port on which the mixnode listens, unless specified otherwise.
+	DefaultListenPort = mainConfig.DefaultRemotePort
+
+	defaultMetricsInterval          = 1000
+	defaultPresenceInterval         = 2000
+	defaultTopologyRefreshInterval  = 30000
+	defaultLoopCoverTrafficRate     = 1.0
+	defaultLoopTimeout              = 30000
+	defaultLoopReturnAlertThreshold = 0.8
+	defaultShutdownTimeout          = 10000
+
+	defaultMaxConnections  = 1024
+	defaultPeerPacketRate  = 5000.0
+	defaultPeerPacketBurst = 10000
+	defaultRateLimitBy     = RateLimitByKey
+
+	defaultMixStrategy     = node.StopAndGoStrategy
+	defaultPoolInterval    = 1000
+	defaultMinimumPoolSize = 10
+	defaultBatchThreshold  = 100
+
+	defaultDirectoryServerPresenceEndpoint      = mainConfig.DirectoryServerMixPresenceURL
+	defaultDirectoryServerMetricsEndpoint       = mainConfig.DirectoryServerMetricsURL
+	defaultDirectoryServerTopologyEndpoint      = mainConfig.DirectoryServerTopology
+	DefaultLocalDirectoryServerPresenceEndpoint = mainConfig.LocalDirectoryServerMixPresenceURL
+	DefaultLocalDirectoryServerMetricsEndpoint  = mainConfig.LocalDirectoryServerMetricsURL
+	DefaultLocalDirectoryServerTopologyEndpoint = mainConfig.LocalDirectoryServerTopology
+)
+
+// Ways of identifying the peers, whose packet rates are limited.
+const (
+	// RateLimitByKey limits the rate of each static key the peers authenticated their links with.
+	RateLimitByKey = "key"
+	// RateLimitByAddress limits the rate of each IP address the peers connected from.
+	RateLimitByAddress = "address"
+)
+
+//nolint: gochecknoglobals
+var (
+	defaultHomeDirectory   = os.ExpandEnv(filepath.Join("$HOME", defaultNymDirectory, defaultNymMixnodesDirectory))
+	defaultPrivateKeyPath  = filepath.Join(defaultConfigDirectory, defaultPrivateKeyFileName)
+	defaultPublicKeyPath   = filepath.Join(defaultConfigDirectory, defaultPublicKeyFileName)
+	defaultReplayCachePath = defaultReplayCacheFileName
+)
+
+// DefaultConfigPath returns absolute path to the default configuration file of the particular mixnode.
+// The returned path should be $HOME/.nym/mixnodes/mixnodeID/config/config.toml
+func DefaultConfigPath(mixnodeID string) (string, error) {
+	if len(mixnodeID) == 0 {
+		return "", errors.New("invalid mixnodeID provided")
+	}
+	return filepath.Join(
+		defaultHomeDirectory,
+		mixnodeID,
+		defaultConfigDirectory,
+		defaultConfigFileName,
+	), nil
+}
+
+// Mixnode is the Nym Mixnode configuration.
+type Mixnode struct {
+	// HomeDirectory specifies absolute path to the home nym Mixnodes directory.
+	// It is expected to use default value and hence .toml file should not redefine this field.
+	HomeDirectory string `toml:"nym_home_directory"`
+
+	// ID specifies the human readable ID of this particular mixnode.
+	ID string `toml:"id"`
+
+	// Layer specifies the mixnet layer of this particular mixnode.
+	Layer int `toml:"layer"`
+
+	// ListenAddress specifies the address, in the form of host:port, on which the mixnode listens for packets.
+	ListenAddress string `toml:"listen_address"`
+
+	// AnnounceAddress specifies the address, in the form of host:port, which the mixnode publishes
+	// in the directory server for other nodes to connect to. If omitted, ListenAddress is used instead.
+	AnnounceAddress string `toml:"announce_address"`
+
+	// DirectoryServerPresenceEndpoint specifies URL to the mixnode presence endpoint of the directory server.
+	DirectoryServerPresenceEndpoint string `toml:"directory_server_presence"`
+
+	// DirectoryServerMetricsEndpoint specifies URL to the mixnode metrics endpoint of the directory server.
+	DirectoryServerMetricsEndpoint string `toml:"directory_server_metrics"`
+
+	// DirectoryServerTopologyEndpoint specifies URL to the topology endpoint of the directory server.
+	DirectoryServerTopologyEndpoint string `toml:"directory_server_topology"`
+
+	// PrivateKey specifies path to file containing private key.
+	PrivateKey string `toml:"priv_key_file"`
+
+	// PublicKey specifies path to file containing public key.
+	PublicKey string `toml:"pub_key_file"`
+
+	// ReplayCache specifies path to file in which the tags of the processed packets are persisted.
+	ReplayCache string `toml:"replay_cache_file"`
+
+	// MetricsAddress specifies the address, in the form of host:port, on which the metrics of the mixnode
+	// are served over HTTP in the Prometheus text format. If omitted, the metrics are not served.
+	MetricsAddress string `toml:"metrics_address"`
+}
+
+// DefaultMixnodeConfig returns default Mixnode config for provided mixnodeID, layer and listen address.
+func DefaultMixnodeConfig(mixnodeID string, layer int, listenAddress string) (*Mixnode, error) {
+	if len(mixnodeID) == 0 {
+		return nil, errors.New("invalid mixnodeID provided")
+	}
+	// Even though defaults could be obtained by validating empty struct, lets be explicit about it.
+	return &Mixnode{
+		HomeDirectory:                   defaultHomeDirectory,
+		ID:                              mixnodeID,
+		Layer:                           layer,
+		ListenAddress:                   listenAddress,
+		AnnounceAddress:                 listenAddress,
+		DirectoryServerPresenceEndpoint: defaultDirectoryServerPresenceEndpoint,
+		DirectoryServerMetricsEndpoint:  defaultDirectoryServerMetricsEndpoint,
+		DirectoryServerTopologyEndpoint: defaultDirectoryServerTopologyEndpoint,
+		PrivateKey:                      defaultPrivateKeyPath,
+		PublicKey:                       defaultPublicKeyPath,
+		ReplayCache:                     defaultReplayCachePath,
+	}, nil
+}
+
+func (cfg *Mixnode) Home() string {
+	return filepath.Join(cfg.HomeDirectory, cfg.ID)
+}
+
+// PrivateKeyFile returns the full path to the private key file.
+func (cfg *Mixnode) PrivateKeyFile() string {
+	return rootify(cfg.PrivateKey, cfg.Home())
+}
+
+// PublicKeyFile returns the full path to the public key file.
+func (cfg *Mixnode) PublicKeyFile() string {
+	return rootify(cfg.PublicKey, cfg.Home())
+}
+
+// ReplayCacheFile returns the full path to the replay cache file.
+func (cfg *Mixnode) ReplayCacheFile() string {
+	return rootify(cfg.ReplayCache, cfg.Home())
+}
+
+func (cfg *Mixnode) validateAndApplyDefaults() error {
+	// if custom home directory is specified it must have an absolute path
+	if len(cfg.HomeDirectory) > 0 {
+		if !filepath.IsAbs(cfg.HomeDirectory) {
+			return errors.New("config: specified home directory is not an absolute path")
+		}
+	} else {
+		cfg.HomeDirectory = defaultHomeDirectory
+	}
+
+	// it is also required to specify ID otherwise we could not distinguish between multiple instances
+	if len(cfg.ID) == 0 {
+		return errors.New("config: mixnode ID was not specified")
+	}
+
+	if cfg.Layer <= 0 {
+		return fmt.Errorf("config: invalid mixnode layer: %v", cfg.Layer)
+	}
+
+	if _, _, err := net.SplitHostPort(cfg.ListenAddress); err != nil {
+		return fmt.Errorf("config: invalid listen address: %s (%v)", cfg.ListenAddress, err)
+	}
+
+	if len(cfg.AnnounceAddress) == 0 {
+		cfg.AnnounceAddress = cfg.ListenAddress
+	}
+	if _, _, err := net.SplitHostPort(cfg.AnnounceAddress); err != nil {
+		return fmt.Errorf("config: invalid announce address: %s (%v)", cfg.AnnounceAddress, err)
+	}
+
+	if len(cfg.MetricsAddress) > 0 {
+		if _, _, err := net.SplitHostPort(cfg.MetricsAddress); err != nil {
+			return fmt.Errorf("config: invalid metrics address: %s (%v)", cfg.MetricsAddress, err)
+		}
+	}
+
+	// for the rest, if left unspecified, use defaults
+	if len(cfg.DirectoryServerPresenceEndpoint) == 0 {
+		cfg.DirectoryServerPresenceEndpoint = defaultDirectoryServerPresenceEndpoint
+	}
+
+	if len(cfg.DirectoryServerMetricsEndpoint) == 0 {
+		cfg.DirectoryServerMetricsEndpoint = defaultDirectoryServerMetricsEndpoint
+	}
+
+	if len(cfg.DirectoryServerTopologyEndpoint) == 0 {
+		cfg.DirectoryServerTopologyEndpoint = defaultDirectoryServerTopologyEndpoint
+	}
+
+	if len(cfg.PrivateKey) == 0 {
+		cfg.PrivateKey = defaultPrivateKeyPath
+	}
+
+	if len(cfg.PublicKey) == 0 {
+		cfg.PublicKey = defaultPublicKeyPath
+	}
+
+	if len(cfg.ReplayCache) == 0 {
+		cfg.ReplayCache = defaultReplayCachePath
+	}
+
+	return nil
+}
+
+// Logging is the Nym Mixnode logging configuration.
+type Logging struct {
+	// Disable disables logging entirely.
+	Disable bool `toml:"disable"`
+
+	// File specifies the log file, if omitted stdout will be used.
+	File string `toml:"file"`
+
+	// Level specifies the log level.
+	Level string `toml:"level"`
+}
+
+func (cfg *Logging) validate() error {
+	_, err := logrus.ParseLevel(cfg.Level)
+	if err != nil {
+		return fmt.Errorf("config: invalid logging level: %s (%v)", cfg.Level, err)
+	}
+	return nil
+}
+
+// DefaultLoggingConfig returns default logging configuration.
+func DefaultLoggingConfig() *Logging {
+	return &Logging{
+		Disable: false,
+		File:    "",
+		Level:   defaultLogLevel,
+	}
+}
+
+// Mixing is the Nym Mixnode configuration of the strategy deciding when the packets are sent further.
+type Mixing struct {
+	// Strategy specifies the mixing strategy of the mixnode, which is one of
+	// "stop-and-go", "timed-pool" and "threshold".
+	// The stop-and-go mix delays each packet for the time chosen by its sender, while the other strategies
+	// ignore those delays.
+	Strategy string `toml:"strategy"`
+
+	// PoolInterval defines how often, in milliseconds, the timed pool mix flushes its pool.
+	PoolInterval int `toml:"pool_interval"`
+
+	// MinimumPoolSize defines the number of packets the timed pool mix keeps in its pool after each flush.
+	MinimumPoolSize int `toml:"minimum_pool_size"`
+
+	// BatchThreshold defines the number of packets the threshold mix collects before releasing them.
+	BatchThreshold int `toml:"batch_threshold"`
+}
+
+func (mCfg *Mixing) applyDefaults() {
+	if len(mCfg.Strategy) == 0 {
+		mCfg.Strategy = defaultMixStrategy
+	}
+	if mCfg.PoolInterval == 0 {
+		mCfg.PoolInterval = defaultPoolInterval
+	}
+	if mCfg.MinimumPoolSize == 0 {
+		mCfg.MinimumPoolSize = defaultMinimumPoolSize
+	}
+	if mCfg.BatchThreshold == 0 {
+		mCfg.BatchThreshold = defaultBatchThreshold
+	}
+}
+
+func (mCfg *Mixing) validate() error {
+	switch mCfg.Strategy {
+	case node.StopAndGoStrategy, node.TimedPoolStrategy, node.ThresholdStrategy:
+	default:
+		return fmt.Errorf("config: unknown mixing strategy: %v", mCfg.Strategy)
+	}
+	if mCfg.PoolInterval < 0 {
+		return fmt.Errorf("config: invalid pool interval: %v", mCfg.PoolInterval)
+	}
+	if mCfg.MinimumPoolSize < 0 {
+		return fmt.Errorf("config: invalid minimum pool size: %v", mCfg.MinimumPoolSize)
+	}
+	if mCfg.BatchThreshold < 0 {
+		return fmt.Errorf("config: invalid batch threshold: %v", mCfg.BatchThreshold)
+	}
+	return nil
+}
+
+// PoolFlushingInterval returns the interval between flushing the pool of the timed pool mix.
+func (mCfg *Mixing) PoolFlushingInterval() time.Duration {
+	return time.Duration(mCfg.PoolInterval) * time.Millisecond
+}
+
+// DefaultMixingConfig returns default mixing configuration.
+func DefaultMixingConfig() *Mixing {
+	return &Mixing{
+		Strategy:        defaultMixStrategy,
+		PoolInterval:    defaultPoolInterval,
+		MinimumPoolSize: defaultMinimumPoolSize,
+		BatchThreshold:  defaultBatchThreshold,
+	}
+}
+
+// Debug is the Nym Mixnode debug configuration.
+type Debug struct {
+	// MetricsInterval defines how often, in milliseconds, the mixnode sends its metrics to the directory server.
+	MetricsInterval int `toml:"metrics_interval"`
+
+	// PresenceInterval defines how often, in milliseconds, the mixnode announces its presence
+	// to the directory server.
+	PresenceInterval int `toml:"presence_interval"`
+
+	// DelayQueueWorkers defines the number of workers sending the packets once they are released
+	// by the mixing strategy.
+	DelayQueueWorkers int `toml:"delay_queue_workers"`
+
+	// MaxInFlightPackets defines the maximum number of packets held by the mixing strategy at the same time.
+	// Packets above the limit are dropped.
+	MaxInFlightPackets int `toml:"max_in_flight_packets"`
+
+	// MaxConnections defines the maximum number of connections accepted by the mixnode at the same time.
+	// Connections above the limit are closed right after being accepted.
+	MaxConnections int `toml:"max_connections"`
+
+	// PeerPacketRate defines the number of packets per second each peer can send to the mixnode on average.
+	// Packets above the rate are dropped, while the connection of the peer is kept open.
+	// If set to a negative value, the rate of the packets is not limited.
+	PeerPacketRate float64 `toml:"peer_packet_rate"`
+
+	// PeerPacketBurst defines the number of packets each peer can send to the mixnode at once,
+	// above its average rate.
+	PeerPacketBurst int `toml:"peer_packet_burst"`
+
+	// RateLimitBy specifies how the peers, whose packet rates are limited, are identified, which is either
+	// by the "key" they authenticated their links with, or by the IP "address" they connected from.
+	RateLimitBy string `toml:"rate_limit_by"`
+
+	// TopologyRefreshInterval defines how often, in milliseconds, the mixnode obtains the network topology
+	// from the directory server.
+	TopologyRefreshInterval int `toml:"topology_refresh_interval"`
+
+	// LoopCoverTrafficRate defines the rate at which the mixnode is sending loop packets, which travel
+	// through the remaining layers of the mixnet and back to the mixnode.
+	// The value is the parameter of an exponential distribution, and is the reciprocal of the
+	// expected value of the exponential distribution.
+	// If set to a negative value, the loop cover traffic stream will be disabled. The mixnodes of the last layer
+	// never send the loop packets, as there are no further layers to route them through. The loop packets
+	// are marked with a hop command, so they are sent only through the nodes supporting the hop commands.
+	LoopCoverTrafficRate float64 `toml:"loop_cover_traffic_rate"`
+
+	// LoopTimeout defines the time, in milliseconds, after which the loop packet which did not return
+	// to the mixnode is considered lost.
+	LoopTimeout int `toml:"loop_timeout"`
+
+	// LoopReturnAlertThreshold defines the fraction of the recent loop packets which have to return
+	// to the mixnode. If fewer of them return, the alert metric is raised.
+	LoopReturnAlertThreshold float64 `toml:"loop_return_alert_threshold"`
+
+	// ShutdownTimeout defines the maximum time, in milliseconds, the mixnode waits on shutdown
+	// for the packets it holds to be sent further. Packets still held afterwards are dropped.
+	ShutdownTimeout int `toml:"shutdown_timeout"`
+}
+
+func (dCfg *Debug) applyDefaults() {
+	if dCfg.MetricsInterval == 0 {
+		dCfg.MetricsInterval = defaultMetricsInterval
+	}
+	if dCfg.PresenceInterval == 0 {
+		dCfg.PresenceInterval = defaultPresenceInterval
+	}
+	if dCfg.DelayQueueWorkers == 0 {
+		dCfg.DelayQueueWorkers = node.DefaultDelayQueueWorkers
+	}
+	if dCfg.MaxInFlightPackets == 0 {
+		dCfg.MaxInFlightPackets = node.DefaultMaxInFlightPackets
+	}
+	if dCfg.MaxConnections == 0 {
+		dCfg.MaxConnections = defaultMaxConnections
+	}
+	if dCfg.PeerPacketRate == 0.0 {
+		dCfg.PeerPacketRate = defaultPeerPacketRate
+	}
+	if dCfg.PeerPacketBurst == 0 {
+		dCfg.PeerPacketBurst = defaultPeerPacketBurst
+	}
+	if len(dCfg.RateLimitBy) == 0 {
+		dCfg.RateLimitBy = defaultRateLimitBy
+	}
+	if dCfg.TopologyRefreshInterval == 0 {
+		dCfg.TopologyRefreshInterval = defaultTopologyRefreshInterval
+	}
+	if dCfg.LoopCoverTrafficRate == 0.0 {
+		dCfg.LoopCoverTrafficRate = defaultLoopCoverTrafficRate
+	}
+	if dCfg.LoopTimeout == 0 {
+		dCfg.LoopTimeout = defaultLoopTimeout
+	}
+	if dCfg.LoopReturnAlertThreshold == 0.0 {
+		dCfg.LoopReturnAlertThreshold = defaultLoopReturnAlertThreshold
+	}
+	if dCfg.ShutdownTimeout == 0 {
+		dCfg.ShutdownTimeout = defaultShutdownTimeout
+	}
+}
+
+func (dCfg *Debug) validate() error {
+	if dCfg.MetricsInterval < 0 {
+		return fmt.Errorf("config: invalid metrics interval: %v", dCfg.MetricsInterval)
+	}
+	if dCfg.PresenceInterval < 0 {
+		return fmt.Errorf("config: invalid presence interval: %v", dCfg.PresenceInterval)
+	}
+	if dCfg.DelayQueueWorkers < 0 || dCfg.MaxInFlightPackets < 0 {
+		return fmt.Errorf("config: invalid delay queue limits: %v workers, %v packets in flight",
+			dCfg.DelayQueueWorkers,
+			dCfg.MaxInFlightPackets,
+		)
+	}
+	if dCfg.MaxConnections < 0 {
+		return fmt.Errorf("config: invalid connection limit: %v", dCfg.MaxConnections)
+	}
+	if dCfg.PeerPacketBurst < 0 {
+		return fmt.Errorf("config: invalid peer packet burst: %v", dCfg.PeerPacketBurst)
+	}
+	if dCfg.RateLimitBy != RateLimitByKey && dCfg.RateLimitBy != RateLimitByAddress {
+		return fmt.Errorf("config: invalid way of identifying rate limited peers: %v", dCfg.RateLimitBy)
+	}
+	if dCfg.TopologyRefreshInterval < 0 {
+		return fmt.Errorf("config: invalid topology refresh interval: %v", dCfg.TopologyRefreshInterval)
+	}
+	if dCfg.LoopTimeout < 0 {
+		return fmt.Errorf("config: invalid loop timeout: %v", dCfg.LoopTimeout)
+	}
+	if dCfg.LoopReturnAlertThreshold < 0.0 || dCfg.LoopReturnAlertThreshold > 1.0 {
+		return fmt.Errorf("config: invalid loop return alert threshold: %v", dCfg.LoopReturnAlertThreshold)
+	}
+	if dCfg.ShutdownTimeout < 0 {
+		return fmt.Errorf("config: invalid shutdown timeout: %v", dCfg.ShutdownTimeout)
+	}
+	return nil
+}
+
+// MetricsSendingInterval returns the interval between sending the metrics to the directory server.
+func (dCfg *Debug) MetricsSendingInterval() time.Duration {
+	return time.Duration(dCfg.MetricsInterval) * time.Millisecond
+}
+
+// PresenceSendingInterval returns the interval between announcing the presence to the directory server.
+func (dCfg *Debug) PresenceSendingInterval() time.Duration {
+	return time.Duration(dCfg.PresenceInterval) * time.Millisecond
+}
+
+// TopologyRefreshingInterval returns the interval between obtaining the network topology from the directory server.
+func (dCfg *Debug) TopologyRefreshingInterval() time.Duration {
+	return time.Duration(dCfg.TopologyRefreshInterval) * time.Millisecond
+}
+
+// LoopReturnTimeout returns the time after which the loop packet which did not return is considered lost.
+func (dCfg *Debug) LoopReturnTimeout() time.Duration {
+	return time.Duration(dCfg.LoopTimeout) * time.Millisecond
+}
+
+// DrainingTimeout returns the maximum time of waiting on shutdown for the held packets to be sent.
+func (dCfg *Debug) DrainingTimeout() time.Duration {
+	return time.Duration(dCfg.ShutdownTimeout) * time.Millisecond
+}
+
+// DefaultDebugConfig returns default debug configuration.
+func DefaultDebugConfig() *Debug {
+	return &Debug{
+		MetricsInterval:          defaultMetricsInterval,
+		PresenceInterval:         defaultPresenceInterval,
+		DelayQueueWorkers:        node.DefaultDelayQueueWorkers,
+		MaxInFlightPackets:       node.DefaultMaxInFlightPackets,
+		MaxConnections:           defaultMaxConnections,
+		PeerPacketRate:           defaultPeerPacketRate,
+		PeerPacketBurst:          defaultPeerPacketBurst,
+		RateLimitBy:              defaultRateLimitBy,
+		TopologyRefreshInterval:  defaultTopologyRefreshInterval,
+		LoopCoverTrafficRate:     defaultLoopCoverTrafficRate,
+		LoopTimeout:              defaultLoopTimeout,
+		LoopReturnAlertThreshold: defaultLoopReturnAlertThreshold,
+		ShutdownTimeout:          defaultShutdownTimeout,
+	}
+}
+
+// Config is the top level Nym Mixnode configuration.
+type Config struct {
+	Mixnode *Mixnode `toml:"mixnode"`
+	Mixing  *Mixing  `toml:"mixing"`
+	Logging *Logging `toml:"logging"`
+	Debug   *Debug   `toml:"debug"`
+}
+
+// DefaultConfig returns full default config for given mixnodeID, layer and listen address.
+func DefaultConfig(mixnodeID string, layer int, listenAddress string) (*Config, error) {
+	defaultMixnodeConfig, err := DefaultMixnodeConfig(mixnodeID, layer, listenAddress)
+	if err != nil {
+		return nil, err
+	}
+	return &Config{
+		Mixnode: defaultMixnodeConfig,
+		Mixing:  DefaultMixingConfig(),
+		Logging: DefaultLoggingConfig(),
+		Debug:   DefaultDebugConfig(),
+	}, nil
+}
+
+func (cfg *Config) validateAndApplyDefaults() error {
+	if cfg.Mixnode == nil {
+		return errors.New("config: No Mixnode block was present")
+	}
+
+	if err := cfg.Mixnode.validateAndApplyDefaults(); err != nil {
+		return err
+	}
+
+	if cfg.Mixing == nil {
+		cfg.Mixing = &Mixing{}
+	}
+	cfg.Mixing.applyDefaults()
+
+	if err := cfg.Mixing.validate(); err != nil {
+		return err
+	}
+
+	if cfg.Debug == nil {
+		cfg.Debug = &Debug{}
+	}
+	cfg.Debug.applyDefaults()
+
+	if err := cfg.Debug.validate(); err != nil {
+		return err
+	}
+
+	if cfg.Logging == nil {
+		cfg.Logging = DefaultLoggingConfig()
+	}
+
+	if err := cfg.Logging.validate(); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,255 @@
+// Copyright 2019 The Nym Mixnet Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nymtech/nym-mixnet/node"
+	"github.com/pelletier/go-toml"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testID            = "foo"
+	testLayer         = 2
+	testListenAddress = "127.0.0.1:1789"
+)
+
+func TestDefaultConfigPathNoID(t *testing.T) {
+	configPath, err := DefaultConfigPath("")
+	assert.Len(t, configPath, 0)
+	assert.Error(t, err)
+}
+
+func TestDefaultConfigPath(t *testing.T) {
+	configPath, err := DefaultConfigPath(testID)
+	homeDir := os.ExpandEnv("$HOME")
+	assert.Equal(t, filepath.Join(homeDir, "/.nym/mixnodes/foo/config/config.toml"), configPath)
+	assert.Nil(t, err)
+}
+
+func TestDefaultConfigNoID(t *testing.T) {
+	fullCfg, err := DefaultConfig("", testLayer, testListenAddress)
+	assert.Nil(t, fullCfg)
+	assert.Error(t, err)
+
+	mixnodeCfg, err := DefaultMixnodeConfig("", testLayer, testListenAddress)
+	assert.Nil(t, mixnodeCfg)
+	assert.Error(t, err)
+}
+
+func TestDefaultConfig(t *testing.T) {
+	fullCfg, err := DefaultConfig(testID, testLayer, testListenAddress)
+	assert.NotNil(t, fullCfg)
+	assert.Nil(t, err)
+	assert.Equal(t, testListenAddress, fullCfg.Mixnode.AnnounceAddress)
+
+	// check that replacing homedir correctly affects locations of keys
+	fullCfg.Mixnode.HomeDirectory = "/baz"
+
+	assert.Equal(t, "/baz/foo/config/private_key.pem", fullCfg.Mixnode.PrivateKeyFile())
+	assert.Equal(t, "/baz/foo/config/public_key.pem", fullCfg.Mixnode.PublicKeyFile())
+	assert.Equal(t, "/baz/foo/replay_cache.dat", fullCfg.Mixnode.ReplayCacheFile())
+
+	// However, if keys have absolute paths, homedir should be ignored
+	fullCfg.Mixnode.PrivateKey = "/some/absolute/path/priv.pem"
+	fullCfg.Mixnode.PublicKey = "/some/absolute/path/pub.pem"
+
+	assert.Equal(t, "/some/absolute/path/priv.pem", fullCfg.Mixnode.PrivateKeyFile())
+	assert.Equal(t, "/some/absolute/path/pub.pem", fullCfg.Mixnode.PublicKeyFile())
+}
+
+func TestValidateAndApplyDefaults(t *testing.T) {
+	// if we create empty structs and apply defaults to them, we should obtain results identical
+	// to just obtaining default structs
+	fullCfg, err := DefaultConfig(testID, testLayer, testListenAddress)
+	assert.NotNil(t, fullCfg)
+	assert.Nil(t, err)
+
+	// We need to explicitly set the fields without defaults
+	freshFullCfg := &Config{
+		Mixnode: &Mixnode{ID: testID, Layer: testLayer, ListenAddress: testListenAddress},
+	}
+
+	assert.Nil(t, freshFullCfg.validateAndApplyDefaults())
+	assert.Equal(t, fullCfg, freshFullCfg)
+
+	debugCfg := DefaultDebugConfig()
+	freshDebugCfg := new(Debug)
+	freshDebugCfg.applyDefaults()
+	assert.Equal(t, debugCfg, freshDebugCfg)
+
+	// No mixnode block
+	newCfg := &Config{}
+	assert.Error(t, newCfg.validateAndApplyDefaults())
+}
+
+func TestValidateMixnodeBlock(t *testing.T) {
+	invalidate := []func(cfg *Mixnode){
+		func(cfg *Mixnode) { cfg.HomeDirectory = "non/absolute/path" },
+		func(cfg *Mixnode) { cfg.ID = "" },
+		func(cfg *Mixnode) { cfg.Layer = 0 },
+		func(cfg *Mixnode) { cfg.ListenAddress = "" },
+		func(cfg *Mixnode) { cfg.ListenAddress = "127.0.0.1" },
+		func(cfg *Mixnode) { cfg.AnnounceAddress = "missing.port" },
+		func(cfg *Mixnode) { cfg.MetricsAddress = "missing.port" },
+	}
+	for _, f := range invalidate {
+		fullCfg, err := DefaultConfig(testID, testLayer, testListenAddress)
+		assert.Nil(t, err)
+		f(fullCfg.Mixnode)
+		assert.Error(t, fullCfg.validateAndApplyDefaults())
+	}
+
+	// the listen address is announced unless specified otherwise
+	fullCfg, err := DefaultConfig(testID, testLayer, testListenAddress)
+	assert.Nil(t, err)
+	fullCfg.Mixnode.AnnounceAddress = ""
+	assert.Nil(t, fullCfg.validateAndApplyDefaults())
+	assert.Equal(t, testListenAddress, fullCfg.Mixnode.AnnounceAddress)
+}
+
+func TestValidateDebug(t *testing.T) {
+	fullCfg, err := DefaultConfig(testID, testLayer, testListenAddress)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1000), fullCfg.Debug.MetricsSendingInterval().Milliseconds())
+
+	fullCfg.Debug.PresenceInterval = -1
+	assert.Error(t, fullCfg.validateAndApplyDefaults())
+
+	fullCfg, err = DefaultConfig(testID, testLayer, testListenAddress)
+	assert.Nil(t, err)
+	fullCfg.Debug.MaxInFlightPackets = -1
+	assert.Error(t, fullCfg.validateAndApplyDefaults())
+
+	fullCfg, err = DefaultConfig(testID, testLayer, testListenAddress)
+	assert.Nil(t, err)
+	fullCfg.Debug.RateLimitBy = "port"
+	assert.Error(t, fullCfg.validateAndApplyDefaults())
+
+	fullCfg, err = DefaultConfig(testID, testLayer, testListenAddress)
+	assert.Nil(t, err)
+	fullCfg.Debug.MaxConnections = -1
+	assert.Error(t, fullCfg.validateAndApplyDefaults())
+
+	fullCfg, err = DefaultConfig(testID, testLayer, testListenAddress)
+	assert.Nil(t, err)
+	fullCfg.Debug.LoopReturnAlertThreshold = 1.5
+	assert.Error(t, fullCfg.validateAndApplyDefaults())
+
+	fullCfg, err = DefaultConfig(testID, testLayer, testListenAddress)
+	assert.Nil(t, err)
+	fullCfg.Debug.ShutdownTimeout = -1
+	assert.Error(t, fullCfg.validateAndApplyDefaults())
+
+	fullCfg, err = DefaultConfig(testID, testLayer, testListenAddress)
+	assert.Nil(t, err)
+	fullCfg.Debug.LoopTimeout = 0
+	fullCfg.Debug.LoopCoverTrafficRate = -1.0
+	fullCfg.Debug.ShutdownTimeout = 0
+	assert.Nil(t, fullCfg.validateAndApplyDefaults())
+	assert.Equal(t, int64(defaultShutdownTimeout), fullCfg.Debug.DrainingTimeout().Milliseconds())
+	assert.Equal(t, int64(defaultLoopTimeout), fullCfg.Debug.LoopReturnTimeout().Milliseconds())
+	assert.Equal(t, -1.0, fullCfg.Debug.LoopCoverTrafficRate)
+
+	fullCfg, err = DefaultConfig(testID, testLayer, testListenAddress)
+	assert.Nil(t, err)
+	fullCfg.Logging.Level = "dbg"
+	assert.Error(t, fullCfg.validateAndApplyDefaults())
+}
+
+func TestValidateMixing(t *testing.T) {
+	fullCfg, err := DefaultConfig(testID, testLayer, testListenAddress)
+	assert.Nil(t, err)
+	assert.Equal(t, node.StopAndGoStrategy, fullCfg.Mixing.Strategy)
+
+	fullCfg.Mixing.Strategy = "shuffle"
+	assert.Error(t, fullCfg.validateAndApplyDefaults())
+
+	fullCfg, err = DefaultConfig(testID, testLayer, testListenAddress)
+	assert.Nil(t, err)
+	fullCfg.Mixing.BatchThreshold = -1
+	assert.Error(t, fullCfg.validateAndApplyDefaults())
+
+	fullCfg, err = DefaultConfig(testID, testLayer, testListenAddress)
+	assert.Nil(t, err)
+	fullCfg.Mixing = nil
+	assert.Nil(t, fullCfg.validateAndApplyDefaults())
+	assert.Equal(t, DefaultMixingConfig(), fullCfg.Mixing)
+}
+
+func TestLoadBinary(t *testing.T) {
+	cfg, err := LoadBinary([]byte(""))
+	assert.Nil(t, cfg)
+	assert.Error(t, err)
+
+	cfg2, err := LoadBinary([]byte("[someinvalid[toml{data]"))
+	assert.Nil(t, cfg2)
+	assert.Error(t, err)
+
+	fullCfg, err := DefaultConfig(testID, testLayer, testListenAddress)
+	assert.NotNil(t, fullCfg)
+	assert.Nil(t, err)
+
+	b, err := toml.Marshal(fullCfg)
+	assert.Nil(t, err)
+
+	cfg3, err := LoadBinary(b)
+	assert.NotNil(t, cfg3)
+	assert.Nil(t, err)
+
+	assert.Equal(t, fullCfg, cfg3)
+}
+
+func TestWriteConfig(t *testing.T) {
+	fullCfg, err := DefaultConfig(testID, testLayer, testListenAddress)
+	assert.NotNil(t, fullCfg)
+	assert.Nil(t, err)
+
+	tmpDir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	outFilePath := filepath.Join(tmpDir, "testCfg.toml")
+
+	// set some nondefault values
+	fullCfg.Mixnode.HomeDirectory = "/foomp/.nym"
+	fullCfg.Mixnode.AnnounceAddress = "1.2.3.4:1789"
+	fullCfg.Mixnode.MetricsAddress = "127.0.0.1:9100"
+	fullCfg.Mixnode.DirectoryServerPresenceEndpoint = DefaultLocalDirectoryServerPresenceEndpoint
+	fullCfg.Mixnode.DirectoryServerTopologyEndpoint = DefaultLocalDirectoryServerTopologyEndpoint
+	fullCfg.Logging.Disable = true
+	fullCfg.Logging.Level = "panic"
+	fullCfg.Debug.MetricsInterval = 42
+	fullCfg.Debug.DelayQueueWorkers = 4
+	fullCfg.Debug.LoopCoverTrafficRate = 0.25
+	fullCfg.Debug.LoopReturnAlertThreshold = 0.5
+	fullCfg.Mixing.Strategy = node.TimedPoolStrategy
+	fullCfg.Mixing.MinimumPoolSize = 5
+	fullCfg.Debug.PeerPacketRate = -1.0
+	fullCfg.Debug.RateLimitBy = RateLimitByAddress
+
+	assert.Nil(t, WriteConfigFile(outFilePath, fullCfg))
+
+	loadedCfg, err := LoadFile(outFilePath)
+	assert.Nil(t, err)
+	assert.Equal(t, fullCfg, loadedCfg)
+
+	_, err = LoadFile("/path/that/does/not/exist")
+	assert.Error(t, err)
+}
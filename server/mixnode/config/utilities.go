@@ -0,0 +1,216 @@
+// Copyright 2019 The Nym Mixnet Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"text/template"
+
+	"github.com/BurntSushi/toml"
+)
+
+var configTemplate *template.Template
+
+func init() {
+	var err error
+	if configTemplate, err = template.New("configFileTemplate").Funcs(template.FuncMap{
+		"FormatFloats": func(f float64) string { return fmt.Sprintf("%.2f", f) },
+	}).Parse(defaultConfigTemplate); err != nil {
+		panic(err)
+	}
+}
+
+// LoadBinary loads, parses and validates the provided buffer b (as a config)
+// and returns the Config.
+func LoadBinary(b []byte) (*Config, error) {
+	cfg := new(Config)
+	_, err := toml.Decode(string(b), cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.validateAndApplyDefaults(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// LoadFile loads, parses and validates the provided file and returns the Config.
+func LoadFile(f string) (*Config, error) {
+	b, err := ioutil.ReadFile(filepath.Clean(f))
+	if err != nil {
+		return nil, err
+	}
+	return LoadBinary(b)
+}
+
+// WriteConfigFile renders config using the template and writes it to specified file path.
+func WriteConfigFile(path string, config *Config) error {
+	var buffer bytes.Buffer
+
+	if err := configTemplate.Execute(&buffer, config); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, buffer.Bytes(), 0644)
+}
+
+// helper function to make config creation independent of root dir
+// adapted from the tendermint code
+func rootify(path, root string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(root, path)
+}
+
+// Note: any changes to the template must be reflected in the appropriate structs and tags.
+const defaultConfigTemplate = `# This is a TOML config file.
+# For more information, see https://github.com/toml-lang/toml
+
+##### main base mixnode config options #####
+[mixnode]
+
+# Human readable ID of this particular mixnode.
+id = "{{ .Mixnode.ID }}"
+
+# Mixnet layer of this particular mixnode.
+layer = {{ .Mixnode.Layer }}
+
+# Address, in the form of host:port, on which the mixnode listens for packets.
+listen_address = "{{ .Mixnode.ListenAddress }}"
+
+# Address, in the form of host:port, which the mixnode publishes in the directory server
+# for other nodes to connect to. If omitted, listen_address is used instead.
+announce_address = "{{ .Mixnode.AnnounceAddress }}"
+
+# URL to the mixnode presence endpoint of the directory server.
+directory_server_presence = "{{ .Mixnode.DirectoryServerPresenceEndpoint }}"
+
+# URL to the mixnode metrics endpoint of the directory server.
+directory_server_metrics = "{{ .Mixnode.DirectoryServerMetricsEndpoint }}"
+
+# URL to the topology endpoint of the directory server.
+directory_server_topology = "{{ .Mixnode.DirectoryServerTopologyEndpoint }}"
+
+# Path to file containing private key.
+priv_key_file = "{{ .Mixnode.PrivateKey }}"
+
+# Path to file containing public key.
+pub_key_file = "{{ .Mixnode.PublicKey }}"
+
+# Path to file in which the tags of the processed packets are persisted,
+# so that the replayed packets are detected across the restarts.
+replay_cache_file = "{{ .Mixnode.ReplayCache }}"
+
+# Address, in the form of host:port, on which the metrics of the mixnode are served over HTTP
+# in the Prometheus text format at /metrics. If left empty, the metrics are not served.
+metrics_address = "{{ .Mixnode.MetricsAddress }}"
+
+##### advanced configuration options #####
+
+# Absolute path to the home Nym Mixnodes directory.
+nym_home_directory = "{{ .Mixnode.HomeDirectory }}"
+
+##### mixing configuration options #####
+[mixing]
+
+# The strategy deciding when the packets are sent further. The available options include:
+# stop-and-go - each packet is delayed for the time chosen by its sender,
+# timed-pool - the pool of packets is flushed periodically, keeping minimum_pool_size random packets in it,
+# threshold - the packets are released in batches of batch_threshold packets.
+# Both the timed-pool and the threshold strategies release the packets in random order
+# and ignore the delays chosen by their senders.
+strategy = "{{ .Mixing.Strategy }}"
+
+# How often, in milliseconds, the timed pool mix flushes its pool.
+pool_interval = {{ .Mixing.PoolInterval }}
+
+# The number of packets the timed pool mix keeps in its pool after each flush.
+minimum_pool_size = {{ .Mixing.MinimumPoolSize }}
+
+# The number of packets the threshold mix collects before releasing them.
+batch_threshold = {{ .Mixing.BatchThreshold }}
+
+##### logging configuration options #####
+[logging]
+
+# Whether to disable disables logging entirely.
+disable = {{ .Logging.Disable }}
+
+# The log file. If omitted or set to empty value, stdout will be used.
+file = "{{ .Logging.File }}"
+
+# The logging level of the mixnode. The available options include:
+# trace, debug, info, warning, error, panic, fatal
+# Warning: The 'trace' and 'debug' log levels are unsafe for production use.
+level = "{{ .Logging.Level }}"
+
+##### debug configuration options #####
+[debug]
+
+# How often, in milliseconds, the mixnode sends its metrics to the directory server.
+metrics_interval = {{ .Debug.MetricsInterval }}
+
+# How often, in milliseconds, the mixnode announces its presence to the directory server.
+presence_interval = {{ .Debug.PresenceInterval }}
+
+# The number of workers sending the packets once they are released by the mixing strategy.
+delay_queue_workers = {{ .Debug.DelayQueueWorkers }}
+
+# The maximum number of packets held by the mixing strategy at the same time.
+# Packets above the limit are dropped.
+max_in_flight_packets = {{ .Debug.MaxInFlightPackets }}
+
+# The maximum number of connections accepted by the mixnode at the same time.
+# Connections above the limit are closed right after being accepted.
+max_connections = {{ .Debug.MaxConnections }}
+
+# The number of packets per second each peer can send to the mixnode on average.
+# Packets above the rate are dropped, while the connection of the peer is kept open.
+# If set to a negative value, the rate of the packets is not limited.
+peer_packet_rate = {{FormatFloats .Debug.PeerPacketRate }}
+
+# The number of packets each peer can send to the mixnode at once, above its average rate.
+peer_packet_burst = {{ .Debug.PeerPacketBurst }}
+
+# How the peers, whose packet rates are limited, are identified. The available options include:
+# key - by the static key the peer authenticated its link with,
+# address - by the IP address the peer connected from.
+rate_limit_by = "{{ .Debug.RateLimitBy }}"
+
+# How often, in milliseconds, the mixnode obtains the network topology from the directory server.
+topology_refresh_interval = {{ .Debug.TopologyRefreshInterval }}
+
+# The parameter of Poisson distribution determining how often the mixnode sends loop packets,
+# If set to a negative value, no loop packets are sent. The mixnodes of the last layer never send them.
+# If set to a negative value, no loop packets are sent.
+loop_cover_traffic_rate = {{FormatFloats .Debug.LoopCoverTrafficRate }}
+
+# The time, in milliseconds, after which the loop packet which did not return is considered lost.
+loop_timeout = {{ .Debug.LoopTimeout }}
+
+# The fraction of the recent loop packets which have to return to the mixnode.
+# If fewer of them return, the loop alert metric is raised.
+loop_return_alert_threshold = {{FormatFloats .Debug.LoopReturnAlertThreshold }}
+
+# The maximum time, in milliseconds, the mixnode waits on shutdown for the packets it holds
+# to be sent further. Packets still held afterwards are dropped.
+shutdown_timeout = {{ .Debug.ShutdownTimeout }}
+
+`
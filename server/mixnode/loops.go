@@ -0,0 +1,367 @@
+// Copyright 2019 The Nym Mixnet Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mixnode
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nymtech/nym-mixnet/config"
+	"github.com/nymtech/nym-mixnet/helpers"
+	"github.com/nymtech/nym-mixnet/node"
+	"github.com/nymtech/nym-mixnet/sphinx"
+	"github.com/nymtech/nym-mixnet/telemetry"
+)
+
+const (
+	// loopIDSize is the size of the random identifier carried in the payload of every loop packet.
+	loopIDSize = 16
+	// loopHistorySize is the number of the most recent loop outcomes the return ratio is computed over.
+	loopHistorySize = 100
+	// minimumLoopOutcomes is the number of the loop outcomes required before the alert can be raised,
+	// so that a single lost packet right after the start does not trigger it.
+	minimumLoopOutcomes = 20
+	// loopDelayRate is the parameter of the exponential distribution of the delays of the loop packets
+	// at every hop. It is the same as for the packets sent by the clients, so that the loops are
+	// indistinguishable from the rest of the traffic.
+	loopDelayRate = 5.0
+	// loopExpiryCheckInterval defines how often the loops which did not return in time are marked as lost.
+	loopExpiryCheckInterval = time.Second
+)
+
+var (
+	// ErrNoLoopPath defines an error when there are no further layers in the topology the loop packets
+	// could be routed through, which is the case for the mixes of the last layer.
+	ErrNoLoopPath = errors.New("no further layers to route the loop packets through")
+)
+
+type loopID [loopIDSize]byte
+
+// loopMonitor keeps track of the loop packets sent by the mix and computes the fraction of them which returned.
+type loopMonitor struct {
+	sync.Mutex
+	timeout        time.Duration
+	alertThreshold float64
+	pending        map[loopID]time.Time
+	// outcomes is a ring buffer of the most recent loop outcomes, true for the loops which returned
+	outcomes []bool
+	next     int
+	alerting bool
+
+	sent     *telemetry.Counter
+	returned *telemetry.Counter
+	lost     *telemetry.Counter
+}
+
+func newLoopMonitor(timeout time.Duration, alertThreshold float64) *loopMonitor {
+	return &loopMonitor{
+		timeout:        timeout,
+		alertThreshold: alertThreshold,
+		pending:        make(map[loopID]time.Time),
+		outcomes:       make([]bool, 0, loopHistorySize),
+	}
+}
+
+// registerMetrics registers the counters of the loops and the alert gauge, prefixed with the given namespace.
+func (l *loopMonitor) registerMetrics(registry *telemetry.Registry, namespace string) {
+	l.sent = registry.NewCounter(namespace+"_loops_sent_total",
+		"Number of the loop packets sent by the node.")
+	l.returned = registry.NewCounter(namespace+"_loops_returned_total",
+		"Number of the loop packets which returned to the node in time.")
+	l.lost = registry.NewCounter(namespace+"_loops_lost_total",
+		"Number of the loop packets which did not return to the node in time.")
+	registry.NewGaugeFunc(namespace+"_loops_pending",
+		"Number of the loop packets the node is waiting for.",
+		func() float64 {
+			l.Lock()
+			defer l.Unlock()
+			return float64(len(l.pending))
+		},
+	)
+	registry.NewGaugeFunc(namespace+"_loop_return_ratio",
+		"Fraction of the recent loop packets which returned to the node.",
+		func() float64 {
+			ratio, _ := l.returnRatio()
+			return ratio
+		},
+	)
+	registry.NewGaugeFunc(namespace+"_loop_return_alert",
+		"Set to 1 if fewer of the recent loop packets returned than expected, "+
+			"indicating the packets are held or dropped by the further layers.",
+		func() float64 {
+			if l.alert() {
+				return 1
+			}
+			return 0
+		},
+	)
+}
+
+// add starts waiting for the return of the loop with the given identifier.
+func (l *loopMonitor) add(id loopID, now time.Time) {
+	l.Lock()
+	defer l.Unlock()
+	l.pending[id] = now
+	l.sent.Inc()
+}
+
+// markReturned records the return of the loop with the given identifier. It returns false if the mix
+// is not waiting for such loop, either because it was never sent or because it was already considered lost.
+func (l *loopMonitor) markReturned(id loopID) bool {
+	l.Lock()
+	defer l.Unlock()
+	if _, ok := l.pending[id]; !ok {
+		return false
+	}
+	delete(l.pending, id)
+	l.record(true)
+	l.returned.Inc()
+	return true
+}
+
+// expire marks all the loops sent longer than the timeout ago as lost.
+func (l *loopMonitor) expire(now time.Time) {
+	l.Lock()
+	defer l.Unlock()
+	for id, sentAt := range l.pending {
+		if now.Sub(sentAt) > l.timeout {
+			delete(l.pending, id)
+			l.record(false)
+			l.lost.Inc()
+		}
+	}
+}
+
+// record adds the outcome of a loop to the history, replacing the oldest one if it is full.
+// It has to be called with the lock held.
+func (l *loopMonitor) record(returned bool) {
+	if len(l.outcomes) < loopHistorySize {
+		l.outcomes = append(l.outcomes, returned)
+		return
+	}
+	l.outcomes[l.next] = returned
+	l.next = (l.next + 1) % loopHistorySize
+}
+
+// returnRatio returns the fraction of the recent loops which returned, together with the number
+// of the outcomes it was computed over. If there are no outcomes yet, the ratio is 1.
+func (l *loopMonitor) returnRatio() (float64, int) {
+	l.Lock()
+	defer l.Unlock()
+	if len(l.outcomes) == 0 {
+		return 1, 0
+	}
+	returned := 0
+	for _, outcome := range l.outcomes {
+		if outcome {
+			returned++
+		}
+	}
+	return float64(returned) / float64(len(l.outcomes)), len(l.outcomes)
+}
+
+// alert checks whether the return ratio of the recent loops fell below the threshold.
+func (l *loopMonitor) alert() bool {
+	ratio, outcomes := l.returnRatio()
+	return outcomes >= minimumLoopOutcomes && ratio < l.alertThreshold
+}
+
+// updateAlert checks the alert and reports whether its state changed since the previous check.
+func (l *loopMonitor) updateAlert() (bool, bool) {
+	alerting := l.alert()
+	l.Lock()
+	defer l.Unlock()
+	changed := alerting != l.alerting
+	l.alerting = alerting
+	return alerting, changed
+}
+
+// loopPath builds the path of a loop packet, consisting of a randomly selected mix of each of the layers
+// following the layer of the mix, up to the last layer in the topology, and of the mix itself.
+func (m *MixServer) loopPath() (config.E2EPath, error) {
+	m.topologyMu.RLock()
+	defer m.topologyMu.RUnlock()
+
+	var hops []config.MixConfig
+	for layer := uint(m.layer + 1); layer <= lastLayer(m.mixes, m.layer); layer++ {
+		mix, err := helpers.RandomMixFrom(rand.Reader, m.mixes[layer])
+		if err != nil {
+			return config.E2EPath{}, fmt.Errorf("error in loopPath - choosing mix for layer %v failed: %v", layer, err)
+		}
+		hops = append(hops, mix)
+	}
+	if len(hops) == 0 {
+		return config.E2EPath{}, ErrNoLoopPath
+	}
+
+	self := m.config
+	self.Layer = uint64(m.layer)
+	self.PacketVersions = sphinx.SupportedPacketVersions()
+	return config.E2EPath{IngressProvider: hops[0],
+		Mixes:          hops[1:],
+		EgressProvider: self,
+		Recipient:      config.ClientConfig{Id: self.Id, Host: self.Host, Port: self.Port, PubKey: self.PubKey},
+	}, nil
+}
+
+// createLoopPacket packs a fresh loop identifier into a sphinx packet travelling along the loop path.
+// It returns the packet as the result of processing by the mix itself, holding the delay for which
+// the mix should hold the packet before sending it to the first hop, like any other packet it relays.
+func (m *MixServer) createLoopPacket() (*node.PacketProcessingResult, loopID, error) {
+	var id loopID
+	path, err := m.loopPath()
+	if err != nil {
+		return nil, id, err
+	}
+
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, id, err
+	}
+
+	// the first delay is the one of the mix itself, followed by the delays of all the hops on the path
+	delays := make([]float64, len(path.Mixes)+3)
+	for i := range delays {
+		if delays[i], err = helpers.RandomExponential(loopDelayRate); err != nil {
+			return nil, id, err
+		}
+	}
+
+	// the mix of the last layer can send the packet back to the mix only if it is marked as a loop
+	hopCommands := make([][]*sphinx.HopCommand, len(path.Mixes)+2)
+	hopCommands[len(path.Mixes)] = []*sphinx.HopCommand{sphinx.NewLoopCommand()}
+
+	sphinxPacket, err := sphinx.PackForwardMessageWithCommands(path, delays[1:], hopCommands, id[:])
+	if err == sphinx.ErrHopCommandsNotSupported {
+		return nil, id, err
+	} else if err != nil {
+		return nil, id, fmt.Errorf("error in createLoopPacket - the pack procedure failed: %v", err)
+	}
+	packet, err := sphinx.EncodePacket(&sphinxPacket)
+	if err != nil {
+		return nil, id, err
+	}
+
+	firstHop := sphinx.Hop{Id: path.IngressProvider.Id,
+		Address: path.IngressProvider.Host + ":" + path.IngressProvider.Port,
+		PubKey:  path.IngressProvider.PubKey,
+	}
+	return node.NewRelayResult(packet, firstHop, delays[0]), id, nil
+}
+
+// sendLoopPacket creates a loop packet and passes it to the mixing strategy, which sends it
+// to the first hop together with the packets relayed by the mix.
+func (m *MixServer) sendLoopPacket() error {
+	res, id, err := m.createLoopPacket()
+	if err != nil {
+		return err
+	}
+	if err := m.strategy.Push(res); err != nil {
+		return err
+	}
+	m.loops.add(id, time.Now())
+	return nil
+}
+
+// startLoopCoverTraffic starts sending the loop packets and monitoring their returns once the topology
+// is obtained. The mixes of the last layer do not send any loops, as there are no further layers
+// to route them through, and do not register the metrics of the loops either.
+func (m *MixServer) startLoopCoverTraffic() {
+	ticker := time.NewTicker(loopExpiryCheckInterval)
+	defer ticker.Stop()
+	for !m.hasTopology() {
+		select {
+		case <-ticker.C:
+		case <-m.haltingCh:
+			return
+		}
+	}
+
+	if m.inLastLayer() {
+		m.log.Infof("Loop cover traffic disabled, as there are no layers after layer %v "+
+			"to route the loop packets through", m.layer)
+		return
+	}
+
+	m.loops.registerMetrics(m.registry, "nym_mixnode")
+	go m.startExpiringLoops()
+	m.runLoopCoverTrafficStream()
+}
+
+// runLoopCoverTrafficStream sends the loop packets at the rate defined in the config, waiting
+// a random time, sampled from the exponential distribution, between any two of them.
+func (m *MixServer) runLoopCoverTrafficStream() {
+	m.log.Debugf("Stream of loop cover traffic started")
+	for {
+		delaySec, err := helpers.RandomExponential(m.cfg.Debug.LoopCoverTrafficRate)
+		if err != nil {
+			m.log.Errorf("Error in the loop cover traffic stream - generating random exp. value failed: %v", err)
+			return
+		}
+		select {
+		case <-time.After(time.Duration(delaySec * float64(time.Second))):
+		case <-m.haltingCh:
+			return
+		}
+
+		// neither the missing layers, nor the nodes unable to recognise the loops, are faults of the mix
+		if err := m.sendLoopPacket(); err == ErrNoLoopPath || err == sphinx.ErrHopCommandsNotSupported {
+			m.log.Debugf("Loop packet not sent: %v", err)
+		} else if err != nil {
+			m.log.Errorf("Could not send loop packet: %v", err)
+		}
+	}
+}
+
+func (m *MixServer) startExpiringLoops() {
+	ticker := time.NewTicker(loopExpiryCheckInterval)
+	for {
+		select {
+		case now := <-ticker.C:
+			m.loops.expire(now)
+			alerting, changed := m.loops.updateAlert()
+			if !changed {
+				continue
+			}
+			ratio, _ := m.loops.returnRatio()
+			if alerting {
+				m.log.Warnf("Only %.2f of the recent loop packets returned. "+
+					"Packets might be held or dropped by the further layers", ratio)
+			} else {
+				m.log.Infof("Return ratio of the loop packets recovered to %.2f", ratio)
+			}
+		case <-m.haltedCh:
+			return
+		}
+	}
+}
+
+// receivedLoop checks whether the fully processed packet is one of the loops sent by the mix
+// and if so, records its return.
+func (m *MixServer) receivedLoop(packetData []byte) bool {
+	sphinxPacket, err := sphinx.DecodePacket(packetData)
+	if err != nil {
+		return false
+	}
+	message, _, err := sphinx.UnpackForwardMessage(sphinxPacket.Pld)
+	if err != nil || len(message) != loopIDSize {
+		return false
+	}
+	var id loopID
+	copy(id[:], message)
+	return m.loops.markReturned(id)
+}
@@ -0,0 +1,221 @@
+// Copyright 2019 The Nym Mixnet Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mixnode
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nymtech/nym-mixnet/config"
+	"github.com/nymtech/nym-mixnet/flags"
+	"github.com/nymtech/nym-mixnet/helpers/topology"
+	"github.com/nymtech/nym-mixnet/node"
+	mixConfig "github.com/nymtech/nym-mixnet/server/mixnode/config"
+	"github.com/nymtech/nym-mixnet/sphinx"
+	"github.com/nymtech/nym-mixnet/telemetry"
+	"github.com/stretchr/testify/assert"
+)
+
+// createTestHop returns the config of the mix listening on localhost, which supports all the packet format versions.
+func createTestHop(pub *sphinx.PublicKey, layer uint) config.MixConfig {
+	hop := config.NewMixConfig("hop", "localhost", "9996", pub.Bytes(), layer)
+	hop.PacketVersions = sphinx.SupportedPacketVersions()
+	return hop
+}
+
+func TestLoopMonitor(t *testing.T) {
+	loops := newLoopMonitor(time.Minute, 0.8)
+	loops.registerMetrics(telemetry.NewRegistry(), "test")
+
+	start := time.Now()
+	for i := 0; i < minimumLoopOutcomes; i++ {
+		loops.add(loopID{byte(i)}, start)
+	}
+	assert.False(t, loops.markReturned(loopID{0xff}))
+	for i := 0; i < minimumLoopOutcomes/2; i++ {
+		assert.True(t, loops.markReturned(loopID{byte(i)}))
+	}
+	assert.False(t, loops.alert())
+
+	loops.expire(start.Add(30 * time.Second))
+	assert.Len(t, loops.pending, minimumLoopOutcomes/2)
+	assert.False(t, loops.alert())
+
+	loops.expire(start.Add(2 * time.Minute))
+	assert.Empty(t, loops.pending)
+	ratio, outcomes := loops.returnRatio()
+	assert.Equal(t, 0.5, ratio)
+	assert.Equal(t, minimumLoopOutcomes, outcomes)
+	assert.True(t, loops.alert())
+	assert.Equal(t, uint64(minimumLoopOutcomes), loops.sent.Value())
+	assert.Equal(t, uint64(minimumLoopOutcomes/2), loops.returned.Value())
+	assert.Equal(t, uint64(minimumLoopOutcomes/2), loops.lost.Value())
+
+	// loops which return after being considered lost are not counted
+	assert.False(t, loops.markReturned(loopID{byte(minimumLoopOutcomes - 1)}))
+
+	// the ratio is computed only over the most recent outcomes
+	for i := 0; i < loopHistorySize; i++ {
+		loops.add(loopID{byte(i)}, start)
+		assert.True(t, loops.markReturned(loopID{byte(i)}))
+	}
+	ratio, outcomes = loops.returnRatio()
+	assert.Equal(t, 1.0, ratio)
+	assert.Equal(t, loopHistorySize, outcomes)
+	assert.False(t, loops.alert())
+}
+
+func TestLoopMonitorUpdateAlert(t *testing.T) {
+	loops := newLoopMonitor(time.Minute, 0.8)
+	loops.registerMetrics(telemetry.NewRegistry(), "test")
+
+	start := time.Now()
+	for i := 0; i < minimumLoopOutcomes; i++ {
+		loops.add(loopID{byte(i)}, start)
+	}
+	loops.expire(start.Add(2 * time.Minute))
+
+	alerting, changed := loops.updateAlert()
+	assert.True(t, alerting)
+	assert.True(t, changed)
+
+	alerting, changed = loops.updateAlert()
+	assert.True(t, alerting)
+	assert.False(t, changed)
+}
+
+func TestMixServer_LoopPacketReturns(t *testing.T) {
+	mix, err := CreateTestMixnode()
+	assert.Nil(t, err)
+	defer mix.listener.Close()
+	mix.layer = 2
+
+	hopPriv, hopPub, err := sphinx.GenerateKeyPair()
+	assert.Nil(t, err)
+	hop := node.NewMix(hopPriv, hopPub)
+	mix.setNetwork(topology.LayeredMixes{
+		2: {mix.config},
+		3: {createTestHop(hopPub, 3)},
+	}, nil)
+
+	mix.loops.registerMetrics(mix.registry, "nym_mixnode")
+
+	loop, id, err := mix.createLoopPacket()
+	assert.Nil(t, err)
+	assert.Equal(t, flags.RelayFlag, loop.Flag())
+	assert.Equal(t, hopPub.Bytes(), loop.NextHop().PubKey)
+	assert.Equal(t, "localhost:9996", loop.NextHop().Address)
+	mix.loops.add(id, time.Now())
+
+	// the packet travels through the mix of the last layer back to the mix which sent it
+	res := hop.ProcessPacket(loop.PacketData())
+	assert.Nil(t, res.Err())
+	assert.Equal(t, flags.RelayFlag, res.Flag())
+	assert.True(t, res.Commands().Loop())
+	assert.Equal(t, "localhost:9995", res.NextHop().Address)
+	assert.Equal(t, mix.GetPublicKey().Bytes(), res.NextHop().PubKey)
+
+	res = mix.ProcessPacket(res.PacketData())
+	assert.Nil(t, res.Err())
+	assert.Equal(t, flags.LastHopFlag, res.Flag())
+	assert.True(t, mix.receivedLoop(res.PacketData()))
+	assert.False(t, mix.receivedLoop(res.PacketData()))
+	assert.Equal(t, uint64(1), mix.loops.returned.Value())
+	assert.Empty(t, mix.loops.pending)
+}
+
+func TestMixServer_LoopPacketLegacyNodes(t *testing.T) {
+	mix, err := CreateTestMixnode()
+	assert.Nil(t, err)
+	defer mix.listener.Close()
+	mix.layer = 2
+
+	// the mixes which do not advertise their versions cannot recognise the loops
+	_, hopPub, err := sphinx.GenerateKeyPair()
+	assert.Nil(t, err)
+	mix.setNetwork(topology.LayeredMixes{
+		2: {mix.config},
+		3: {config.NewMixConfig("hop", "localhost", "9996", hopPub.Bytes(), 3)},
+	}, nil)
+
+	_, _, err = mix.createLoopPacket()
+	assert.Equal(t, sphinx.ErrHopCommandsNotSupported, err)
+}
+
+func TestMixServer_LoopPathLastLayer(t *testing.T) {
+	mix, err := CreateTestMixnode()
+	assert.Nil(t, err)
+	defer mix.listener.Close()
+	mix.layer = 3
+
+	_, hopPub, err := sphinx.GenerateKeyPair()
+	assert.Nil(t, err)
+	mix.setNetwork(topology.LayeredMixes{
+		2: {createTestHop(hopPub, 2)},
+		3: {mix.config},
+	}, nil)
+
+	_, err = mix.loopPath()
+	assert.Equal(t, ErrNoLoopPath, err)
+}
+
+func TestMixServer_SendLoopPacketMixed(t *testing.T) {
+	mix, err := CreateTestMixnode()
+	assert.Nil(t, err)
+	defer mix.listener.Close()
+	mix.layer = 2
+	assert.Nil(t, mix.SetMixStrategy(mixConfig.DefaultMixingConfig(), 1, 10))
+	mix.loops.registerMetrics(mix.registry, "nym_mixnode")
+
+	_, hopPub, err := sphinx.GenerateKeyPair()
+	assert.Nil(t, err)
+	mix.setNetwork(topology.LayeredMixes{
+		2: {mix.config},
+		3: {createTestHop(hopPub, 3)},
+	}, nil)
+
+	// the loop packet is held by the mixing strategy, like the packets relayed by the mix
+	assert.Nil(t, mix.sendLoopPacket())
+	assert.Equal(t, 1, mix.strategy.Stats().Queued)
+	assert.Len(t, mix.loops.pending, 1)
+	assert.Equal(t, uint64(1), mix.loops.sent.Value())
+}
+
+func TestMixServer_LoopCoverTrafficLastLayer(t *testing.T) {
+	mix, err := CreateTestMixnode()
+	assert.Nil(t, err)
+	defer mix.listener.Close()
+	mix.layer = 3
+
+	_, hopPub, err := sphinx.GenerateKeyPair()
+	assert.Nil(t, err)
+	mix.setNetwork(topology.LayeredMixes{
+		2: {createTestHop(hopPub, 2)},
+		3: {mix.config},
+	}, nil)
+
+	done := make(chan struct{})
+	go func() {
+		mix.startLoopCoverTraffic()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("mix of the last layer started the loop cover traffic")
+	}
+	// the metrics of the loops are not registered
+	assert.Nil(t, mix.loops.sent)
+}
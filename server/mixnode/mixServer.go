@@ -17,6 +17,8 @@ package mixnode
 
 import (
 	"encoding/base64"
+	"fmt"
+	"io"
 	"net"
 	"sync"
 	"time"
@@ -24,25 +26,23 @@ import (
 	"github.com/golang/protobuf/proto"
 	"github.com/nymtech/nym-directory/models"
 	"github.com/nymtech/nym-mixnet/config"
+	"github.com/nymtech/nym-mixnet/constants"
 	"github.com/nymtech/nym-mixnet/flags"
 	"github.com/nymtech/nym-mixnet/helpers"
+	"github.com/nymtech/nym-mixnet/helpers/topology"
 	"github.com/nymtech/nym-mixnet/logger"
 	"github.com/nymtech/nym-mixnet/networker"
 	"github.com/nymtech/nym-mixnet/node"
+	mixConfig "github.com/nymtech/nym-mixnet/server/mixnode/config"
 	"github.com/nymtech/nym-mixnet/sphinx"
+	"github.com/nymtech/nym-mixnet/telemetry"
 	"github.com/sirupsen/logrus"
 )
 
 const (
-	metricsInterval  = time.Second
-	presenceInterval = 2 * time.Second
-
-	// Below should be moved to a config file once we have it
-	// logFileLocation can either point to some valid file to which all log data should be written
-	// or if left an empty string, stdout will be used instead
-	defaultLogFileLocation = ""
-	// considering we are under heavy development and nowhere near production level, log EVERYTHING
-	defaultLogLevel = "trace"
+	replayCacheSaveInterval = time.Minute
+	// idlePeersRemovalInterval defines how often the rate limiter forgets the peers which stopped sending packets.
+	idlePeersRemovalInterval = time.Minute
 )
 
 // MixServerIt is the interface of a mix server.
@@ -60,17 +60,45 @@ type MixServer struct {
 	host     string
 	port     string
 	layer    int
+	cfg      *mixConfig.Config
 	listener net.Listener
 	config   config.MixConfig
 	metrics  *metrics
-	haltedCh chan struct{}
-	haltOnce sync.Once
-	log      *logrus.Logger
+	// haltingCh is closed once the shutdown starts, while haltedCh once it is finished
+	haltingCh chan struct{}
+	haltedCh  chan struct{}
+	haltOnce  sync.Once
+	log       *logrus.Logger
+
+	strategy node.MixStrategy
+	pool     *networker.ConnectionPool
+
+	// connSlots holds a token for each connection being handled, limiting their number
+	connSlots chan struct{}
+	// rateLimiter limits the packet rate of each peer, if enabled in the config
+	rateLimiter *node.RateLimiter
+	rateLimitBy string
+
+	registry *telemetry.Registry
+	// metricsServer serves the metrics of the registry, if enabled in the config
+	metricsServer *telemetry.Server
+	packetMetrics *node.PacketMetrics
+	// connectionsRejected counts the connections closed because of the limit of connections
+	connectionsRejected *telemetry.Counter
+
+	// mixes and providers are the view of the network topology, used for routing the loop packets
+	// and for checking whether the packets are sent between the adjacent layers
+	topologyMu        sync.RWMutex
+	mixes             topology.LayeredMixes
+	providers         []config.MixConfig
+	topologyUpdated   time.Time
+	topologyRefreshCh chan struct{}
+	loops             *loopMonitor
 }
 
 type metrics struct {
 	sync.Mutex
-	host             string
+	endpoint         string
 	b64Key           string
 	receivedMessages uint
 	sentMessages     map[string]uint
@@ -101,35 +129,46 @@ func (m *metrics) addMessage(hopAddress string) {
 	}
 }
 
-func (m *metrics) sendToDirectoryServer() {
+// collect returns a copy of the metrics gathered since the last reset.
+func (m *metrics) collect() models.MixMetric {
 	m.Lock()
 	defer m.Unlock()
-	// send the data in a new goroutine so we wouldn't block if there were issues in sending the data
 	sentCopy := make(map[string]uint)
 	for k, v := range m.sentMessages {
 		sentCopy[k] = v
 	}
 	receivedCopy := m.receivedMessages
+	return models.MixMetric{
+		PubKey:   m.b64Key,
+		Sent:     sentCopy,
+		Received: &receivedCopy,
+	}
+}
 
+func (m *metrics) sendToDirectoryServer() {
+	// send the data in a new goroutine so we wouldn't block if there were issues in sending the data
 	go func(metricsCopy models.MixMetric) {
-		if err := helpers.SendMixMetrics(metricsCopy, m.host); err != nil {
+		if err := helpers.SendMixMetricsTo(m.endpoint, metricsCopy); err != nil {
 			m.log.Errorf("Failed to send metrics: %v", err)
 		}
-	}(models.MixMetric{
-		PubKey:   m.b64Key,
-		Sent:     sentCopy,
-		Received: &receivedCopy,
-	})
+	}(m.collect())
+}
+
+// flushToDirectoryServer sends the metrics gathered since the last reset and waits for the request to complete.
+func (m *metrics) flushToDirectoryServer() {
+	if err := helpers.SendMixMetricsTo(m.endpoint, m.collect()); err != nil {
+		m.log.Errorf("Failed to send metrics: %v", err)
+	}
 }
 
-func newMetrics(log *logrus.Logger, publicKey *sphinx.PublicKey, host string) *metrics {
+func newMetrics(log *logrus.Logger, publicKey *sphinx.PublicKey, endpoint string) *metrics {
 	b64key := base64.URLEncoding.EncodeToString(publicKey.Bytes())
 	log.Infof("Our public key is: %v", b64key)
 	return &metrics{
 		log:          log,
 		b64Key:       b64key,
 		sentMessages: make(map[string]uint),
-		host:         host,
+		endpoint:     endpoint,
 	}
 }
 
@@ -146,10 +185,33 @@ func (m *MixServer) Shutdown() {
 // calls any required cleanup code
 func (m *MixServer) halt() {
 	m.log.Info("Starting graceful shutdown")
-	// close any listeners, free resources, etc
-	// possibly send "remove presence" message
+	// stop announcing our presence, sending loops and accepting new connections.
+	// The directory server has no way of removing the presence explicitly, but it forgets the nodes
+	// which did not announce it for a few seconds, so the clients stop routing through us soon after.
+	close(m.haltingCh)
+	if err := m.listener.Close(); err != nil {
+		m.log.Errorf("Failed to close the listener: %v", err)
+	}
+
+	// the packets already held are still sent further, as long as they are released before the deadline
+	if !m.strategy.Drain(time.Now().Add(m.cfg.Debug.DrainingTimeout())) {
+		m.log.Warnf("Dropping %v packets not sent before the shutdown deadline", m.strategy.Stats().InFlight)
+	}
+	m.strategy.Stop()
+	m.pool.Close()
+
+	m.metrics.flushToDirectoryServer()
+	if err := m.SaveReplayCache(); err != nil {
+		m.log.Errorf("Failed to save replay cache: %v", err)
+	}
+	if m.metricsServer != nil {
+		if err := m.metricsServer.Close(); err != nil {
+			m.log.Errorf("Failed to stop serving metrics: %v", err)
+		}
+	}
 
 	close(m.haltedCh)
+	m.log.Info("Shutdown finished")
 }
 
 // Start runs a mix server
@@ -163,67 +225,195 @@ func (m *MixServer) GetConfig() config.MixConfig {
 	return m.config
 }
 
-func (m *MixServer) receivedPacket(packet []byte) error {
+// registerMetrics creates the registry of the metrics of the mix server.
+func (m *MixServer) registerMetrics() {
+	m.registry = telemetry.NewRegistry()
+	m.packetMetrics = node.NewPacketMetrics(m.registry,
+		"nym_mixnode",
+		func() node.MixStrategyStats { return m.strategy.Stats() },
+		func() networker.PoolStats { return m.pool.Stats() },
+	)
+	m.connectionsRejected = m.registry.NewCounter("nym_mixnode_connections_rejected_total",
+		"Number of connections closed because of the limit of connections handled at the same time.")
+	m.registry.NewGaugeFunc("nym_mixnode_incoming_connections",
+		"Number of connections from other nodes and clients being handled.",
+		func() float64 { return float64(len(m.connSlots)) })
+}
+
+// SetLoadLimits sets the limit of connections handled at the same time and of the packet rate of each peer,
+// as defined in the given config. It has to be called before the server is started.
+func (m *MixServer) SetLoadLimits(cfg *mixConfig.Debug) error {
+	m.connSlots = make(chan struct{}, cfg.MaxConnections)
+	m.rateLimiter = nil
+	if cfg.PeerPacketRate > 0.0 {
+		rateLimiter, err := node.NewRateLimiter(cfg.PeerPacketRate, cfg.PeerPacketBurst)
+		if err != nil {
+			return err
+		}
+		m.rateLimiter = rateLimiter
+	}
+	m.rateLimitBy = cfg.RateLimitBy
+	return nil
+}
+
+// SetMixStrategy replaces the mixing strategy of the mix server with the one defined in the given config,
+// having the given number of sending workers and the limit of packets in flight.
+// It has to be called before the server is started.
+func (m *MixServer) SetMixStrategy(cfg *mixConfig.Mixing, workers int, maxInFlight int) error {
+	var strategy node.MixStrategy
+	var err error
+	switch cfg.Strategy {
+	case node.StopAndGoStrategy:
+		strategy, err = node.NewDelayQueue(workers, maxInFlight, m.releasePacket)
+	case node.TimedPoolStrategy:
+		strategy, err = node.NewTimedPoolMix(cfg.PoolFlushingInterval(),
+			cfg.MinimumPoolSize,
+			workers,
+			maxInFlight,
+			m.releasePacket,
+		)
+	case node.ThresholdStrategy:
+		strategy, err = node.NewThresholdMix(cfg.BatchThreshold, workers, maxInFlight, m.releasePacket)
+	default:
+		return fmt.Errorf("unknown mixing strategy: %v", cfg.Strategy)
+	}
+	if err != nil {
+		return err
+	}
+	m.strategy = strategy
+	return nil
+}
+
+// receivedPacket processes the packet sent by the node which authenticated its link with the given key
+// and passes it to the mixing strategy. The packets are accepted only from the previous layer of the mixnet
+// and only if they are sent further to the next one, apart from the loop packets returning to the mix.
+func (m *MixServer) receivedPacket(sender []byte, packet []byte) error {
 	m.log.Infof("%s: Received new sphinx packet", m.id)
 	m.metrics.incrementReceived()
+	m.packetMetrics.Received.Inc()
+
+	senderKind := m.checkSender(sender)
+	if senderKind == senderUnknown {
+		m.packetMetrics.Dropped.WithLabel(node.DropReasonUnexpectedSender).Inc()
+		m.log.Warnf("Dropped packet sent by a node outside of the previous layer")
+		m.requestTopologyRefresh()
+		return nil
+	}
 
-	// process in goroutine so we wouldn't block while executing the required delay
-	go func(packet []byte) {
-		res := m.ProcessPacket(packet)
-		dePacket := res.PacketData()
-		nextHop := res.NextHop()
-		flag := res.Flag()
-		if err := res.Err(); err != nil {
+	processingStart := time.Now()
+	res := m.ProcessPacket(packet)
+	m.packetMetrics.ProcessingTime.ObserveSince(processingStart)
+	if err := res.Err(); err != nil {
+		m.packetMetrics.Dropped.WithLabel(node.DropReason(err)).Inc()
+		switch err {
+		case sphinx.ErrReplayedPacket:
+			m.log.Warnf("Dropped replayed packet (total replays: %v)", m.ReplayedPackets())
+		case sphinx.ErrUnsupportedPacketVersion:
+			m.log.Warnf("Dropped packet of unsupported version (total unsupported: %v)", m.UnsupportedPackets())
+		default:
 			m.log.Errorf("error while processing packet: %v", err)
 		}
+		return nil
+	}
 
-		if flag == flags.RelayFlag {
-			if err := m.forwardPacket(dePacket, nextHop.Address); err != nil {
-				m.log.Errorf("error while forwarding packet: %v", err)
-			}
-			// add it only if we didn't return an error
-			m.metrics.addMessage(nextHop.Address)
-		} else {
-			m.log.Info("Packet has non-forward flag. Packet dropped")
-		}
-	}(packet)
+	if res.Commands().DropCover() {
+		m.packetMetrics.Dropped.WithLabel(node.DropReasonCover).Inc()
+		m.log.Debugf("%s: Dropped cover packet as instructed by its sender", m.id)
+		return nil
+	}
 
-	return nil
-}
+	if res.Flag() == flags.LastHopFlag && m.receivedLoop(res.PacketData()) {
+		m.log.Debugf("%s: Received own loop packet", m.id)
+		return nil
+	}
 
-func (m *MixServer) forwardPacket(sphinxPacket []byte, address string) error {
-	packetBytes, err := config.WrapWithFlag(flags.CommFlag, sphinxPacket)
-	if err != nil {
-		return err
+	if senderKind != senderPreviousLayer {
+		m.packetMetrics.Dropped.WithLabel(node.DropReasonUnexpectedSender).Inc()
+		m.log.Warnf("Dropped packet sent by the last layer, which was not a loop of the mix")
+		return nil
 	}
-	if err := m.send(packetBytes, address); err != nil {
-		return err
+
+	if res.Flag() == flags.RelayFlag && !m.checkNextHop(res.NextHop(), res.Commands()) {
+		m.packetMetrics.Dropped.WithLabel(node.DropReasonUnexpectedNextHop).Inc()
+		m.log.Warnf("Dropped packet addressed to %v, which is not in the next layer", res.NextHop().Address)
+		m.requestTopologyRefresh()
+		return nil
 	}
 
+	// the packet is sent further by one of the workers of the mixing strategy, once it is released
+	if err := m.strategy.Push(res); err != nil {
+		m.packetMetrics.Dropped.WithLabel(node.PushDropReason(err)).Inc()
+		m.log.Warnf("Dropped packet which could not be mixed: %v", err)
+	}
 	return nil
 }
 
-func (m *MixServer) send(packet []byte, address string) error {
-	conn, err := net.Dial("tcp", address)
+// releasePacket sends the processed packet further once it is released by the mixing strategy.
+func (m *MixServer) releasePacket(res *node.PacketProcessingResult) {
+	m.packetMetrics.MixingDelay.ObserveSince(res.ProcessedAt())
+	nextHop := res.NextHop()
+	if res.Flag() == flags.RelayFlag {
+		if err := m.forwardPacket(res.PacketData(), nextHop.Address, nextHop.PubKey); err != nil {
+			m.packetMetrics.Dropped.WithLabel(node.DropReasonForwardFailed).Inc()
+			m.log.Errorf("error while forwarding packet: %v", err)
+		} else {
+			m.packetMetrics.Forwarded.Inc()
+		}
+		// add it only if we didn't return an error
+		m.metrics.addMessage(nextHop.Address)
+	} else {
+		m.packetMetrics.Dropped.WithLabel(node.DropReasonUnexpectedFlag).Inc()
+		m.log.Info("Packet has non-forward flag. Packet dropped")
+	}
+}
+
+func (m *MixServer) forwardPacket(sphinxPacket []byte, address string, pubKey []byte) error {
+	packetBytes, err := helpers.WrapSphinxPacket(sphinxPacket)
 	if err != nil {
 		return err
 	}
-	defer conn.Close()
-
-	if _, err := conn.Write(packet); err != nil {
+	if err := m.send(packetBytes, address, pubKey); err != nil {
 		return err
 	}
+
 	return nil
 }
 
+// send sends the packet over the pooled link to the node with the given address and public key.
+func (m *MixServer) send(packet []byte, address string, pubKey []byte) error {
+	return m.pool.Send(address, pubKey, packet)
+}
+
 func (m *MixServer) run() {
 	defer m.listener.Close()
 
+	m.strategy.Start()
+
+	if len(m.cfg.Mixnode.MetricsAddress) > 0 {
+		metricsServer, err := telemetry.ListenAndServe(m.cfg.Mixnode.MetricsAddress, m.registry)
+		if err != nil {
+			m.log.Errorf("Failed to serve metrics: %v", err)
+		} else {
+			m.log.Infof("Serving metrics on %s", metricsServer.Addr())
+			m.metricsServer = metricsServer
+		}
+	}
+
 	go m.startSendingMetrics()
 	go m.startSendingPresence()
+	go m.startSavingReplayCache()
+	go m.startRemovingIdlePeers()
+
+	if err := m.UpdateNetworkView(); err != nil {
+		m.log.Errorf("Failed to obtain network topology: %v", err)
+	}
+	go m.startRefreshingTopology()
+	if m.cfg.Debug.LoopCoverTrafficRate > 0.0 {
+		go m.startLoopCoverTraffic()
+	}
 
 	go func() {
-		m.log.Infof("Listening on %s", m.host+":"+m.port)
+		m.log.Infof("Listening on %s", m.listener.Addr())
 		m.listenForIncomingConnections()
 	}()
 
@@ -231,12 +421,57 @@ func (m *MixServer) run() {
 }
 
 func (m *MixServer) startSendingMetrics() {
-	ticker := time.NewTicker(metricsInterval)
+	ticker := time.NewTicker(m.cfg.Debug.MetricsSendingInterval())
 	for {
 		select {
 		case <-ticker.C:
 			m.metrics.sendToDirectoryServer()
 			m.metrics.reset()
+			stats := m.strategy.Stats()
+			m.log.Debugf("Mix: %v queued, %v in flight, %v released, %v rejected, %v rounds",
+				stats.Queued,
+				stats.InFlight,
+				stats.Released,
+				stats.Rejected,
+				stats.Rounds,
+			)
+			poolStats := m.pool.Stats()
+			m.log.Debugf("Connections: %v open, %v dials, %v reconnects, %v failed dials, %v evictions",
+				poolStats.Open,
+				poolStats.Dials,
+				poolStats.Reconnects,
+				poolStats.FailedDials,
+				poolStats.Evictions,
+			)
+		case <-m.haltingCh:
+			return
+		}
+	}
+}
+
+func (m *MixServer) startSavingReplayCache() {
+	ticker := time.NewTicker(replayCacheSaveInterval)
+	for {
+		select {
+		case <-ticker.C:
+			if err := m.SaveReplayCache(); err != nil {
+				m.log.Errorf("Failed to save replay cache: %v", err)
+			}
+		case <-m.haltedCh:
+			return
+		}
+	}
+}
+
+func (m *MixServer) startRemovingIdlePeers() {
+	if m.rateLimiter == nil {
+		return
+	}
+	ticker := time.NewTicker(idlePeersRemovalInterval)
+	for {
+		select {
+		case now := <-ticker.C:
+			m.rateLimiter.RemoveIdle(now)
 		case <-m.haltedCh:
 			return
 		}
@@ -244,106 +479,210 @@ func (m *MixServer) startSendingMetrics() {
 }
 
 func (m *MixServer) startSendingPresence() {
-	ticker := time.NewTicker(presenceInterval)
+	ticker := time.NewTicker(m.cfg.Debug.PresenceSendingInterval())
 	for {
 		select {
 		case <-ticker.C:
-			if err := helpers.RegisterMixNodePresence(m.GetPublicKey(),
+			if err := helpers.RegisterMixNodePresenceAt(m.cfg.Mixnode.DirectoryServerPresenceEndpoint,
+				m.GetPublicKey(),
 				m.layer,
-				net.JoinHostPort(m.host, m.port),
+				m.cfg.Mixnode.AnnounceAddress,
 			); err != nil {
 				m.log.Errorf("Failed to register presence: %v", err)
 			}
-		case <-m.haltedCh:
+		case <-m.haltingCh:
 			return
 		}
 	}
 }
 
+// listenForIncomingConnections accepts the connections and handles each of them in its own goroutine.
 func (m *MixServer) listenForIncomingConnections() {
 	for {
 		conn, err := m.listener.Accept()
 		if err != nil {
+			select {
+			case <-m.haltingCh:
+				// the listener was closed on shutdown
+				return
+			default:
+			}
 			m.log.Errorf("Error when listening for incoming connection: %v", err)
 		} else {
-			m.log.Infof("Received connection from %s", conn.RemoteAddr())
-			go func(conn net.Conn) {
-				err := m.handleConnection(conn)
-				if err != nil {
-					m.log.Errorf("Error when listening for incoming connection: %v", err)
-				}
-			}(conn)
+			m.acceptConnection(conn)
 		}
 	}
 }
 
+// acceptConnection starts handling the connection, unless the limit of connections is reached.
+// In such case the new connection is closed right away, while the ones already established
+// are handled as usual.
+func (m *MixServer) acceptConnection(conn net.Conn) {
+	select {
+	case m.connSlots <- struct{}{}:
+	default:
+		m.connectionsRejected.Inc()
+		m.log.Warnf("Rejected connection from %s: limit of %v connections reached",
+			conn.RemoteAddr(),
+			cap(m.connSlots),
+		)
+		conn.Close()
+		return
+	}
+
+	m.log.Infof("Received connection from %s", conn.RemoteAddr())
+	go func() {
+		defer func() { <-m.connSlots }()
+		if err := m.handleConnection(conn); err != nil {
+			m.log.Errorf("Error when listening for incoming connection: %v", err)
+		}
+	}()
+}
+
+// peerID returns the identifier of the peer on the other end of the link, by which its packet rate is limited.
+func (m *MixServer) peerID(link *networker.Link) string {
+	if m.rateLimitBy == mixConfig.RateLimitByAddress {
+		if host, _, err := net.SplitHostPort(link.RemoteAddr().String()); err == nil {
+			return host
+		}
+		return link.RemoteAddr().String()
+	}
+	return string(link.RemoteKey())
+}
+
+// handleConnection establishes the link over the connection and handles all the packets sent over it,
+// until it is closed by the sender. The packets sent above the rate allowed for the peer are dropped.
 func (m *MixServer) handleConnection(conn net.Conn) error {
 	defer conn.Close()
 
-	buff := make([]byte, 2048)
-	reqLen, err := conn.Read(buff)
+	link, err := networker.AcceptLink(conn, m.GetKeyPair)
 	if err != nil {
-		return err
+		return fmt.Errorf("error in handle connection - link handshake failed: %v", err)
+	}
+	peer := m.peerID(link)
+	for {
+		packetBytes, err := link.ReadFrame(node.MaxPacketFrameSize)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if m.rateLimiter != nil && !m.rateLimiter.Allow(peer, time.Now()) {
+			m.packetMetrics.Received.Inc()
+			m.packetMetrics.Dropped.WithLabel(node.DropReasonRateLimited).Inc()
+			m.log.Debugf("Dropped packet from %s above its rate limit", conn.RemoteAddr())
+			continue
+		}
+		if err := m.handlePacket(link.RemoteKey(), packetBytes); err != nil {
+			return err
+		}
 	}
+}
 
+// handlePacket checks the flag of the packet, received from the node which authenticated its link
+// with the given key, and passes it to the corresponding process function.
+func (m *MixServer) handlePacket(sender []byte, packetBytes []byte) error {
 	var packet config.GeneralPacket
-	if err := proto.Unmarshal(buff[:reqLen], &packet); err != nil {
+	if err := proto.Unmarshal(packetBytes, &packet); err != nil {
 		return err
 	}
 
-	switch flags.PacketTypeFlagFromBytes(packet.Flag) {
+	flag, err := flags.ParsePacketTypeFlag(packet.Flag)
+	if err != nil {
+		m.log.Infof("Packet flag %v not recognised. Packet dropped", packet.Flag)
+		return nil
+	}
+
+	switch flag {
 	case flags.CommFlag:
-		if err := m.receivedPacket(packet.Data); err != nil {
+		if err := m.CheckPacketVersion(packet.Version); err != nil {
+			m.packetMetrics.Received.Inc()
+			m.packetMetrics.Dropped.WithLabel(node.DropReasonUnsupportedVersion).Inc()
+			m.log.Warnf("Dropped packet of unsupported version %v (total unsupported: %v)",
+				packet.Version,
+				m.UnsupportedPackets(),
+			)
+			return nil
+		}
+		if err := m.receivedPacket(sender, packet.Data); err != nil {
 			return err
 		}
 	default:
-		m.log.Infof("Packet flag %s not recognised. Packet dropped", packet.Flag)
+		m.log.Infof("Packet flag %v not expected by a mix. Packet dropped", packet.Flag)
 		return nil
 	}
 	return nil
 }
 
-// NewMixServer constructor
-// TODO: Identical case to 'NewClient'
-func NewMixServer(id string,
-	host string,
-	port string,
-	prvKey *sphinx.PrivateKey,
-	pubKey *sphinx.PublicKey,
-	layer int,
-) (*MixServer, error) {
+// NewMixServer creates a mix server with the identity and the settings defined in its config.
+func NewMixServer(cfg *mixConfig.Config) (*MixServer, error) {
+	baseLogger, err := logger.New(cfg.Logging.File, cfg.Logging.Level, cfg.Logging.Disable)
+	if err != nil {
+		return nil, err
+	}
 
-	baseLogger, err := logger.New(defaultLogFileLocation, defaultLogLevel, false)
+	prvKey := new(sphinx.PrivateKey)
+	pubKey := new(sphinx.PublicKey)
+	if err := helpers.FromPEMFile(prvKey, cfg.Mixnode.PrivateKeyFile(), constants.PrivateKeyPEMType); err != nil {
+		return nil, fmt.Errorf("Failed to load the private key: %v", err)
+	}
+
+	if err := helpers.FromPEMFile(pubKey, cfg.Mixnode.PublicKeyFile(), constants.PublicKeyPEMType); err != nil {
+		return nil, fmt.Errorf("Failed to load the public key: %v", err)
+	}
+
+	host, port, err := net.SplitHostPort(cfg.Mixnode.AnnounceAddress)
 	if err != nil {
 		return nil, err
 	}
 
+	id := cfg.Mixnode.ID
 	log := baseLogger.GetLogger(id)
+	log.Infof("Logging level set to %v", cfg.Logging.Level)
+	log.Infof("Mixing strategy set to %v", cfg.Mixing.Strategy)
 
 	mix := node.NewMix(prvKey, pubKey)
 	mixServer := MixServer{id: id,
-		host:     host,
-		port:     port,
-		Mix:      mix,
-		layer:    layer,
-		metrics:  newMetrics(baseLogger.GetLogger("metrics "+id), pubKey, net.JoinHostPort(host, port)),
-		haltedCh: make(chan struct{}),
-		log:      log,
+		host:      host,
+		port:      port,
+		Mix:       mix,
+		layer:     cfg.Mixnode.Layer,
+		cfg:       cfg,
+		metrics:   newMetrics(baseLogger.GetLogger("metrics "+id), pubKey, cfg.Mixnode.DirectoryServerMetricsEndpoint),
+		haltingCh: make(chan struct{}),
+		haltedCh:  make(chan struct{}),
+		log:       log,
+		pool:      networker.NewConnectionPool(networker.DefaultIdleTimeout, mix.GetKeyPair),
+		loops:     newLoopMonitor(cfg.Debug.LoopReturnTimeout(), cfg.Debug.LoopReturnAlertThreshold),
+
+		topologyRefreshCh: make(chan struct{}, 1),
+	}
+	if err := mixServer.SetMixStrategy(cfg.Mixing, cfg.Debug.DelayQueueWorkers, cfg.Debug.MaxInFlightPackets); err != nil {
+		return nil, err
+	}
+	if err := mixServer.SetLoadLimits(cfg.Debug); err != nil {
+		return nil, err
+	}
+	if err := mixServer.EnableReplayCachePersistence(cfg.Mixnode.ReplayCacheFile()); err != nil {
+		return nil, err
 	}
+	mixServer.registerMetrics()
 	mixServer.config = config.MixConfig{Id: mixServer.id,
 		Host:   mixServer.host,
 		Port:   mixServer.port,
 		PubKey: mixServer.GetPublicKey().Bytes(),
 	}
 
-	if err := helpers.RegisterMixNodePresence(mixServer.GetPublicKey(),
-		layer,
-		net.JoinHostPort(host, port),
+	if err := helpers.RegisterMixNodePresenceAt(cfg.Mixnode.DirectoryServerPresenceEndpoint,
+		mixServer.GetPublicKey(),
+		mixServer.layer,
+		cfg.Mixnode.AnnounceAddress,
 	); err != nil {
 		return nil, err
 	}
 
-	listener, err := net.Listen("tcp", net.JoinHostPort(host, port))
+	listener, err := net.Listen("tcp", cfg.Mixnode.ListenAddress)
 	if err != nil {
 		return nil, err
 	}
@@ -357,15 +696,28 @@ func CreateTestMixnode() (*MixServer, error) {
 	if err != nil {
 		return nil, err
 	}
-	baseDisabledLogger, err := logger.New(defaultLogFileLocation, defaultLogLevel, true)
+	baseDisabledLogger, err := logger.New("", "info", true)
 	if err != nil {
 		return nil, err
 	}
 	// this logger can be shared as it will be disabled anyway
 	disabledLog := baseDisabledLogger.GetLogger("test")
 
-	node := node.NewMix(priv, pub)
-	mix := MixServer{host: "localhost", port: "9995", Mix: node, log: disabledLog}
+	debugCfg := mixConfig.DefaultDebugConfig()
+	mix := MixServer{host: "localhost",
+		port:    "9995",
+		Mix:     node.NewMix(priv, pub),
+		log:     disabledLog,
+		metrics: newMetrics(disabledLog, pub, ""),
+		loops:   newLoopMonitor(debugCfg.LoopReturnTimeout(), debugCfg.LoopReturnAlertThreshold),
+
+		haltingCh: make(chan struct{}),
+		haltedCh:  make(chan struct{}),
+	}
+	if err := mix.SetLoadLimits(debugCfg); err != nil {
+		return nil, err
+	}
+	mix.registerMetrics()
 	mix.config = config.MixConfig{Id: mix.id,
 		Host:   mix.host,
 		Port:   mix.port,
@@ -13,3 +13,112 @@
 // limitations under the License.
 
 package mixnode
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/nymtech/nym-mixnet/config"
+	"github.com/nymtech/nym-mixnet/networker"
+	"github.com/nymtech/nym-mixnet/node"
+	mixConfig "github.com/nymtech/nym-mixnet/server/mixnode/config"
+	"github.com/nymtech/nym-mixnet/sphinx"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMixServer_RateLimit(t *testing.T) {
+	mix, err := CreateTestMixnode()
+	assert.Nil(t, err)
+	defer mix.listener.Close()
+
+	debugCfg := mixConfig.DefaultDebugConfig()
+	debugCfg.PeerPacketRate = 0.001
+	debugCfg.PeerPacketBurst = 1
+	assert.Nil(t, mix.SetLoadLimits(debugCfg))
+
+	clientConn, serverConn := net.Pipe()
+	done := make(chan error)
+	go func() { done <- mix.handleConnection(serverConn) }()
+
+	priv, pub, err := sphinx.GenerateKeyPair()
+	assert.Nil(t, err)
+	link, err := networker.ConnectLink(clientConn, networker.StaticLinkKeys(priv, pub), mix.GetPublicKey().Bytes())
+	assert.Nil(t, err)
+
+	// the packets with unknown flags are dropped by the mix without closing the connection
+	packet, err := proto.Marshal(&config.GeneralPacket{Flag: []byte{0xff}})
+	assert.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, link.WriteFrame(packet))
+	}
+	clientConn.Close()
+	assert.Nil(t, <-done)
+
+	assert.Equal(t, uint64(2), mix.packetMetrics.Dropped.WithLabel(node.DropReasonRateLimited).Value())
+	assert.Equal(t, 1, mix.rateLimiter.Peers())
+}
+
+func TestMixServer_ConnectionLimit(t *testing.T) {
+	mix, err := CreateTestMixnode()
+	assert.Nil(t, err)
+	defer mix.listener.Close()
+
+	debugCfg := mixConfig.DefaultDebugConfig()
+	debugCfg.MaxConnections = 1
+	assert.Nil(t, mix.SetLoadLimits(debugCfg))
+
+	firstClient, firstServer := net.Pipe()
+	defer firstClient.Close()
+	mix.acceptConnection(firstServer)
+
+	secondClient, secondServer := net.Pipe()
+	defer secondClient.Close()
+	mix.acceptConnection(secondServer)
+	assert.Equal(t, uint64(1), mix.connectionsRejected.Value())
+
+	// the rejected connection is closed right away
+	_, err = secondClient.Write([]byte{0})
+	assert.Error(t, err)
+
+	// once the first connection is closed, new connections are accepted again
+	firstClient.Close()
+	for i := 0; len(mix.connSlots) > 0 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	thirdClient, thirdServer := net.Pipe()
+	defer thirdClient.Close()
+	mix.acceptConnection(thirdServer)
+	assert.Equal(t, uint64(1), mix.connectionsRejected.Value())
+}
+
+func TestMixServer_Shutdown(t *testing.T) {
+	mix, err := CreateTestMixnode()
+	assert.Nil(t, err)
+
+	mix.cfg = &mixConfig.Config{Debug: mixConfig.DefaultDebugConfig()}
+	mix.pool = networker.NewConnectionPool(networker.DefaultIdleTimeout, mix.GetKeyPair)
+	assert.Nil(t, mix.SetMixStrategy(mixConfig.DefaultMixingConfig(), 1, 10))
+	mix.strategy.Start()
+	assert.Nil(t, mix.strategy.Push(&node.PacketProcessingResult{}))
+
+	listening := make(chan struct{})
+	go func() {
+		mix.listenForIncomingConnections()
+		close(listening)
+	}()
+
+	mix.Shutdown()
+	mix.Wait()
+	select {
+	case <-listening:
+	case <-time.After(time.Second):
+		t.Fatal("mix kept listening after the shutdown")
+	}
+
+	// the packet held by the mix was released before the shutdown finished
+	assert.Equal(t, 0, mix.strategy.Stats().InFlight)
+	assert.Equal(t, uint64(1), mix.packetMetrics.Dropped.WithLabel(node.DropReasonUnexpectedFlag).Value())
+	assert.Equal(t, node.ErrDelayQueueStopped, mix.strategy.Push(&node.PacketProcessingResult{}))
+}
@@ -0,0 +1,187 @@
+// Copyright 2019 The Nym Mixnet Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mixnode
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/nymtech/nym-mixnet/config"
+	"github.com/nymtech/nym-mixnet/helpers/topology"
+	"github.com/nymtech/nym-mixnet/sphinx"
+)
+
+const (
+	// minimumTopologyRefreshInterval is the shortest time between two refreshes of the topology
+	// requested because of a packet sent from or to a node the mix did not know about.
+	minimumTopologyRefreshInterval = 5 * time.Second
+)
+
+// senderKind describes the place in the topology of the node which sent the packet to the mix.
+type senderKind int
+
+const (
+	// senderUnknown is a node which is not supposed to send any packets to the mix.
+	senderUnknown senderKind = iota
+	// senderPreviousLayer is a mix of the previous layer or, for the mixes of the first layer, a provider.
+	senderPreviousLayer
+	// senderLastLayer is a mix of the last layer, which can only return the loop packets of the mix.
+	senderLastLayer
+)
+
+// UpdateNetworkView obtains the current network topology from the directory server and replaces
+// the view of the mix with the mixes and the providers it contains.
+func (m *MixServer) UpdateNetworkView() error {
+	networkTopology, err := topology.GetNetworkTopology(m.cfg.Mixnode.DirectoryServerTopologyEndpoint)
+	if err != nil {
+		return fmt.Errorf("error in UpdateNetworkView - obtaining topology failed: %v", err)
+	}
+	mixes, err := topology.GetMixesPKI(networkTopology.MixNodes, networkTopology.PacketVersions)
+	if err != nil {
+		return fmt.Errorf("error in UpdateNetworkView - reading mixes failed: %v", err)
+	}
+	providers := make([]config.MixConfig, 0, len(networkTopology.MixProviderNodes))
+	for _, presence := range networkTopology.MixProviderNodes {
+		provider, err := topology.ProviderPresenceToConfig(presence, networkTopology.PacketVersions)
+		if err != nil {
+			continue
+		}
+		providers = append(providers, provider)
+	}
+	m.setNetwork(mixes, providers)
+	return nil
+}
+
+func (m *MixServer) setNetwork(mixes topology.LayeredMixes, providers []config.MixConfig) {
+	m.topologyMu.Lock()
+	defer m.topologyMu.Unlock()
+	m.mixes = mixes
+	m.providers = providers
+	m.topologyUpdated = time.Now()
+}
+
+// requestTopologyRefresh asks for refreshing the topology before the next regular refresh.
+func (m *MixServer) requestTopologyRefresh() {
+	select {
+	case m.topologyRefreshCh <- struct{}{}:
+	default:
+	}
+}
+
+func (m *MixServer) startRefreshingTopology() {
+	ticker := time.NewTicker(m.cfg.Debug.TopologyRefreshingInterval())
+	for {
+		select {
+		case <-ticker.C:
+		case <-m.topologyRefreshCh:
+			m.topologyMu.RLock()
+			updated := m.topologyUpdated
+			m.topologyMu.RUnlock()
+			if time.Since(updated) < minimumTopologyRefreshInterval {
+				continue
+			}
+		case <-m.haltedCh:
+			return
+		}
+		if err := m.UpdateNetworkView(); err != nil {
+			m.log.Errorf("Failed to refresh network topology: %v", err)
+		}
+	}
+}
+
+// hasTopology checks whether the topology was obtained from the directory server at least once.
+func (m *MixServer) hasTopology() bool {
+	m.topologyMu.RLock()
+	defer m.topologyMu.RUnlock()
+	return !m.topologyUpdated.IsZero()
+}
+
+// inLastLayer checks whether there are no layers after the layer of the mix in the topology.
+func (m *MixServer) inLastLayer() bool {
+	m.topologyMu.RLock()
+	defer m.topologyMu.RUnlock()
+	return lastLayer(m.mixes, m.layer) == uint(m.layer)
+}
+
+// lastLayer returns the last layer of the mixnet, given the mixes in the topology and the layer of the mix,
+// which might not be in the topology yet.
+func lastLayer(mixes topology.LayeredMixes, layer int) uint {
+	last := uint(layer)
+	for l := range mixes {
+		if l > last {
+			last = l
+		}
+	}
+	return last
+}
+
+// containsNode checks whether any of the nodes has the given public key and, unless it is empty, the given address.
+func containsNode(nodes []config.MixConfig, address string, pubKey []byte) bool {
+	for _, n := range nodes {
+		if bytes.Equal(n.PubKey, pubKey) && (len(address) == 0 || n.Host+":"+n.Port == address) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSender finds the place in the topology of the node which authenticated its link with the given key.
+// The mixes accept the packets only from the previous layer, or from the providers if they are in the first layer,
+// and the loop packets, sent by the mix itself, from the last layer.
+func (m *MixServer) checkSender(pubKey []byte) senderKind {
+	m.topologyMu.RLock()
+	defer m.topologyMu.RUnlock()
+
+	previousLayer := m.providers
+	if m.layer > 1 {
+		previousLayer = m.mixes[uint(m.layer-1)]
+	}
+	if containsNode(previousLayer, "", pubKey) {
+		return senderPreviousLayer
+	}
+
+	last := lastLayer(m.mixes, m.layer)
+	if last > uint(m.layer) && containsNode(m.mixes[last], "", pubKey) {
+		return senderLastLayer
+	}
+	return senderUnknown
+}
+
+// checkNextHop checks whether the mix is allowed to forward the packet with the given routing commands
+// to the given hop. Both the address and the public key of the hop have to belong to a mix of the next layer or,
+// if the mix is in the last layer, to a provider. Since the mixes route their loop packets back to themselves,
+// the mixes of the last layer can forward the packets marked as loops also to the mixes of the other layers.
+func (m *MixServer) checkNextHop(hop sphinx.Hop, commands *sphinx.Commands) bool {
+	m.topologyMu.RLock()
+	defer m.topologyMu.RUnlock()
+
+	if uint(m.layer) < lastLayer(m.mixes, m.layer) {
+		return containsNode(m.mixes[uint(m.layer+1)], hop.Address, hop.PubKey)
+	}
+
+	if containsNode(m.providers, hop.Address, hop.PubKey) {
+		return true
+	}
+	if !commands.Loop() {
+		return false
+	}
+	for layer, mixes := range m.mixes {
+		if layer < uint(m.layer) && containsNode(mixes, hop.Address, hop.PubKey) {
+			return true
+		}
+	}
+	return false
+}
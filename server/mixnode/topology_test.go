@@ -0,0 +1,159 @@
+// Copyright 2019 The Nym Mixnet Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mixnode
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/nymtech/nym-mixnet/config"
+	"github.com/nymtech/nym-mixnet/flags"
+	"github.com/nymtech/nym-mixnet/helpers/topology"
+	"github.com/nymtech/nym-mixnet/node"
+	mixConfig "github.com/nymtech/nym-mixnet/server/mixnode/config"
+	"github.com/nymtech/nym-mixnet/sphinx"
+	"github.com/stretchr/testify/assert"
+)
+
+// createTestNetwork returns a topology of two mixes in each of three layers and a single provider.
+func createTestNetwork(t *testing.T) (topology.LayeredMixes, []config.MixConfig) {
+	mixes := make(topology.LayeredMixes)
+	for layer := uint(1); layer <= 3; layer++ {
+		for i := 0; i < 2; i++ {
+			_, pub, err := sphinx.GenerateKeyPair()
+			assert.Nil(t, err)
+			mixes[layer] = append(mixes[layer],
+				config.NewMixConfig("mix", "10.0.0.1", fmt.Sprintf("17%v%v", layer, i), pub.Bytes(), layer),
+			)
+		}
+	}
+	_, pub, err := sphinx.GenerateKeyPair()
+	assert.Nil(t, err)
+	providers := []config.MixConfig{config.NewMixConfig("provider", "10.0.0.2", "1789", pub.Bytes(), config.ProviderLayer)}
+	return mixes, providers
+}
+
+func hopTo(node config.MixConfig) sphinx.Hop {
+	return sphinx.Hop{Address: node.Host + ":" + node.Port, PubKey: node.PubKey}
+}
+
+func TestMixServer_CheckSender(t *testing.T) {
+	mix, err := CreateTestMixnode()
+	assert.Nil(t, err)
+	defer mix.listener.Close()
+	mixes, providers := createTestNetwork(t)
+	mix.setNetwork(mixes, providers)
+
+	mix.layer = 1
+	assert.Equal(t, senderPreviousLayer, mix.checkSender(providers[0].PubKey))
+	assert.Equal(t, senderUnknown, mix.checkSender(mixes[1][1].PubKey))
+	assert.Equal(t, senderLastLayer, mix.checkSender(mixes[3][0].PubKey))
+
+	mix.layer = 2
+	assert.Equal(t, senderPreviousLayer, mix.checkSender(mixes[1][1].PubKey))
+	assert.Equal(t, senderUnknown, mix.checkSender(providers[0].PubKey))
+	assert.Equal(t, senderLastLayer, mix.checkSender(mixes[3][1].PubKey))
+	assert.Equal(t, senderUnknown, mix.checkSender([]byte("unknown")))
+
+	mix.layer = 3
+	assert.Equal(t, senderPreviousLayer, mix.checkSender(mixes[2][0].PubKey))
+	assert.Equal(t, senderUnknown, mix.checkSender(mixes[3][0].PubKey))
+}
+
+func TestMixServer_CheckNextHop(t *testing.T) {
+	mix, err := CreateTestMixnode()
+	assert.Nil(t, err)
+	defer mix.listener.Close()
+	mixes, providers := createTestNetwork(t)
+	mix.setNetwork(mixes, providers)
+
+	relay := &sphinx.Commands{Flag: flags.RelayFlag.Bytes()}
+	loop := &sphinx.Commands{Flag: flags.RelayFlag.Bytes(), HopCommands: []*sphinx.HopCommand{sphinx.NewLoopCommand()}}
+	relayTo := func(node config.MixConfig) (sphinx.Hop, *sphinx.Commands) {
+		return hopTo(node), relay
+	}
+
+	mix.layer = 1
+	assert.True(t, mix.checkNextHop(relayTo(mixes[2][1])))
+	assert.False(t, mix.checkNextHop(relayTo(mixes[3][0])))
+	assert.False(t, mix.checkNextHop(relayTo(providers[0])))
+
+	// both the address and the key have to match the same node
+	hop := hopTo(mixes[2][0])
+	hop.Address = "192.168.0.1:1789"
+	assert.False(t, mix.checkNextHop(hop, relay))
+	hop = hopTo(mixes[2][0])
+	hop.PubKey = mixes[2][1].PubKey
+	assert.False(t, mix.checkNextHop(hop, relay))
+
+	mix.layer = 3
+	assert.True(t, mix.checkNextHop(relayTo(providers[0])))
+	// only the loop packets return to the mixes of the other layers, which sent them
+	assert.False(t, mix.checkNextHop(relayTo(mixes[1][0])))
+	assert.True(t, mix.checkNextHop(hopTo(mixes[1][0]), loop))
+	assert.False(t, mix.checkNextHop(hopTo(mixes[3][1]), loop))
+	assert.False(t, mix.checkNextHop(sphinx.Hop{Address: "example.com:80", PubKey: providers[0].PubKey}, relay))
+}
+
+func TestMixServer_DropsPacketsFromUnknownSenders(t *testing.T) {
+	mix, err := CreateTestMixnode()
+	assert.Nil(t, err)
+	defer mix.listener.Close()
+	mixes, providers := createTestNetwork(t)
+	mix.setNetwork(mixes, providers)
+	mix.layer = 2
+
+	assert.Nil(t, mix.receivedPacket([]byte("unknown"), make([]byte, sphinx.PacketSize)))
+	assert.Equal(t, uint64(1), mix.packetMetrics.Dropped.WithLabel(node.DropReasonUnexpectedSender).Value())
+	assert.Equal(t, uint64(0), mix.packetMetrics.Dropped.WithLabel(node.DropReasonInvalid).Value())
+}
+
+func TestMixServer_DropsPacketsFromLastLayerToLowerLayers(t *testing.T) {
+	mix, err := CreateTestMixnode()
+	assert.Nil(t, err)
+	defer mix.listener.Close()
+	assert.Nil(t, mix.SetMixStrategy(mixConfig.DefaultMixingConfig(), 1, 10))
+	mixes, providers := createTestNetwork(t)
+	mix.layer = 3
+	self := mix.config
+	self.PacketVersions = sphinx.SupportedPacketVersions()
+	mixes[3][0] = self
+	mix.setNetwork(mixes, providers)
+
+	target := mixes[1][0]
+	target.PacketVersions = sphinx.SupportedPacketVersions()
+	path := config.E2EPath{IngressProvider: self, EgressProvider: target}
+	delays := []float64{0, 0}
+
+	packet, err := sphinx.PackForwardMessage(path, delays, []byte("Message"))
+	assert.Nil(t, err)
+	packetBytes, err := sphinx.EncodePacket(&packet)
+	assert.Nil(t, err)
+
+	// the packet sent from the last layer back to the first one is not a loop, so it is dropped
+	assert.Nil(t, mix.receivedPacket(mixes[2][0].PubKey, packetBytes))
+	assert.Equal(t, uint64(1), mix.packetMetrics.Dropped.WithLabel(node.DropReasonUnexpectedNextHop).Value())
+	assert.Equal(t, 0, mix.strategy.Stats().Queued)
+
+	hopCommands := [][]*sphinx.HopCommand{{sphinx.NewLoopCommand()}, nil}
+	packet, err = sphinx.PackForwardMessageWithCommands(path, delays, hopCommands, []byte("Message"))
+	assert.Nil(t, err)
+	packetBytes, err = sphinx.EncodePacket(&packet)
+	assert.Nil(t, err)
+
+	assert.Nil(t, mix.receivedPacket(mixes[2][0].PubKey, packetBytes))
+	assert.Equal(t, uint64(1), mix.packetMetrics.Dropped.WithLabel(node.DropReasonUnexpectedNextHop).Value())
+	assert.Equal(t, 1, mix.strategy.Stats().Queued)
+}
@@ -19,21 +19,32 @@ package provider
 import (
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"os"
 	"time"
 
 	"github.com/golang/protobuf/proto"
+	"github.com/nymtech/nym-mixnet/clientcore"
 	"github.com/nymtech/nym-mixnet/config"
 	"github.com/nymtech/nym-mixnet/flags"
 	"github.com/nymtech/nym-mixnet/helpers"
+	"github.com/nymtech/nym-mixnet/networker"
+	"github.com/nymtech/nym-mixnet/node"
+	"github.com/nymtech/nym-mixnet/sphinx"
 )
 
 const (
 	summaryFileName = "benchProviderSummary"
 )
 
+// benchmarkRecipientPrivateKey is the private key of the recipient of the benchmark messages,
+// which allows to read their end-to-end encrypted content. It corresponds to the public key
+// of the recipient used by the benchmark client.
+var benchmarkRecipientPrivateKey = sphinx.BytesToPrivateKey([]byte{97, 63, 189, 80, 88, 107, 161, 173, 45, 7, 43, 5,
+	202, 160, 204, 115, 132, 61, 228, 185, 43, 186, 254, 1, 242, 33, 165, 218, 228, 113, 110, 14})
+
 type timestampedMessage struct {
 	content   string
 	timestamp time.Time
@@ -48,17 +59,18 @@ type BenchProvider struct {
 }
 
 func (p *BenchProvider) startSendingPresence() {
-	ticker := time.NewTicker(presenceInterval)
+	ticker := time.NewTicker(p.cfg.Debug.PresenceSendingInterval())
 	for {
 		select {
 		case <-ticker.C:
-			if err := helpers.RegisterMixProviderPresence(p.GetPublicKey(),
+			if err := helpers.RegisterMixProviderPresenceAt(p.cfg.Provider.DirectoryServerPresenceEndpoint,
+				p.GetPublicKey(),
 				p.convertRecordsToModelData(),
-				net.JoinHostPort(p.host, p.port),
+				p.cfg.Provider.AnnounceAddress,
 			); err != nil {
 				p.log.Errorf("Failed to register presence: %v", err)
 			}
-		case <-p.haltedCh:
+		case <-p.haltingCh:
 			return
 		}
 	}
@@ -80,7 +92,7 @@ func (p *BenchProvider) run() {
 	defer p.listener.Close()
 
 	go func() {
-		p.log.Infof("Listening on %s", p.host+":"+p.port)
+		p.log.Infof("Listening on %s", p.listener.Addr())
 		p.listenForIncomingConnections()
 	}()
 	go p.startSendingPresence()
@@ -135,10 +147,29 @@ func (p *BenchProvider) receivedPacket(packet []byte) error {
 	if err := res.Err(); err != nil {
 		return err
 	}
+	// the benchmark measures the delivery as experienced by the clients, including the final delay
+	time.Sleep(res.Delay())
 
 	if flag == flags.LastHopFlag {
 		if nextHop.Id == "BenchmarkClientRecipient" {
-			msgContent := string(dePacket[38:])
+			sphinxPacket, err := sphinx.DecodePacket(dePacket)
+			if err != nil {
+				return err
+			}
+			envelope, _, err := sphinx.UnpackForwardMessage(sphinxPacket.Pld)
+			if err != nil {
+				return err
+			}
+			msg, err := sphinx.OpenMessage(benchmarkRecipientPrivateKey, envelope)
+			if err != nil {
+				return err
+			}
+			// benchmark messages are short enough to always fit into a single fragment
+			fragment, err := clientcore.ParseFragment(msg)
+			if err != nil {
+				return err
+			}
+			msgContent := string(fragment.Data)
 			p.receivedMessages = append(p.receivedMessages, timestampedMessage{timestamp: time.Now(), content: msgContent})
 			p.receivedMessagesCount++
 			if p.receivedMessagesCount == p.numMessages {
@@ -160,6 +191,12 @@ func (p *BenchProvider) listenForIncomingConnections() {
 	for {
 		conn, err := p.listener.Accept()
 		if err != nil {
+			select {
+			case <-p.haltingCh:
+				// the listener was closed on shutdown
+				return
+			default:
+			}
 			if e, ok := err.(net.Error); ok && !e.Temporary() {
 				p.log.Panicf("Critical accept failure: %v", err)
 				return
@@ -182,24 +219,40 @@ func (p *BenchProvider) handleConnection(conn net.Conn) {
 		}
 	}()
 
-	buff := make([]byte, 1024)
-	reqLen, err := conn.Read(buff)
+	link, err := networker.AcceptLink(conn, p.GetKeyPair)
 	if err != nil {
-		p.log.Errorf("Error while reading from the connection: %v", err)
+		p.log.Errorf("Error while establishing the link: %v", err)
 		return
 	}
+	for {
+		packetBytes, err := link.ReadFrame(node.MaxPacketFrameSize)
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			p.log.Errorf("Error while reading from the connection: %v", err)
+			return
+		}
+		p.handlePacket(packetBytes)
+	}
+}
 
+// handlePacket checks the flag of the received packet and processes it in a separate goroutine,
+// so that the delays of the packets received over the same connection do not add up.
+func (p *BenchProvider) handlePacket(packetBytes []byte) {
 	var packet config.GeneralPacket
-	if err = proto.Unmarshal(buff[:reqLen], &packet); err != nil {
+	if err := proto.Unmarshal(packetBytes, &packet); err != nil {
 		p.log.Errorf("Error while unmarshalling received packet: %v", err)
 		return
 	}
 
 	switch flags.PacketTypeFlagFromBytes(packet.Flag) {
 	case flags.CommFlag:
-		if err := p.receivedPacket(packet.Data); err != nil {
-			panic(err)
-		}
+		go func(data []byte) {
+			if err := p.receivedPacket(data); err != nil {
+				panic(err)
+			}
+		}(packet.Data)
 
 	default:
 		fmt.Fprintf(os.Stderr, "%v", string(packet.Data))
@@ -0,0 +1,392 @@
+// Copyright 2019 The Nym Mixnet Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	mainConfig "github.com/nymtech/nym-mixnet/config"
+	"github.com/nymtech/nym-mixnet/node"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultNymDirectory          = ".nym"
+	defaultNymProvidersDirectory = "providers"
+	defaultConfigDirectory       = "config"
+	defaultConfigFileName        = "config.toml"
+
+	defaultLogLevel = "info"
+
+	defaultPrivateKeyFileName  = "private_key.pem"
+	defaultPublicKeyFileName   = "public_key.pem"
+	defaultReplayCacheFileName = "replay_cache.dat"
+	defaultInboxesDirectory    = "inboxes"
+
+	// DefaultListenPort is the port on which the provider listens, unless specified otherwise.
+	DefaultListenPort = mainConfig.DefaultRemotePort
+
+	defaultMaxInboxMessages = 1000
+	// defaultMessageRetention is expressed in hours
+	defaultMessageRetention = 7 * 24
+
+	defaultPresenceInterval = 2000
+	defaultShutdownTimeout  = 10000
+
+	defaultDirectoryServerPresenceEndpoint      = mainConfig.DirectoryServerMixProviderPresenceURL
+	DefaultLocalDirectoryServerPresenceEndpoint = mainConfig.LocalDirectoryServerMixProviderPresenceURL
+)
+
+//nolint: gochecknoglobals
+var (
+	defaultHomeDirectory   = os.ExpandEnv(filepath.Join("$HOME", defaultNymDirectory, defaultNymProvidersDirectory))
+	defaultPrivateKeyPath  = filepath.Join(defaultConfigDirectory, defaultPrivateKeyFileName)
+	defaultPublicKeyPath   = filepath.Join(defaultConfigDirectory, defaultPublicKeyFileName)
+	defaultReplayCachePath = defaultReplayCacheFileName
+	defaultInboxesPath     = defaultInboxesDirectory
+)
+
+// DefaultConfigPath returns absolute path to the default configuration file of the particular provider.
+// The returned path should be $HOME/.nym/providers/providerID/config/config.toml
+func DefaultConfigPath(providerID string) (string, error) {
+	if len(providerID) == 0 {
+		return "", errors.New("invalid providerID provided")
+	}
+	return filepath.Join(
+		defaultHomeDirectory,
+		providerID,
+		defaultConfigDirectory,
+		defaultConfigFileName,
+	), nil
+}
+
+// Provider is the Nym Provider configuration.
+type Provider struct {
+	// HomeDirectory specifies absolute path to the home nym Providers directory.
+	// It is expected to use default value and hence .toml file should not redefine this field.
+	HomeDirectory string `toml:"nym_home_directory"`
+
+	// ID specifies the human readable ID of this particular provider.
+	ID string `toml:"id"`
+
+	// ListenAddress specifies the address, in the form of host:port, on which the provider listens
+	// for packets and client requests.
+	ListenAddress string `toml:"listen_address"`
+
+	// AnnounceAddress specifies the address, in the form of host:port, which the provider publishes
+	// in the directory server for other nodes and clients to connect to. If omitted, ListenAddress is used instead.
+	AnnounceAddress string `toml:"announce_address"`
+
+	// DirectoryServerPresenceEndpoint specifies URL to the provider presence endpoint of the directory server.
+	DirectoryServerPresenceEndpoint string `toml:"directory_server_presence"`
+
+	// PrivateKey specifies path to file containing private key.
+	PrivateKey string `toml:"priv_key_file"`
+
+	// PublicKey specifies path to file containing public key.
+	PublicKey string `toml:"pub_key_file"`
+
+	// ReplayCache specifies path to file in which the tags of the processed packets are persisted.
+	ReplayCache string `toml:"replay_cache_file"`
+
+	// Inboxes specifies path to directory in which the messages of the registered clients are stored.
+	Inboxes string `toml:"inboxes_dir"`
+
+	// MaxInboxMessages defines the maximum number of messages stored for a single client.
+	// Messages arriving at a full inbox are dropped.
+	MaxInboxMessages int `toml:"max_inbox_messages"`
+
+	// MessageRetention defines for how many hours the messages are kept in the inboxes
+	// before being removed, if not pulled by the clients.
+	MessageRetention int `toml:"message_retention"`
+
+	// MetricsAddress specifies the address, in the form of host:port, on which the metrics of the provider
+	// are served over HTTP in the Prometheus text format. If omitted, the metrics are not served.
+	MetricsAddress string `toml:"metrics_address"`
+}
+
+// DefaultProviderConfig returns default Provider config for provided providerID and listen address.
+func DefaultProviderConfig(providerID string, listenAddress string) (*Provider, error) {
+	if len(providerID) == 0 {
+		return nil, errors.New("invalid providerID provided")
+	}
+	// Even though defaults could be obtained by validating empty struct, lets be explicit about it.
+	return &Provider{
+		HomeDirectory:                   defaultHomeDirectory,
+		ID:                              providerID,
+		ListenAddress:                   listenAddress,
+		AnnounceAddress:                 listenAddress,
+		DirectoryServerPresenceEndpoint: defaultDirectoryServerPresenceEndpoint,
+		PrivateKey:                      defaultPrivateKeyPath,
+		PublicKey:                       defaultPublicKeyPath,
+		ReplayCache:                     defaultReplayCachePath,
+		Inboxes:                         defaultInboxesPath,
+		MaxInboxMessages:                defaultMaxInboxMessages,
+		MessageRetention:                defaultMessageRetention,
+	}, nil
+}
+
+func (cfg *Provider) Home() string {
+	return filepath.Join(cfg.HomeDirectory, cfg.ID)
+}
+
+// PrivateKeyFile returns the full path to the private key file.
+func (cfg *Provider) PrivateKeyFile() string {
+	return rootify(cfg.PrivateKey, cfg.Home())
+}
+
+// PublicKeyFile returns the full path to the public key file.
+func (cfg *Provider) PublicKeyFile() string {
+	return rootify(cfg.PublicKey, cfg.Home())
+}
+
+// ReplayCacheFile returns the full path to the replay cache file.
+func (cfg *Provider) ReplayCacheFile() string {
+	return rootify(cfg.ReplayCache, cfg.Home())
+}
+
+// InboxesDir returns the full path to the directory of the client inboxes.
+func (cfg *Provider) InboxesDir() string {
+	return rootify(cfg.Inboxes, cfg.Home())
+}
+
+// MessageRetentionPeriod returns for how long the messages are kept in the inboxes.
+func (cfg *Provider) MessageRetentionPeriod() time.Duration {
+	return time.Duration(cfg.MessageRetention) * time.Hour
+}
+
+func (cfg *Provider) validateAndApplyDefaults() error {
+	// if custom home directory is specified it must have an absolute path
+	if len(cfg.HomeDirectory) > 0 {
+		if !filepath.IsAbs(cfg.HomeDirectory) {
+			return errors.New("config: specified home directory is not an absolute path")
+		}
+	} else {
+		cfg.HomeDirectory = defaultHomeDirectory
+	}
+
+	// it is also required to specify ID otherwise we could not distinguish between multiple instances
+	if len(cfg.ID) == 0 {
+		return errors.New("config: provider ID was not specified")
+	}
+
+	if _, _, err := net.SplitHostPort(cfg.ListenAddress); err != nil {
+		return fmt.Errorf("config: invalid listen address: %s (%v)", cfg.ListenAddress, err)
+	}
+
+	if len(cfg.AnnounceAddress) == 0 {
+		cfg.AnnounceAddress = cfg.ListenAddress
+	}
+	if _, _, err := net.SplitHostPort(cfg.AnnounceAddress); err != nil {
+		return fmt.Errorf("config: invalid announce address: %s (%v)", cfg.AnnounceAddress, err)
+	}
+
+	if len(cfg.MetricsAddress) > 0 {
+		if _, _, err := net.SplitHostPort(cfg.MetricsAddress); err != nil {
+			return fmt.Errorf("config: invalid metrics address: %s (%v)", cfg.MetricsAddress, err)
+		}
+	}
+
+	if cfg.MaxInboxMessages < 0 {
+		return fmt.Errorf("config: invalid maximum number of inbox messages: %v", cfg.MaxInboxMessages)
+	}
+
+	if cfg.MessageRetention < 0 {
+		return fmt.Errorf("config: invalid message retention: %v", cfg.MessageRetention)
+	}
+
+	// for the rest, if left unspecified, use defaults
+	if len(cfg.DirectoryServerPresenceEndpoint) == 0 {
+		cfg.DirectoryServerPresenceEndpoint = defaultDirectoryServerPresenceEndpoint
+	}
+
+	if len(cfg.PrivateKey) == 0 {
+		cfg.PrivateKey = defaultPrivateKeyPath
+	}
+
+	if len(cfg.PublicKey) == 0 {
+		cfg.PublicKey = defaultPublicKeyPath
+	}
+
+	if len(cfg.ReplayCache) == 0 {
+		cfg.ReplayCache = defaultReplayCachePath
+	}
+
+	if len(cfg.Inboxes) == 0 {
+		cfg.Inboxes = defaultInboxesPath
+	}
+
+	if cfg.MaxInboxMessages == 0 {
+		cfg.MaxInboxMessages = defaultMaxInboxMessages
+	}
+
+	if cfg.MessageRetention == 0 {
+		cfg.MessageRetention = defaultMessageRetention
+	}
+
+	return nil
+}
+
+// Logging is the Nym Provider logging configuration.
+type Logging struct {
+	// Disable disables logging entirely.
+	Disable bool `toml:"disable"`
+
+	// File specifies the log file, if omitted stdout will be used.
+	File string `toml:"file"`
+
+	// Level specifies the log level.
+	Level string `toml:"level"`
+}
+
+func (cfg *Logging) validate() error {
+	_, err := logrus.ParseLevel(cfg.Level)
+	if err != nil {
+		return fmt.Errorf("config: invalid logging level: %s (%v)", cfg.Level, err)
+	}
+	return nil
+}
+
+// DefaultLoggingConfig returns default logging configuration.
+func DefaultLoggingConfig() *Logging {
+	return &Logging{
+		Disable: false,
+		File:    "",
+		Level:   defaultLogLevel,
+	}
+}
+
+// Debug is the Nym Provider debug configuration.
+type Debug struct {
+	// PresenceInterval defines how often, in milliseconds, the provider announces its presence
+	// to the directory server.
+	PresenceInterval int `toml:"presence_interval"`
+
+	// DelayQueueWorkers defines the number of workers sending the packets once their delays elapse.
+	DelayQueueWorkers int `toml:"delay_queue_workers"`
+
+	// MaxInFlightPackets defines the maximum number of delayed packets held at the same time.
+	// Packets above the limit are dropped.
+	MaxInFlightPackets int `toml:"max_in_flight_packets"`
+
+	// ShutdownTimeout defines the maximum time, in milliseconds, the provider waits on shutdown
+	// for the delayed packets to be sent further. Packets still held afterwards are dropped.
+	ShutdownTimeout int `toml:"shutdown_timeout"`
+}
+
+func (dCfg *Debug) applyDefaults() {
+	if dCfg.PresenceInterval == 0 {
+		dCfg.PresenceInterval = defaultPresenceInterval
+	}
+	if dCfg.DelayQueueWorkers == 0 {
+		dCfg.DelayQueueWorkers = node.DefaultDelayQueueWorkers
+	}
+	if dCfg.MaxInFlightPackets == 0 {
+		dCfg.MaxInFlightPackets = node.DefaultMaxInFlightPackets
+	}
+	if dCfg.ShutdownTimeout == 0 {
+		dCfg.ShutdownTimeout = defaultShutdownTimeout
+	}
+}
+
+func (dCfg *Debug) validate() error {
+	if dCfg.PresenceInterval < 0 {
+		return fmt.Errorf("config: invalid presence interval: %v", dCfg.PresenceInterval)
+	}
+	if dCfg.DelayQueueWorkers < 0 || dCfg.MaxInFlightPackets < 0 {
+		return fmt.Errorf("config: invalid delay queue limits: %v workers, %v packets in flight",
+			dCfg.DelayQueueWorkers,
+			dCfg.MaxInFlightPackets,
+		)
+	}
+	if dCfg.ShutdownTimeout < 0 {
+		return fmt.Errorf("config: invalid shutdown timeout: %v", dCfg.ShutdownTimeout)
+	}
+	return nil
+}
+
+// PresenceSendingInterval returns the interval between announcing the presence to the directory server.
+func (dCfg *Debug) PresenceSendingInterval() time.Duration {
+	return time.Duration(dCfg.PresenceInterval) * time.Millisecond
+}
+
+// DrainingTimeout returns the maximum time of waiting on shutdown for the delayed packets to be sent.
+func (dCfg *Debug) DrainingTimeout() time.Duration {
+	return time.Duration(dCfg.ShutdownTimeout) * time.Millisecond
+}
+
+// DefaultDebugConfig returns default debug configuration.
+func DefaultDebugConfig() *Debug {
+	return &Debug{
+		PresenceInterval:   defaultPresenceInterval,
+		DelayQueueWorkers:  node.DefaultDelayQueueWorkers,
+		MaxInFlightPackets: node.DefaultMaxInFlightPackets,
+		ShutdownTimeout:    defaultShutdownTimeout,
+	}
+}
+
+// Config is the top level Nym Provider configuration.
+type Config struct {
+	Provider *Provider `toml:"provider"`
+	Logging  *Logging  `toml:"logging"`
+	Debug    *Debug    `toml:"debug"`
+}
+
+// DefaultConfig returns full default config for given providerID and listen address.
+func DefaultConfig(providerID string, listenAddress string) (*Config, error) {
+	defaultProviderConfig, err := DefaultProviderConfig(providerID, listenAddress)
+	if err != nil {
+		return nil, err
+	}
+	return &Config{
+		Provider: defaultProviderConfig,
+		Logging:  DefaultLoggingConfig(),
+		Debug:    DefaultDebugConfig(),
+	}, nil
+}
+
+func (cfg *Config) validateAndApplyDefaults() error {
+	if cfg.Provider == nil {
+		return errors.New("config: No Provider block was present")
+	}
+
+	if err := cfg.Provider.validateAndApplyDefaults(); err != nil {
+		return err
+	}
+
+	if cfg.Debug == nil {
+		cfg.Debug = &Debug{}
+	}
+	cfg.Debug.applyDefaults()
+
+	if err := cfg.Debug.validate(); err != nil {
+		return err
+	}
+
+	if cfg.Logging == nil {
+		cfg.Logging = DefaultLoggingConfig()
+	}
+
+	if err := cfg.Logging.validate(); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,160 @@
+// Copyright 2019 The Nym Mixnet Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pelletier/go-toml"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testID            = "foo"
+	testListenAddress = "127.0.0.1:1789"
+)
+
+func TestDefaultConfigPathNoID(t *testing.T) {
+	configPath, err := DefaultConfigPath("")
+	assert.Len(t, configPath, 0)
+	assert.Error(t, err)
+}
+
+func TestDefaultConfigPath(t *testing.T) {
+	configPath, err := DefaultConfigPath(testID)
+	homeDir := os.ExpandEnv("$HOME")
+	assert.Equal(t, filepath.Join(homeDir, "/.nym/providers/foo/config/config.toml"), configPath)
+	assert.Nil(t, err)
+}
+
+func TestDefaultConfigNoID(t *testing.T) {
+	fullCfg, err := DefaultConfig("", testListenAddress)
+	assert.Nil(t, fullCfg)
+	assert.Error(t, err)
+
+	providerCfg, err := DefaultProviderConfig("", testListenAddress)
+	assert.Nil(t, providerCfg)
+	assert.Error(t, err)
+}
+
+func TestDefaultConfig(t *testing.T) {
+	fullCfg, err := DefaultConfig(testID, testListenAddress)
+	assert.NotNil(t, fullCfg)
+	assert.Nil(t, err)
+	assert.Equal(t, testListenAddress, fullCfg.Provider.AnnounceAddress)
+	assert.Equal(t, int64(7*24), int64(fullCfg.Provider.MessageRetentionPeriod().Hours()))
+	assert.Equal(t, int64(defaultShutdownTimeout), fullCfg.Debug.DrainingTimeout().Milliseconds())
+
+	// check that replacing homedir correctly affects locations of keys and inboxes
+	fullCfg.Provider.HomeDirectory = "/baz"
+
+	assert.Equal(t, "/baz/foo/config/private_key.pem", fullCfg.Provider.PrivateKeyFile())
+	assert.Equal(t, "/baz/foo/config/public_key.pem", fullCfg.Provider.PublicKeyFile())
+	assert.Equal(t, "/baz/foo/replay_cache.dat", fullCfg.Provider.ReplayCacheFile())
+	assert.Equal(t, "/baz/foo/inboxes", fullCfg.Provider.InboxesDir())
+
+	// However, if paths are absolute, homedir should be ignored
+	fullCfg.Provider.PrivateKey = "/some/absolute/path/priv.pem"
+	fullCfg.Provider.Inboxes = "/var/lib/inboxes"
+
+	assert.Equal(t, "/some/absolute/path/priv.pem", fullCfg.Provider.PrivateKeyFile())
+	assert.Equal(t, "/var/lib/inboxes", fullCfg.Provider.InboxesDir())
+}
+
+func TestValidateAndApplyDefaults(t *testing.T) {
+	// if we create empty structs and apply defaults to them, we should obtain results identical
+	// to just obtaining default structs
+	fullCfg, err := DefaultConfig(testID, testListenAddress)
+	assert.NotNil(t, fullCfg)
+	assert.Nil(t, err)
+
+	// We need to explicitly set the fields without defaults
+	freshFullCfg := &Config{
+		Provider: &Provider{ID: testID, ListenAddress: testListenAddress},
+	}
+
+	assert.Nil(t, freshFullCfg.validateAndApplyDefaults())
+	assert.Equal(t, fullCfg, freshFullCfg)
+
+	// No provider block
+	newCfg := &Config{}
+	assert.Error(t, newCfg.validateAndApplyDefaults())
+}
+
+func TestValidateProviderBlock(t *testing.T) {
+	invalidate := []func(cfg *Config){
+		func(cfg *Config) { cfg.Provider.HomeDirectory = "non/absolute/path" },
+		func(cfg *Config) { cfg.Provider.ID = "" },
+		func(cfg *Config) { cfg.Provider.ListenAddress = "127.0.0.1" },
+		func(cfg *Config) { cfg.Provider.AnnounceAddress = "missing.port" },
+		func(cfg *Config) { cfg.Provider.MetricsAddress = "missing.port" },
+		func(cfg *Config) { cfg.Provider.MaxInboxMessages = -1 },
+		func(cfg *Config) { cfg.Provider.MessageRetention = -1 },
+		func(cfg *Config) { cfg.Debug.DelayQueueWorkers = -1 },
+		func(cfg *Config) { cfg.Debug.ShutdownTimeout = -1 },
+		func(cfg *Config) { cfg.Logging.Level = "dbg" },
+	}
+	for _, f := range invalidate {
+		fullCfg, err := DefaultConfig(testID, testListenAddress)
+		assert.Nil(t, err)
+		f(fullCfg)
+		assert.Error(t, fullCfg.validateAndApplyDefaults())
+	}
+}
+
+func TestLoadBinary(t *testing.T) {
+	cfg, err := LoadBinary([]byte(""))
+	assert.Nil(t, cfg)
+	assert.Error(t, err)
+
+	fullCfg, err := DefaultConfig(testID, testListenAddress)
+	assert.Nil(t, err)
+
+	b, err := toml.Marshal(fullCfg)
+	assert.Nil(t, err)
+
+	cfg2, err := LoadBinary(b)
+	assert.Nil(t, err)
+	assert.Equal(t, fullCfg, cfg2)
+}
+
+func TestWriteConfig(t *testing.T) {
+	fullCfg, err := DefaultConfig(testID, testListenAddress)
+	assert.Nil(t, err)
+
+	tmpDir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	outFilePath := filepath.Join(tmpDir, "testCfg.toml")
+
+	// set some nondefault values
+	fullCfg.Provider.HomeDirectory = "/foomp/.nym"
+	fullCfg.Provider.AnnounceAddress = "1.2.3.4:1789"
+	fullCfg.Provider.MetricsAddress = "127.0.0.1:9100"
+	fullCfg.Provider.Inboxes = "/srv/inboxes"
+	fullCfg.Provider.MaxInboxMessages = 42
+	fullCfg.Provider.MessageRetention = 1
+	fullCfg.Logging.Level = "panic"
+	fullCfg.Debug.PresenceInterval = 100
+
+	assert.Nil(t, WriteConfigFile(outFilePath, fullCfg))
+
+	loadedCfg, err := LoadFile(outFilePath)
+	assert.Nil(t, err)
+	assert.Equal(t, fullCfg, loadedCfg)
+}
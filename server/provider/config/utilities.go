@@ -0,0 +1,157 @@
+// Copyright 2019 The Nym Mixnet Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"text/template"
+
+	"github.com/BurntSushi/toml"
+)
+
+var configTemplate *template.Template
+
+func init() {
+	var err error
+	if configTemplate, err = template.New("configFileTemplate").Parse(defaultConfigTemplate); err != nil {
+		panic(err)
+	}
+}
+
+// LoadBinary loads, parses and validates the provided buffer b (as a config)
+// and returns the Config.
+func LoadBinary(b []byte) (*Config, error) {
+	cfg := new(Config)
+	_, err := toml.Decode(string(b), cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.validateAndApplyDefaults(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// LoadFile loads, parses and validates the provided file and returns the Config.
+func LoadFile(f string) (*Config, error) {
+	b, err := ioutil.ReadFile(filepath.Clean(f))
+	if err != nil {
+		return nil, err
+	}
+	return LoadBinary(b)
+}
+
+// WriteConfigFile renders config using the template and writes it to specified file path.
+func WriteConfigFile(path string, config *Config) error {
+	var buffer bytes.Buffer
+
+	if err := configTemplate.Execute(&buffer, config); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, buffer.Bytes(), 0644)
+}
+
+// helper function to make config creation independent of root dir
+// adapted from the tendermint code
+func rootify(path, root string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(root, path)
+}
+
+// Note: any changes to the template must be reflected in the appropriate structs and tags.
+const defaultConfigTemplate = `# This is a TOML config file.
+# For more information, see https://github.com/toml-lang/toml
+
+##### main base provider config options #####
+[provider]
+
+# Human readable ID of this particular provider.
+id = "{{ .Provider.ID }}"
+
+# Address, in the form of host:port, on which the provider listens for packets and client requests.
+listen_address = "{{ .Provider.ListenAddress }}"
+
+# Address, in the form of host:port, which the provider publishes in the directory server
+# for other nodes and clients to connect to. If omitted, listen_address is used instead.
+announce_address = "{{ .Provider.AnnounceAddress }}"
+
+# URL to the provider presence endpoint of the directory server.
+directory_server_presence = "{{ .Provider.DirectoryServerPresenceEndpoint }}"
+
+# Path to file containing private key.
+priv_key_file = "{{ .Provider.PrivateKey }}"
+
+# Path to file containing public key.
+pub_key_file = "{{ .Provider.PublicKey }}"
+
+# Path to file in which the tags of the processed packets are persisted,
+# so that the replayed packets are detected across the restarts.
+replay_cache_file = "{{ .Provider.ReplayCache }}"
+
+# Path to directory in which the messages of the registered clients are stored.
+inboxes_dir = "{{ .Provider.Inboxes }}"
+
+# The maximum number of messages stored for a single client. Messages arriving at a full inbox are dropped.
+max_inbox_messages = {{ .Provider.MaxInboxMessages }}
+
+# For how many hours the messages are kept in the inboxes before being removed, if not pulled by the clients.
+message_retention = {{ .Provider.MessageRetention }}
+
+# Address, in the form of host:port, on which the metrics of the provider are served over HTTP
+# in the Prometheus text format at /metrics. If left empty, the metrics are not served.
+metrics_address = "{{ .Provider.MetricsAddress }}"
+
+##### advanced configuration options #####
+
+# Absolute path to the home Nym Providers directory.
+nym_home_directory = "{{ .Provider.HomeDirectory }}"
+
+##### logging configuration options #####
+[logging]
+
+# Whether to disable disables logging entirely.
+disable = {{ .Logging.Disable }}
+
+# The log file. If omitted or set to empty value, stdout will be used.
+file = "{{ .Logging.File }}"
+
+# The logging level of the provider. The available options include:
+# trace, debug, info, warning, error, panic, fatal
+# Warning: The 'trace' and 'debug' log levels are unsafe for production use.
+level = "{{ .Logging.Level }}"
+
+##### debug configuration options #####
+[debug]
+
+# How often, in milliseconds, the provider announces its presence to the directory server.
+presence_interval = {{ .Debug.PresenceInterval }}
+
+# The number of workers sending the packets once their delays elapse.
+delay_queue_workers = {{ .Debug.DelayQueueWorkers }}
+
+# The maximum number of delayed packets held at the same time. Packets above the limit are dropped.
+max_in_flight_packets = {{ .Debug.MaxInFlightPackets }}
+
+# The maximum time, in milliseconds, the provider waits on shutdown for the packets it holds
+# to be sent further. Packets still held afterwards are dropped.
+shutdown_timeout = {{ .Debug.ShutdownTimeout }}
+
+`
@@ -20,6 +20,7 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"os"
@@ -30,24 +31,43 @@ import (
 	"github.com/golang/protobuf/proto"
 	"github.com/nymtech/nym-directory/models"
 	"github.com/nymtech/nym-mixnet/config"
+	"github.com/nymtech/nym-mixnet/constants"
 	"github.com/nymtech/nym-mixnet/flags"
 	"github.com/nymtech/nym-mixnet/helpers"
 	"github.com/nymtech/nym-mixnet/logger"
 	"github.com/nymtech/nym-mixnet/networker"
 	"github.com/nymtech/nym-mixnet/node"
+	providerConfig "github.com/nymtech/nym-mixnet/server/provider/config"
 	"github.com/nymtech/nym-mixnet/sphinx"
+	"github.com/nymtech/nym-mixnet/telemetry"
 	"github.com/sirupsen/logrus"
 )
 
 const (
-	presenceInterval = 2 * time.Second
-
-	// Below should be moved to a config file once we have it
-	// logFileLocation can either point to some valid file to which all log data should be written
-	// or if left an empty string, stdout will be used instead
-	defaultLogFileLocation = ""
-	// considering we are under heavy development and nowhere near production level, log EVERYTHING
-	defaultLogLevel = "trace"
+	replayCacheSaveInterval = time.Minute
+	// inboxCleanupInterval defines how often the inboxes are checked for the messages past their retention period.
+	inboxCleanupInterval = 10 * time.Minute
+
+	// maxPullResponseSize is the maximum total size of the messages sent in response to a single pull request,
+	// leaving space in the frame for the encoding of the response. Any remaining messages are sent in response
+	// to the following requests.
+	maxPullResponseSize = networker.MaxFrameSize - 1024
+	// pulledMessageOverhead is the upper bound of the size the encoding of the response adds to each message.
+	pulledMessageOverhead = 8
+
+	// reasons, specific to the provider, for which the received packets are dropped
+	dropReasonInboxFull   = "inbox_full"
+	dropReasonStoreFailed = "store_failed"
+)
+
+var (
+	// ErrClientKeyMismatch defines an error when the request of the client is sent over the link
+	// authenticated with a different key than the one of the client.
+	ErrClientKeyMismatch = errors.New("client key does not match the key of the link")
+
+	// ErrInboxFull defines an error when the message cannot be stored, because the inbox of the client
+	// already holds the maximum number of messages.
+	ErrInboxFull = errors.New("inbox is full")
 )
 
 // ProviderIt is the interface of a given Provider mix server
@@ -67,9 +87,23 @@ type ProviderServer struct {
 	listener        net.Listener
 	assignedClients map[string]ClientRecord
 	config          config.MixConfig
-	haltedCh        chan struct{}
-	haltOnce        sync.Once
-	log             *logrus.Logger
+	cfg             *providerConfig.Config
+	// inboxesDir is the directory in which the inboxes of all the registered clients are created
+	inboxesDir       string
+	maxInboxMessages int
+	messageRetention time.Duration
+	registry         *telemetry.Registry
+	// metricsServer serves the metrics of the registry, if enabled in the config
+	metricsServer  *telemetry.Server
+	packetMetrics  *node.PacketMetrics
+	storedMessages *telemetry.Counter
+	// haltingCh is closed once the shutdown starts, while haltedCh once it is finished
+	haltingCh  chan struct{}
+	haltedCh   chan struct{}
+	haltOnce   sync.Once
+	log        *logrus.Logger
+	delayQueue *node.DelayQueue
+	pool       *networker.ConnectionPool
 }
 
 // ClientRecord holds identity and network data for clients.
@@ -94,10 +128,31 @@ func (p *ProviderServer) Shutdown() {
 // calls any required cleanup code
 func (p *ProviderServer) halt() {
 	p.log.Info("Starting graceful shutdown")
-	// close any listeners, free resources, etc
-	// possibly send "remove presence" message
+	// stop announcing our presence and accepting new connections.
+	// The directory server has no way of removing the presence explicitly, but it forgets the nodes
+	// which did not announce it for a few seconds, so the clients stop routing through us soon after.
+	close(p.haltingCh)
+	if err := p.listener.Close(); err != nil {
+		p.log.Errorf("Failed to close the listener: %v", err)
+	}
+
+	// the delayed packets are still sent further or stored, as long as their delays elapse before the deadline
+	if !p.delayQueue.Drain(time.Now().Add(p.cfg.Debug.DrainingTimeout())) {
+		p.log.Warnf("Dropping %v packets not sent before the shutdown deadline", p.delayQueue.Stats().InFlight)
+	}
+	p.delayQueue.Stop()
+	p.pool.Close()
+	if err := p.SaveReplayCache(); err != nil {
+		p.log.Errorf("Failed to save replay cache: %v", err)
+	}
+	if p.metricsServer != nil {
+		if err := p.metricsServer.Close(); err != nil {
+			p.log.Errorf("Failed to stop serving metrics: %v", err)
+		}
+	}
 
 	close(p.haltedCh)
+	p.log.Info("Shutdown finished")
 }
 
 // Start creates loggers for capturing info and error logs
@@ -119,12 +174,26 @@ func (p *ProviderServer) run() {
 
 	defer p.listener.Close()
 
+	p.delayQueue.Start()
+
+	if len(p.cfg.Provider.MetricsAddress) > 0 {
+		metricsServer, err := telemetry.ListenAndServe(p.cfg.Provider.MetricsAddress, p.registry)
+		if err != nil {
+			p.log.Errorf("Failed to serve metrics: %v", err)
+		} else {
+			p.log.Infof("Serving metrics on %s", metricsServer.Addr())
+			p.metricsServer = metricsServer
+		}
+	}
+
 	go func() {
-		p.log.Infof("Listening on %s", p.host+":"+p.port)
+		p.log.Infof("Listening on %s", p.listener.Addr())
 		p.listenForIncomingConnections()
 	}()
 
 	go p.startSendingPresence()
+	go p.startSavingReplayCache()
+	go p.startRemovingExpiredMessages()
 
 	p.Wait()
 }
@@ -139,18 +208,33 @@ func (p *ProviderServer) convertRecordsToModelData() []models.RegisteredClient {
 	return registeredClients
 }
 
+func (p *ProviderServer) startSavingReplayCache() {
+	ticker := time.NewTicker(replayCacheSaveInterval)
+	for {
+		select {
+		case <-ticker.C:
+			if err := p.SaveReplayCache(); err != nil {
+				p.log.Errorf("Failed to save replay cache: %v", err)
+			}
+		case <-p.haltedCh:
+			return
+		}
+	}
+}
+
 func (p *ProviderServer) startSendingPresence() {
-	ticker := time.NewTicker(presenceInterval)
+	ticker := time.NewTicker(p.cfg.Debug.PresenceSendingInterval())
 	for {
 		select {
 		case <-ticker.C:
-			if err := helpers.RegisterMixProviderPresence(p.GetPublicKey(),
+			if err := helpers.RegisterMixProviderPresenceAt(p.cfg.Provider.DirectoryServerPresenceEndpoint,
+				p.GetPublicKey(),
 				p.convertRecordsToModelData(),
-				net.JoinHostPort(p.host, p.port),
+				p.cfg.Provider.AnnounceAddress,
 			); err != nil {
 				p.log.Errorf("Failed to register presence: %v", err)
 			}
-		case <-p.haltedCh:
+		case <-p.haltingCh:
 			return
 		}
 	}
@@ -161,42 +245,83 @@ func (p *ProviderServer) startSendingPresence() {
 // forwarded or stored. If the processing was unsuccessful and error is returned.
 func (p *ProviderServer) receivedPacket(packet []byte) error {
 	p.log.Infof("%s: Received new sphinx packet", p.id)
-
-	// process in goroutine so we wouldn't block while executing the required delay
-	go func(packet []byte) {
-		res := p.ProcessPacket(packet)
-		dePacket := res.PacketData()
-		nextHop := res.NextHop()
-		flag := res.Flag()
-		if err := res.Err(); err != nil {
+	p.packetMetrics.Received.Inc()
+
+	processingStart := time.Now()
+	res := p.ProcessPacket(packet)
+	p.packetMetrics.ProcessingTime.ObserveSince(processingStart)
+	if err := res.Err(); err != nil {
+		p.packetMetrics.Dropped.WithLabel(node.DropReason(err)).Inc()
+		switch err {
+		case sphinx.ErrReplayedPacket:
+			p.log.Warnf("Dropped replayed packet (total replays: %v)", p.ReplayedPackets())
+		case sphinx.ErrUnsupportedPacketVersion:
+			p.log.Warnf("Dropped packet of unsupported version (total unsupported: %v)", p.UnsupportedPackets())
+		default:
 			p.log.Errorf("error while processing packet: %v", err)
 		}
+		return nil
+	}
 
-		switch flag {
-		case flags.RelayFlag:
-			if err := p.forwardPacket(dePacket, nextHop.Address); err != nil {
-				p.log.Errorf("error while forwarding packet: %v", err)
-			}
-		case flags.LastHopFlag:
-			tmpMsgID := fmt.Sprintf("TMP_MESSAGE_%v", helpers.RandomString(8))
-			if err := p.storeMessage(dePacket, nextHop.Id, tmpMsgID); err != nil {
-				p.log.Errorf("error while storing packet: %v", err)
-			}
-		default:
-			p.log.Info("Sphinx packet flag not recognised")
-		}
-	}(packet)
+	if res.Commands().DropCover() {
+		p.packetMetrics.Dropped.WithLabel(node.DropReasonCover).Inc()
+		p.log.Debugf("%s: Dropped cover packet as instructed by its sender", p.id)
+		return nil
+	}
 
+	// the packet is forwarded or stored by one of the workers of the delay queue, once its delay elapses
+	if err := p.delayQueue.Push(res); err != nil {
+		p.packetMetrics.Dropped.WithLabel(node.PushDropReason(err)).Inc()
+		p.log.Warnf("Dropped packet which could not be delayed: %v", err)
+	}
 	return nil
 }
 
-func (p *ProviderServer) forwardPacket(sphinxPacket []byte, address string) error {
-	packetBytes, err := config.WrapWithFlag(flags.CommFlag, sphinxPacket)
+// releasePacket forwards or stores the processed packet once its delay elapsed.
+func (p *ProviderServer) releasePacket(res *node.PacketProcessingResult) {
+	p.packetMetrics.MixingDelay.ObserveSince(res.ProcessedAt())
+	dePacket := res.PacketData()
+	nextHop := res.NextHop()
+	commands := res.Commands()
+
+	switch res.Flag() {
+	case flags.RelayFlag:
+		if err := p.forwardPacket(dePacket, nextHop.Address, nextHop.PubKey); err != nil {
+			p.packetMetrics.Dropped.WithLabel(node.DropReasonForwardFailed).Inc()
+			p.log.Errorf("error while forwarding packet: %v", err)
+		} else {
+			p.packetMetrics.Forwarded.Inc()
+		}
+	case flags.LastHopFlag:
+		if commands.Loop() {
+			p.log.Debugf("%s: Received loop message of %v", p.id, nextHop.Id)
+		}
+		if tag := commands.AppTag(); tag != nil {
+			p.log.Debugf("%s: Received message with application tag %x", p.id, tag)
+		}
+		tmpMsgID := fmt.Sprintf("TMP_MESSAGE_%v", helpers.RandomString(8))
+		if err := p.storeMessage(dePacket, nextHop.Id, tmpMsgID); err == ErrInboxFull {
+			p.packetMetrics.Dropped.WithLabel(dropReasonInboxFull).Inc()
+			p.log.Warnf("Dropped message for %v: %v", nextHop.Id, err)
+		} else if err != nil {
+			p.packetMetrics.Dropped.WithLabel(dropReasonStoreFailed).Inc()
+			p.log.Errorf("error while storing packet: %v", err)
+		} else {
+			p.storedMessages.Inc()
+		}
+	default:
+		p.packetMetrics.Dropped.WithLabel(node.DropReasonUnexpectedFlag).Inc()
+		p.log.Info("Sphinx packet flag not recognised")
+	}
+}
+
+func (p *ProviderServer) forwardPacket(sphinxPacket []byte, address string, pubKey []byte) error {
+	packetBytes, err := helpers.WrapSphinxPacket(sphinxPacket)
 	if err != nil {
 		return err
 	}
 	p.log.Infof("%s: Going to forward the sphinx packet", p.id)
-	err = p.send(packetBytes, address)
+	err = p.send(packetBytes, address, pubKey)
 	if err != nil {
 		return err
 	}
@@ -204,35 +329,29 @@ func (p *ProviderServer) forwardPacket(sphinxPacket []byte, address string) erro
 	return nil
 }
 
-// Function opens a connection with selected network address
-// and send the passed packet. If connection failed or
+// Function sends the passed packet over the pooled link
+// to the node with the selected network address and public key. If connection failed or
 // the packet could not be send, an error is returned
-func (p *ProviderServer) send(packet []byte, address string) error {
-	p.log.Debugf("%s: Dialling", p.id)
-	conn, err := net.Dial("tcp", address)
-	if err != nil {
-		return err
-	}
-	defer conn.Close()
-	p.log.Debugf("%s: Writing", p.id)
-
-	if _, err := conn.Write(packet); err != nil {
-		return err
-	}
-	p.log.Debugf("%s: Returning", p.id)
-
-	return nil
+func (p *ProviderServer) send(packet []byte, address string, pubKey []byte) error {
+	return p.pool.Send(address, pubKey, packet)
 }
 
 // Function responsible for running the listening process of the server;
 // The providers listener accepts incoming connections and
 // passes the incoming packets to the packet handler.
 // If the connection could not be accepted an error
-// is logged into the log files, but the function is not stopped
+// is logged into the log files, but the function is not stopped,
+// unless the listener was closed on shutdown
 func (p *ProviderServer) listenForIncomingConnections() {
 	for {
 		conn, err := p.listener.Accept()
 		if err != nil {
+			select {
+			case <-p.haltingCh:
+				// the listener was closed on shutdown
+				return
+			default:
+			}
 			p.log.Errorf("Error when listening for incoming connection: %v", err)
 		} else {
 			p.log.Infof("Received connection from %s", conn.RemoteAddr())
@@ -243,9 +362,9 @@ func (p *ProviderServer) listenForIncomingConnections() {
 	}
 }
 
-func (p *ProviderServer) replyToClient(data []byte, conn net.Conn) {
-	p.log.Infof("Replying back to the client (%v)", conn.RemoteAddr())
-	if _, err := conn.Write(data); err != nil {
+func (p *ProviderServer) replyToClient(data []byte, link *networker.Link) {
+	p.log.Infof("Replying back to the client (%v)", link.RemoteAddr())
+	if err := link.WriteFrame(data); err != nil {
 		p.log.Errorf("Couldn't reply to the client. Connection write error: %v", err)
 	}
 }
@@ -262,8 +381,8 @@ func (p *ProviderServer) createClientResponse(marshalledPackets ...[]byte) ([]by
 	return mBytes, nil
 }
 
-// HandleConnection handles the received packets; it checks the flag of the
-// packet and schedules a corresponding process function and returns an error.
+// HandleConnection establishes the link over the connection and handles the packets received over it
+// until it is closed by the sender.
 func (p *ProviderServer) handleConnection(conn net.Conn) {
 	defer func() {
 		p.log.Debugf("Closing Connection to %v", conn.RemoteAddr())
@@ -272,52 +391,80 @@ func (p *ProviderServer) handleConnection(conn net.Conn) {
 		}
 	}()
 
-	buff := make([]byte, 2048)
-	reqLen, err := conn.Read(buff)
+	link, err := networker.AcceptLink(conn, p.GetKeyPair)
 	if err != nil {
-		p.log.Errorf("Error while reading from the connection: %v", err)
+		p.log.Errorf("Error while establishing the link: %v", err)
 		return
 	}
+	for {
+		packetBytes, err := link.ReadFrame(node.MaxPacketFrameSize)
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			p.log.Errorf("Error while reading from the connection: %v", err)
+			return
+		}
+		p.handlePacket(packetBytes, link)
+	}
+}
 
+// handlePacket checks the flag of the received packet and schedules a corresponding process function.
+// The requests of the clients are always answered, with an empty response if they could not be handled,
+// so that the client does not wait for the response in vain.
+func (p *ProviderServer) handlePacket(packetBytes []byte, link *networker.Link) {
 	var packet config.GeneralPacket
-	if err = proto.Unmarshal(buff[:reqLen], &packet); err != nil {
+	if err := proto.Unmarshal(packetBytes, &packet); err != nil {
 		p.log.Errorf("Error while unmarshalling received packet: %v", err)
 		return
 	}
 
 	switch flags.PacketTypeFlagFromBytes(packet.Flag) {
 	case flags.AssignFlag:
-		tokenBytes, err := p.handleAssignRequest(packet.Data)
+		tokenBytes, err := p.handleAssignRequest(packet.Data, link.RemoteKey())
 		if err != nil {
 			p.log.Errorf("Error while handling token request: %v", err)
+			p.replyToClient(nil, link)
 			return
 		}
 		clientResponse, err := p.createClientResponse(tokenBytes)
 		if err != nil {
 			p.log.Errorf("Error while creating client response for token: %v", err)
+			p.replyToClient(nil, link)
 			return
 		}
-		p.replyToClient(clientResponse, conn)
+		p.replyToClient(clientResponse, link)
 
 	case flags.CommFlag:
+		if err := p.CheckPacketVersion(packet.Version); err != nil {
+			p.packetMetrics.Received.Inc()
+			p.packetMetrics.Dropped.WithLabel(node.DropReasonUnsupportedVersion).Inc()
+			p.log.Warnf("Dropped packet of unsupported version %v (total unsupported: %v)",
+				packet.Version,
+				p.UnsupportedPackets(),
+			)
+			return
+		}
 		if err := p.receivedPacket(packet.Data); err != nil {
 			p.log.Errorf("Error while handling received packet: %v", err)
 			return
 		}
 
 	case flags.PullFlag:
-		messagesBytes, err := p.handlePullRequest(packet.Data)
+		messagesBytes, err := p.handlePullRequest(packet.Data, link.RemoteKey())
 		if err != nil {
 			p.log.Errorf("Error while handling pull request: %v", err)
+			p.replyToClient(nil, link)
 			return
 		}
 
 		clientResponse, err := p.createClientResponse(messagesBytes...)
 		if err != nil {
 			p.log.Errorf("Error while creating client response for pull request: %v", err)
+			p.replyToClient(nil, link)
 			return
 		}
-		p.replyToClient(clientResponse, conn)
+		p.replyToClient(clientResponse, link)
 
 	default:
 		p.log.Info(packet.Flag)
@@ -330,12 +477,16 @@ func (p *ProviderServer) handleConnection(conn net.Conn) {
 // saves it together with client's public configuration data
 // in the list of all registered clients. After the client is registered the function creates an inbox directory
 // for the client's inbox, in which clients messages will be stored.
-func (p *ProviderServer) registerNewClient(clientBytes []byte) ([]byte, error) {
+// Only the client authenticated with the same key by the link can be registered.
+func (p *ProviderServer) registerNewClient(clientBytes []byte, linkKey []byte) ([]byte, error) {
 	var clientConf config.ClientConfig
 	err := proto.Unmarshal(clientBytes, &clientConf)
 	if err != nil {
 		return nil, err
 	}
+	if !bytes.Equal(clientConf.PubKey, linkKey) {
+		return nil, ErrClientKeyMismatch
+	}
 	clientID := base64.URLEncoding.EncodeToString(clientConf.PubKey)
 
 	token, err := helpers.SHA256([]byte("TMP_Token" + clientID))
@@ -350,7 +501,7 @@ func (p *ProviderServer) registerNewClient(clientBytes []byte) ([]byte, error) {
 	}
 	p.assignedClients[clientID] = record
 
-	path := fmt.Sprintf("./inboxes/%s", clientID)
+	path := p.inboxPath(clientID)
 	exists, err := helpers.DirExists(path)
 	if err != nil {
 		return nil, err
@@ -367,10 +518,10 @@ func (p *ProviderServer) registerNewClient(clientBytes []byte) ([]byte, error) {
 // Function is responsible for handling the registration request from the client.
 // it registers the client in the list of all registered clients and send
 // an authentication token back to the client.
-func (p *ProviderServer) handleAssignRequest(packet []byte) ([]byte, error) {
+func (p *ProviderServer) handleAssignRequest(packet []byte, linkKey []byte) ([]byte, error) {
 	p.log.Info("Received assign request from the client")
 
-	token, err := p.registerNewClient(packet)
+	token, err := p.registerNewClient(packet, linkKey)
 	if err != nil {
 		return nil, err
 	}
@@ -379,15 +530,19 @@ func (p *ProviderServer) handleAssignRequest(packet []byte) ([]byte, error) {
 }
 
 // Function is responsible for handling the pull request received from the client.
-// It first authenticates the client, by checking if the received token is valid.
+// It first authenticates the client, by checking if the received token is valid
+// and if the request was sent over the link authenticated with the key of the client.
 // If yes, the function triggers the function for checking client's inbox
 // and sending buffered messages. Otherwise, an error is returned.
-func (p *ProviderServer) handlePullRequest(rqsBytes []byte) ([][]byte, error) {
+func (p *ProviderServer) handlePullRequest(rqsBytes []byte, linkKey []byte) ([][]byte, error) {
 	var request config.PullRequest
 	err := proto.Unmarshal(rqsBytes, &request)
 	if err != nil {
 		return nil, err
 	}
+	if !bytes.Equal(request.ClientPublicKey, linkKey) {
+		return nil, ErrClientKeyMismatch
+	}
 	clientID := base64.URLEncoding.EncodeToString(request.ClientPublicKey)
 
 	p.log.Infof("Processing pull request: %s %s", clientID, string(request.Token))
@@ -434,7 +589,7 @@ func (p *ProviderServer) authenticateUser(clientKey, clientToken []byte) bool {
 // (SI) messages were send to the client; and an error.
 func (p *ProviderServer) fetchMessages(clientID string) (string, [][]byte, error) {
 
-	path := fmt.Sprintf("./inboxes/%s", clientID)
+	path := p.inboxPath(clientID)
 	exist, err := helpers.DirExists(path)
 	if err != nil {
 		return "", nil, err
@@ -450,21 +605,26 @@ func (p *ProviderServer) fetchMessages(clientID string) (string, [][]byte, error
 		return "EI", nil, nil
 	}
 
-	messagesBytes := make([][]byte, len(files))
-	for i, f := range files {
+	messagesBytes := make([][]byte, 0, len(files))
+	responseSize := 0
+	for _, f := range files {
 		fullPath := filepath.Join(path, f.Name())
 		dat, err := ioutil.ReadFile(fullPath)
 		if err != nil {
 			return "", nil, err
 		}
 
-		p.log.Infof("Found stored message for %s", clientID)
-		p.log.Infof("Messages data: %v", string(dat))
+		p.log.Infof("Found stored message for %s (%v bytes)", clientID, len(dat))
 		msgBytes, err := config.WrapWithFlag(flags.CommFlag, dat)
 		if err != nil {
 			return "", nil, err
 		}
-		messagesBytes[i] = msgBytes
+		responseSize += len(msgBytes) + pulledMessageOverhead
+		if responseSize > maxPullResponseSize {
+			p.log.Infof("Response is full, the remaining messages are kept for the next pull request")
+			break
+		}
+		messagesBytes = append(messagesBytes, msgBytes)
 
 		if err := os.Remove(fullPath); err != nil {
 			p.log.Errorf("Failed to remove %v: %v", f, err)
@@ -476,10 +636,19 @@ func (p *ProviderServer) fetchMessages(clientID string) (string, [][]byte, error
 
 // StoreMessage saves the given message in the inbox defined by the given id.
 // If the inbox address does not exist or writing into the inbox was unsuccessful
-// the function returns an error
+// the function returns an error. If the inbox already holds the maximum number
+// of messages, ErrInboxFull is returned.
 func (p *ProviderServer) storeMessage(message []byte, inboxID string, messageID string) error {
-	path := fmt.Sprintf("./inboxes/%s", inboxID)
-	fileName := path + "/" + messageID + ".txt"
+	path := p.inboxPath(inboxID)
+	fileName := filepath.Join(path, messageID+".txt")
+
+	stored, err := ioutil.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	if len(stored) >= p.maxInboxMessages {
+		return ErrInboxFull
+	}
 
 	file, err := os.Create(fileName)
 	if err != nil {
@@ -493,49 +662,181 @@ func (p *ProviderServer) storeMessage(message []byte, inboxID string, messageID
 	}
 
 	p.log.Infof("Stored message for %s", inboxID)
-	p.log.Infof("Stored message content: %v", string(message))
 	return nil
 }
 
-// NewProviderServer constructs a new provider object.
-// NewProviderServer returns a new provider object and an error.
-// TODO: same case as 'NewClient'
-func NewProviderServer(id string,
-	host string,
-	port string,
-	prvKey *sphinx.PrivateKey,
-	pubKey *sphinx.PublicKey,
-) (*ProviderServer, error) {
-	baseLogger, err := logger.New(defaultLogFileLocation, defaultLogLevel, false)
+// registerMetrics creates the registry of the metrics of the provider.
+func (p *ProviderServer) registerMetrics() {
+	p.registry = telemetry.NewRegistry()
+	p.packetMetrics = node.NewPacketMetrics(p.registry,
+		"nym_provider",
+		func() node.MixStrategyStats { return p.delayQueue.Stats() },
+		func() networker.PoolStats { return p.pool.Stats() },
+	)
+	p.storedMessages = p.registry.NewCounter("nym_provider_messages_stored_total",
+		"Number of messages stored in the inboxes of the clients.")
+	p.registry.NewGaugeFunc("nym_provider_inbox_messages",
+		"Number of messages currently stored in all the inboxes.",
+		func() float64 {
+			total, _ := p.inboxSizes()
+			return float64(total)
+		})
+	p.registry.NewGaugeFunc("nym_provider_largest_inbox_messages",
+		"Number of messages currently stored in the largest inbox.",
+		func() float64 {
+			_, largest := p.inboxSizes()
+			return float64(largest)
+		})
+}
+
+// inboxSizes returns the total number of messages stored in all the inboxes and the number
+// of messages stored in the largest of them.
+func (p *ProviderServer) inboxSizes() (int, int) {
+	inboxes, err := ioutil.ReadDir(p.inboxesDir)
+	if err != nil {
+		return 0, 0
+	}
+	total, largest := 0, 0
+	for _, inbox := range inboxes {
+		if !inbox.IsDir() {
+			continue
+		}
+		messages, err := ioutil.ReadDir(filepath.Join(p.inboxesDir, inbox.Name()))
+		if err != nil {
+			continue
+		}
+		total += len(messages)
+		if len(messages) > largest {
+			largest = len(messages)
+		}
+	}
+	return total, largest
+}
+
+// inboxPath returns the path to the inbox directory of the given client.
+func (p *ProviderServer) inboxPath(clientID string) string {
+	return filepath.Join(p.inboxesDir, clientID)
+}
+
+func (p *ProviderServer) startRemovingExpiredMessages() {
+	ticker := time.NewTicker(inboxCleanupInterval)
+	for {
+		select {
+		case <-ticker.C:
+			if err := p.removeExpiredMessages(time.Now()); err != nil {
+				p.log.Errorf("Failed to remove expired messages: %v", err)
+			}
+		case <-p.haltedCh:
+			return
+		}
+	}
+}
+
+// removeExpiredMessages removes from all the inboxes the messages, which were stored
+// longer than the retention period before the given time and were not pulled by their clients.
+func (p *ProviderServer) removeExpiredMessages(now time.Time) error {
+	inboxes, err := ioutil.ReadDir(p.inboxesDir)
+	if err != nil {
+		return err
+	}
+	expiry := now.Add(-p.messageRetention)
+	removed := 0
+	for _, inbox := range inboxes {
+		if !inbox.IsDir() {
+			continue
+		}
+		path := filepath.Join(p.inboxesDir, inbox.Name())
+		messages, err := ioutil.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		for _, message := range messages {
+			if message.ModTime().After(expiry) {
+				continue
+			}
+			if err := os.Remove(filepath.Join(path, message.Name())); err != nil {
+				return err
+			}
+			removed++
+		}
+	}
+	if removed > 0 {
+		p.log.Infof("Removed %v expired messages", removed)
+	}
+	return nil
+}
+
+// NewProviderServer creates a provider with the identity and the settings defined in its config.
+func NewProviderServer(cfg *providerConfig.Config) (*ProviderServer, error) {
+	baseLogger, err := logger.New(cfg.Logging.File, cfg.Logging.Level, cfg.Logging.Disable)
 	if err != nil {
 		return nil, err
 	}
 
+	prvKey := new(sphinx.PrivateKey)
+	pubKey := new(sphinx.PublicKey)
+	if err := helpers.FromPEMFile(prvKey, cfg.Provider.PrivateKeyFile(), constants.PrivateKeyPEMType); err != nil {
+		return nil, fmt.Errorf("Failed to load the private key: %v", err)
+	}
+
+	if err := helpers.FromPEMFile(pubKey, cfg.Provider.PublicKeyFile(), constants.PublicKeyPEMType); err != nil {
+		return nil, fmt.Errorf("Failed to load the public key: %v", err)
+	}
+
+	host, port, err := net.SplitHostPort(cfg.Provider.AnnounceAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := helpers.EnsureDir(cfg.Provider.InboxesDir(), 0700); err != nil {
+		return nil, fmt.Errorf("Failed to create the inboxes directory: %v", err)
+	}
+
+	id := cfg.Provider.ID
 	log := baseLogger.GetLogger(id)
+	log.Infof("Logging level set to %v", cfg.Logging.Level)
 
-	node := node.NewMix(prvKey, pubKey)
+	mix := node.NewMix(prvKey, pubKey)
 	providerServer := ProviderServer{id: id,
-		host:     host,
-		port:     port,
-		Mix:      node,
-		listener: nil,
-		haltedCh: make(chan struct{}),
-		log:      log,
+		host:             host,
+		port:             port,
+		Mix:              mix,
+		listener:         nil,
+		cfg:              cfg,
+		inboxesDir:       cfg.Provider.InboxesDir(),
+		maxInboxMessages: cfg.Provider.MaxInboxMessages,
+		messageRetention: cfg.Provider.MessageRetentionPeriod(),
+		haltingCh:        make(chan struct{}),
+		haltedCh:         make(chan struct{}),
+		log:              log,
+		pool:             networker.NewConnectionPool(networker.DefaultIdleTimeout, mix.GetKeyPair),
+	}
+	providerServer.delayQueue, err = node.NewDelayQueue(cfg.Debug.DelayQueueWorkers,
+		cfg.Debug.MaxInFlightPackets,
+		providerServer.releasePacket,
+	)
+	if err != nil {
+		return nil, err
 	}
+	if err := providerServer.EnableReplayCachePersistence(cfg.Provider.ReplayCacheFile()); err != nil {
+		return nil, err
+	}
+	providerServer.registerMetrics()
 	providerServer.config = config.MixConfig{Id: providerServer.id,
 		Host:   providerServer.host,
 		Port:   providerServer.port,
 		PubKey: providerServer.GetPublicKey().Bytes()}
 	providerServer.assignedClients = make(map[string]ClientRecord)
 
-	if err := helpers.RegisterMixProviderPresence(providerServer.GetPublicKey(),
+	if err := helpers.RegisterMixProviderPresenceAt(cfg.Provider.DirectoryServerPresenceEndpoint,
+		providerServer.GetPublicKey(),
 		providerServer.convertRecordsToModelData(),
-		net.JoinHostPort(host, port),
+		cfg.Provider.AnnounceAddress,
 	); err != nil {
 		return nil, err
 	}
 
-	providerServer.listener, err = net.Listen("tcp", net.JoinHostPort(host, port))
+	providerServer.listener, err = net.Listen("tcp", cfg.Provider.ListenAddress)
 
 	if err != nil {
 		return nil, err
@@ -549,20 +850,43 @@ func CreateTestProvider() (*ProviderServer, error) {
 	if err != nil {
 		return nil, err
 	}
-	baseDisabledLogger, err := logger.New(defaultLogFileLocation, defaultLogLevel, true)
+	cfg, err := providerConfig.DefaultConfig("test", "localhost:9999")
+	if err != nil {
+		return nil, err
+	}
+	baseDisabledLogger, err := logger.New("", cfg.Logging.Level, true)
 	if err != nil {
 		return nil, err
 	}
 	// this logger can be shared as it will be disabled anyway
 	disabledLog := baseDisabledLogger.GetLogger("test")
 
-	node := node.NewMix(priv, pub)
-	provider := ProviderServer{host: "localhost", port: "9999", Mix: node, log: disabledLog}
+	mix := node.NewMix(priv, pub)
+	provider := ProviderServer{host: "localhost",
+		port:             "9999",
+		Mix:              mix,
+		cfg:              cfg,
+		inboxesDir:       "./inboxes",
+		maxInboxMessages: cfg.Provider.MaxInboxMessages,
+		messageRetention: cfg.Provider.MessageRetentionPeriod(),
+		log:              disabledLog,
+		pool:             networker.NewConnectionPool(networker.DefaultIdleTimeout, mix.GetKeyPair),
+		haltingCh:        make(chan struct{}),
+		haltedCh:         make(chan struct{}),
+	}
+	provider.delayQueue, err = node.NewDelayQueue(node.DefaultDelayQueueWorkers,
+		node.DefaultMaxInFlightPackets,
+		provider.releasePacket,
+	)
+	if err != nil {
+		return nil, err
+	}
 	provider.config = config.MixConfig{Id: provider.id,
 		Host:   provider.host,
 		Port:   provider.port,
 		PubKey: provider.GetPublicKey().Bytes(),
 	}
 	provider.assignedClients = make(map[string]ClientRecord)
+	provider.registerMetrics()
 	return &provider, nil
 }
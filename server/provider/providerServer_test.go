@@ -15,6 +15,7 @@
 package provider
 
 import (
+	"bytes"
 	"encoding/base64"
 	"fmt"
 	"io/ioutil"
@@ -22,10 +23,14 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/nymtech/nym-mixnet/config"
+	"github.com/nymtech/nym-mixnet/flags"
 	"github.com/nymtech/nym-mixnet/helpers"
+	"github.com/nymtech/nym-mixnet/networker"
+	"github.com/nymtech/nym-mixnet/node"
 	"github.com/nymtech/nym-mixnet/server/mixnode"
 	"github.com/nymtech/nym-mixnet/sphinx"
 	"github.com/stretchr/testify/assert"
@@ -154,6 +159,89 @@ func TestProviderServer_StoreMessage(t *testing.T) {
 
 }
 
+func TestProviderServer_FetchMessagesLimit(t *testing.T) {
+	inboxID := "LimitedInbox"
+	err := os.MkdirAll("./inboxes/"+inboxID, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("./inboxes/" + inboxID)
+
+	// only 10 of the messages fit into a single response
+	message := make([]byte, 100000)
+	for i := 0; i < 15; i++ {
+		if err := providerServer.storeMessage(message, inboxID, fmt.Sprintf("%02d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	signal, messages, err := providerServer.fetchMessages(inboxID)
+	assert.Nil(t, err)
+	assert.Equal(t, "SI", signal)
+	assert.Len(t, messages, 10)
+
+	response, err := providerServer.createClientResponse(messages...)
+	assert.Nil(t, err)
+	assert.True(t, len(response) <= networker.MaxFrameSize)
+
+	_, messages, err = providerServer.fetchMessages(inboxID)
+	assert.Nil(t, err)
+	assert.Len(t, messages, 5)
+
+	signal, _, err = providerServer.fetchMessages(inboxID)
+	assert.Nil(t, err)
+	assert.Equal(t, "EI", signal)
+}
+
+func TestProviderServer_StoreMessageInboxFull(t *testing.T) {
+	inboxID := "FullInbox"
+	err := os.MkdirAll("./inboxes/"+inboxID, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("./inboxes/" + inboxID)
+
+	maxInboxMessages := providerServer.maxInboxMessages
+	providerServer.maxInboxMessages = 3
+	defer func() { providerServer.maxInboxMessages = maxInboxMessages }()
+
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, providerServer.storeMessage([]byte("Message"), inboxID, fmt.Sprintf("%02d", i)))
+	}
+	assert.Equal(t, ErrInboxFull, providerServer.storeMessage([]byte("Message"), inboxID, "03"))
+
+	// pulling the messages frees the inbox
+	_, messages, err := providerServer.fetchMessages(inboxID)
+	assert.Nil(t, err)
+	assert.Len(t, messages, 3)
+	assert.Nil(t, providerServer.storeMessage([]byte("Message"), inboxID, "03"))
+}
+
+func TestProviderServer_RemoveExpiredMessages(t *testing.T) {
+	inboxID := "ExpiringInbox"
+	err := os.MkdirAll("./inboxes/"+inboxID, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("./inboxes/" + inboxID)
+
+	assert.Nil(t, providerServer.storeMessage([]byte("Old message"), inboxID, "old"))
+	assert.Nil(t, providerServer.storeMessage([]byte("New message"), inboxID, "new"))
+
+	stored := time.Now().Add(-providerServer.messageRetention - time.Minute)
+	assert.Nil(t, os.Chtimes(filepath.Join("./inboxes", inboxID, "old.txt"), stored, stored))
+
+	assert.Nil(t, providerServer.removeExpiredMessages(time.Now()))
+
+	_, messages, err := providerServer.fetchMessages(inboxID)
+	assert.Nil(t, err)
+	assert.Len(t, messages, 1)
+
+	var packet config.GeneralPacket
+	assert.Nil(t, proto.Unmarshal(messages[0], &packet))
+	assert.Equal(t, []byte("New message"), packet.Data)
+}
+
 func createTestPacket(t *testing.T) *sphinx.SphinxPacket {
 	path := config.E2EPath{IngressProvider: providerServer.config,
 		Mixes:          []config.MixConfig{mixServer.GetConfig()},
@@ -169,7 +257,7 @@ func createTestPacket(t *testing.T) *sphinx.SphinxPacket {
 
 func TestProviderServer_ReceivedPacket(t *testing.T) {
 	sphinxPacket := createTestPacket(t)
-	bSphinxPacket, err := proto.Marshal(sphinxPacket)
+	bSphinxPacket, err := sphinx.EncodePacket(sphinxPacket)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -178,3 +266,126 @@ func TestProviderServer_ReceivedPacket(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestProviderServer_Metrics(t *testing.T) {
+	sphinxPacket := createTestPacket(t)
+	bSphinxPacket, err := sphinx.EncodePacket(sphinxPacket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := providerServer.packetMetrics.Received.Value()
+	replayed := providerServer.packetMetrics.Dropped.WithLabel(node.DropReasonReplayed).Value()
+
+	assert.Nil(t, providerServer.receivedPacket(bSphinxPacket))
+	assert.Nil(t, providerServer.receivedPacket(bSphinxPacket))
+
+	assert.Equal(t, received+2, providerServer.packetMetrics.Received.Value())
+	assert.Equal(t, replayed+1, providerServer.packetMetrics.Dropped.WithLabel(node.DropReasonReplayed).Value())
+
+	var b bytes.Buffer
+	assert.Nil(t, providerServer.registry.Write(&b))
+	assert.Contains(t, b.String(), fmt.Sprintf("nym_provider_packets_dropped_total{reason=\"replayed\"} %v\n", replayed+1))
+	assert.Contains(t, b.String(), "# TYPE nym_provider_packet_processing_seconds histogram\n")
+	assert.Contains(t, b.String(), "# TYPE nym_provider_inbox_messages gauge\n")
+}
+
+func TestProviderServer_Shutdown(t *testing.T) {
+	provider, err := CreateTestProvider()
+	assert.Nil(t, err)
+	provider.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	provider.delayQueue.Start()
+	assert.Nil(t, provider.delayQueue.Push(&node.PacketProcessingResult{}))
+
+	listening := make(chan struct{})
+	go func() {
+		provider.listenForIncomingConnections()
+		close(listening)
+	}()
+
+	provider.Shutdown()
+	provider.Wait()
+	select {
+	case <-listening:
+	case <-time.After(time.Second):
+		t.Fatal("provider kept listening after the shutdown")
+	}
+
+	// the delayed packet was released before the shutdown finished
+	assert.Equal(t, 0, provider.delayQueue.Stats().InFlight)
+	assert.Equal(t, uint64(1), provider.packetMetrics.Dropped.WithLabel(node.DropReasonUnexpectedFlag).Value())
+	_, err = net.Dial("tcp", provider.listener.Addr().String())
+	assert.Error(t, err)
+}
+
+// connectTestLink establishes the link to the provider over an in-memory connection handled by the provider.
+func connectTestLink(t *testing.T, keys networker.LinkKeys) (*networker.Link, chan struct{}) {
+	clientConn, serverConn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		providerServer.handleConnection(serverConn)
+		close(done)
+	}()
+	link, err := networker.ConnectLink(clientConn, keys, providerServer.GetPublicKey().Bytes())
+	assert.Nil(t, err)
+	return link, done
+}
+
+func TestProviderServer_HandleConnectionFrameTooLarge(t *testing.T) {
+	priv, pub, err := sphinx.GenerateKeyPair()
+	assert.Nil(t, err)
+	link, done := connectTestLink(t, networker.StaticLinkKeys(priv, pub))
+	defer link.Close()
+
+	// the frame is rejected by its header, before its content is sent
+	go func() {
+		_ = link.WriteFrame(make([]byte, node.MaxPacketFrameSize+1))
+	}()
+	<-done
+
+	_, err = link.ReadFrame(networker.MaxLinkFrameSize)
+	assert.Error(t, err)
+}
+
+func TestProviderServer_RequestsBoundToLinkKey(t *testing.T) {
+	priv, pub, err := sphinx.GenerateKeyPair()
+	assert.Nil(t, err)
+	_, otherPub, err := sphinx.GenerateKeyPair()
+	assert.Nil(t, err)
+	link, done := connectTestLink(t, networker.StaticLinkKeys(priv, pub))
+
+	register := func(clientKey []byte) config.ProviderResponse {
+		clientBytes, err := proto.Marshal(&config.ClientConfig{Id: "Client", PubKey: clientKey})
+		assert.Nil(t, err)
+		packet, err := config.WrapWithFlag(flags.AssignFlag, clientBytes)
+		assert.Nil(t, err)
+		assert.Nil(t, link.WriteFrame(packet))
+		responseBytes, err := link.ReadFrame(networker.MaxLinkFrameSize)
+		assert.Nil(t, err)
+		var response config.ProviderResponse
+		assert.Nil(t, proto.Unmarshal(responseBytes, &response))
+		return response
+	}
+
+	// the client cannot register a key other than the one authenticated by the link
+	assert.Zero(t, register(otherPub.Bytes()).NumberOfPackets)
+	assert.Equal(t, uint64(1), register(pub.Bytes()).NumberOfPackets)
+	link.Close()
+	<-done
+
+	clientID := base64.URLEncoding.EncodeToString(pub.Bytes())
+	defer os.RemoveAll("./inboxes/" + clientID)
+	request, err := proto.Marshal(&config.PullRequest{
+		ClientPublicKey: pub.Bytes(),
+		Token:           providerServer.assignedClients[clientID].token,
+	})
+	assert.Nil(t, err)
+
+	// the token is of no use over a link authenticated with a different key
+	_, err = providerServer.handlePullRequest(request, otherPub.Bytes())
+	assert.Equal(t, ErrClientKeyMismatch, err)
+	_, err = providerServer.handlePullRequest(request, pub.Bytes())
+	assert.Nil(t, err)
+}
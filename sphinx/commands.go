@@ -0,0 +1,136 @@
+// Copyright 2019 The Nym Mixnet Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sphinx
+
+import (
+	"errors"
+	"math"
+)
+
+// HopCommandType identifies the kind of the command the sender included in the routing information of a hop.
+type HopCommandType uint32
+
+const (
+	// HopCommandDropCover instructs the hop to discard the packet, which is the cover traffic only
+	// meant to travel up to that hop.
+	HopCommandDropCover HopCommandType = 1
+	// HopCommandLoop marks the packet as a loop message, which the sender addressed to itself.
+	HopCommandLoop HopCommandType = 2
+	// HopCommandSURBID carries the identifier of the single use reply block the packet was created with.
+	HopCommandSURBID HopCommandType = 3
+	// HopCommandAppTag carries an opaque tag of the application, meant for the final hop.
+	HopCommandAppTag HopCommandType = 4
+)
+
+var (
+	// ErrInvalidHopCommand defines an error when the hop command cannot be encoded or was encoded incorrectly.
+	ErrInvalidHopCommand = errors.New("invalid hop command")
+	// ErrHopCommandsNotSupported defines an error when the packet format version cannot carry the hop commands.
+	ErrHopCommandsNotSupported = errors.New("packet format does not support hop commands")
+)
+
+// NewDropCoverCommand returns the command instructing the hop to drop the packet.
+func NewDropCoverCommand() *HopCommand {
+	return &HopCommand{Type: uint32(HopCommandDropCover)}
+}
+
+// NewLoopCommand returns the command marking the packet as a loop message.
+func NewLoopCommand() *HopCommand {
+	return &HopCommand{Type: uint32(HopCommandLoop)}
+}
+
+// NewSURBIDCommand returns the command carrying the identifier of a single use reply block.
+func NewSURBIDCommand(id []byte) *HopCommand {
+	return &HopCommand{Type: uint32(HopCommandSURBID), Value: id}
+}
+
+// NewAppTagCommand returns the command carrying the opaque application tag.
+func NewAppTagCommand(tag []byte) *HopCommand {
+	return &HopCommand{Type: uint32(HopCommandAppTag), Value: tag}
+}
+
+// DropCover checks whether the sender instructed the hop to drop the packet.
+func (m *Commands) DropCover() bool {
+	return m.hopCommand(HopCommandDropCover) != nil
+}
+
+// Loop checks whether the packet was marked as a loop message.
+func (m *Commands) Loop() bool {
+	return m.hopCommand(HopCommandLoop) != nil
+}
+
+// SURBID returns the identifier of the single use reply block, or nil if it was not included.
+func (m *Commands) SURBID() []byte {
+	return m.hopCommand(HopCommandSURBID).GetValue()
+}
+
+// AppTag returns the opaque application tag, or nil if it was not included.
+func (m *Commands) AppTag() []byte {
+	return m.hopCommand(HopCommandAppTag).GetValue()
+}
+
+// hopCommand returns the first command of the given type, or nil if there is none.
+// Commands of types unknown to this implementation are kept, but never acted upon.
+func (m *Commands) hopCommand(commandType HopCommandType) *HopCommand {
+	for _, c := range m.GetHopCommands() {
+		if HopCommandType(c.Type) == commandType {
+			return c
+		}
+	}
+	return nil
+}
+
+// putHopCommands encodes the commands into their area of the routing information, each as the byte of its type,
+// the byte of the length of its value and the value itself. The rest of the area is left zeroed,
+// which terminates the list, hence the type 0 is not valid.
+func putHopCommands(area []byte, commands []*HopCommand) error {
+	if len(commands) > 0 && len(area) == 0 {
+		return ErrHopCommandsNotSupported
+	}
+
+	offset := 0
+	for _, c := range commands {
+		if c == nil || c.Type == 0 || c.Type > math.MaxUint8 || len(c.Value) > math.MaxUint8 {
+			return ErrInvalidHopCommand
+		}
+		if offset+2+len(c.Value) > len(area) {
+			return ErrRoutingInfoTooLong
+		}
+		area[offset] = byte(c.Type)
+		area[offset+1] = byte(len(c.Value))
+		copy(area[offset+2:], c.Value)
+		offset += 2 + len(c.Value)
+	}
+	return nil
+}
+
+// getHopCommands decodes the commands encoded with putHopCommands.
+func getHopCommands(area []byte) ([]*HopCommand, error) {
+	var commands []*HopCommand
+	for offset := 0; offset+2 <= len(area) && area[offset] != 0; {
+		length := int(area[offset+1])
+		if offset+2+length > len(area) {
+			return nil, ErrInvalidHopCommand
+		}
+
+		c := &HopCommand{Type: uint32(area[offset])}
+		if length > 0 {
+			c.Value = append([]byte{}, area[offset+2:offset+2+length]...)
+		}
+		commands = append(commands, c)
+		offset += 2 + length
+	}
+	return commands, nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2019 The Nym Mixnet Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sphinx
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/nymtech/nym-mixnet/config"
+	"github.com/nymtech/nym-mixnet/flags"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHopCommandsRoutingInfo(t *testing.T) {
+	routingInfo := RoutingInfo{
+		NextHop: &Hop{Id: "Node", Address: "localhost:3333", PubKey: make([]byte, PublicKeySize)},
+		RoutingCommands: &Commands{Delay: 1.25, Flag: flags.LastHopFlag.Bytes(), HopCommands: []*HopCommand{
+			NewDropCoverCommand(),
+			NewSURBIDCommand([]byte("0123456789abcdef")),
+			{Type: 200, Value: []byte("new")},
+		}},
+	}
+
+	encoded, err := commandsLayout.encode(&routingInfo)
+	assert.Nil(t, err)
+	assert.Len(t, encoded, RoutingInfoSize)
+
+	decoded, err := commandsLayout.decode(encoded)
+	assert.Nil(t, err)
+	assert.True(t, proto.Equal(&routingInfo, &decoded))
+	assert.True(t, decoded.RoutingCommands.DropCover())
+	assert.False(t, decoded.RoutingCommands.Loop())
+	assert.Equal(t, []byte("0123456789abcdef"), decoded.RoutingCommands.SURBID())
+	assert.Nil(t, decoded.RoutingCommands.AppTag())
+
+	routingInfo.RoutingCommands.HopCommands = []*HopCommand{NewAppTagCommand([]byte(strings.Repeat("x", 30)))}
+	_, err = commandsLayout.encode(&routingInfo)
+	assert.Equal(t, ErrRoutingInfoTooLong, err)
+
+	routingInfo.RoutingCommands.HopCommands = []*HopCommand{{Type: 0}}
+	_, err = commandsLayout.encode(&routingInfo)
+	assert.Equal(t, ErrInvalidHopCommand, err)
+
+	routingInfo.RoutingCommands.HopCommands = []*HopCommand{NewLoopCommand()}
+	_, err = compactLayout.encode(&routingInfo)
+	assert.Equal(t, ErrHopCommandsNotSupported, err)
+	_, err = encodeRoutingInfo(&routingInfo)
+	assert.Equal(t, ErrHopCommandsNotSupported, err)
+}
+
+func TestGetHopCommandsMalformed(t *testing.T) {
+	area := make([]byte, commandsLayout.commandsSize)
+	area[0] = byte(HopCommandAppTag)
+	area[1] = byte(len(area))
+	_, err := getHopCommands(area)
+	assert.Equal(t, ErrInvalidHopCommand, err)
+}
+
+func TestPackForwardMessageWithCommands(t *testing.T) {
+	privs, nodes := createTestPath(t, 3)
+	path := config.E2EPath{IngressProvider: nodes[0], Mixes: nodes[1:2], EgressProvider: nodes[2]}
+	hopCommands := [][]*HopCommand{
+		nil,
+		{NewDropCoverCommand()},
+		{NewLoopCommand(), NewAppTagCommand([]byte("app"))},
+	}
+
+	packet, err := PackForwardMessageWithCommands(path, []float64{0, 0, 0}, hopCommands, []byte("Message"))
+	assert.Nil(t, err)
+	packetBytes, err := EncodePacket(&packet)
+	assert.Nil(t, err)
+
+	for i, priv := range privs {
+		var commands Commands
+		_, commands, packetBytes, err = ProcessSphinxPacket(packetBytes, priv)
+		assert.Nil(t, err)
+		assert.Equal(t, len(hopCommands[i]), len(commands.HopCommands))
+		assert.Equal(t, i == 1, commands.DropCover())
+		assert.Equal(t, i == 2, commands.Loop())
+	}
+
+	// the commands cannot be sent through nodes which do not support any format carrying them
+	nodes[1].PacketVersions = []uint32{PacketVersionCompact}
+	path.Mixes = nodes[1:2]
+	_, err = PackForwardMessageWithCommands(path, []float64{0, 0, 0}, hopCommands, []byte("Message"))
+	assert.Error(t, err)
+
+	_, err = PackForwardMessageWithCommands(path, []float64{0, 0, 0}, hopCommands[:1], []byte("Message"))
+	assert.Error(t, err)
+}
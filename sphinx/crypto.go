@@ -19,6 +19,7 @@ import (
 	"crypto/cipher"
 	"crypto/hmac"
 	"crypto/sha256"
+	"errors"
 )
 
 // AesCtr returns AES XOR ciphertext in counter mode for the given key and plaintext
@@ -72,3 +73,36 @@ func KDF(key []byte) ([]byte, error) {
 func computeMac(key, data []byte) ([]byte, error) {
 	return Hmac(key, data)
 }
+
+// hkdfExtract is the extraction step of HKDF (RFC 5869) instantiated with HMAC-SHA256.
+// It concentrates the entropy of the input keying material into a pseudo-random key.
+func hkdfExtract(salt, ikm []byte) ([]byte, error) {
+	if len(salt) == 0 {
+		salt = make([]byte, sha256.Size)
+	}
+	return Hmac(salt, ikm)
+}
+
+// hkdfExpand is the expansion step of HKDF (RFC 5869) instantiated with HMAC-SHA256.
+// It expands the pseudo-random key into length bytes of output bound to the given info.
+func hkdfExpand(prk, info []byte, length int) ([]byte, error) {
+	if length > 255*sha256.Size {
+		return nil, errors.New("hkdf cannot expand to more than 255 blocks")
+	}
+
+	okm := make([]byte, 0, length)
+	var block []byte
+	for i := byte(1); len(okm) < length; i++ {
+		input := make([]byte, 0, len(block)+len(info)+1)
+		input = append(input, block...)
+		input = append(input, info...)
+		input = append(input, i)
+
+		var err error
+		if block, err = Hmac(prk, input); err != nil {
+			return nil, err
+		}
+		okm = append(okm, block...)
+	}
+	return okm[:length], nil
+}
@@ -118,9 +118,15 @@ func (pub *PublicKey) ToFieldElement() *FieldElement {
 
 // GenerateKeyPair returns public and private keypair bytes for Curve25519 elliptic curve, or an error.
 func GenerateKeyPair() (*PrivateKey, *PublicKey, error) {
+	return GenerateKeyPairFrom(rand.Reader)
+}
+
+// GenerateKeyPairFrom works like GenerateKeyPair, but reads the private key from the given source of randomness.
+// It allows to deterministically recreate the keys, for example in the test vectors.
+func GenerateKeyPairFrom(random io.Reader) (*PrivateKey, *PublicKey, error) {
 	priv := new(PrivateKey)
 	pub := new(PublicKey)
-	if _, err := io.ReadFull(rand.Reader, priv.Bytes()); err != nil {
+	if _, err := io.ReadFull(random, priv.Bytes()); err != nil {
 		return nil, nil, err
 	}
 	curve25519.ScalarBaseMult(&pub.bytes, &priv.bytes)
@@ -132,8 +138,13 @@ func CompareElements(e1, e2 CryptoElement) bool {
 }
 
 func RandomElement() (*FieldElement, error) {
+	return RandomElementFrom(rand.Reader)
+}
+
+// RandomElementFrom returns the field element read from the given source of randomness.
+func RandomElementFrom(random io.Reader) (*FieldElement, error) {
 	b := [32]byte{}
-	if _, err := io.ReadFull(rand.Reader, b[:]); err != nil {
+	if _, err := io.ReadFull(random, b[:]); err != nil {
 		return nil, err
 	}
 	return &FieldElement{
@@ -0,0 +1,126 @@
+// Copyright 2019 The Nym Mixnet Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sphinx
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+const (
+	// envelopeVersion is the version of the format of the end-to-end encrypted messages.
+	envelopeVersion = 1
+
+	// envelopeHeaderSize is the size of the version and the ephemeral public key preceding the ciphertext.
+	envelopeHeaderSize = 1 + PublicKeySize
+
+	// envelopeTagSize is the size of the authentication tag of AES-GCM.
+	envelopeTagSize = 16
+
+	// EnvelopeOverhead is the number of bytes the end-to-end encryption adds to the message.
+	EnvelopeOverhead = envelopeHeaderSize + envelopeTagSize
+
+	// envelopeSalt and envelopeKeyLabel separate the derivation of the key of the envelope
+	// from the other uses of HKDF.
+	envelopeSalt     = "nym-e2e-v1"
+	envelopeKeyLabel = "envelope-key"
+)
+
+var (
+	// ErrInvalidEnvelope defines an error when the end-to-end encrypted message is malformed.
+	ErrInvalidEnvelope = errors.New("invalid end-to-end encrypted message")
+	// ErrEnvelopeAuthentication defines an error when the end-to-end encrypted message was not encrypted
+	// to the key of the recipient or it was modified on its way.
+	ErrEnvelopeAuthentication = errors.New("end-to-end encrypted message could not be authenticated")
+)
+
+// SealMessage encrypts the message to the public key of its recipient, so that only the recipient
+// is able to read it, while the nodes, including its provider, only ever handle the ciphertext.
+// For every message a new ephemeral key is generated from the given source of randomness.
+// The key of AES-256-GCM is derived with HKDF from the secret the ephemeral key shares with the recipient key.
+// The result is the envelope of the version byte, the ephemeral public key and the authenticated ciphertext.
+func SealMessage(random io.Reader, recipientKey *PublicKey, message []byte) ([]byte, error) {
+	ephemeralPriv, ephemeralPub, err := GenerateKeyPairFrom(random)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := envelopeCipher(ephemeralPriv.ToFieldElement(), recipientKey.ToFieldElement(), ephemeralPub, recipientKey)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, envelopeHeaderSize, envelopeHeaderSize+len(message)+envelopeTagSize)
+	header[0] = envelopeVersion
+	copy(header[1:], ephemeralPub.Bytes())
+	// every key is used only once, so the nonce can be constant
+	return aead.Seal(header, make([]byte, aead.NonceSize()), message, header), nil
+}
+
+// OpenMessage decrypts the envelope created by SealMessage for the public key corresponding to privKey.
+// It returns ErrInvalidEnvelope if the envelope is malformed and ErrEnvelopeAuthentication if it cannot
+// be decrypted with the given key.
+func OpenMessage(privKey *PrivateKey, envelope []byte) ([]byte, error) {
+	if len(envelope) < EnvelopeOverhead || envelope[0] != envelopeVersion {
+		return nil, ErrInvalidEnvelope
+	}
+
+	ephemeralPub := BytesToPublicKey(envelope[1:envelopeHeaderSize])
+	ownPub := new(PublicKey)
+	curve25519.ScalarBaseMult(&ownPub.bytes, &privKey.bytes)
+
+	aead, err := envelopeCipher(privKey.ToFieldElement(), ephemeralPub.ToFieldElement(), ephemeralPub, ownPub)
+	if err != nil {
+		return nil, err
+	}
+
+	header := envelope[:envelopeHeaderSize]
+	message, err := aead.Open(nil, make([]byte, aead.NonceSize()), envelope[envelopeHeaderSize:], header)
+	if err != nil {
+		return nil, ErrEnvelopeAuthentication
+	}
+	return message, nil
+}
+
+// envelopeCipher computes the secret shared between the ephemeral key and the recipient key and derives
+// from it the AES-GCM cipher of the envelope. Both public keys are bound to the derived key.
+func envelopeCipher(priv, pub *FieldElement, ephemeralPub, recipientPub *PublicKey) (cipher.AEAD, error) {
+	sharedSecret := new(FieldElement)
+	curve25519.ScalarMult(sharedSecret.el(), priv.el(), pub.el())
+	if subtle.ConstantTimeCompare(sharedSecret.Bytes(), make([]byte, FieldElementSize)) == 1 {
+		return nil, ErrEnvelopeAuthentication
+	}
+
+	prk, err := hkdfExtract([]byte(envelopeSalt), sharedSecret.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	info := append(append([]byte(envelopeKeyLabel), ephemeralPub.Bytes()...), recipientPub.Bytes()...)
+	key, err := hkdfExpand(prk, info, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,58 @@
+// Copyright 2019 The Nym Mixnet Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sphinx
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSealOpenMessage(t *testing.T) {
+	priv, pub, err := GenerateKeyPair()
+	assert.Nil(t, err)
+	message := []byte("Secret message")
+
+	envelope, err := SealMessage(rand.Reader, pub, message)
+	assert.Nil(t, err)
+	assert.Len(t, envelope, len(message)+EnvelopeOverhead)
+
+	opened, err := OpenMessage(priv, envelope)
+	assert.Nil(t, err)
+	assert.Equal(t, message, opened)
+
+	// every message is encrypted with a new ephemeral key
+	another, err := SealMessage(rand.Reader, pub, message)
+	assert.Nil(t, err)
+	assert.NotEqual(t, envelope, another)
+
+	otherPriv, _, err := GenerateKeyPair()
+	assert.Nil(t, err)
+	_, err = OpenMessage(otherPriv, envelope)
+	assert.Equal(t, ErrEnvelopeAuthentication, err)
+
+	envelope[len(envelope)-1] ^= 1
+	_, err = OpenMessage(priv, envelope)
+	assert.Equal(t, ErrEnvelopeAuthentication, err)
+
+	_, err = OpenMessage(priv, envelope[:EnvelopeOverhead-1])
+	assert.Equal(t, ErrInvalidEnvelope, err)
+}
+
+func TestSealMessageLowOrderKey(t *testing.T) {
+	_, err := SealMessage(rand.Reader, BytesToPublicKey(make([]byte, PublicKeySize)), []byte("Message"))
+	assert.Equal(t, ErrEnvelopeAuthentication, err)
+}
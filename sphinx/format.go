@@ -0,0 +1,303 @@
+// Copyright 2019 The Nym Mixnet Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sphinx
+
+import (
+	"crypto/sha256"
+	"sort"
+
+	"github.com/nymtech/nym-mixnet/config"
+)
+
+const (
+	// PacketVersionLioness is the version of the packet format, in which the payload of the packet
+	// is encrypted with the Lioness wide-block cipher and its integrity is verified by the final hop.
+	// Prior to it, packets did not include the version and their payload was encrypted with AES_CTR.
+	PacketVersionLioness = 1
+
+	// PacketVersionHKDF is the version of the packet format, in which every key used by a hop
+	// is derived from the shared secret with HKDF-SHA256, using a distinct label for each of its purposes.
+	PacketVersionHKDF = 2
+
+	// PacketVersionCompact is the version of the packet format, in which the routing information of each hop
+	// is encoded in a fixed binary layout instead of protobuf. The keys are derived as in PacketVersionHKDF.
+	PacketVersionCompact = 3
+
+	// PacketVersionCommands is the version of the packet format, in which the binary routing information
+	// of each hop additionally carries the commands of the sender, such as the instruction to drop cover traffic.
+	PacketVersionCommands = 4
+
+	// CurrentPacketVersion is the version of the packets created by this implementation.
+	CurrentPacketVersion = PacketVersionCommands
+
+	// LegacyPacketVersion is the only version assumed to be supported by the nodes which do not advertise
+	// their versions, that is the oldest version still supported by this implementation. It is understood
+	// by every node able to process the versioned packets, regardless of how old its implementation is.
+	LegacyPacketVersion = PacketVersionLioness
+)
+
+const (
+	// hkdfSalt is the salt of the HKDF extraction step for PacketVersionHKDF.
+	hkdfSalt = "nym-sphinx-v2"
+
+	// labels of the keys derived from the shared secret for PacketVersionHKDF
+	routingKeyLabel  = "routing-encryption"
+	macKeyLabel      = "header-mac"
+	payloadKeyLabel  = "payload"
+	blindingLabel    = "blinding"
+	replayTagLabel   = "replay-tag"
+	surbPayloadLabel = "surb-payload"
+
+	// lionessKeyPrefix separates the derivation of the payload encryption keys from the other uses
+	// of the hop keys in PacketVersionLioness.
+	lionessKeyPrefix = "nym-sphinx-lioness-key"
+
+	// replayTagPrefix separates the derivation of the replay tag from the other uses
+	// of the shared secret in PacketVersionLioness.
+	replayTagPrefix = "nym-sphinx-replay-tag"
+)
+
+// hopKeys holds all the values derived from the secret shared between the sender and a single hop.
+type hopKeys struct {
+	// routingKey is the key of the AES_CTR encryption of the routing block
+	routingKey []byte
+	// macKey is the key of the message authentication code of the routing block
+	macKey []byte
+	// payloadKey is the Lioness key of the payload encryption
+	payloadKey []byte
+	// blinder is the factor by which the hop blinds the public element of the header
+	blinder *FieldElement
+	// replayTag identifies the packet in the replay cache of the hop
+	replayTag []byte
+}
+
+// packetFormat defines the cryptographic operations which differ between the versions of the packet format.
+type packetFormat struct {
+	version uint32
+	// deriveHopKeys computes the keys of a hop given the shared secret
+	deriveHopKeys func(sharedSecret []byte) (*hopKeys, error)
+	// deriveSURBPayloadKey expands the key included in the reply block into the Lioness key
+	deriveSURBPayloadKey func(key []byte) ([]byte, error)
+	// encodeRoutingInfo encodes the routing information of a hop into a slot of RoutingInfoSize bytes
+	encodeRoutingInfo func(routingInfo *RoutingInfo) ([]byte, error)
+	// decodeRoutingInfo recovers the routing information of a hop from its slot
+	decodeRoutingInfo func(encoded []byte) (RoutingInfo, error)
+}
+
+// packetFormats holds the definitions of all the packet format versions supported by this implementation.
+var packetFormats = map[uint32]*packetFormat{
+	PacketVersionLioness: {
+		version:              PacketVersionLioness,
+		deriveHopKeys:        deriveLionessHopKeys,
+		deriveSURBPayloadKey: deriveLionessKey,
+		encodeRoutingInfo:    encodeRoutingInfo,
+		decodeRoutingInfo:    decodeRoutingInfo,
+	},
+	PacketVersionHKDF: {
+		version:              PacketVersionHKDF,
+		deriveHopKeys:        deriveHKDFHopKeys,
+		deriveSURBPayloadKey: deriveHKDFSURBPayloadKey,
+		encodeRoutingInfo:    encodeRoutingInfo,
+		decodeRoutingInfo:    decodeRoutingInfo,
+	},
+	PacketVersionCompact: {
+		version:              PacketVersionCompact,
+		deriveHopKeys:        deriveHKDFHopKeys,
+		deriveSURBPayloadKey: deriveHKDFSURBPayloadKey,
+		encodeRoutingInfo:    compactLayout.encode,
+		decodeRoutingInfo:    compactLayout.decode,
+	},
+	PacketVersionCommands: {
+		version:              PacketVersionCommands,
+		deriveHopKeys:        deriveHKDFHopKeys,
+		deriveSURBPayloadKey: deriveHKDFSURBPayloadKey,
+		encodeRoutingInfo:    commandsLayout.encode,
+		decodeRoutingInfo:    commandsLayout.decode,
+	},
+}
+
+// getPacketFormat returns the definition of the given packet format version,
+// or ErrUnsupportedPacketVersion if the version is not known.
+func getPacketFormat(version uint32) (*packetFormat, error) {
+	format, ok := packetFormats[version]
+	if !ok {
+		return nil, ErrUnsupportedPacketVersion
+	}
+	return format, nil
+}
+
+// SupportedPacketVersions returns, in ascending order, all the packet format versions this implementation can process.
+func SupportedPacketVersions() []uint32 {
+	versions := make([]uint32, 0, len(packetFormats))
+	for version := range packetFormats {
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+	return versions
+}
+
+// IsSupportedPacketVersion checks whether this implementation can process the packets of the given format version.
+func IsSupportedPacketVersion(version uint32) bool {
+	_, ok := packetFormats[version]
+	return ok
+}
+
+// SelectPacketVersion returns the newest packet format version supported both by this implementation
+// and by every given node, as advertised in the PacketVersions of its configuration.
+// The nodes which do not advertise any versions are assumed to support only the LegacyPacketVersion.
+// The packets are created in an older version, if the routing information of the path cannot be encoded in it.
+// If there is no such version, ErrNoCommonPacketVersion is returned.
+func SelectPacketVersion(nodes []config.MixConfig) (uint32, error) {
+	versions := SupportedPacketVersions()
+	for i := len(versions) - 1; i >= 0; i-- {
+		if supportedByAll(nodes, versions[i]) {
+			return versions[i], nil
+		}
+	}
+	return 0, ErrNoCommonPacketVersion
+}
+
+// selectPacketFormat returns the newest packet format supported by all of the nodes, in which the routing
+// information of every hop, given its routing commands, can be encoded. An otherwise preferred version is skipped
+// if the identifier or the address of any hop does not fit into the slots of its layout, or if it cannot carry
+// the hop commands. If none of the common versions can encode the routing information, the encoding error
+// of the newest one is returned.
+func selectPacketFormat(nodes []config.MixConfig, commands []Commands, dest config.ClientConfig) (*packetFormat, error) {
+	var encodingErr error
+	versions := SupportedPacketVersions()
+	for i := len(versions) - 1; i >= 0; i-- {
+		if !supportedByAll(nodes, versions[i]) {
+			continue
+		}
+		format := packetFormats[versions[i]]
+		err := format.canEncode(nodes, commands, dest)
+		if err == nil {
+			return format, nil
+		}
+		if encodingErr == nil {
+			encodingErr = err
+		}
+	}
+	if encodingErr != nil {
+		return nil, encodingErr
+	}
+	return nil, ErrNoCommonPacketVersion
+}
+
+// canEncode checks whether the routing information of every hop can be encoded in the format.
+func (f *packetFormat) canEncode(nodes []config.MixConfig, commands []Commands, dest config.ClientConfig) error {
+	for i := range nodes {
+		routing := hopRoutingInfo(nodes, commands, dest, i)
+		if _, err := f.encodeRoutingInfo(&routing); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// supportedByAll checks whether all of the nodes support the given packet format version.
+func supportedByAll(nodes []config.MixConfig, version uint32) bool {
+	for _, node := range nodes {
+		if len(node.PacketVersions) == 0 {
+			if version != LegacyPacketVersion {
+				return false
+			}
+			continue
+		}
+
+		supported := false
+		for _, v := range node.PacketVersions {
+			if v == version {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			return false
+		}
+	}
+	return true
+}
+
+// deriveHKDFHopKeys derives the keys of a hop for PacketVersionHKDF. A single pseudo-random key
+// is extracted from the shared secret and then expanded into each of the keys with its own label.
+func deriveHKDFHopKeys(sharedSecret []byte) (*hopKeys, error) {
+	prk, err := hkdfExtract([]byte(hkdfSalt), sharedSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := new(hopKeys)
+	if keys.routingKey, err = hkdfExpand(prk, []byte(routingKeyLabel), K); err != nil {
+		return nil, err
+	}
+	if keys.macKey, err = hkdfExpand(prk, []byte(macKeyLabel), sha256.Size); err != nil {
+		return nil, err
+	}
+	if keys.payloadKey, err = hkdfExpand(prk, []byte(payloadKeyLabel), LionessKeySize); err != nil {
+		return nil, err
+	}
+	blinder, err := hkdfExpand(prk, []byte(blindingLabel), FieldElementSize)
+	if err != nil {
+		return nil, err
+	}
+	keys.blinder = BytesToFieldElement(blinder)
+	if keys.replayTag, err = hkdfExpand(prk, []byte(replayTagLabel), sha256.Size); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// deriveHKDFSURBPayloadKey expands the payload key of the reply block for PacketVersionHKDF.
+func deriveHKDFSURBPayloadKey(key []byte) ([]byte, error) {
+	prk, err := hkdfExtract([]byte(hkdfSalt), key)
+	if err != nil {
+		return nil, err
+	}
+	return hkdfExpand(prk, []byte(surbPayloadLabel), LionessKeySize)
+}
+
+// deriveLionessHopKeys derives the keys of a hop for PacketVersionLioness. In this version the same key
+// is used for both the encryption and the authentication of the routing block.
+func deriveLionessHopKeys(sharedSecret []byte) (*hopKeys, error) {
+	aesS, err := KDF(sharedSecret)
+	if err != nil {
+		return nil, err
+	}
+	encKey, err := KDF(aesS)
+	if err != nil {
+		return nil, err
+	}
+	payloadKey, err := deriveLionessKey(encKey)
+	if err != nil {
+		return nil, err
+	}
+	blinder, err := computeBlindingFactor(aesS)
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	h.Write([]byte(replayTagPrefix))
+	h.Write(sharedSecret)
+
+	return &hopKeys{
+		routingKey: encKey,
+		macKey:     encKey,
+		payloadKey: payloadKey,
+		blinder:    blinder,
+		replayTag:  h.Sum(nil),
+	}, nil
+}
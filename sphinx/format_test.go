@@ -0,0 +1,268 @@
+// Copyright 2019 The Nym Mixnet Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sphinx
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/nymtech/nym-mixnet/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func decodeHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	assert.Nil(t, err)
+	return b
+}
+
+// RFC 5869, Appendix A.1
+func TestHKDFKnownAnswer(t *testing.T) {
+	ikm := decodeHex(t, "0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b")
+	salt := decodeHex(t, "000102030405060708090a0b0c")
+	info := decodeHex(t, "f0f1f2f3f4f5f6f7f8f9")
+
+	prk, err := hkdfExtract(salt, ikm)
+	assert.Nil(t, err)
+	assert.Equal(t, decodeHex(t, "077709362c2e32df0ddc3f0dc47bba6390b6c73bb50f9c3122ec844ad7c2b3e5"), prk)
+
+	okm, err := hkdfExpand(prk, info, 42)
+	assert.Nil(t, err)
+	assert.Equal(t,
+		decodeHex(t, "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf34007208d5b887185865"),
+		okm)
+}
+
+func TestHKDFExpandTooLong(t *testing.T) {
+	_, err := hkdfExpand(make([]byte, 32), nil, 255*32+1)
+	assert.Error(t, err)
+}
+
+func TestDeriveHKDFHopKeysKnownAnswer(t *testing.T) {
+	secret := make([]byte, 32)
+	for i := range secret {
+		secret[i] = byte(i)
+	}
+
+	keys, err := deriveHKDFHopKeys(secret)
+	assert.Nil(t, err)
+
+	assert.Equal(t, decodeHex(t, "fae39e06a7cdad0bf7796bdd6ad57f77"), keys.routingKey)
+	assert.Equal(t, decodeHex(t, "1dd6f065735d1de940e406e3ce8a52f0f5b7da27223133de363ca7c172457c75"), keys.macKey)
+	assert.Equal(t, decodeHex(t, "372ca020fcd4f9270ecc6bc716bef1da24d28db32fdeba627af41b86129159812429096b4bc8f8a8f2f5031f15f20b13"+
+		"e23c37e9667937316247382296acc21fbb666ecfdbe4b8d6d338f5d6d0dc5ff6da2ee6d001ceac145188275a4132040d5c2da5b14a9cf26265015b133d81c51c637b8425002b0bdba910220b4a77c19e"),
+		keys.payloadKey)
+	assert.Equal(t, decodeHex(t, "3738db81b1b062cebcd021f842b91d7747d150aea26a1a9592ae8f1b6b45acba"), keys.blinder.Bytes())
+	assert.Equal(t, decodeHex(t, "43046141f59fa87774e84a012dfd54ab610bad492ab8c6b91fc8172cba275da5"), keys.replayTag)
+
+	surbKey, err := deriveHKDFSURBPayloadKey(secret[:K])
+	assert.Nil(t, err)
+	assert.Equal(t, decodeHex(t, "81c78a1ed1c7b6c720cba701218748f36d6315d65537e49ef86e3dcae03fa4808433947667a1a37ce7d3789a7d6eb1bc"+
+		"ce2d3e3e083521f3b41d4657035b3ec90a4ba15ca13fd491de50d1fe020434b80e082f0e66f0f92bc6da630ac0de1f8c9ab856ef8cf40d8597e9cf73e9a63dd43907d5dfde3f0bcc7531676b86db1f91"),
+		surbKey)
+}
+
+func TestDeriveHKDFHopKeysAreSeparated(t *testing.T) {
+	keys, err := deriveHKDFHopKeys([]byte("11111111111111111111111111111111"))
+	assert.Nil(t, err)
+
+	// no key is a prefix of any other, even though they are all expanded from the same secret
+	derived := [][]byte{keys.routingKey, keys.macKey, keys.payloadKey, keys.blinder.Bytes(), keys.replayTag}
+	for i := range derived {
+		for j := range derived {
+			if i != j {
+				assert.NotEqual(t, derived[i][:K], derived[j][:K])
+			}
+		}
+	}
+}
+
+func TestSupportedPacketVersions(t *testing.T) {
+	assert.Equal(t,
+		[]uint32{PacketVersionLioness, PacketVersionHKDF, PacketVersionCompact, PacketVersionCommands},
+		SupportedPacketVersions(),
+	)
+
+	for _, version := range SupportedPacketVersions() {
+		format, err := getPacketFormat(version)
+		assert.Nil(t, err)
+		assert.Equal(t, version, format.version)
+	}
+
+	_, err := getPacketFormat(0)
+	assert.Equal(t, ErrUnsupportedPacketVersion, err)
+}
+
+// packTestMessage mirrors PackForwardMessage for an arbitrary packet format version.
+func packTestMessage(t *testing.T, version uint32, nodes []config.MixConfig, message []byte) SphinxPacket {
+	format, err := getPacketFormat(version)
+	assert.Nil(t, err)
+
+	forwardMessage, err := encodeForwardMessage(message, nil)
+	assert.Nil(t, err)
+	paddedMessage, err := padMessage(forwardMessage)
+	assert.Nil(t, err)
+
+	delays := make([]float64, len(nodes))
+	dest := config.ClientConfig{Id: "DestinationId", Host: "DestinationAddress", Port: "9998"}
+	commands, err := routingCommands(nodes, delays, nil, false)
+	assert.Nil(t, err)
+	headerInitials, header, err := createHeader(rand.Reader, format, nodes, commands, dest)
+	assert.Nil(t, err)
+	payload, err := encapsulateContent(format, headerInitials, paddedMessage)
+	assert.Nil(t, err)
+	return SphinxPacket{Hdr: &header, Pld: payload, Version: version}
+}
+
+func TestProcessSphinxPacketAllVersions(t *testing.T) {
+	message := []byte("Message in every format")
+	for _, version := range SupportedPacketVersions() {
+		privs, nodes := createTestPath(t, 3)
+		packet := packTestMessage(t, version, nodes, message)
+
+		packetBytes, err := EncodePacket(&packet)
+		assert.Nil(t, err)
+		assert.Len(t, packetBytes, PacketSize)
+
+		for _, priv := range privs {
+			_, _, packetBytes, err = ProcessSphinxPacket(packetBytes, priv)
+			assert.Nil(t, err)
+		}
+
+		final, err := DecodePacket(packetBytes)
+		assert.Nil(t, err)
+		assert.Equal(t, version, final.Version)
+		msg, _, err := UnpackForwardMessage(final.Pld)
+		assert.Nil(t, err)
+		assert.Equal(t, message, msg)
+	}
+}
+
+func TestProcessSphinxPacketVersionMismatch(t *testing.T) {
+	privs, nodes := createTestPath(t, 3)
+	packet := packTestMessage(t, PacketVersionHKDF, nodes, []byte("Message"))
+
+	// keys derived in the legacy way do not verify the header created with HKDF
+	packet.Version = PacketVersionLioness
+	packetBytes, err := EncodePacket(&packet)
+	assert.Nil(t, err)
+	_, _, _, err = ProcessSphinxPacket(packetBytes, privs[0])
+	assert.Error(t, err)
+}
+
+func TestSelectPacketVersion(t *testing.T) {
+	_, nodes := createTestPath(t, 3)
+	version, err := SelectPacketVersion(nodes)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(CurrentPacketVersion), version)
+
+	// nodes which do not advertise their versions are assumed to support only the legacy one
+	for i := range nodes {
+		nodes[i].PacketVersions = nil
+	}
+	version, err = SelectPacketVersion(nodes)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(LegacyPacketVersion), version)
+
+	nodes[0].PacketVersions = []uint32{PacketVersionLioness, PacketVersionHKDF, PacketVersionCompact}
+	nodes[1].PacketVersions = []uint32{PacketVersionLioness, PacketVersionHKDF}
+	nodes[2].PacketVersions = []uint32{PacketVersionHKDF, PacketVersionCompact}
+	version, err = SelectPacketVersion(nodes)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(PacketVersionHKDF), version)
+
+	nodes[2].PacketVersions = []uint32{PacketVersionCompact, 42}
+	_, err = SelectPacketVersion(nodes)
+	assert.Equal(t, ErrNoCommonPacketVersion, err)
+}
+
+func TestSelectPacketVersionMixedNodes(t *testing.T) {
+	_, nodes := createTestPath(t, 4)
+	nodes[0].PacketVersions = SupportedPacketVersions()
+	nodes[1].PacketVersions = []uint32{PacketVersionLioness, PacketVersionHKDF, PacketVersionCompact}
+	nodes[2].PacketVersions = nil
+	nodes[3].PacketVersions = SupportedPacketVersions()
+
+	// a single node not advertising its versions restricts the whole path to the legacy version
+	version, err := SelectPacketVersion(nodes)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(LegacyPacketVersion), version)
+
+	nodes[2].PacketVersions = []uint32{PacketVersionHKDF, PacketVersionCompact, PacketVersionCommands}
+	version, err = SelectPacketVersion(nodes)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(PacketVersionCompact), version)
+
+	// the version-less node cannot be reached by the path of nodes without the legacy version
+	nodes[1].PacketVersions = []uint32{PacketVersionCompact}
+	nodes[2].PacketVersions = nil
+	_, err = SelectPacketVersion(nodes)
+	assert.Equal(t, ErrNoCommonPacketVersion, err)
+}
+
+func TestPackForwardMessageSelectsVersion(t *testing.T) {
+	privs, nodes := createTestPath(t, 3)
+	for i := range nodes {
+		nodes[i].PacketVersions = []uint32{PacketVersionLioness}
+	}
+	path := config.E2EPath{IngressProvider: nodes[0], Mixes: nodes[1:2], EgressProvider: nodes[2]}
+	packet, err := PackForwardMessage(path, []float64{0.1, 0.2, 0.3}, []byte("Message"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(PacketVersionLioness), packet.Version)
+
+	packetBytes, err := EncodePacket(&packet)
+	assert.Nil(t, err)
+	version, err := PacketVersion(packetBytes)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(PacketVersionLioness), version)
+
+	_, _, _, err = ProcessSphinxPacket(packetBytes, privs[0])
+	assert.Nil(t, err)
+}
+
+func TestPackForwardMessageLongAddress(t *testing.T) {
+	privs, nodes := createTestPath(t, 3)
+	nodes[1].Host = "2001:0db8:85a3:0000:0000:8a2e:0370:7334"
+	nodes[1].Port = "65535"
+	path := config.E2EPath{IngressProvider: nodes[0], Mixes: nodes[1:2], EgressProvider: nodes[2]}
+
+	// the address does not fit into the layout of the current version, so an older one is used instead
+	packet, err := PackForwardMessage(path, []float64{0, 0, 0}, []byte("Message"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(PacketVersionCompact), packet.Version)
+
+	packetBytes, err := EncodePacket(&packet)
+	assert.Nil(t, err)
+	hop, _, _, err := ProcessSphinxPacket(packetBytes, privs[0])
+	assert.Nil(t, err)
+	assert.Equal(t, nodes[1].Host+":"+nodes[1].Port, hop.Address)
+
+	surb, _, err := CreateSURB(path, []float64{0, 0, 0})
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(PacketVersionCompact), surb.Version)
+
+	// none of the versions able to carry the commands can encode the address
+	hopCommands := [][]*HopCommand{{NewDropCoverCommand()}, nil, nil}
+	_, err = PackForwardMessageWithCommands(path, []float64{0, 0, 0}, hopCommands, []byte("Message"))
+	assert.Equal(t, ErrRoutingInfoTooLong, err)
+
+	// nor can any version encode the address which does not fit into the routing information at all
+	nodes[1].Host = strings.Repeat("long-host-name.", 10) + "example.com"
+	path.Mixes = nodes[1:2]
+	_, err = PackForwardMessage(path, []float64{0, 0, 0}, []byte("Message"))
+	assert.Equal(t, ErrRoutingInfoTooLong, err)
+}
@@ -0,0 +1,149 @@
+// Copyright 2019 The Nym Mixnet Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sphinx
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+const (
+	// lionessLeftSize is the size of the left part of the block processed by Lioness.
+	// It is equal to the output size of the hash function used in the hash rounds.
+	lionessLeftSize = sha256.Size
+
+	// lionessRoundKeySize is the size of the key of a single Lioness round.
+	lionessRoundKeySize = lionessLeftSize
+
+	// LionessKeySize is the size of the Lioness key, consisting of the keys of all four rounds.
+	LionessKeySize = 4 * lionessRoundKeySize
+)
+
+var (
+	// ErrLionessBlockTooShort defines an error when the block is too short to be processed by Lioness.
+	ErrLionessBlockTooShort = fmt.Errorf("lioness block has to be longer than %v bytes", lionessLeftSize)
+	// ErrInvalidLionessKey defines an error when the Lioness key has invalid length.
+	ErrInvalidLionessKey = fmt.Errorf("lioness key has to be exactly %v bytes long", LionessKeySize)
+)
+
+// LionessEncrypt encrypts the block using the Lioness wide-block cipher, built from AES_CTR as the stream cipher
+// and HMAC-SHA256 as the keyed hash function. Unlike with a stream cipher, modifying any bit of the ciphertext
+// garbles the entire decrypted block, which makes the payload resistant to tagging attacks.
+// The returned ciphertext has the same length as the block.
+func LionessEncrypt(key, block []byte) ([]byte, error) {
+	k, l, r, err := lionessSplit(key, block)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := lionessStreamRound(k[0], l, r); err != nil {
+		return nil, err
+	}
+	if err := lionessHashRound(k[1], l, r); err != nil {
+		return nil, err
+	}
+	if err := lionessStreamRound(k[2], l, r); err != nil {
+		return nil, err
+	}
+	if err := lionessHashRound(k[3], l, r); err != nil {
+		return nil, err
+	}
+	return append(l, r...), nil
+}
+
+// LionessDecrypt reverses LionessEncrypt.
+func LionessDecrypt(key, block []byte) ([]byte, error) {
+	k, l, r, err := lionessSplit(key, block)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := lionessHashRound(k[3], l, r); err != nil {
+		return nil, err
+	}
+	if err := lionessStreamRound(k[2], l, r); err != nil {
+		return nil, err
+	}
+	if err := lionessHashRound(k[1], l, r); err != nil {
+		return nil, err
+	}
+	if err := lionessStreamRound(k[0], l, r); err != nil {
+		return nil, err
+	}
+	return append(l, r...), nil
+}
+
+// lionessSplit divides the key into the round keys and copies the block into its left and right parts.
+func lionessSplit(key, block []byte) ([4][]byte, []byte, []byte, error) {
+	var roundKeys [4][]byte
+	if len(key) != LionessKeySize {
+		return roundKeys, nil, nil, ErrInvalidLionessKey
+	}
+	if len(block) <= lionessLeftSize {
+		return roundKeys, nil, nil, ErrLionessBlockTooShort
+	}
+
+	for i := range roundKeys {
+		roundKeys[i] = key[i*lionessRoundKeySize : (i+1)*lionessRoundKeySize]
+	}
+
+	l := make([]byte, lionessLeftSize, len(block))
+	copy(l, block[:lionessLeftSize])
+	r := make([]byte, len(block)-lionessLeftSize)
+	copy(r, block[lionessLeftSize:])
+	return roundKeys, l, r, nil
+}
+
+// lionessStreamRound encrypts the right part with the stream cipher keyed by the left part and the round key.
+func lionessStreamRound(roundKey, l, r []byte) error {
+	streamKey, err := KDF(XorBytes(l, roundKey))
+	if err != nil {
+		return err
+	}
+	enc, err := AesCtr(streamKey, r)
+	if err != nil {
+		return err
+	}
+	copy(r, enc)
+	return nil
+}
+
+// lionessHashRound masks the left part with the keyed hash of the right part.
+func lionessHashRound(roundKey, l, r []byte) error {
+	h, err := Hmac(roundKey, r)
+	if err != nil {
+		return err
+	}
+	copy(l, XorBytes(l, h))
+	return nil
+}
+
+// deriveLionessKey expands the symmetric key shared with a hop into the key of the Lioness cipher.
+func deriveLionessKey(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, errors.New("cannot derive lioness key from an empty key")
+	}
+
+	lionessKey := make([]byte, 0, LionessKeySize)
+	for i := 0; i < 4; i++ {
+		roundKey, err := hash(append([]byte(fmt.Sprintf("%s%d", lionessKeyPrefix, i)), key...))
+		if err != nil {
+			return nil, err
+		}
+		lionessKey = append(lionessKey, roundKey...)
+	}
+	return lionessKey, nil
+}
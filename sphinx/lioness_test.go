@@ -0,0 +1,64 @@
+// Copyright 2019 The Nym Mixnet Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sphinx
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLionessEncryptDecrypt(t *testing.T) {
+	key, err := deriveLionessKey([]byte("1111111111111111"))
+	assert.Nil(t, err)
+	assert.Len(t, key, LionessKeySize)
+
+	block := bytes.Repeat([]byte("Plaintext block "), 64)
+	enc, err := LionessEncrypt(key, block)
+	assert.Nil(t, err)
+	assert.Len(t, enc, len(block))
+	assert.NotEqual(t, block, enc)
+
+	dec, err := LionessDecrypt(key, enc)
+	assert.Nil(t, err)
+	assert.Equal(t, block, dec)
+}
+
+func TestLionessTamperingGarblesBlock(t *testing.T) {
+	key, err := deriveLionessKey([]byte("1111111111111111"))
+	assert.Nil(t, err)
+
+	block := make([]byte, 1024)
+	enc, err := LionessEncrypt(key, block)
+	assert.Nil(t, err)
+
+	// flipping a single bit at the end of the ciphertext has to affect the beginning of the plaintext
+	enc[len(enc)-1] ^= 0x01
+	dec, err := LionessDecrypt(key, enc)
+	assert.Nil(t, err)
+	assert.NotEqual(t, block[:K], dec[:K])
+}
+
+func TestLionessInvalidInput(t *testing.T) {
+	key, err := deriveLionessKey([]byte("1111111111111111"))
+	assert.Nil(t, err)
+
+	_, err = LionessEncrypt(key, make([]byte, lionessLeftSize))
+	assert.Equal(t, ErrLionessBlockTooShort, err)
+
+	_, err = LionessEncrypt(key[:K], make([]byte, 1024))
+	assert.Equal(t, ErrInvalidLionessKey, err)
+}
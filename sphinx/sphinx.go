@@ -20,12 +20,16 @@
 package sphinx
 
 import (
-	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
 	"errors"
 	"fmt"
-	"strings"
+	"io"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/nymtech/nym-mixnet/config"
@@ -34,36 +38,254 @@ import (
 )
 
 const (
-	// K TODO: document padding-related Sphinx parameter
-	K            = 16
-	headerLength = 192
+	// K is the security parameter of the packet format in bytes. It defines the length of the symmetric keys
+	// derived from the shared secrets.
+	K = 16
+
+	// MaxPathLength is the maximum number of hops, including both providers, a packet can traverse.
+	// Headers are always padded as if the packet was going through MaxPathLength hops,
+	// so that the header size does not reveal the position of the node on the path.
+	MaxPathLength = 5
+
+	// RoutingInfoSize is the size of the routing information of a single hop inside the encrypted routing block.
+	RoutingInfoSize = 160
+
+	// MacSize is the size of the message authentication code protecting the routing block.
+	MacSize = sha256.Size
+
+	// hopSlotSize is the number of bytes a single hop occupies in the routing block,
+	// i.e. its routing information followed by the MAC for the next hop.
+	hopSlotSize = RoutingInfoSize + MacSize
+
+	// BetaSize is the constant size of the encrypted routing block of every header.
+	BetaSize = MaxPathLength * hopSlotSize
+
+	// routingInfoLengthSize is the size of the length prefix of the encoded routing information.
+	routingInfoLengthSize = 2
+
+	// PayloadSize is the constant size of the payload of every packet sent through the network.
+	// Messages are padded to this size, so that the payload length does not allow to link packets across hops.
+	PayloadSize = 2048
+
+	// MaxMessageSize is the maximum length of a message that fits into a single forward packet payload
+	// without any attached reply block. The payload always contains the integrity tag,
+	// the byte describing its content and at least a single byte of padding.
+	MaxMessageSize = maxPaddedMessageSize - forwardMessageHeaderSize
+
+	// payloadIntegrityTagSize is the size of the zero-filled tag preceding the padded message in the payload.
+	// As the payload is encrypted with a wide-block cipher, any modification of the payload on its way
+	// garbles the tag, which allows the final hop to detect and discard tampered payloads.
+	payloadIntegrityTagSize = K
+
+	// maxPaddedMessageSize is the maximum length of data, which can be padded into a single payload.
+	maxPaddedMessageSize = PayloadSize - payloadIntegrityTagSize - 1
+
+	// forwardMessageHeaderSize is the size of the byte preceding the message in the forward payload,
+	// signalling whether a reply block is attached to the message.
+	forwardMessageHeaderSize = 1
+
+	// surbLengthSize is the size of the length prefix of the reply block attached to a forward message.
+	surbLengthSize = 2
+
+	noSURBAttached = 0x00
+	surbAttached   = 0x01
+
+	// paddingStartByte marks the beginning of the padding appended to the message.
+	// It is followed only by zero bytes until the end of the payload.
+	paddingStartByte = 0x01
+)
+
+var (
+	// ErrPathTooLong defines an error when the path has more hops than the header can encode.
+	ErrPathTooLong = fmt.Errorf("path cannot be longer than %v hops", MaxPathLength)
+	// ErrInvalidBetaSize defines an error when the routing block of a received header has invalid length.
+	ErrInvalidBetaSize = fmt.Errorf("routing block has to be exactly %v bytes long", BetaSize)
+	// ErrRoutingInfoTooLong defines an error when the routing information of a hop does not fit in its slot.
+	ErrRoutingInfoTooLong = fmt.Errorf("encoded routing information cannot be longer than %v bytes",
+		RoutingInfoSize-routingInfoLengthSize)
+	// ErrMessageTooLong defines an error when the message does not fit into a single packet payload.
+	ErrMessageTooLong = fmt.Errorf("message cannot be longer than %v bytes", MaxMessageSize)
+	// ErrInvalidPayloadSize defines an error when the payload does not have the size defined for the network.
+	ErrInvalidPayloadSize = fmt.Errorf("payload has to be exactly %v bytes long", PayloadSize)
+	// ErrInvalidPadding defines an error when the padding of the received payload is malformed.
+	ErrInvalidPadding = errors.New("invalid payload padding")
+	// ErrUnsupportedPacketVersion defines an error when the packet uses an unknown version of the packet format.
+	ErrUnsupportedPacketVersion = errors.New("unsupported packet format version")
+	// ErrNoCommonPacketVersion defines an error when the nodes on the path do not support any common
+	// version of the packet format.
+	ErrNoCommonPacketVersion = errors.New("no packet format version is supported by all the nodes on the path")
+	// ErrTamperedPayload defines an error when the integrity check of the payload at the final hop failed.
+	ErrTamperedPayload = errors.New("payload integrity check failed")
+	// ErrReplayedPacket defines an error when the processed packet was already seen by the node.
+	ErrReplayedPacket = errors.New("packet was already processed")
+	// ErrInvalidForwardMessage defines an error when the content of the received forward payload is malformed.
+	ErrInvalidForwardMessage = errors.New("invalid forward message")
 )
 
 // PackForwardMessage encapsulates the given message into the cryptographic Sphinx packet format.
 // As arguments the function takes the path, consisting of the sequence of nodes the packet should traverse
 // and the destination of the message, a set of delays and the information about the curve used to perform cryptographic
 // operations.
+// The packet uses the newest version of the packet format supported by all the nodes on the path.
 // In order to encapsulate the message PackForwardMessage computes two parts of the packet - the header and
-// the encrypted payload. If creating of any of the packet block failed, an error is returned. Otherwise,
+// the encrypted payload. Before the encryption the message is padded to PayloadSize bytes,
+// and if it does not fit into a single payload, ErrMessageTooLong is returned.
+// If creating of any of the packet block failed, an error is returned. Otherwise,
 // a Sphinx packet format is returned.
 func PackForwardMessage(path config.E2EPath, delays []float64, message []byte) (SphinxPacket, error) {
+	return PackForwardMessageWithSURB(path, delays, message, nil)
+}
+
+// PackForwardMessageWithSURB works like PackForwardMessage, but additionally attaches the given
+// single use reply block to the message, which allows the recipient to reply to the anonymous sender.
+// The reply block is encrypted together with the message, so it is visible only to the recipient.
+// If surb is nil, no reply block is attached.
+func PackForwardMessageWithSURB(path config.E2EPath,
+	delays []float64,
+	message []byte,
+	surb *SURB,
+) (SphinxPacket, error) {
+	return PackForwardMessageFrom(rand.Reader, path, delays, message, surb)
+}
+
+// PackForwardMessageFrom works like PackForwardMessageWithSURB, but reads all the randomness required
+// to create the packet from the given source instead of crypto/rand. Given the same source, path,
+// delays and message it always creates exactly the same packet, which is what the test vectors rely on.
+// The randomness is consumed in a fixed order: first FieldElementSize bytes of the initial secret element,
+// followed by the padding of the routing block of the final hop.
+// The source has to be cryptographically secure for any packet which is actually sent to the network.
+func PackForwardMessageFrom(random io.Reader,
+	path config.E2EPath,
+	delays []float64,
+	message []byte,
+	surb *SURB,
+) (SphinxPacket, error) {
+	return packForwardMessage(random, path, delays, nil, message, surb)
+}
+
+// PackForwardMessageWithCommands works like PackForwardMessage, but additionally includes the given commands
+// in the routing information of the hops, so that hopCommands[i] is read by the i-th node on the path,
+// starting from the ingress provider. The commands of the egress provider are read by it together with
+// the address of the recipient. If the nodes on the path do not share any packet format version able
+// to carry the commands, ErrHopCommandsNotSupported is returned.
+func PackForwardMessageWithCommands(path config.E2EPath,
+	delays []float64,
+	hopCommands [][]*HopCommand,
+	message []byte,
+) (SphinxPacket, error) {
+	return packForwardMessage(rand.Reader, path, delays, hopCommands, message, nil)
+}
+
+// packForwardMessage implements all the variants of PackForwardMessage.
+func packForwardMessage(random io.Reader,
+	path config.E2EPath,
+	delays []float64,
+	hopCommands [][]*HopCommand,
+	message []byte,
+	surb *SURB,
+) (SphinxPacket, error) {
+	forwardMessage, err := encodeForwardMessage(message, surb)
+	if err != nil {
+		return SphinxPacket{}, err
+	}
+
+	paddedMessage, err := padMessage(forwardMessage)
+	if err != nil {
+		return SphinxPacket{}, err
+	}
+
 	nodes := []config.MixConfig{path.IngressProvider}
 	nodes = append(nodes, path.Mixes...)
 	nodes = append(nodes, path.EgressProvider)
 	dest := path.Recipient
 
-	headerInitials, header, err := createHeader(nodes, delays, dest)
+	commands, err := routingCommands(nodes, delays, hopCommands, false)
+	if err != nil {
+		return SphinxPacket{}, fmt.Errorf("error in PackForwardMessage - %v", err)
+	}
+	format, err := selectPacketFormat(nodes, commands, dest)
+	if err != nil {
+		return SphinxPacket{}, err
+	}
+
+	headerInitials, header, err := createHeader(random, format, nodes, commands, dest)
 	if err != nil {
 		errMsg := fmt.Errorf("error in PackForwardMessage - createHeader failed: %v", err)
 		return SphinxPacket{}, errMsg
 	}
 
-	payload, err := encapsulateContent(headerInitials, message)
+	payload, err := encapsulateContent(format, headerInitials, paddedMessage)
 	if err != nil {
 		errMsg := fmt.Errorf("error in PackForwardMessage - encapsulateContent failed: %v", err)
 		return SphinxPacket{}, errMsg
 	}
-	return SphinxPacket{Hdr: &header, Pld: payload}, nil
+	return SphinxPacket{Hdr: &header, Pld: payload, Version: format.version}, nil
+}
+
+// UnpackForwardMessage recovers the message, and the attached reply block if there was any,
+// from the fully decrypted payload of a forward packet.
+// UnpackForwardMessage returns an error if the payload is malformed.
+func UnpackForwardMessage(payload []byte) ([]byte, *SURB, error) {
+	forwardMessage, err := UnpadMessage(payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	return decodeForwardMessage(forwardMessage)
+}
+
+// encodeForwardMessage prefixes the message with the byte signalling whether a reply block is attached.
+// If the reply block is present, it is marshalled and put, together with its length, between that byte
+// and the message.
+func encodeForwardMessage(message []byte, surb *SURB) ([]byte, error) {
+	if surb == nil {
+		return append([]byte{noSURBAttached}, message...), nil
+	}
+
+	surbBytes, err := proto.Marshal(surb)
+	if err != nil {
+		errMsg := fmt.Errorf("error in encodeForwardMessage - marshal of SURB failed: %v", err)
+		return nil, errMsg
+	}
+	if len(surbBytes) > PayloadSize {
+		return nil, ErrMessageTooLong
+	}
+
+	encoded := make([]byte, forwardMessageHeaderSize+surbLengthSize,
+		forwardMessageHeaderSize+surbLengthSize+len(surbBytes)+len(message))
+	encoded[0] = surbAttached
+	binary.BigEndian.PutUint16(encoded[forwardMessageHeaderSize:], uint16(len(surbBytes)))
+	encoded = append(encoded, surbBytes...)
+	return append(encoded, message...), nil
+}
+
+// decodeForwardMessage reverses encodeForwardMessage.
+func decodeForwardMessage(encoded []byte) ([]byte, *SURB, error) {
+	if len(encoded) < forwardMessageHeaderSize {
+		return nil, nil, ErrInvalidForwardMessage
+	}
+
+	switch encoded[0] {
+	case noSURBAttached:
+		return encoded[forwardMessageHeaderSize:], nil, nil
+	case surbAttached:
+		if len(encoded) < forwardMessageHeaderSize+surbLengthSize {
+			return nil, nil, ErrInvalidForwardMessage
+		}
+		surbStart := forwardMessageHeaderSize + surbLengthSize
+		surbEnd := surbStart + int(binary.BigEndian.Uint16(encoded[forwardMessageHeaderSize:]))
+		if surbEnd > len(encoded) {
+			return nil, nil, ErrInvalidForwardMessage
+		}
+
+		surb := new(SURB)
+		if err := proto.Unmarshal(encoded[surbStart:surbEnd], surb); err != nil {
+			errMsg := fmt.Errorf("error in decodeForwardMessage - unmarshal of SURB failed: %v", err)
+			return nil, nil, errMsg
+		}
+		return encoded[surbEnd:], surb, nil
+	default:
+		return nil, nil, ErrInvalidForwardMessage
+	}
 }
 
 // createHeader builds the Sphinx packet header, consisting of three parts: the public element,
@@ -72,20 +294,28 @@ func PackForwardMessage(path config.E2EPath, delays []float64, message []byte) (
 // contains information where the packet should be forwarded next, how long it should be delayed by the node,
 // and if relevant additional auxiliary information. The message authentication code allows to detect tagging attacks.
 // createHeader computes the secret shared key between sender and the nodes and destination,
-// which are used as keys for encryption.
+// from which the keys used for encryption are derived as defined by the given packet format.
+// The commands, as returned by routingCommands, have to contain the routing commands of each of the nodes.
+// All the randomness used to create the header is read from the given source.
 // createHeader returns the header and a list of the initial elements, used for creating the header.
 // If any operation was unsuccessful createHeader returns an error.
-func createHeader(nodes []config.MixConfig,
-	delays []float64,
+func createHeader(random io.Reader,
+	format *packetFormat,
+	nodes []config.MixConfig,
+	commands []Commands,
 	dest config.ClientConfig,
 ) ([]HeaderInitials, Header, error) {
-	x, err := RandomElement()
+	if len(commands) != len(nodes) {
+		return nil, Header{}, errors.New("error in createHeader - inconsistent number of routing commands")
+	}
+
+	x, err := RandomElementFrom(random)
 	if err != nil {
 		errMsg := fmt.Errorf("error in createHeader - Random failed: %v", err)
 		return nil, Header{}, errMsg
 	}
 
-	headerInitials, err := getSharedSecrets(nodes, x)
+	headerInitials, err := getSharedSecrets(format, nodes, x)
 	if err != nil {
 		errMsg := fmt.Errorf("error in createHeader - getSharedSecrets failed: %v", err)
 		return nil, Header{}, errMsg
@@ -96,123 +326,226 @@ func createHeader(nodes []config.MixConfig,
 		return nil, Header{}, errMsg
 	}
 
+	header, err := encapsulateHeader(random, format, headerInitials, nodes, commands, dest)
+	if err != nil {
+		errMsg := fmt.Errorf("error in createHeader - encapsulateHeader failed: %v", err)
+		return nil, Header{}, errMsg
+	}
+	return headerInitials, header, nil
+
+}
+
+// routingCommands returns the routing commands of each of the nodes: the delays, the flags signalling
+// whether the node is the final hop, and the hop commands, if not nil. If reply is set, the final hop
+// is informed the payload is a reply, which integrity can be verified only by its recipient.
+// The commands are computed once per packet, so that the chosen packet format and the header agree on them.
+func routingCommands(nodes []config.MixConfig,
+	delays []float64,
+	hopCommands [][]*HopCommand,
+	reply bool,
+) ([]Commands, error) {
+	if len(delays) < len(nodes) {
+		return nil, errors.New("insufficient number of delays")
+	}
+	if hopCommands != nil && len(hopCommands) != len(nodes) {
+		return nil, errors.New("inconsistent number of hop commands")
+	}
+
 	commands := make([]Commands, len(nodes))
 	for i := range nodes {
 		var c Commands
 		if i == len(nodes)-1 {
-			c = Commands{Delay: delays[i], Flag: flags.LastHopFlag.Bytes()}
+			c = Commands{Delay: delays[i], Flag: flags.LastHopFlag.Bytes(), Reply: reply}
 		} else {
 			c = Commands{Delay: delays[i], Flag: flags.RelayFlag.Bytes()}
 		}
+		if hopCommands != nil {
+			c.HopCommands = hopCommands[i]
+		}
 		commands[i] = c
 	}
+	return commands, nil
+}
 
-	header, err := encapsulateHeader(headerInitials, nodes, commands, dest)
-	if err != nil {
-		errMsg := fmt.Errorf("error in createHeader - encapsulateHeader failed: %v", err)
-		return nil, Header{}, errMsg
+// hopRoutingInfo returns the routing information read by the i-th node, which points either at the next node
+// on the path, or, for the final hop, at the destination.
+func hopRoutingInfo(nodes []config.MixConfig, commands []Commands, destination config.ClientConfig, i int) RoutingInfo {
+	if i == len(nodes)-1 {
+		return RoutingInfo{NextHop: &Hop{Id: destination.Id,
+			Address: destination.Host + ":" + destination.Port,
+			PubKey:  []byte{},
+		}, RoutingCommands: &commands[i],
+		}
+	}
+	nextNode := nodes[i+1]
+	return RoutingInfo{NextHop: &Hop{Id: nextNode.Id,
+		Address: nextNode.Host + ":" + nextNode.Port,
+		PubKey:  nextNode.PubKey,
+	}, RoutingCommands: &commands[i],
 	}
-	return headerInitials, header, nil
-
 }
 
 // encapsulateHeader layer encrypts the meta-data of the packet, containing information about the
 // sequence of nodes the packet should traverse before reaching the destination, and message authentication codes,
 // given the pre-computed shared keys which are used for encryption.
+// Each hop occupies a fixed-size slot in the routing block and the block of the last hop is followed
+// by the filler string, so that every node on the path receives a routing block of exactly BetaSize bytes.
+// The padding of the routing block of the final hop is read from the given source of randomness.
 // encapsulateHeader returns the Header, or an error if any internal cryptographic of parsing operation failed.
-func encapsulateHeader(headerInitials []HeaderInitials,
+func encapsulateHeader(random io.Reader,
+	format *packetFormat,
+	headerInitials []HeaderInitials,
 	nodes []config.MixConfig,
 	commands []Commands,
 	destination config.ClientConfig,
 ) (Header, error) {
-	finalHop := RoutingInfo{NextHop: &Hop{Id: destination.Id,
-		Address: destination.Host + ":" + destination.Port,
-		PubKey:  []byte{},
-	}, RoutingCommands: &commands[len(commands)-1],
-		NextHopMetaData: []byte{},
-		Mac:             []byte{},
+	if len(nodes) > MaxPathLength {
+		return Header{}, ErrPathTooLong
+	}
+	if len(headerInitials) != len(nodes) || len(commands) != len(nodes) {
+		return Header{}, errors.New("error in encapsulateHeader - inconsistent number of hops")
 	}
 
-	finalHopBytes, err := proto.Marshal(&finalHop)
+	filler, err := computeFillers(format, headerInitials)
+	if err != nil {
+		errMsg := fmt.Errorf("error in encapsulateHeader - computeFillers failed: %v", err)
+		return Header{}, errMsg
+	}
+
+	finalHop := hopRoutingInfo(nodes, commands, destination, len(nodes)-1)
+	finalHopBytes, err := format.encodeRoutingInfo(&finalHop)
+	if err != nil {
+		return Header{}, err
+	}
+
+	// the final hop does not have any next MAC, the remaining space is filled with random padding
+	padding, err := randomBytes(random, BetaSize-len(nodes)*hopSlotSize)
 	if err != nil {
 		return Header{}, err
 	}
+	finalBlock := make([]byte, 0, BetaSize-len(filler))
+	finalBlock = append(finalBlock, finalHopBytes...)
+	finalBlock = append(finalBlock, make([]byte, MacSize)...)
+	finalBlock = append(finalBlock, padding...)
 
-	kdfRes, err := KDF(headerInitials[len(headerInitials)-1].SecretHash)
+	keys, err := format.deriveHopKeys(headerInitials[len(headerInitials)-1].Secret)
 	if err != nil {
 		return Header{}, err
 	}
 
-	encFinalHop, err := AesCtr(kdfRes, finalHopBytes)
+	stream, err := routingKeyStream(keys.routingKey)
 	if err != nil {
 		errMsg := fmt.Errorf("error in encapsulateHeader - AES_CTR encryption failed: %v", err)
 		return Header{}, errMsg
 	}
 
-	mac, err := computeMac(kdfRes, encFinalHop)
+	beta := append(XorBytes(finalBlock, stream[:len(finalBlock)]), filler...)
+	mac, err := computeMac(keys.macKey, beta)
 	if err != nil {
 		return Header{}, err
 	}
 
-	routingCommands := [][]byte{encFinalHop}
-
-	var encRouting []byte
 	for i := len(nodes) - 2; i >= 0; i-- {
-		nextNode := nodes[i+1]
-		routing := RoutingInfo{NextHop: &Hop{Id: nextNode.Id,
-			Address: nextNode.Host + ":" + nextNode.Port,
-			PubKey:  nodes[i+1].PubKey,
-		}, RoutingCommands: &commands[i],
-			NextHopMetaData: routingCommands[len(routingCommands)-1],
-			Mac:             mac,
-		}
-
-		encKey, err := KDF(headerInitials[i].SecretHash)
+		routing := hopRoutingInfo(nodes, commands, destination, i)
+		routingBytes, err := format.encodeRoutingInfo(&routing)
 		if err != nil {
 			return Header{}, err
 		}
 
-		routingBytes, err := proto.Marshal(&routing)
+		block := make([]byte, 0, BetaSize)
+		block = append(block, routingBytes...)
+		block = append(block, mac...)
+		block = append(block, beta[:BetaSize-hopSlotSize]...)
+
+		keys, err := format.deriveHopKeys(headerInitials[i].Secret)
 		if err != nil {
 			return Header{}, err
 		}
 
-		encRouting, err = AesCtr(encKey, routingBytes)
+		stream, err := routingKeyStream(keys.routingKey)
 		if err != nil {
 			return Header{}, err
 		}
 
-		routingCommands = append(routingCommands, encRouting)
-		kdfResL, err := KDF(headerInitials[i].SecretHash)
-		if err != nil {
-			return Header{}, nil
-		}
-		mac, err = computeMac(kdfResL, encRouting)
+		beta = XorBytes(block, stream[:BetaSize])
+		mac, err = computeMac(keys.macKey, beta)
 		if err != nil {
 			return Header{}, err
 		}
+	}
+	return Header{Alpha: headerInitials[0].Alpha, Beta: beta, Mac: mac}, nil
+}
+
+// encodeRoutingInfo marshals the routing information of a single hop into a slot of RoutingInfoSize bytes.
+// The marshalled data is prefixed with its length and padded with zeroes.
+// It is the encoding of the routing information used by the formats prior to PacketVersionCompact,
+// which do not carry any hop commands.
+func encodeRoutingInfo(routingInfo *RoutingInfo) ([]byte, error) {
+	if len(routingInfo.GetRoutingCommands().GetHopCommands()) > 0 {
+		return nil, ErrHopCommandsNotSupported
+	}
+	routingBytes, err := proto.Marshal(routingInfo)
+	if err != nil {
+		return nil, err
+	}
+	if len(routingBytes) > RoutingInfoSize-routingInfoLengthSize {
+		return nil, ErrRoutingInfoTooLong
+	}
+
+	encoded := make([]byte, RoutingInfoSize)
+	binary.BigEndian.PutUint16(encoded, uint16(len(routingBytes)))
+	copy(encoded[routingInfoLengthSize:], routingBytes)
+	return encoded, nil
+}
+
+// decodeRoutingInfo recovers the routing information of a single hop from its slot in the routing block.
+func decodeRoutingInfo(encoded []byte) (RoutingInfo, error) {
+	length := int(binary.BigEndian.Uint16(encoded))
+	if length > len(encoded)-routingInfoLengthSize {
+		return RoutingInfo{}, ErrRoutingInfoTooLong
+	}
 
+	var routingInfo RoutingInfo
+	if err := proto.Unmarshal(encoded[routingInfoLengthSize:routingInfoLengthSize+length], &routingInfo); err != nil {
+		return RoutingInfo{}, err
+	}
+	if routingInfo.NextHop == nil || routingInfo.RoutingCommands == nil {
+		return RoutingInfo{}, errors.New("incomplete routing information")
 	}
-	return Header{Alpha: headerInitials[0].Alpha, Beta: encRouting, Mac: mac}, nil
+	return routingInfo, nil
+}
+
+// routingKeyStream generates the pseudo-random stream used to encrypt the routing block for a single hop.
+// The stream is one hop slot longer than the routing block as every node pads the block before decrypting it.
+func routingKeyStream(key []byte) ([]byte, error) {
+	return AesCtr(key, make([]byte, BetaSize+hopSlotSize))
+}
 
+// randomBytes returns a slice of given length filled with data read from the source of randomness.
+func randomBytes(random io.Reader, length int) ([]byte, error) {
+	b := make([]byte, length)
+	if _, err := io.ReadFull(random, b); err != nil {
+		return nil, err
+	}
+	return b, nil
 }
 
-// encapsulateContent layer encrypts the given messages using a set of shared keys
-// and the AES_CTR encryption.
-// encapsulateContent returns the encrypted payload in byte representation. If the AES_CTR
+// encapsulateContent layer encrypts the given messages using the payload keys of all the hops,
+// derived as defined by the packet format, and the Lioness wide-block cipher.
+// encapsulateContent returns the encrypted payload in byte representation. If the Lioness
 // encryption failed encapsulateContent returns an error.
-func encapsulateContent(headerInitials []HeaderInitials, message []byte) ([]byte, error) {
+func encapsulateContent(format *packetFormat, headerInitials []HeaderInitials, message []byte) ([]byte, error) {
 
 	enc := message
 
 	for i := len(headerInitials) - 1; i >= 0; i-- {
-		sharedKey, err := KDF(headerInitials[i].SecretHash)
+		keys, err := format.deriveHopKeys(headerInitials[i].Secret)
 		if err != nil {
 			return nil, err
 		}
-		enc, err = AesCtr(sharedKey, enc)
+		enc, err = LionessEncrypt(keys.payloadKey, enc)
 		if err != nil {
-			errMsg := fmt.Errorf("error in encapsulateContent - AES_CTR encryption failed: %v", err)
+			errMsg := fmt.Errorf("error in encapsulateContent - Lioness encryption failed: %v", err)
 			return nil, errMsg
 		}
 
@@ -220,11 +553,72 @@ func encapsulateContent(headerInitials []HeaderInitials, message []byte) ([]byte
 	return enc, nil
 }
 
+// padMessage pads the given message to PayloadSize bytes. The padding consists of a single paddingStartByte
+// followed by zero bytes, which makes it unambiguous to remove regardless of the content of the message.
+// The padded message is preceded by the zero-filled integrity tag.
+// padMessage returns ErrMessageTooLong if the message does not fit into a single payload.
+func padMessage(message []byte) ([]byte, error) {
+	padded, err := pad(message, PayloadSize-payloadIntegrityTagSize)
+	if err != nil {
+		return nil, err
+	}
+	return append(make([]byte, payloadIntegrityTagSize, PayloadSize), padded...), nil
+}
+
+// UnpadMessage removes the integrity tag and the padding from the fully decrypted payload
+// and returns the original message.
+// UnpadMessage returns an error if the payload has invalid size, if it was tampered with
+// or if the padding is malformed.
+func UnpadMessage(payload []byte) ([]byte, error) {
+	if err := verifyPayloadIntegrity(payload); err != nil {
+		return nil, err
+	}
+	return unpad(payload[payloadIntegrityTagSize:])
+}
+
+// verifyPayloadIntegrity checks whether the fully decrypted payload starts with the zero-filled integrity tag.
+func verifyPayloadIntegrity(payload []byte) error {
+	if len(payload) != PayloadSize {
+		return ErrInvalidPayloadSize
+	}
+	if subtle.ConstantTimeCompare(payload[:payloadIntegrityTagSize], make([]byte, payloadIntegrityTagSize)) != 1 {
+		return ErrTamperedPayload
+	}
+	return nil
+}
+
+// pad appends the padding to the data, so that the result is exactly size bytes long.
+func pad(data []byte, size int) ([]byte, error) {
+	if len(data) >= size {
+		return nil, ErrMessageTooLong
+	}
+
+	padded := make([]byte, size)
+	copy(padded, data)
+	padded[len(data)] = paddingStartByte
+	return padded, nil
+}
+
+// unpad removes the padding appended by pad.
+func unpad(padded []byte) ([]byte, error) {
+	for i := len(padded) - 1; i >= 0; i-- {
+		switch padded[i] {
+		case 0x00:
+			continue
+		case paddingStartByte:
+			return padded[:i], nil
+		default:
+			return nil, ErrInvalidPadding
+		}
+	}
+	return nil, ErrInvalidPadding
+}
+
 // getSharedSecrets computes a sequence of HeaderInitial values, containing the initial elements,
 // shared secrets and blinding factors for each node on the path. As input getSharedSecrets takes the initial
-// secret value, the list of nodes, and the curve in which the cryptographic operations are performed.
+// secret value, the list of nodes, and the packet format defining how the blinding factors are derived.
 // getSharedSecrets returns the list of computed HeaderInitials or an error.
-func getSharedSecrets(nodes []config.MixConfig, initialVal *FieldElement) ([]HeaderInitials, error) {
+func getSharedSecrets(format *packetFormat, nodes []config.MixConfig, initialVal *FieldElement) ([]HeaderInitials, error) {
 
 	blindFactors := []*FieldElement{initialVal}
 	tuples := make([]HeaderInitials, len(nodes))
@@ -261,52 +655,48 @@ func getSharedSecrets(nodes []config.MixConfig, initialVal *FieldElement) ([]Hea
 		// return tmpn-1^xn
 		s := expo(BytesToPublicKey(n.PubKey).ToFieldElement(), blindFactors)
 
-		// TODO: move to the other crypto file?
 		aesS, err := KDF(s.Bytes())
 		if err != nil {
 			return nil, err
 		}
 
-		blinder, err := computeBlindingFactor(aesS)
+		keys, err := format.deriveHopKeys(s.Bytes())
 		if err != nil {
-			errMsg := fmt.Errorf("error in getSharedSecrets - computeBlindingFactor failed: %v", err)
+			errMsg := fmt.Errorf("error in getSharedSecrets - deriveHopKeys failed: %v", err)
 			return nil, errMsg
 		}
 
-		blindFactors = append(blindFactors, blinder)
-		tuples[i] = HeaderInitials{Alpha: alpha.Bytes(), Secret: s.Bytes(), Blinder: blinder.Bytes(), SecretHash: aesS}
+		blindFactors = append(blindFactors, keys.blinder)
+		tuples[i] = HeaderInitials{Alpha: alpha.Bytes(), Secret: s.Bytes(), Blinder: keys.blinder.Bytes(), SecretHash: aesS}
 	}
 	return tuples, nil
 
 }
 
-// TODO: computeFillers needs to be fixed
-func computeFillers(nodes []config.MixConfig, tuples []HeaderInitials) (string, error) {
-
-	filler := ""
-	minLen := headerLength - 32
-	for i := 1; i < len(nodes); i++ {
-		base := filler + strings.Repeat("\x00", K)
-		kx, err := computeSharedSecretHash(tuples[i-1].SecretHash, []byte("hrhohrhohrhohrho"))
+// computeFillers computes the filler string appended to the routing block of the last hop.
+// Each node on the path shifts the routing block by a single hop slot and pads it with the part of
+// its key stream past the end of the block. The filler is the sequence of those paddings as seen by the last hop,
+// which allows the sender to compute correct message authentication codes for all of the hops.
+// computeFillers returns the filler of (len(headerInitials) - 1) hop slots or an error.
+func computeFillers(format *packetFormat, headerInitials []HeaderInitials) ([]byte, error) {
+	filler := []byte{}
+	for i := 0; i < len(headerInitials)-1; i++ {
+		keys, err := format.deriveHopKeys(headerInitials[i].Secret)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
-		mx := strings.Repeat("\x00", minLen) + base
 
-		xorVal, err := AesCtr(kx, []byte(mx))
+		stream, err := routingKeyStream(keys.routingKey)
 		if err != nil {
 			errMsg := fmt.Errorf("error in computeFillers - AES_CTR failed: %v", err)
-			return "", errMsg
+			return nil, errMsg
 		}
 
-		filler = BytesToString(xorVal)
-		filler = filler[minLen:]
-
-		minLen -= K
+		filler = append(filler, make([]byte, hopSlotSize)...)
+		filler = XorBytes(filler, stream[BetaSize-i*hopSlotSize:])
 	}
 
 	return filler, nil
-
 }
 
 // computeBlindingFactor computes the blinding factor extracted from the
@@ -350,31 +740,56 @@ func computeSharedSecretHash(key []byte, iv []byte) ([]byte, error) {
 // be used by the processing node. If any cryptographic or parsing operation failed ProcessSphinxPacket
 // returns an error.
 func ProcessSphinxPacket(packetBytes []byte, privKey *PrivateKey) (Hop, Commands, []byte, error) {
+	return ProcessSphinxPacketWithReplayCheck(packetBytes, privKey, nil)
+}
 
-	var packet SphinxPacket
-	err := proto.Unmarshal(packetBytes, &packet)
-
+// ProcessSphinxPacketWithReplayCheck works like ProcessSphinxPacket, but once the integrity of the header
+// is verified, it passes the replay tag of the packet to the isReplay function. The tag is derived from
+// the secret shared between the sender and the processing node, hence it is the same for every copy of the packet.
+// If isReplay reports the tag was already seen, the packet is not processed any further and ErrReplayedPacket
+// is returned. If isReplay is nil, no replay detection is performed.
+func ProcessSphinxPacketWithReplayCheck(packetBytes []byte,
+	privKey *PrivateKey,
+	isReplay func(tag []byte) bool,
+) (Hop, Commands, []byte, error) {
+
+	version, header, payload, err := decodePacket(packetBytes)
 	if err != nil {
-		errMsg := fmt.Errorf("error in ProcessSphinxPacket - unmarshal of packet failed: %v", err)
+		errMsg := fmt.Errorf("error in ProcessSphinxPacket - decoding of packet failed: %v", err)
 		return Hop{}, Commands{}, nil, errMsg
 	}
 
-	hop, commands, newHeader, err := ProcessSphinxHeader(*packet.Hdr, privKey)
+	format, err := getPacketFormat(version)
+	if err != nil {
+		return Hop{}, Commands{}, nil, err
+	}
+
+	hop, commands, newHeader, keys, err := processSphinxHeader(format, header, privKey)
 	if err != nil {
 		errMsg := fmt.Errorf("error in ProcessSphinxPacket - ProcessSphinxHeader failed: %v", err)
 		return Hop{}, Commands{}, nil, errMsg
 	}
 
-	newPayload, err := ProcessSphinxPayload(packet.Hdr.Alpha, packet.Pld, privKey)
+	if isReplay != nil && isReplay(keys.replayTag) {
+		return Hop{}, Commands{}, nil, ErrReplayedPacket
+	}
+
+	newPayload, err := LionessDecrypt(keys.payloadKey, payload)
 	if err != nil {
 		errMsg := fmt.Errorf("error in ProcessSphinxPacket - ProcessSphinxPayload failed: %v", err)
 		return Hop{}, Commands{}, nil, errMsg
 	}
 
-	newPacket := SphinxPacket{Hdr: &newHeader, Pld: newPayload}
-	newPacketBytes, err := proto.Marshal(&newPacket)
+	// integrity of replies can be verified only by their recipients, which hold the keys of the reply block
+	if flags.SphinxFlagFromBytes(commands.Flag) == flags.LastHopFlag && !commands.Reply {
+		if err := verifyPayloadIntegrity(newPayload); err != nil {
+			return Hop{}, Commands{}, nil, err
+		}
+	}
+
+	newPacketBytes, err := encodePacket(version, &newHeader, newPayload)
 	if err != nil {
-		errMsg := fmt.Errorf("error in ProcessSphinxPacket - marshal of packet failed: %v", err)
+		errMsg := fmt.Errorf("error in ProcessSphinxPacket - encoding of packet failed: %v", err)
 		return Hop{}, Commands{}, nil, errMsg
 	}
 
@@ -384,92 +799,101 @@ func ProcessSphinxPacket(packetBytes []byte, privKey *PrivateKey) (Hop, Commands
 // ProcessSphinxHeader unwraps one layer of encryption from the header of a sphinx packet.
 // ProcessSphinxHeader recomputes the shared key and checks whether the message authentication code is valid.
 // If not, the packet is dropped and error is returned. If MAC checking was passed successfully ProcessSphinxHeader
-// performs the AES_CTR decryption, recomputes the blinding factor and updates the init public element from the header.
-// Next, ProcessSphinxHeader extracts the routing information from the decrypted packet and returns it,
-// together with the updated init public element.
+// pads the routing block with a hop slot of zeroes, performs the AES_CTR decryption,
+// recomputes the blinding factor and updates the init public element from the header.
+// Next, ProcessSphinxHeader extracts the routing information from the first slot of the decrypted block
+// and returns it, together with the updated header. The routing block of the new header
+// is of the same size as the received one.
+// ProcessSphinxHeader expects the header of a packet in the CurrentPacketVersion format.
 // If any crypto or parsing operation failed ProcessSphinxHeader returns an error.
 func ProcessSphinxHeader(packet Header, privKey *PrivateKey) (Hop, Commands, Header, error) {
+	format, err := getPacketFormat(CurrentPacketVersion)
+	if err != nil {
+		return Hop{}, Commands{}, Header{}, err
+	}
+	hop, commands, header, _, err := processSphinxHeader(format, packet, privKey)
+	return hop, commands, header, err
+}
+
+// processSphinxHeader implements ProcessSphinxHeader for the given packet format
+// and additionally returns the keys derived from the recomputed shared secret.
+func processSphinxHeader(format *packetFormat, packet Header, privKey *PrivateKey) (Hop, Commands, Header, *hopKeys, error) {
 	alpha := BytesToFieldElement(packet.Alpha)
 	beta := packet.Beta
 	mac := packet.Mac
 
+	if len(beta) != BetaSize {
+		return Hop{}, Commands{}, Header{}, nil, ErrInvalidBetaSize
+	}
+
 	sharedSecret := new(FieldElement)
 	curve25519.ScalarMult(sharedSecret.el(), privKey.ToFieldElement().el(), alpha.el())
 
-	aesS, err := KDF(sharedSecret.Bytes())
+	keys, err := format.deriveHopKeys(sharedSecret.Bytes())
 	if err != nil {
-		return Hop{}, Commands{}, Header{}, err
-	}
-	encKey, err := KDF(aesS)
-	if err != nil {
-		return Hop{}, Commands{}, Header{}, err
+		return Hop{}, Commands{}, Header{}, nil, err
 	}
 
-	recomputedMac, err := computeMac(encKey, beta)
+	recomputedMac, err := computeMac(keys.macKey, beta)
 	if err != nil {
-		return Hop{}, Commands{}, Header{}, err
-	}
-
-	if !bytes.Equal(recomputedMac, mac) {
-		return Hop{}, Commands{}, Header{}, errors.New("packet processing error: MACs are not matching")
+		return Hop{}, Commands{}, Header{}, nil, err
 	}
 
-	blinder, err := computeBlindingFactor(aesS)
-	if err != nil {
-		errMsg := fmt.Errorf("error in ProcessSphinxHeader - computeBlindingFactor failed: %v", err)
-		return Hop{}, Commands{}, Header{}, errMsg
+	if !hmac.Equal(recomputedMac, mac) {
+		return Hop{}, Commands{}, Header{}, nil, errors.New("packet processing error: MACs are not matching")
 	}
 
 	newAlpha := new(FieldElement)
-	curve25519.ScalarMult(newAlpha.el(), blinder.el(), alpha.el())
+	curve25519.ScalarMult(newAlpha.el(), keys.blinder.el(), alpha.el())
 
-	decBeta, err := AesCtr(encKey, beta)
+	stream, err := routingKeyStream(keys.routingKey)
 	if err != nil {
 		errMsg := fmt.Errorf("error in ProcessSphinxHeader - AES_CTR failed: %v", err)
-		return Hop{}, Commands{}, Header{}, errMsg
+		return Hop{}, Commands{}, Header{}, nil, errMsg
 	}
 
-	var routingInfo RoutingInfo
-	err = proto.Unmarshal(decBeta, &routingInfo)
+	paddedBeta := append(append(make([]byte, 0, BetaSize+hopSlotSize), beta...), make([]byte, hopSlotSize)...)
+	decBeta := XorBytes(paddedBeta, stream)
+
+	routingInfo, err := format.decodeRoutingInfo(decBeta[:RoutingInfoSize])
 	if err != nil {
-		errMsg := fmt.Errorf("error in ProcessSphinxHeader - unmarshal of beta failed: %v", err)
-		return Hop{}, Commands{}, Header{}, errMsg
+		errMsg := fmt.Errorf("error in ProcessSphinxHeader - unmarshal of routing information failed: %v", err)
+		return Hop{}, Commands{}, Header{}, nil, errMsg
 	}
-	nextHop, commands, nextBeta, nextMac := readBeta(routingInfo)
+	nextHop, commands := readRoutingInfo(routingInfo)
+	nextMac := decBeta[RoutingInfoSize:hopSlotSize]
+	nextBeta := decBeta[hopSlotSize:]
 
-	return nextHop, commands, Header{Alpha: newAlpha.Bytes(), Beta: nextBeta, Mac: nextMac}, nil
+	newHeader := Header{Alpha: newAlpha.Bytes(), Beta: nextBeta, Mac: nextMac}
+	return nextHop, commands, newHeader, keys, nil
 }
 
-// readBeta extracts all the fields from the RoutingInfo structure
-func readBeta(beta RoutingInfo) (Hop, Commands, []byte, []byte) {
-	nextHop := *beta.NextHop
-	commands := *beta.RoutingCommands
-	nextBeta := beta.NextHopMetaData
-	nextMac := beta.Mac
-
-	return nextHop, commands, nextBeta, nextMac
+// readRoutingInfo extracts all the fields from the RoutingInfo structure
+func readRoutingInfo(routingInfo RoutingInfo) (Hop, Commands) {
+	return *routingInfo.NextHop, *routingInfo.RoutingCommands
 }
 
 // ProcessSphinxPayload unwraps a single layer of the encryption from the sphinx packet payload.
-// ProcessSphinxPayload first recomputes the shared secret which is used to perform the AES_CTR decryption.
+// ProcessSphinxPayload first recomputes the shared secret, from which the key of the Lioness decryption
+// is derived as defined by the CurrentPacketVersion format.
 // ProcessSphinxPayload returns the new packet payload or an error if the decryption failed.
 func ProcessSphinxPayload(alpha []byte, payload []byte, privKey *PrivateKey) ([]byte, error) {
-	sharedSecret := new(FieldElement)
-	curve25519.ScalarMult(sharedSecret.el(), privKey.ToFieldElement().el(), BytesToFieldElement(alpha).el())
-
-	aesS, err := KDF(sharedSecret.Bytes())
+	format, err := getPacketFormat(CurrentPacketVersion)
 	if err != nil {
 		return nil, err
 	}
 
-	decKey, err := KDF(aesS)
+	sharedSecret := new(FieldElement)
+	curve25519.ScalarMult(sharedSecret.el(), privKey.ToFieldElement().el(), BytesToFieldElement(alpha).el())
+
+	keys, err := format.deriveHopKeys(sharedSecret.Bytes())
 	if err != nil {
 		return nil, err
 	}
 
-	decPayload, err := AesCtr(decKey, payload)
+	decPayload, err := LionessDecrypt(keys.payloadKey, payload)
 	if err != nil {
-		errMsg := fmt.Errorf("error in ProcessSphinxPayload - AES_CTR decryption failed: %v", err)
+		errMsg := fmt.Errorf("error in ProcessSphinxPayload - Lioness decryption failed: %v", err)
 		return nil, errMsg
 	}
 
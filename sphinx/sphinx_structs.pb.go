@@ -23,6 +23,7 @@ const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
 type SphinxPacket struct {
 	Hdr                  *Header  `protobuf:"bytes,1,opt,name=Hdr,json=hdr,proto3" json:"Hdr,omitempty"`
 	Pld                  []byte   `protobuf:"bytes,2,opt,name=Pld,json=pld,proto3" json:"Pld,omitempty"`
+	Version              uint32   `protobuf:"varint,3,opt,name=Version,json=version,proto3" json:"Version,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -67,6 +68,13 @@ func (m *SphinxPacket) GetPld() []byte {
 	return nil
 }
 
+func (m *SphinxPacket) GetVersion() uint32 {
+	if m != nil {
+		return m.Version
+	}
+	return 0
+}
+
 type Header struct {
 	Alpha                []byte   `protobuf:"bytes,1,opt,name=Alpha,json=alpha,proto3" json:"Alpha,omitempty"`
 	Beta                 []byte   `protobuf:"bytes,2,opt,name=Beta,json=beta,proto3" json:"Beta,omitempty"`
@@ -180,8 +188,6 @@ func (m *Hop) GetPubKey() []byte {
 type RoutingInfo struct {
 	NextHop              *Hop      `protobuf:"bytes,1,opt,name=NextHop,json=nextHop,proto3" json:"NextHop,omitempty"`
 	RoutingCommands      *Commands `protobuf:"bytes,2,opt,name=RoutingCommands,json=routingCommands,proto3" json:"RoutingCommands,omitempty"`
-	NextHopMetaData      []byte    `protobuf:"bytes,3,opt,name=NextHopMetaData,json=nextHopMetaData,proto3" json:"NextHopMetaData,omitempty"`
-	Mac                  []byte    `protobuf:"bytes,4,opt,name=Mac,json=mac,proto3" json:"Mac,omitempty"`
 	XXX_NoUnkeyedLiteral struct{}  `json:"-"`
 	XXX_unrecognized     []byte    `json:"-"`
 	XXX_sizecache        int32     `json:"-"`
@@ -226,26 +232,14 @@ func (m *RoutingInfo) GetRoutingCommands() *Commands {
 	return nil
 }
 
-func (m *RoutingInfo) GetNextHopMetaData() []byte {
-	if m != nil {
-		return m.NextHopMetaData
-	}
-	return nil
-}
-
-func (m *RoutingInfo) GetMac() []byte {
-	if m != nil {
-		return m.Mac
-	}
-	return nil
-}
-
 type Commands struct {
-	Delay                float64  `protobuf:"fixed64,1,opt,name=Delay,json=delay,proto3" json:"Delay,omitempty"`
-	Flag                 []byte   `protobuf:"bytes,2,opt,name=Flag,json=flag,proto3" json:"Flag,omitempty"`
-	XXX_NoUnkeyedLiteral struct{} `json:"-"`
-	XXX_unrecognized     []byte   `json:"-"`
-	XXX_sizecache        int32    `json:"-"`
+	Delay                float64       `protobuf:"fixed64,1,opt,name=Delay,json=delay,proto3" json:"Delay,omitempty"`
+	Flag                 []byte        `protobuf:"bytes,2,opt,name=Flag,json=flag,proto3" json:"Flag,omitempty"`
+	Reply                bool          `protobuf:"varint,3,opt,name=Reply,json=reply,proto3" json:"Reply,omitempty"`
+	HopCommands          []*HopCommand `protobuf:"bytes,4,rep,name=HopCommands,json=hopCommands,proto3" json:"HopCommands,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}      `json:"-"`
+	XXX_unrecognized     []byte        `json:"-"`
+	XXX_sizecache        int32         `json:"-"`
 }
 
 func (m *Commands) Reset()         { *m = Commands{} }
@@ -287,6 +281,67 @@ func (m *Commands) GetFlag() []byte {
 	return nil
 }
 
+func (m *Commands) GetReply() bool {
+	if m != nil {
+		return m.Reply
+	}
+	return false
+}
+
+func (m *Commands) GetHopCommands() []*HopCommand {
+	if m != nil {
+		return m.HopCommands
+	}
+	return nil
+}
+
+type HopCommand struct {
+	Type                 uint32   `protobuf:"varint,1,opt,name=Type,json=type,proto3" json:"Type,omitempty"`
+	Value                []byte   `protobuf:"bytes,2,opt,name=Value,json=value,proto3" json:"Value,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *HopCommand) Reset()         { *m = HopCommand{} }
+func (m *HopCommand) String() string { return proto.CompactTextString(m) }
+func (*HopCommand) ProtoMessage()    {}
+func (*HopCommand) Descriptor() ([]byte, []int) {
+	return fileDescriptor_278563119aefb899, []int{5}
+}
+
+func (m *HopCommand) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_HopCommand.Unmarshal(m, b)
+}
+func (m *HopCommand) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_HopCommand.Marshal(b, m, deterministic)
+}
+func (m *HopCommand) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_HopCommand.Merge(m, src)
+}
+func (m *HopCommand) XXX_Size() int {
+	return xxx_messageInfo_HopCommand.Size(m)
+}
+func (m *HopCommand) XXX_DiscardUnknown() {
+	xxx_messageInfo_HopCommand.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_HopCommand proto.InternalMessageInfo
+
+func (m *HopCommand) GetType() uint32 {
+	if m != nil {
+		return m.Type
+	}
+	return 0
+}
+
+func (m *HopCommand) GetValue() []byte {
+	if m != nil {
+		return m.Value
+	}
+	return nil
+}
+
 type HeaderInitials struct {
 	Alpha                []byte   `protobuf:"bytes,1,opt,name=Alpha,json=alpha,proto3" json:"Alpha,omitempty"`
 	Secret               []byte   `protobuf:"bytes,2,opt,name=Secret,json=secret,proto3" json:"Secret,omitempty"`
@@ -301,7 +356,7 @@ func (m *HeaderInitials) Reset()         { *m = HeaderInitials{} }
 func (m *HeaderInitials) String() string { return proto.CompactTextString(m) }
 func (*HeaderInitials) ProtoMessage()    {}
 func (*HeaderInitials) Descriptor() ([]byte, []int) {
-	return fileDescriptor_278563119aefb899, []int{5}
+	return fileDescriptor_278563119aefb899, []int{6}
 }
 
 func (m *HeaderInitials) XXX_Unmarshal(b []byte) error {
@@ -350,41 +405,113 @@ func (m *HeaderInitials) GetSecretHash() []byte {
 	return nil
 }
 
+type SURB struct {
+	FirstHop             *Hop     `protobuf:"bytes,1,opt,name=FirstHop,json=firstHop,proto3" json:"FirstHop,omitempty"`
+	Hdr                  *Header  `protobuf:"bytes,2,opt,name=Hdr,json=hdr,proto3" json:"Hdr,omitempty"`
+	PayloadKey           []byte   `protobuf:"bytes,3,opt,name=PayloadKey,json=payloadKey,proto3" json:"PayloadKey,omitempty"`
+	Version              uint32   `protobuf:"varint,4,opt,name=Version,json=version,proto3" json:"Version,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *SURB) Reset()         { *m = SURB{} }
+func (m *SURB) String() string { return proto.CompactTextString(m) }
+func (*SURB) ProtoMessage()    {}
+func (*SURB) Descriptor() ([]byte, []int) {
+	return fileDescriptor_278563119aefb899, []int{7}
+}
+
+func (m *SURB) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_SURB.Unmarshal(m, b)
+}
+func (m *SURB) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_SURB.Marshal(b, m, deterministic)
+}
+func (m *SURB) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_SURB.Merge(m, src)
+}
+func (m *SURB) XXX_Size() int {
+	return xxx_messageInfo_SURB.Size(m)
+}
+func (m *SURB) XXX_DiscardUnknown() {
+	xxx_messageInfo_SURB.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_SURB proto.InternalMessageInfo
+
+func (m *SURB) GetFirstHop() *Hop {
+	if m != nil {
+		return m.FirstHop
+	}
+	return nil
+}
+
+func (m *SURB) GetHdr() *Header {
+	if m != nil {
+		return m.Hdr
+	}
+	return nil
+}
+
+func (m *SURB) GetPayloadKey() []byte {
+	if m != nil {
+		return m.PayloadKey
+	}
+	return nil
+}
+
+func (m *SURB) GetVersion() uint32 {
+	if m != nil {
+		return m.Version
+	}
+	return 0
+}
+
 func init() {
 	proto.RegisterType((*SphinxPacket)(nil), "sphinx.SphinxPacket")
 	proto.RegisterType((*Header)(nil), "sphinx.Header")
 	proto.RegisterType((*Hop)(nil), "sphinx.Hop")
 	proto.RegisterType((*RoutingInfo)(nil), "sphinx.RoutingInfo")
 	proto.RegisterType((*Commands)(nil), "sphinx.Commands")
+	proto.RegisterType((*HopCommand)(nil), "sphinx.HopCommand")
 	proto.RegisterType((*HeaderInitials)(nil), "sphinx.HeaderInitials")
+	proto.RegisterType((*SURB)(nil), "sphinx.SURB")
 }
 
 func init() { proto.RegisterFile("sphinx/sphinx_structs.proto", fileDescriptor_278563119aefb899) }
 
 var fileDescriptor_278563119aefb899 = []byte{
-	// 378 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x74, 0x52, 0xd1, 0x6a, 0xdb, 0x30,
-	0x14, 0xc5, 0x71, 0x62, 0xaf, 0x37, 0x21, 0x29, 0xa2, 0x14, 0xc3, 0x60, 0x04, 0xc3, 0x20, 0x4f,
-	0x19, 0x74, 0x7b, 0xda, 0x5b, 0xb3, 0xb0, 0x39, 0x8c, 0x8e, 0xa0, 0x7e, 0xc0, 0xb8, 0xb6, 0xd4,
-	0xd8, 0x4c, 0x91, 0x84, 0xa4, 0x40, 0xfa, 0x4f, 0xfb, 0xc8, 0x61, 0x49, 0xce, 0xc8, 0x43, 0x9f,
-	0xec, 0x73, 0x7d, 0xcf, 0xb9, 0xe7, 0x1c, 0x0c, 0xef, 0xad, 0x6e, 0x3b, 0x79, 0xfe, 0x14, 0x1e,
-	0xbf, 0xad, 0x33, 0xa7, 0xc6, 0xd9, 0xb5, 0x36, 0xca, 0x29, 0x92, 0x85, 0x69, 0xb9, 0x81, 0xd9,
-	0xb3, 0x7f, 0xdb, 0x63, 0xf3, 0x87, 0x3b, 0xb2, 0x84, 0xb4, 0x62, 0xa6, 0x48, 0x96, 0xc9, 0x6a,
-	0xfa, 0x30, 0x5f, 0x87, 0xad, 0x75, 0xc5, 0x91, 0x71, 0x43, 0xd3, 0x96, 0x19, 0x72, 0x0b, 0xe9,
-	0x5e, 0xb0, 0x62, 0xb4, 0x4c, 0x56, 0x33, 0x9a, 0x6a, 0xc1, 0xca, 0x2d, 0x64, 0x61, 0x81, 0xdc,
-	0xc1, 0xe4, 0x51, 0xe8, 0x16, 0x3d, 0x7f, 0x46, 0x27, 0xd8, 0x03, 0x42, 0x60, 0xbc, 0xe1, 0x0e,
-	0x23, 0x65, 0x5c, 0x73, 0x87, 0xbd, 0xca, 0x13, 0x36, 0x45, 0x1a, 0x54, 0x8e, 0xd8, 0x94, 0x3f,
-	0x20, 0xad, 0x94, 0x26, 0x73, 0x18, 0xed, 0x98, 0xe7, 0xdf, 0xd0, 0x51, 0xc7, 0x48, 0x01, 0xf9,
-	0x23, 0x63, 0x86, 0x5b, 0xeb, 0xf9, 0x37, 0x34, 0xc7, 0x00, 0xc9, 0x3d, 0x64, 0xfb, 0x53, 0xfd,
-	0x93, 0xbf, 0x46, 0x95, 0x4c, 0x7b, 0x54, 0xfe, 0x4d, 0x60, 0x4a, 0xd5, 0xc9, 0x75, 0xf2, 0xb0,
-	0x93, 0x2f, 0x8a, 0x7c, 0x84, 0xfc, 0x17, 0x3f, 0xbb, 0x4a, 0xe9, 0x18, 0x6b, 0x7a, 0x89, 0xa5,
-	0x34, 0xcd, 0x65, 0xf8, 0x46, 0xbe, 0xc2, 0x22, 0xb2, 0xbe, 0xa9, 0xe3, 0x11, 0x25, 0x0b, 0x07,
-	0xa7, 0x0f, 0xb7, 0xc3, 0xfa, 0x30, 0xa7, 0x0b, 0x73, 0xbd, 0x48, 0x56, 0xb0, 0x88, 0x27, 0x9e,
-	0xb8, 0xc3, 0x2d, 0x3a, 0x8c, 0x9e, 0x16, 0xf2, 0x7a, 0x3c, 0xe4, 0x1e, 0xff, 0xcf, 0xfd, 0x05,
-	0xde, 0x5d, 0x74, 0xee, 0x60, 0xb2, 0xe5, 0x02, 0x5f, 0xbd, 0xd1, 0x84, 0x4e, 0x58, 0x0f, 0xfa,
-	0xfe, 0xbe, 0x0b, 0x3c, 0x0c, 0xfd, 0xbd, 0x08, 0x3c, 0x94, 0x67, 0x98, 0x87, 0xce, 0x77, 0xb2,
-	0x73, 0x1d, 0x0a, 0xfb, 0x46, 0xf7, 0xf7, 0x90, 0x3d, 0xf3, 0xc6, 0x70, 0x17, 0xd9, 0x99, 0xf5,
-	0xa8, 0xaf, 0x75, 0x23, 0x3a, 0xc9, 0xb8, 0x89, 0x4e, 0xf3, 0x3a, 0x40, 0xf2, 0x01, 0x20, 0x30,
-	0x2a, 0xb4, 0x6d, 0x34, 0x0a, 0xf6, 0x32, 0xa9, 0x33, 0xff, 0x03, 0x7d, 0xfe, 0x17, 0x00, 0x00,
-	0xff, 0xff, 0x89, 0xde, 0xc9, 0x39, 0x5f, 0x02, 0x00, 0x00,
+	// 481 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x74, 0x93, 0x51, 0x6b, 0xdb, 0x30,
+	0x10, 0xc7, 0x71, 0xec, 0xd8, 0xe9, 0x39, 0x4d, 0x8b, 0x18, 0x25, 0x30, 0x28, 0xc1, 0x30, 0x96,
+	0xa7, 0x0c, 0xb2, 0xb1, 0x87, 0xbd, 0x35, 0x2b, 0x9d, 0xc3, 0xd8, 0x08, 0xca, 0xd6, 0xa7, 0xc1,
+	0x50, 0x22, 0x25, 0x36, 0x53, 0x2c, 0x21, 0x29, 0x25, 0x7e, 0xdb, 0xfb, 0xbe, 0xf4, 0x90, 0x64,
+	0x27, 0xed, 0x43, 0x9e, 0x92, 0xdf, 0xdd, 0xfd, 0xef, 0x4e, 0x77, 0x67, 0x78, 0xad, 0x65, 0x51,
+	0x56, 0x87, 0x77, 0xfe, 0xe7, 0xb7, 0x36, 0x6a, 0xbf, 0x36, 0x7a, 0x22, 0x95, 0x30, 0x02, 0xc5,
+	0xde, 0x9a, 0xfd, 0x82, 0xfe, 0xd2, 0xfd, 0x5b, 0x90, 0xf5, 0x1f, 0x66, 0xd0, 0x08, 0xc2, 0x9c,
+	0xaa, 0x61, 0x30, 0x0a, 0xc6, 0xe9, 0x74, 0x30, 0xf1, 0x51, 0x93, 0x9c, 0x11, 0xca, 0x14, 0x0e,
+	0x0b, 0xaa, 0xd0, 0x35, 0x84, 0x0b, 0x4e, 0x87, 0x9d, 0x51, 0x30, 0xee, 0xe3, 0x50, 0x72, 0x8a,
+	0x86, 0x90, 0x3c, 0x32, 0xa5, 0x4b, 0x51, 0x0d, 0xc3, 0x51, 0x30, 0xbe, 0xc4, 0xc9, 0x93, 0xc7,
+	0xec, 0x1e, 0x62, 0x2f, 0x45, 0xaf, 0xa0, 0x7b, 0xc7, 0x65, 0x41, 0x5c, 0xe6, 0x3e, 0xee, 0x12,
+	0x0b, 0x08, 0x41, 0x34, 0x63, 0x86, 0x34, 0xc9, 0xa2, 0x15, 0x33, 0xc4, 0xe6, 0xff, 0x46, 0xd6,
+	0x2e, 0x53, 0x1f, 0x87, 0x3b, 0xb2, 0xce, 0xbe, 0x40, 0x98, 0x0b, 0x89, 0x06, 0xd0, 0x99, 0x53,
+	0xa7, 0xbf, 0xc0, 0x9d, 0xd2, 0x95, 0xbd, 0xa3, 0x54, 0x31, 0xad, 0x9d, 0xfe, 0x02, 0x27, 0xc4,
+	0x23, 0xba, 0x81, 0x78, 0xb1, 0x5f, 0x7d, 0x65, 0x75, 0x93, 0x25, 0x96, 0x8e, 0x32, 0x09, 0x29,
+	0x16, 0x7b, 0x53, 0x56, 0xdb, 0x79, 0xb5, 0x11, 0xe8, 0x0d, 0x24, 0xdf, 0xd9, 0xc1, 0xe4, 0x42,
+	0x36, 0xef, 0x4d, 0x8f, 0xef, 0x15, 0x12, 0x27, 0x95, 0xf7, 0xa1, 0x4f, 0x70, 0xd5, 0xa8, 0x3e,
+	0x8b, 0xdd, 0x8e, 0x54, 0xd4, 0xd7, 0x4b, 0xa7, 0xd7, 0x6d, 0x78, 0x6b, 0xc7, 0x57, 0xea, 0x65,
+	0x60, 0xf6, 0x37, 0x80, 0x5e, 0x0b, 0x76, 0x06, 0xf7, 0x8c, 0x93, 0xda, 0x55, 0x0b, 0x70, 0x97,
+	0x5a, 0xb0, 0x33, 0x78, 0xe0, 0x64, 0xdb, 0xce, 0x60, 0xc3, 0xc9, 0xd6, 0x46, 0x62, 0x26, 0xb9,
+	0xef, 0xbf, 0x87, 0xbb, 0xca, 0x02, 0xfa, 0x00, 0x69, 0x2e, 0xe4, 0xb1, 0x89, 0x68, 0x14, 0x8e,
+	0xd3, 0x29, 0x7a, 0xd6, 0x73, 0xe3, 0xc2, 0x69, 0x71, 0x0a, 0xcb, 0x3e, 0x02, 0x9c, 0x5c, 0xb6,
+	0xda, 0x8f, 0x5a, 0x32, 0xd7, 0xc2, 0x25, 0x8e, 0x4c, 0x2d, 0x99, 0xad, 0xf6, 0x48, 0xf8, 0x9e,
+	0x35, 0x2d, 0x74, 0x9f, 0x2c, 0x64, 0x07, 0x18, 0xf8, 0xdd, 0xcd, 0xab, 0xd2, 0x94, 0x84, 0xeb,
+	0x33, 0x3b, 0xbc, 0x81, 0x78, 0xc9, 0xd6, 0x8a, 0x99, 0x46, 0x1e, 0x6b, 0x47, 0x76, 0x3d, 0x33,
+	0x5e, 0x56, 0x94, 0xa9, 0x66, 0x0b, 0xc9, 0xca, 0x23, 0xba, 0x05, 0xf0, 0x8a, 0x9c, 0xe8, 0x62,
+	0x18, 0x39, 0x27, 0xe8, 0xa3, 0x25, 0xfb, 0x17, 0x40, 0xb4, 0xfc, 0x89, 0x67, 0xe8, 0x2d, 0xf4,
+	0x1e, 0x4a, 0xa5, 0xcf, 0x6d, 0xa8, 0xb7, 0x69, 0x9c, 0xed, 0xd5, 0x76, 0xce, 0x5f, 0xed, 0x2d,
+	0xc0, 0x82, 0xd4, 0x5c, 0x10, 0x7a, 0x3a, 0x0b, 0x90, 0x47, 0xcb, 0xf3, 0x1b, 0x8e, 0x5e, 0xdc,
+	0xf0, 0x2a, 0x76, 0x1f, 0xcc, 0xfb, 0xff, 0x03, 0x00, 0x40, 0xfc, 0x44, 0x2f, 0x4f, 0x03, 0x00,
+	0x00,
 }
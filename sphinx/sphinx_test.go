@@ -16,12 +16,14 @@ package sphinx
 
 import (
 	"crypto/aes"
+	"crypto/rand"
 	"fmt"
 	"os"
 	"testing"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/nymtech/nym-mixnet/config"
+	"github.com/nymtech/nym-mixnet/flags"
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/crypto/curve25519"
 )
@@ -127,7 +129,7 @@ func TestGetSharedSecrets(t *testing.T) {
 	x, err := RandomElement()
 	assert.Nil(t, err)
 
-	result, err := getSharedSecrets(nodes, x)
+	result, err := getSharedSecrets(packetFormats[CurrentPacketVersion], nodes, x)
 	assert.Nil(t, err)
 
 	var expected []HeaderInitials
@@ -139,8 +141,9 @@ func TestGetSharedSecrets(t *testing.T) {
 	s0 := expo(pubs[0].ToFieldElement(), blindFactors)
 	aesS0, err := KDF(s0.Bytes())
 	assert.Nil(t, err)
-	b0, err := computeBlindingFactor(aesS0)
+	keys0, err := deriveHKDFHopKeys(s0.Bytes())
 	assert.Nil(t, err)
+	b0 := keys0.blinder
 
 	expected = append(expected, HeaderInitials{Alpha: alpha0.Bytes(),
 		Secret:     s0.Bytes(),
@@ -154,8 +157,9 @@ func TestGetSharedSecrets(t *testing.T) {
 	s1 := expo(pubs[1].ToFieldElement(), blindFactors)
 	aesS1, err := KDF(s1.Bytes())
 	assert.Nil(t, err)
-	b1, err := computeBlindingFactor(aesS1)
+	keys1, err := deriveHKDFHopKeys(s1.Bytes())
 	assert.Nil(t, err)
+	b1 := keys1.blinder
 
 	expected = append(expected, HeaderInitials{Alpha: alpha1.Bytes(),
 		Secret:     s1.Bytes(),
@@ -169,8 +173,9 @@ func TestGetSharedSecrets(t *testing.T) {
 	s2 := expo(pubs[2].ToFieldElement(), blindFactors)
 	aesS2, err := KDF(s2.Bytes())
 	assert.Nil(t, err)
-	b2, err := computeBlindingFactor(aesS2)
+	keys2, err := deriveHKDFHopKeys(s2.Bytes())
 	assert.Nil(t, err)
+	b2 := keys2.blinder
 
 	expected = append(expected, HeaderInitials{Alpha: alpha2.Bytes(),
 		Secret:     s2.Bytes(),
@@ -184,31 +189,22 @@ func TestGetSharedSecrets(t *testing.T) {
 }
 
 func TestComputeFillers(t *testing.T) {
-	basePoint := [32]byte{9, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
-
-	h1 := HeaderInitials{Alpha: []byte{}, Secret: basePoint[:], Blinder: []byte{}, SecretHash: []byte("1111111111111111")}
-	h2 := HeaderInitials{Alpha: []byte{}, Secret: basePoint[:], Blinder: []byte{}, SecretHash: []byte("1111111111111111")}
-	h3 := HeaderInitials{Alpha: []byte{}, Secret: basePoint[:], Blinder: []byte{}, SecretHash: []byte("1111111111111111")}
+	h1 := HeaderInitials{Alpha: []byte{}, Secret: []byte("11111111111111111111111111111111"), Blinder: []byte{}}
+	h2 := HeaderInitials{Alpha: []byte{}, Secret: []byte("22222222222222222222222222222222"), Blinder: []byte{}}
+	h3 := HeaderInitials{Alpha: []byte{}, Secret: []byte("33333333333333333333333333333333"), Blinder: []byte{}}
 	tuples := []HeaderInitials{h1, h2, h3}
 
-	_, pub1, err := GenerateKeyPair()
-	assert.Nil(t, err)
-
-	_, pub2, err := GenerateKeyPair()
+	format := packetFormats[CurrentPacketVersion]
+	fillers, err := computeFillers(format, tuples)
 	assert.Nil(t, err)
+	assert.Len(t, fillers, 2*hopSlotSize)
 
-	_, pub3, err := GenerateKeyPair()
+	// the last hop slot of the filler is the padding introduced by the second to last node
+	keys, err := format.deriveHopKeys(h2.Secret)
 	assert.Nil(t, err)
-
-	m1 := config.MixConfig{Id: "", Host: "", Port: "", PubKey: pub1.Bytes()}
-	m2 := config.MixConfig{Id: "", Host: "", Port: "", PubKey: pub2.Bytes()}
-	m3 := config.MixConfig{Id: "", Host: "", Port: "", PubKey: pub3.Bytes()}
-
-	fillers, err := computeFillers([]config.MixConfig{m1, m2, m3}, tuples)
+	stream, err := routingKeyStream(keys.routingKey)
 	assert.Nil(t, err)
-
-	fmt.Println("FILLER: ", fillers)
-
+	assert.Equal(t, stream[BetaSize:], fillers[hopSlotSize:])
 }
 
 func TestXorBytesPass(t *testing.T) {
@@ -221,121 +217,131 @@ func TestXorBytesFail(t *testing.T) {
 	assert.NotEqual(t, []byte("00000"), result)
 }
 
+func createTestPath(t *testing.T, length int) ([]*PrivateKey, []config.MixConfig) {
+	privs := make([]*PrivateKey, length)
+	nodes := make([]config.MixConfig, length)
+	for i := 0; i < length; i++ {
+		priv, pub, err := GenerateKeyPair()
+		assert.Nil(t, err)
+		privs[i] = priv
+		nodes[i] = config.NewMixConfig(fmt.Sprintf("Node%d", i+1), "localhost", fmt.Sprintf("333%d", i+1), pub.Bytes(), uint(i+1))
+		nodes[i].PacketVersions = SupportedPacketVersions()
+	}
+	return privs, nodes
+}
+
 func TestEncapsulateHeader(t *testing.T) {
-	_, pub1, err := GenerateKeyPair()
+	_, pubD, err := GenerateKeyPair()
 	assert.Nil(t, err)
+	dest := config.ClientConfig{Id: "DestinationId", Host: "DestinationAddress", Port: "9998", PubKey: pubD.Bytes()}
 
-	_, pub2, err := GenerateKeyPair()
-	assert.Nil(t, err)
+	for length := 1; length <= MaxPathLength; length++ {
+		_, nodes := createTestPath(t, length)
+		commands := make([]Commands, length)
+		for i := range commands {
+			commands[i] = Commands{Delay: 0.34, Flag: []byte("0")}
+		}
 
-	_, pub3, err := GenerateKeyPair()
-	assert.Nil(t, err)
+		x, err := RandomElement()
+		assert.Nil(t, err)
+		sharedSecrets, err := getSharedSecrets(packetFormats[CurrentPacketVersion], nodes, x)
+		assert.Nil(t, err)
 
-	_, pubD, err := GenerateKeyPair()
-	assert.Nil(t, err)
+		header, err := encapsulateHeader(rand.Reader, packetFormats[CurrentPacketVersion], sharedSecrets, nodes, commands, dest)
+		assert.Nil(t, err)
 
-	m1 := config.NewMixConfig("Node1", "localhost", "3331", pub1.Bytes(), 1)
-	m2 := config.NewMixConfig("Node2", "localhost", "3332", pub2.Bytes(), 2)
-	m3 := config.NewMixConfig("Node3", "localhost", "3333", pub3.Bytes(), 3)
+		// the size of the header must not depend on the length of the path
+		assert.Equal(t, sharedSecrets[0].Alpha, header.Alpha)
+		assert.Len(t, header.Beta, BetaSize)
 
-	nodes := []config.MixConfig{m1, m2, m3}
+		keys, err := deriveHKDFHopKeys(sharedSecrets[0].Secret)
+		assert.Nil(t, err)
+		mac, err := computeMac(keys.macKey, header.Beta)
+		assert.Nil(t, err)
+		assert.Equal(t, mac, header.Mac)
+	}
+}
 
-	c1 := Commands{Delay: 0.34, Flag: []byte("0")}
-	c2 := Commands{Delay: 0.25, Flag: []byte("1")}
-	c3 := Commands{Delay: 1.10, Flag: []byte("1")}
-	commands := []Commands{c1, c2, c3}
+func TestEncapsulateHeaderTooLongPath(t *testing.T) {
+	_, nodes := createTestPath(t, MaxPathLength+1)
+	commands := make([]Commands, len(nodes))
 
 	x, err := RandomElement()
 	assert.Nil(t, err)
-	sharedSecrets, err := getSharedSecrets(nodes, x)
+	sharedSecrets, err := getSharedSecrets(packetFormats[CurrentPacketVersion], nodes, x)
 	assert.Nil(t, err)
 
-	actualHeader, err := encapsulateHeader(sharedSecrets, nodes, commands,
-		config.ClientConfig{Id: "DestinationId", Host: "DestinationAddress", Port: "9998", PubKey: pubD.Bytes()})
-
-	assert.Nil(t, err)
+	_, err = encapsulateHeader(rand.Reader, packetFormats[CurrentPacketVersion], sharedSecrets, nodes, commands, config.ClientConfig{})
+	assert.Equal(t, ErrPathTooLong, err)
+}
 
-	routing1 := RoutingInfo{NextHop: &Hop{Id: "DestinationId",
-		Address: "DestinationAddress:9998",
-		PubKey:  []byte{},
-	}, RoutingCommands: &c3,
-		NextHopMetaData: []byte{},
-		Mac:             []byte{},
-	}
+func TestProcessSphinxHeader(t *testing.T) {
+	privs, nodes := createTestPath(t, 3)
 
-	routing1Bytes, err := proto.Marshal(&routing1)
-	assert.Nil(t, err)
+	c1 := Commands{Delay: 0.34, Flag: flags.RelayFlag.Bytes()}
+	c2 := Commands{Delay: 0.25, Flag: flags.RelayFlag.Bytes()}
+	c3 := Commands{Delay: 1.10, Flag: flags.LastHopFlag.Bytes()}
+	commands := []Commands{c1, c2, c3}
 
-	kdfRes, err := KDF(sharedSecrets[2].SecretHash)
+	x, err := RandomElement()
 	assert.Nil(t, err)
-	encRouting1, err := AesCtr(kdfRes, routing1Bytes)
+	sharedSecrets, err := getSharedSecrets(packetFormats[CurrentPacketVersion], nodes, x)
 	assert.Nil(t, err)
 
-	mac1, err := computeMac(kdfRes, encRouting1)
+	header, err := encapsulateHeader(rand.Reader, packetFormats[CurrentPacketVersion], sharedSecrets, nodes, commands,
+		config.ClientConfig{Id: "DestinationId", Host: "DestinationAddress", Port: "9998"})
 	assert.Nil(t, err)
 
-	routing2 := RoutingInfo{NextHop: &Hop{Id: "Node3",
-		Address: "localhost:3333",
-		PubKey:  pub3.Bytes(),
-	}, RoutingCommands: &c2,
-		NextHopMetaData: encRouting1,
-		Mac:             mac1,
+	expectedHops := []Hop{
+		{Id: "Node2", Address: "localhost:3332", PubKey: nodes[1].PubKey},
+		{Id: "Node3", Address: "localhost:3333", PubKey: nodes[2].PubKey},
+		{Id: "DestinationId", Address: "DestinationAddress:9998", PubKey: []byte{}},
 	}
 
-	routing2Bytes, err := proto.Marshal(&routing2)
-	assert.Nil(t, err)
-
-	kdfRes, err = KDF(sharedSecrets[1].SecretHash)
-	assert.Nil(t, err)
-
-	encRouting2, err := AesCtr(kdfRes, routing2Bytes)
-	assert.Nil(t, err)
-
-	mac2, err := computeMac(kdfRes, encRouting2)
-	assert.Nil(t, err)
+	for i, priv := range privs {
+		nextHop, newCommands, newHeader, err := ProcessSphinxHeader(header, priv)
+		assert.Nil(t, err)
 
-	expectedRouting := RoutingInfo{NextHop: &Hop{Id: "Node2",
-		Address: "localhost:3332",
-		PubKey:  pub2.Bytes(),
-	}, RoutingCommands: &c1,
-		NextHopMetaData: encRouting2,
-		Mac:             mac2,
+		assert.True(t, proto.Equal(&nextHop, &expectedHops[i]))
+		assert.True(t, proto.Equal(&newCommands, &commands[i]))
+		assert.Len(t, newHeader.Beta, BetaSize)
+		if i < len(privs)-1 {
+			assert.Equal(t, sharedSecrets[i+1].Alpha, newHeader.Alpha)
+		}
+		header = newHeader
 	}
+}
 
-	expectedRoutingBytes, err := proto.Marshal(&expectedRouting)
-	assert.Nil(t, err)
+func TestProcessSphinxHeaderInvalidMac(t *testing.T) {
+	privs, nodes := createTestPath(t, 3)
+	commands := []Commands{{Delay: 0.1}, {Delay: 0.2}, {Delay: 0.3}}
 
-	kdfRes, err = KDF(sharedSecrets[0].SecretHash)
+	x, err := RandomElement()
 	assert.Nil(t, err)
-
-	encExpectedRouting, err := AesCtr(kdfRes, expectedRoutingBytes)
+	sharedSecrets, err := getSharedSecrets(packetFormats[CurrentPacketVersion], nodes, x)
 	assert.Nil(t, err)
 
-	mac3, err := computeMac(kdfRes, encExpectedRouting)
+	header, err := encapsulateHeader(rand.Reader, packetFormats[CurrentPacketVersion], sharedSecrets, nodes, commands, config.ClientConfig{})
 	assert.Nil(t, err)
 
-	expectedHeader := Header{Alpha: sharedSecrets[0].Alpha,
-		Beta: encExpectedRouting,
-		Mac:  mac3,
-	}
-
-	assert.Equal(t, expectedHeader, actualHeader)
+	header.Beta[42] ^= 0xff
+	_, _, _, err = ProcessSphinxHeader(header, privs[0])
+	assert.Error(t, err)
 }
 
-func TestProcessSphinxHeader(t *testing.T) {
+func TestProcessSphinxPayload(t *testing.T) {
+
+	message := []byte("Plaintext message")
+
 	priv1, pub1, err := GenerateKeyPair()
 	assert.Nil(t, err)
 
-	_, pub2, err := GenerateKeyPair()
+	priv2, pub2, err := GenerateKeyPair()
 	assert.Nil(t, err)
 
-	_, pub3, err := GenerateKeyPair()
+	priv3, pub3, err := GenerateKeyPair()
 	assert.Nil(t, err)
 
-	c1 := Commands{Delay: 0.34}
-	c2 := Commands{Delay: 0.25}
-	c3 := Commands{Delay: 1.10}
-
 	m1 := config.NewMixConfig("Node1", "localhost", "3331", pub1.Bytes(), 1)
 	m2 := config.NewMixConfig("Node2", "localhost", "3332", pub2.Bytes(), 2)
 	m3 := config.NewMixConfig("Node3", "localhost", "3333", pub3.Bytes(), 3)
@@ -344,118 +350,167 @@ func TestProcessSphinxHeader(t *testing.T) {
 
 	x, err := RandomElement()
 	assert.Nil(t, err)
-	sharedSecrets, err := getSharedSecrets(nodes, x)
-	assert.Nil(t, err)
-
-	// Intermediate steps, which are needed to check whether the processing of the header was correct
-	routing1 := RoutingInfo{NextHop: &Hop{Id: "DestinationId",
-		Address: "DestinationAddress", PubKey: []byte{},
-	}, RoutingCommands: &c3,
-		NextHopMetaData: []byte{},
-		Mac:             []byte{},
-	}
-
-	routing1Bytes, err := proto.Marshal(&routing1)
-	assert.Nil(t, err)
-
-	kdfRes, err := KDF(sharedSecrets[2].SecretHash)
+	headerInitials, err := getSharedSecrets(packetFormats[CurrentPacketVersion], nodes, x)
 	assert.Nil(t, err)
 
-	encRouting1, err := AesCtr(kdfRes, routing1Bytes)
+	paddedMessage, err := padMessage(message)
 	assert.Nil(t, err)
-
-	mac1, err := computeMac(kdfRes, encRouting1)
+	encMsg, err := encapsulateContent(packetFormats[CurrentPacketVersion], headerInitials, paddedMessage)
 	assert.Nil(t, err)
 
-	routing2 := RoutingInfo{NextHop: &Hop{Id: "Node3",
-		Address: "localhost:3333",
-		PubKey:  pub3.Bytes(),
-	}, RoutingCommands: &c2,
-		NextHopMetaData: encRouting1,
-		Mac:             mac1,
+	decMsg := encMsg
+	privs := []*PrivateKey{priv1, priv2, priv3}
+	for i, v := range privs {
+		decMsg, err = ProcessSphinxPayload(headerInitials[i].Alpha, decMsg, v)
+		if err != nil {
+			t.Error(err)
+		}
 	}
+	assert.Equal(t, paddedMessage, decMsg)
+}
 
-	routing2Bytes, err := proto.Marshal(&routing2)
-	assert.Nil(t, err)
+func TestPadMessage(t *testing.T) {
+	message := []byte("Plaintext message")
 
-	kdfRes, err = KDF(sharedSecrets[1].SecretHash)
+	padded, err := padMessage(message)
 	assert.Nil(t, err)
+	assert.Len(t, padded, PayloadSize)
+	assert.Equal(t, make([]byte, payloadIntegrityTagSize), padded[:payloadIntegrityTagSize])
+	assert.Equal(t, message, padded[payloadIntegrityTagSize:payloadIntegrityTagSize+len(message)])
 
-	encRouting2, err := AesCtr(kdfRes, routing2Bytes)
+	unpadded, err := UnpadMessage(padded)
 	assert.Nil(t, err)
+	assert.Equal(t, message, unpadded)
+}
 
-	mac2, err := computeMac(kdfRes, encRouting2)
-	assert.Nil(t, err)
+func TestPadMessageBoundaries(t *testing.T) {
+	for _, message := range [][]byte{{}, make([]byte, maxPaddedMessageSize), {0x01, 0x00, 0x01}} {
+		padded, err := padMessage(message)
+		assert.Nil(t, err)
+		assert.Len(t, padded, PayloadSize)
 
-	routing3 := RoutingInfo{NextHop: &Hop{Id: "Node2",
-		Address: "localhost:3332",
-		PubKey:  pub2.Bytes(),
-	}, RoutingCommands: &c1,
-		NextHopMetaData: encRouting2,
-		Mac:             mac2,
+		unpadded, err := UnpadMessage(padded)
+		assert.Nil(t, err)
+		assert.Equal(t, message, unpadded)
 	}
 
-	routing3Bytes, err := proto.Marshal(&routing3)
-	assert.Nil(t, err)
+	_, err := padMessage(make([]byte, maxPaddedMessageSize+1))
+	assert.Equal(t, ErrMessageTooLong, err)
+}
 
-	kdfRes, err = KDF(sharedSecrets[0].SecretHash)
-	assert.Nil(t, err)
+func TestUnpadMessageInvalid(t *testing.T) {
+	_, err := UnpadMessage(make([]byte, PayloadSize-1))
+	assert.Equal(t, ErrInvalidPayloadSize, err)
 
-	encExpectedRouting, err := AesCtr(kdfRes, routing3Bytes)
-	assert.Nil(t, err)
+	_, err = UnpadMessage(make([]byte, PayloadSize))
+	assert.Equal(t, ErrInvalidPadding, err)
+
+	payload := make([]byte, PayloadSize)
+	payload[PayloadSize-1] = 0x02
+	_, err = UnpadMessage(payload)
+	assert.Equal(t, ErrInvalidPadding, err)
 
-	mac3, err := computeMac(kdfRes, encExpectedRouting)
+	payload, err = padMessage([]byte("Message"))
 	assert.Nil(t, err)
+	payload[0] = 0x01
+	_, err = UnpadMessage(payload)
+	assert.Equal(t, ErrTamperedPayload, err)
+}
+
+func TestPackForwardMessageConstantSize(t *testing.T) {
+	_, nodes := createTestPath(t, 3)
+	path := config.E2EPath{IngressProvider: nodes[0], Mixes: nodes[1:2], EgressProvider: nodes[2]}
 
-	header := Header{Alpha: sharedSecrets[0].Alpha,
-		Beta: encExpectedRouting,
-		Mac:  mac3,
+	for _, message := range [][]byte{[]byte("short"), make([]byte, MaxMessageSize)} {
+		packet, err := PackForwardMessage(path, []float64{0.1, 0.2, 0.3}, message)
+		assert.Nil(t, err)
+		assert.Len(t, packet.Pld, PayloadSize)
+
+		packetBytes, err := EncodePacket(&packet)
+		assert.Nil(t, err)
+		assert.Len(t, packetBytes, PacketSize)
 	}
 
-	nextHop, newCommands, newHeader, err := ProcessSphinxHeader(header, priv1)
+	_, err := PackForwardMessage(path, []float64{0.1, 0.2, 0.3}, make([]byte, MaxMessageSize+1))
+	assert.Equal(t, ErrMessageTooLong, err)
+}
 
-	assert.Nil(t, err)
+func TestPackForwardMessageInsufficientDelays(t *testing.T) {
+	_, nodes := createTestPath(t, 3)
+	path := config.E2EPath{IngressProvider: nodes[0], Mixes: nodes[1:2], EgressProvider: nodes[2]}
 
-	assert.True(t, proto.Equal(&nextHop, &Hop{Id: "Node2", Address: "localhost:3332", PubKey: pub2.Bytes()}))
-	assert.True(t, proto.Equal(&newCommands, &c1))
-	assert.True(t, proto.Equal(&newHeader, &Header{Alpha: sharedSecrets[1].Alpha, Beta: encRouting2, Mac: mac2}))
+	_, err := PackForwardMessage(path, []float64{0.1, 0.2}, []byte("Message"))
+	assert.Error(t, err)
 
+	_, _, err = CreateSURB(path, []float64{0.1, 0.2})
+	assert.Error(t, err)
 }
 
-func TestProcessSphinxPayload(t *testing.T) {
+func TestProcessSphinxPacketReplayTag(t *testing.T) {
+	privs, nodes := createTestPath(t, 3)
+	path := config.E2EPath{IngressProvider: nodes[0], Mixes: nodes[1:2], EgressProvider: nodes[2]}
 
-	message := []byte("Plaintext message")
+	var tags [][]byte
+	recordTag := func(tag []byte) bool {
+		for _, seen := range tags {
+			if string(seen) == string(tag) {
+				return true
+			}
+		}
+		tags = append(tags, tag)
+		return false
+	}
 
-	priv1, pub1, err := GenerateKeyPair()
+	for i := 0; i < 2; i++ {
+		packet, err := PackForwardMessage(path, []float64{0.1, 0.2, 0.3}, []byte("Message"))
+		assert.Nil(t, err)
+		packetBytes, err := EncodePacket(&packet)
+		assert.Nil(t, err)
+
+		_, _, _, err = ProcessSphinxPacketWithReplayCheck(packetBytes, privs[0], recordTag)
+		assert.Nil(t, err)
+		_, _, _, err = ProcessSphinxPacketWithReplayCheck(packetBytes, privs[0], recordTag)
+		assert.Equal(t, ErrReplayedPacket, err)
+	}
+	assert.Len(t, tags, 2)
+}
+
+func TestProcessSphinxPacketTamperedPayload(t *testing.T) {
+	privs, nodes := createTestPath(t, 3)
+	path := config.E2EPath{IngressProvider: nodes[0], Mixes: nodes[1:2], EgressProvider: nodes[2]}
+
+	packet, err := PackForwardMessage(path, []float64{0.1, 0.2, 0.3}, []byte("Message"))
+	assert.Nil(t, err)
+	packetBytes, err := EncodePacket(&packet)
 	assert.Nil(t, err)
 
-	priv2, pub2, err := GenerateKeyPair()
+	_, _, packetBytes, err = ProcessSphinxPacket(packetBytes, privs[0])
 	assert.Nil(t, err)
 
-	priv3, pub3, err := GenerateKeyPair()
+	// a malicious mix flips a single bit of the payload
+	tampered, err := DecodePacket(packetBytes)
+	assert.Nil(t, err)
+	tampered.Pld[100] ^= 0x01
+	packetBytes, err = EncodePacket(&tampered)
 	assert.Nil(t, err)
 
-	m1 := config.NewMixConfig("Node1", "localhost", "3331", pub1.Bytes(), 1)
-	m2 := config.NewMixConfig("Node2", "localhost", "3332", pub2.Bytes(), 2)
-	m3 := config.NewMixConfig("Node3", "localhost", "3333", pub3.Bytes(), 3)
+	_, _, packetBytes, err = ProcessSphinxPacket(packetBytes, privs[1])
+	assert.Nil(t, err)
+	_, _, _, err = ProcessSphinxPacket(packetBytes, privs[2])
+	assert.Equal(t, ErrTamperedPayload, err)
+}
 
-	nodes := []config.MixConfig{m1, m2, m3}
+func TestProcessSphinxPacketUnsupportedVersion(t *testing.T) {
+	privs, nodes := createTestPath(t, 3)
+	path := config.E2EPath{IngressProvider: nodes[0], Mixes: nodes[1:2], EgressProvider: nodes[2]}
 
-	x, err := RandomElement()
-	assert.Nil(t, err)
-	headerInitials, err := getSharedSecrets(nodes, x)
+	packet, err := PackForwardMessage(path, []float64{0.1, 0.2, 0.3}, []byte("Message"))
 	assert.Nil(t, err)
+	assert.Equal(t, uint32(CurrentPacketVersion), packet.Version)
 
-	encMsg, err := encapsulateContent(headerInitials, message)
+	packet.Version = 0
+	packetBytes, err := EncodePacket(&packet)
 	assert.Nil(t, err)
-
-	decMsg := encMsg
-	privs := []*PrivateKey{priv1, priv2, priv3}
-	for i, v := range privs {
-		decMsg, err = ProcessSphinxPayload(headerInitials[i].Alpha, decMsg, v)
-		if err != nil {
-			t.Error(err)
-		}
-	}
-	assert.Equal(t, []byte(message), decMsg)
+	_, _, _, err = ProcessSphinxPacket(packetBytes, privs[0])
+	assert.Equal(t, ErrUnsupportedPacketVersion, err)
 }
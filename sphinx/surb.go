@@ -0,0 +1,197 @@
+// Copyright 2019 The Nym Mixnet Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sphinx
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/nymtech/nym-mixnet/config"
+)
+
+const (
+	// replyMarkerSize is the size of the zero-filled marker preceding the reply message.
+	// It allows the creator of the reply block to recognise a correctly decrypted reply.
+	replyMarkerSize = K
+
+	// MaxReplySize is the maximum length of a reply message that fits into a single packet payload.
+	MaxReplySize = PayloadSize - replyMarkerSize - 1
+)
+
+var (
+	// ErrInvalidSURB defines an error when the provided reply block is incomplete.
+	ErrInvalidSURB = errors.New("invalid single use reply block")
+	// ErrNotReply defines an error when the payload could not be decrypted with the given reply block keys.
+	ErrNotReply = errors.New("payload is not a reply to the given reply block")
+)
+
+// SURBDecryptionKeys holds the keys, known only to the creator of the single use reply block,
+// required to decrypt the reply sent using that block.
+type SURBDecryptionKeys struct {
+	// PayloadKey is the Lioness key the replier uses to encrypt the reply. It is derived from the key included
+	// in the SURB itself.
+	PayloadKey []byte
+	// HopKeys are the Lioness keys each of the hops on the reply path uses to process the payload.
+	HopKeys [][]byte
+	// ID is the public element of the header of the reply, as it is delivered to the creator of the block.
+	// It is derived from the secrets of the reply block, so the creator can find the keys of the received reply
+	// with ReplyID, while nobody else can link the delivered reply to the block.
+	ID []byte
+}
+
+// CreateSURB creates a single use reply block, which allows the recipient of a message to send
+// a reply to the creator of the block, without learning who the creator is.
+// The path of the reply starts at path.IngressProvider, which should be the provider of the replier,
+// and ends at path.EgressProvider and path.Recipient, which should be the provider and the address of the creator.
+// CreateSURB returns the reply block, which should be passed to the replier, and the keys
+// which should be kept by the creator in order to decrypt the reply, or an error.
+// The reply block uses the newest packet format supported by all the nodes on the path. The version is recorded
+// in the block, so that the reply is packed in the same format regardless of the versions supported by the replier.
+func CreateSURB(path config.E2EPath, delays []float64) (SURB, SURBDecryptionKeys, error) {
+	return CreateSURBFrom(rand.Reader, path, delays)
+}
+
+// CreateSURBFrom works like CreateSURB, but reads all the randomness required to create the reply block
+// from the given source instead of crypto/rand. The randomness is consumed in the same order as by
+// PackForwardMessageFrom, followed by K bytes of the payload key.
+func CreateSURBFrom(random io.Reader, path config.E2EPath, delays []float64) (SURB, SURBDecryptionKeys, error) {
+	nodes := []config.MixConfig{path.IngressProvider}
+	nodes = append(nodes, path.Mixes...)
+	nodes = append(nodes, path.EgressProvider)
+
+	commands, err := routingCommands(nodes, delays, nil, true)
+	if err != nil {
+		return SURB{}, SURBDecryptionKeys{}, fmt.Errorf("error in CreateSURB - %v", err)
+	}
+	format, err := selectPacketFormat(nodes, commands, path.Recipient)
+	if err != nil {
+		return SURB{}, SURBDecryptionKeys{}, err
+	}
+
+	headerInitials, header, err := createHeader(random, format, nodes, commands, path.Recipient)
+	if err != nil {
+		errMsg := fmt.Errorf("error in CreateSURB - createHeader failed: %v", err)
+		return SURB{}, SURBDecryptionKeys{}, errMsg
+	}
+
+	payloadKey, err := randomBytes(random, K)
+	if err != nil {
+		return SURB{}, SURBDecryptionKeys{}, err
+	}
+
+	lionessKey, err := format.deriveSURBPayloadKey(payloadKey)
+	if err != nil {
+		return SURB{}, SURBDecryptionKeys{}, err
+	}
+
+	hopKeys := make([][]byte, len(headerInitials))
+	for i := range headerInitials {
+		keys, err := format.deriveHopKeys(headerInitials[i].Secret)
+		if err != nil {
+			return SURB{}, SURBDecryptionKeys{}, err
+		}
+		hopKeys[i] = keys.payloadKey
+	}
+
+	// the egress provider blinds the public element of the header the same way every hop before it did
+	last := headerInitials[len(headerInitials)-1]
+	replyID := expo(BytesToFieldElement(last.Alpha), []*FieldElement{BytesToFieldElement(last.Blinder)})
+
+	firstHop := Hop{Id: path.IngressProvider.Id,
+		Address: path.IngressProvider.Host + ":" + path.IngressProvider.Port,
+		PubKey:  path.IngressProvider.PubKey,
+	}
+	surb := SURB{FirstHop: &firstHop, Hdr: &header, PayloadKey: payloadKey, Version: format.version}
+	return surb, SURBDecryptionKeys{PayloadKey: lionessKey, HopKeys: hopKeys, ID: replyID.Bytes()}, nil
+}
+
+// ReplyID returns the identifier of the reply block the received packet might have been sent with.
+// It matches SURBDecryptionKeys.ID of that block, if the packet is a reply processed by all the hops on its path.
+func ReplyID(packet *SphinxPacket) []byte {
+	return packet.GetHdr().GetAlpha()
+}
+
+// PackReplyMessage encapsulates the reply message into the Sphinx packet format using only
+// the received single use reply block. The packet should be sent to the surb.FirstHop.
+// PackReplyMessage returns ErrMessageTooLong if the message is longer than MaxReplySize
+// and ErrUnsupportedPacketVersion if the reply block uses an unknown packet format.
+func PackReplyMessage(surb *SURB, message []byte) (SphinxPacket, error) {
+	if surb == nil || surb.Hdr == nil || surb.FirstHop == nil || len(surb.PayloadKey) != K {
+		return SphinxPacket{}, ErrInvalidSURB
+	}
+
+	format, err := getPacketFormat(surb.Version)
+	if err != nil {
+		return SphinxPacket{}, err
+	}
+
+	// the marker is already zeroed
+	plaintext := make([]byte, replyMarkerSize, PayloadSize)
+	padded, err := pad(message, PayloadSize-replyMarkerSize)
+	if err != nil {
+		return SphinxPacket{}, err
+	}
+	plaintext = append(plaintext, padded...)
+
+	lionessKey, err := format.deriveSURBPayloadKey(surb.PayloadKey)
+	if err != nil {
+		return SphinxPacket{}, err
+	}
+
+	payload, err := LionessEncrypt(lionessKey, plaintext)
+	if err != nil {
+		errMsg := fmt.Errorf("error in PackReplyMessage - Lioness encryption failed: %v", err)
+		return SphinxPacket{}, errMsg
+	}
+
+	header := *surb.Hdr
+	return SphinxPacket{Hdr: &header, Pld: payload, Version: format.version}, nil
+}
+
+// ProcessReplyPayload decrypts the payload of the received reply using the keys of the reply block.
+// Since the hops on the reply path processed the payload in the same way as they do for
+// the forward messages, ProcessReplyPayload first reverts their processing, starting from the last hop,
+// and then removes the encryption applied by the replier.
+// ProcessReplyPayload returns ErrNotReply if the payload was not created with the given reply block.
+func ProcessReplyPayload(keys SURBDecryptionKeys, payload []byte) ([]byte, error) {
+	if len(payload) != PayloadSize {
+		return nil, ErrInvalidPayloadSize
+	}
+
+	dec := payload
+	for i := len(keys.HopKeys) - 1; i >= 0; i-- {
+		var err error
+		dec, err = LionessEncrypt(keys.HopKeys[i], dec)
+		if err != nil {
+			errMsg := fmt.Errorf("error in ProcessReplyPayload - Lioness encryption failed: %v", err)
+			return nil, errMsg
+		}
+	}
+
+	dec, err := LionessDecrypt(keys.PayloadKey, dec)
+	if err != nil {
+		errMsg := fmt.Errorf("error in ProcessReplyPayload - Lioness decryption failed: %v", err)
+		return nil, errMsg
+	}
+
+	if subtle.ConstantTimeCompare(dec[:replyMarkerSize], make([]byte, replyMarkerSize)) != 1 {
+		return nil, ErrNotReply
+	}
+
+	return unpad(dec[replyMarkerSize:])
+}
@@ -0,0 +1,162 @@
+// Copyright 2019 The Nym Mixnet Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sphinx
+
+import (
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/nymtech/nym-mixnet/config"
+	"github.com/nymtech/nym-mixnet/flags"
+	"github.com/stretchr/testify/assert"
+)
+
+func createTestSURB(t *testing.T) ([]*PrivateKey, SURB, SURBDecryptionKeys) {
+	privs, nodes := createTestPath(t, 4)
+	path := config.E2EPath{IngressProvider: nodes[0],
+		Mixes:          nodes[1:3],
+		EgressProvider: nodes[3],
+		Recipient:      config.ClientConfig{Id: "Creator", Host: "localhost", Port: "9998"},
+	}
+
+	surb, keys, err := CreateSURB(path, []float64{0.1, 0.2, 0.3, 0.4})
+	assert.Nil(t, err)
+	return privs, surb, keys
+}
+
+// processThroughPath processes the packet by all of the nodes and returns the payload delivered to the last hop.
+func processThroughPath(t *testing.T, packet SphinxPacket, privs []*PrivateKey) (Hop, []byte) {
+	packetBytes, err := EncodePacket(&packet)
+	assert.Nil(t, err)
+
+	var hop Hop
+	var commands Commands
+	for _, priv := range privs {
+		hop, commands, packetBytes, err = ProcessSphinxPacket(packetBytes, priv)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, flags.LastHopFlag.Bytes(), commands.Flag)
+
+	finalPacket, err := DecodePacket(packetBytes)
+	assert.Nil(t, err)
+	return hop, finalPacket.Pld
+}
+
+func TestReplyWithSURB(t *testing.T) {
+	privs, surb, keys := createTestSURB(t)
+	assert.Equal(t, "Node1", surb.FirstHop.Id)
+	assert.Equal(t, "localhost:3331", surb.FirstHop.Address)
+	assert.Equal(t, uint32(CurrentPacketVersion), surb.Version)
+
+	// the replier only has the serialized reply block
+	surbBytes, err := proto.Marshal(&surb)
+	assert.Nil(t, err)
+	receivedSURB := new(SURB)
+	assert.Nil(t, proto.Unmarshal(surbBytes, receivedSURB))
+
+	reply := []byte("Reply message")
+	packet, err := PackReplyMessage(receivedSURB, reply)
+	assert.Nil(t, err)
+	assert.Len(t, packet.Pld, PayloadSize)
+	assert.Equal(t, receivedSURB.Version, packet.Version)
+
+	hop, payload := processThroughPath(t, packet, privs)
+	assert.Equal(t, "Creator", hop.Id)
+
+	decrypted, err := ProcessReplyPayload(keys, payload)
+	assert.Nil(t, err)
+	assert.Equal(t, reply, decrypted)
+}
+
+func TestReplyID(t *testing.T) {
+	privs, surb, keys := createTestSURB(t)
+	_, _, otherKeys := createTestSURB(t)
+	assert.Len(t, keys.ID, PublicKeySize)
+
+	packet, err := PackReplyMessage(&surb, []byte("Reply message"))
+	assert.Nil(t, err)
+	// none of the hops has processed the reply yet
+	assert.NotEqual(t, keys.ID, ReplyID(&packet))
+
+	packetBytes, err := EncodePacket(&packet)
+	assert.Nil(t, err)
+	for _, priv := range privs {
+		_, _, packetBytes, err = ProcessSphinxPacket(packetBytes, priv)
+		assert.Nil(t, err)
+	}
+	received, err := DecodePacket(packetBytes)
+	assert.Nil(t, err)
+
+	assert.Equal(t, keys.ID, ReplyID(&received))
+	assert.NotEqual(t, otherKeys.ID, ReplyID(&received))
+	assert.Nil(t, ReplyID(&SphinxPacket{}))
+}
+
+func TestProcessReplyPayloadWrongKeys(t *testing.T) {
+	privs, surb, _ := createTestSURB(t)
+	_, _, otherKeys := createTestSURB(t)
+
+	packet, err := PackReplyMessage(&surb, []byte("Reply message"))
+	assert.Nil(t, err)
+	_, payload := processThroughPath(t, packet, privs)
+
+	_, err = ProcessReplyPayload(otherKeys, payload)
+	assert.Equal(t, ErrNotReply, err)
+}
+
+func TestPackReplyMessageInvalid(t *testing.T) {
+	_, surb, _ := createTestSURB(t)
+
+	_, err := PackReplyMessage(&surb, make([]byte, MaxReplySize+1))
+	assert.Equal(t, ErrMessageTooLong, err)
+
+	_, err = PackReplyMessage(&SURB{}, []byte("Reply message"))
+	assert.Equal(t, ErrInvalidSURB, err)
+
+	surb.Version = 0
+	_, err = PackReplyMessage(&surb, []byte("Reply message"))
+	assert.Equal(t, ErrUnsupportedPacketVersion, err)
+}
+
+func TestForwardMessageWithSURB(t *testing.T) {
+	_, surb, _ := createTestSURB(t)
+	privs, nodes := createTestPath(t, 3)
+	path := config.E2EPath{IngressProvider: nodes[0], Mixes: nodes[1:2], EgressProvider: nodes[2]}
+
+	message := []byte("Message with reply block")
+	packet, err := PackForwardMessageWithSURB(path, []float64{0.1, 0.2, 0.3}, message, &surb)
+	assert.Nil(t, err)
+
+	_, payload := processThroughPath(t, packet, privs)
+	receivedMessage, receivedSURB, err := UnpackForwardMessage(payload)
+	assert.Nil(t, err)
+	assert.Equal(t, message, receivedMessage)
+	assert.True(t, proto.Equal(&surb, receivedSURB))
+}
+
+func TestUnpackForwardMessageWithoutSURB(t *testing.T) {
+	privs, nodes := createTestPath(t, 3)
+	path := config.E2EPath{IngressProvider: nodes[0], Mixes: nodes[1:2], EgressProvider: nodes[2]}
+
+	message := []byte("Message without reply block")
+	packet, err := PackForwardMessage(path, []float64{0.1, 0.2, 0.3}, message)
+	assert.Nil(t, err)
+
+	_, payload := processThroughPath(t, packet, privs)
+	receivedMessage, receivedSURB, err := UnpackForwardMessage(payload)
+	assert.Nil(t, err)
+	assert.Equal(t, message, receivedMessage)
+	assert.Nil(t, receivedSURB)
+}
@@ -0,0 +1,225 @@
+// Copyright 2019 The Nym Mixnet Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sphinx
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/nymtech/nym-mixnet/config"
+	"github.com/stretchr/testify/assert"
+)
+
+var updateVectors = flag.Bool("update-vectors", false, "regenerate the sphinx test vectors")
+
+// vectorsFile holds the known-answer test vectors of the packet construction and processing,
+// intended to be shared with other implementations of the packet format.
+var vectorsFile = filepath.Join("testdata", "vectors.json")
+
+// testVector describes the creation of a single forward packet with PackForwardMessageFrom
+// and its processing by every hop on the path. All the binary values are hex encoded.
+type testVector struct {
+	Description string `json:"description"`
+	Version     uint32 `json:"version"`
+	// Nodes are the ingress provider, the mixes and the egress provider, in the order they process the packet
+	Nodes     []vectorNode    `json:"nodes"`
+	Recipient vectorRecipient `json:"recipient"`
+	Delays    []float64       `json:"delays"`
+	Message   string          `json:"message"`
+	// Randomness is the exact content read from the source of randomness while creating the packet
+	Randomness string `json:"randomness"`
+	// Packet is the created packet in the binary wire format
+	Packet string `json:"packet"`
+	// Hops are the results of processing the packet by each of the nodes
+	Hops []vectorHop `json:"hops"`
+}
+
+type vectorNode struct {
+	ID         string `json:"id"`
+	Host       string `json:"host"`
+	Port       string `json:"port"`
+	PrivateKey string `json:"privateKey"`
+	PublicKey  string `json:"publicKey"`
+}
+
+type vectorRecipient struct {
+	ID   string `json:"id"`
+	Host string `json:"host"`
+	Port string `json:"port"`
+}
+
+type vectorHop struct {
+	NextHopID      string  `json:"nextHopId"`
+	NextHopAddress string  `json:"nextHopAddress"`
+	NextHopPubKey  string  `json:"nextHopPubKey"`
+	Delay          float64 `json:"delay"`
+	Flag           string  `json:"flag"`
+	// Output is the processed packet, which is either sent to the next hop or, for the final hop,
+	// contains the fully decrypted payload
+	Output string `json:"output"`
+}
+
+// vectorStream returns length bytes of a deterministic stream derived from the seed.
+func vectorStream(seed string, length int) []byte {
+	stream := make([]byte, 0, length+sha256.Size)
+	counter := make([]byte, 8)
+	for i := uint64(0); len(stream) < length; i++ {
+		binary.BigEndian.PutUint64(counter, i)
+		block := sha256.Sum256(append([]byte(seed), counter...))
+		stream = append(stream, block[:]...)
+	}
+	return stream[:length]
+}
+
+func (v *testVector) path(t *testing.T) config.E2EPath {
+	nodes := make([]config.MixConfig, len(v.Nodes))
+	for i, node := range v.Nodes {
+		nodes[i] = config.MixConfig{
+			Id:             node.ID,
+			Host:           node.Host,
+			Port:           node.Port,
+			PubKey:         decodeHex(t, node.PublicKey),
+			PacketVersions: []uint32{v.Version},
+		}
+	}
+	return config.E2EPath{
+		IngressProvider: nodes[0],
+		Mixes:           nodes[1 : len(nodes)-1],
+		EgressProvider:  nodes[len(nodes)-1],
+		Recipient:       config.ClientConfig{Id: v.Recipient.ID, Host: v.Recipient.Host, Port: v.Recipient.Port},
+	}
+}
+
+// generateTestVector creates the vector of the given packet format version from the deterministic streams.
+func generateTestVector(t *testing.T, version uint32) testVector {
+	v := testVector{
+		Description: fmt.Sprintf("forward packet of version %d through 5 hops", version),
+		Version:     version,
+		Recipient:   vectorRecipient{ID: "Recipient", Host: "127.0.0.1", Port: "9000"},
+		Delays:      []float64{0.5, 0.25, 0.125, 1.5, 0},
+		Message:     hex.EncodeToString([]byte("The quick brown fox jumps over the lazy dog")),
+	}
+	for i := range v.Delays {
+		seed := fmt.Sprintf("nym-sphinx-test-vector-%d-node-%d", version, i)
+		priv, pub, err := GenerateKeyPairFrom(bytes.NewReader(vectorStream(seed, PrivateKeySize)))
+		assert.Nil(t, err)
+		v.Nodes = append(v.Nodes, vectorNode{
+			ID:         fmt.Sprintf("Node%d", i+1),
+			Host:       "127.0.0.1",
+			Port:       fmt.Sprintf("%d", 1789+i),
+			PrivateKey: hex.EncodeToString(priv.Bytes()),
+			PublicKey:  hex.EncodeToString(pub.Bytes()),
+		})
+	}
+
+	random := vectorStream(fmt.Sprintf("nym-sphinx-test-vector-%d-randomness", version), 4096)
+	reader := bytes.NewReader(random)
+	packet, err := PackForwardMessageFrom(reader, v.path(t), v.Delays, decodeHex(t, v.Message), nil)
+	assert.Nil(t, err)
+	v.Randomness = hex.EncodeToString(random[:len(random)-reader.Len()])
+
+	packetBytes, err := EncodePacket(&packet)
+	assert.Nil(t, err)
+	v.Packet = hex.EncodeToString(packetBytes)
+
+	for _, node := range v.Nodes {
+		hop, commands, output, err := ProcessSphinxPacket(packetBytes, BytesToPrivateKey(decodeHex(t, node.PrivateKey)))
+		assert.Nil(t, err)
+		v.Hops = append(v.Hops, vectorHop{
+			NextHopID:      hop.Id,
+			NextHopAddress: hop.Address,
+			NextHopPubKey:  hex.EncodeToString(hop.PubKey),
+			Delay:          commands.Delay,
+			Flag:           hex.EncodeToString(commands.Flag),
+			Output:         hex.EncodeToString(output),
+		})
+		packetBytes = output
+	}
+	return v
+}
+
+func loadTestVectors(t *testing.T) []testVector {
+	if *updateVectors {
+		var vectors []testVector
+		for _, version := range SupportedPacketVersions() {
+			vectors = append(vectors, generateTestVector(t, version))
+		}
+		encoded, err := json.MarshalIndent(vectors, "", "  ")
+		assert.Nil(t, err)
+		assert.Nil(t, ioutil.WriteFile(vectorsFile, append(encoded, '\n'), 0644))
+	}
+
+	encoded, err := ioutil.ReadFile(vectorsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vectors []testVector
+	if err := json.Unmarshal(encoded, &vectors); err != nil {
+		t.Fatal(err)
+	}
+	return vectors
+}
+
+func TestVectors(t *testing.T) {
+	vectors := loadTestVectors(t)
+	assert.Len(t, vectors, len(SupportedPacketVersions()))
+
+	for _, v := range vectors {
+		for _, node := range v.Nodes {
+			_, pub, err := GenerateKeyPairFrom(bytes.NewReader(decodeHex(t, node.PrivateKey)))
+			assert.Nil(t, err)
+			assert.Equal(t, node.PublicKey, hex.EncodeToString(pub.Bytes()), v.Description)
+		}
+
+		// the packet consumes exactly the recorded randomness
+		reader := bytes.NewReader(decodeHex(t, v.Randomness))
+		packet, err := PackForwardMessageFrom(reader, v.path(t), v.Delays, decodeHex(t, v.Message), nil)
+		assert.Nil(t, err, v.Description)
+		assert.Zero(t, reader.Len(), v.Description)
+		assert.Equal(t, v.Version, packet.Version, v.Description)
+
+		packetBytes, err := EncodePacket(&packet)
+		assert.Nil(t, err)
+		assert.Equal(t, v.Packet, hex.EncodeToString(packetBytes), v.Description)
+
+		assert.Len(t, v.Hops, len(v.Nodes))
+		for i, expected := range v.Hops {
+			privKey := BytesToPrivateKey(decodeHex(t, v.Nodes[i].PrivateKey))
+			hop, commands, output, err := ProcessSphinxPacket(packetBytes, privKey)
+			assert.Nil(t, err, v.Description)
+			assert.Equal(t, expected.NextHopID, hop.Id, v.Description)
+			assert.Equal(t, expected.NextHopAddress, hop.Address, v.Description)
+			assert.Equal(t, expected.NextHopPubKey, hex.EncodeToString(hop.PubKey), v.Description)
+			assert.Equal(t, expected.Delay, commands.Delay, v.Description)
+			assert.Equal(t, expected.Flag, hex.EncodeToString(commands.Flag), v.Description)
+			assert.Equal(t, expected.Output, hex.EncodeToString(output), v.Description)
+			packetBytes = output
+		}
+
+		final, err := DecodePacket(packetBytes)
+		assert.Nil(t, err)
+		message, _, err := UnpackForwardMessage(final.Pld)
+		assert.Nil(t, err, v.Description)
+		assert.Equal(t, v.Message, hex.EncodeToString(message), v.Description)
+	}
+}
@@ -0,0 +1,297 @@
+// Copyright 2019 The Nym Mixnet Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sphinx
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// Layout of the packet in the binary wire format. All of the fields have constant sizes,
+// hence every packet travelling through the network is exactly PacketSize bytes long.
+const (
+	versionOffset = 0
+	versionSize   = 1
+	alphaOffset   = versionOffset + versionSize
+	betaOffset    = alphaOffset + PublicKeySize
+	macOffset     = betaOffset + BetaSize
+	payloadOffset = macOffset + MacSize
+
+	// PacketSize is the total size of every encoded Sphinx packet travelling through the network.
+	PacketSize = payloadOffset + PayloadSize
+)
+
+// Layout of the fields at the beginning of the routing information of a single hop in the binary formats.
+// Variable length fields occupy constant size slots, in which they are prefixed with their length.
+const (
+	routingFlagOffset   = 0
+	routingReplyOffset  = routingFlagOffset + 1
+	routingDelayOffset  = routingReplyOffset + 1
+	routingPubKeyOffset = routingDelayOffset + 8
+	routingPubKeySize   = 1 + PublicKeySize
+	routingIDOffset     = routingPubKeyOffset + routingPubKeySize
+)
+
+// routingLayout defines the sizes of the slots following the public key in the binary routing information.
+type routingLayout struct {
+	idSize      int
+	addressSize int
+	// commandsSize is the size of the area of the hop commands, zero if the layout cannot carry them
+	commandsSize int
+}
+
+var (
+	// compactLayout is the layout of the routing information of PacketVersionCompact.
+	compactLayout = routingLayout{
+		idSize:      64,
+		addressSize: RoutingInfoSize - routingIDOffset - 64,
+	}
+
+	// commandsLayout is the layout of the routing information of PacketVersionCommands, in which
+	// the slots of the id and the address are shortened to make space for the hop commands.
+	// The packets sent through the nodes with longer ids or addresses are created in an older version,
+	// as chosen by selectPacketFormat.
+	commandsLayout = routingLayout{
+		idSize:       48,
+		addressSize:  40,
+		commandsSize: RoutingInfoSize - routingIDOffset - 48 - 40,
+	}
+)
+
+var (
+	// LegacyPacketSize is the size of the packets encoded with protobuf, which are still accepted
+	// by the nodes, but no longer created by this implementation.
+	LegacyPacketSize = proto.Size(&SphinxPacket{
+		Hdr: &Header{
+			Alpha: make([]byte, PublicKeySize),
+			Beta:  make([]byte, BetaSize),
+			Mac:   make([]byte, MacSize),
+		},
+		Pld:     make([]byte, PayloadSize),
+		Version: CurrentPacketVersion,
+	})
+)
+
+var (
+	// ErrInvalidPacketEncoding defines an error when the packet cannot be encoded into or decoded from
+	// the binary wire format.
+	ErrInvalidPacketEncoding = errors.New("invalid packet encoding")
+)
+
+// RawPacket is a Sphinx packet in the binary wire format. All of its accessors return
+// sub-slices of the underlying bytes, so reading the packet does not allocate any memory.
+type RawPacket []byte
+
+// ParseRawPacket checks whether the bytes are a packet in the binary wire format and returns its view.
+// The returned packet shares the memory with b.
+func ParseRawPacket(b []byte) (RawPacket, error) {
+	if len(b) != PacketSize {
+		return nil, ErrInvalidPacketEncoding
+	}
+	return RawPacket(b), nil
+}
+
+// Version returns the version of the packet format.
+func (p RawPacket) Version() uint32 {
+	return uint32(p[versionOffset])
+}
+
+// Alpha returns the public element of the packet header.
+func (p RawPacket) Alpha() []byte {
+	return p[alphaOffset:betaOffset:betaOffset]
+}
+
+// Beta returns the encrypted routing block of the packet header.
+func (p RawPacket) Beta() []byte {
+	return p[betaOffset:macOffset:macOffset]
+}
+
+// Mac returns the message authentication code of the routing block.
+func (p RawPacket) Mac() []byte {
+	return p[macOffset:payloadOffset:payloadOffset]
+}
+
+// Payload returns the encrypted payload of the packet.
+func (p RawPacket) Payload() []byte {
+	return p[payloadOffset:PacketSize:PacketSize]
+}
+
+// Header returns the header of the packet.
+func (p RawPacket) Header() Header {
+	return Header{Alpha: p.Alpha(), Beta: p.Beta(), Mac: p.Mac()}
+}
+
+// EncodePacket encodes the packet into the binary wire format.
+// It returns ErrInvalidPacketEncoding if any of the packet fields does not have its defined size.
+func EncodePacket(packet *SphinxPacket) ([]byte, error) {
+	if packet == nil || packet.Hdr == nil {
+		return nil, ErrInvalidPacketEncoding
+	}
+	return encodePacket(packet.Version, packet.Hdr, packet.Pld)
+}
+
+func encodePacket(version uint32, header *Header, payload []byte) ([]byte, error) {
+	if version > math.MaxUint8 ||
+		len(header.Alpha) != PublicKeySize ||
+		len(header.Beta) != BetaSize ||
+		len(header.Mac) != MacSize ||
+		len(payload) != PayloadSize {
+		return nil, ErrInvalidPacketEncoding
+	}
+
+	b := make([]byte, PacketSize)
+	b[versionOffset] = byte(version)
+	copy(b[alphaOffset:], header.Alpha)
+	copy(b[betaOffset:], header.Beta)
+	copy(b[macOffset:], header.Mac)
+	copy(b[payloadOffset:], payload)
+	return b, nil
+}
+
+// DecodePacket decodes the packet from either the binary wire format, or the legacy protobuf encoding.
+// The packet decoded from the binary format shares the memory with b.
+func DecodePacket(b []byte) (SphinxPacket, error) {
+	version, header, payload, err := decodePacket(b)
+	if err != nil {
+		return SphinxPacket{}, err
+	}
+	return SphinxPacket{Hdr: &header, Pld: payload, Version: version}, nil
+}
+
+// PacketVersion returns the version of the format of the encoded packet.
+func PacketVersion(b []byte) (uint32, error) {
+	version, _, _, err := decodePacket(b)
+	return version, err
+}
+
+// decodePacket implements DecodePacket, without allocating any memory for packets in the binary format.
+// The encoding is recognised by the length of the packet. Only the parsing of the packet itself is free
+// of allocations, the routing information of the hop is copied out of the decrypted header by routingLayout.decode.
+func decodePacket(b []byte) (uint32, Header, []byte, error) {
+	if len(b) == PacketSize {
+		packet := RawPacket(b)
+		return packet.Version(), packet.Header(), packet.Payload(), nil
+	}
+
+	var packet SphinxPacket
+	if err := proto.Unmarshal(b, &packet); err != nil {
+		return 0, Header{}, nil, ErrInvalidPacketEncoding
+	}
+	if packet.Hdr == nil {
+		return 0, Header{}, nil, ErrInvalidPacketEncoding
+	}
+	return packet.Version, *packet.Hdr, packet.Pld, nil
+}
+
+// encode encodes the routing information of a single hop into a slot of RoutingInfoSize bytes,
+// where each field has its fixed offset.
+func (l routingLayout) encode(routingInfo *RoutingInfo) ([]byte, error) {
+	hop, commands := routingInfo.NextHop, routingInfo.RoutingCommands
+	if hop == nil || commands == nil {
+		return nil, errors.New("incomplete routing information")
+	}
+	if len(commands.Flag) > 1 {
+		return nil, ErrRoutingInfoTooLong
+	}
+
+	encoded := make([]byte, RoutingInfoSize)
+	if len(commands.Flag) == 1 {
+		encoded[routingFlagOffset] = commands.Flag[0]
+	}
+	if commands.Reply {
+		encoded[routingReplyOffset] = 1
+	}
+	binary.BigEndian.PutUint64(encoded[routingDelayOffset:], math.Float64bits(commands.Delay))
+
+	addressOffset := routingIDOffset + l.idSize
+	commandsOffset := addressOffset + l.addressSize
+	if err := putRoutingField(encoded[routingPubKeyOffset:routingIDOffset], hop.PubKey); err != nil {
+		return nil, err
+	}
+	if err := putRoutingField(encoded[routingIDOffset:addressOffset], []byte(hop.Id)); err != nil {
+		return nil, err
+	}
+	if err := putRoutingField(encoded[addressOffset:commandsOffset], []byte(hop.Address)); err != nil {
+		return nil, err
+	}
+	if err := putHopCommands(encoded[commandsOffset:], commands.HopCommands); err != nil {
+		return nil, err
+	}
+	return encoded, nil
+}
+
+// decode recovers the routing information of a single hop encoded with encode.
+// The fields of the returned routing information are copies, so they do not share the memory with encoded.
+func (l routingLayout) decode(encoded []byte) (RoutingInfo, error) {
+	if len(encoded) != RoutingInfoSize {
+		return RoutingInfo{}, ErrRoutingInfoTooLong
+	}
+
+	addressOffset := routingIDOffset + l.idSize
+	commandsOffset := addressOffset + l.addressSize
+	pubKey, err := getRoutingField(encoded[routingPubKeyOffset:routingIDOffset])
+	if err != nil {
+		return RoutingInfo{}, err
+	}
+	id, err := getRoutingField(encoded[routingIDOffset:addressOffset])
+	if err != nil {
+		return RoutingInfo{}, err
+	}
+	address, err := getRoutingField(encoded[addressOffset:commandsOffset])
+	if err != nil {
+		return RoutingInfo{}, err
+	}
+	hopCommands, err := getHopCommands(encoded[commandsOffset:])
+	if err != nil {
+		return RoutingInfo{}, err
+	}
+
+	flag := []byte{}
+	if encoded[routingFlagOffset] != 0 {
+		flag = []byte{encoded[routingFlagOffset]}
+	}
+
+	return RoutingInfo{
+		NextHop: &Hop{Id: string(id), Address: string(address), PubKey: append([]byte{}, pubKey...)},
+		RoutingCommands: &Commands{
+			Delay:       math.Float64frombits(binary.BigEndian.Uint64(encoded[routingDelayOffset:])),
+			Flag:        flag,
+			Reply:       encoded[routingReplyOffset] == 1,
+			HopCommands: hopCommands,
+		},
+	}, nil
+}
+
+// putRoutingField writes the value, prefixed with its length, into its slot of the routing information.
+func putRoutingField(slot []byte, value []byte) error {
+	if len(value) > len(slot)-1 {
+		return ErrRoutingInfoTooLong
+	}
+	slot[0] = byte(len(value))
+	copy(slot[1:], value)
+	return nil
+}
+
+// getRoutingField reads the length prefixed value from its slot of the routing information.
+func getRoutingField(slot []byte) ([]byte, error) {
+	length := int(slot[0])
+	if length > len(slot)-1 {
+		return nil, ErrRoutingInfoTooLong
+	}
+	return slot[1 : 1+length], nil
+}
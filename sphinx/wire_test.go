@@ -0,0 +1,110 @@
+// Copyright 2019 The Nym Mixnet Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sphinx
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/nymtech/nym-mixnet/config"
+	"github.com/nymtech/nym-mixnet/flags"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeDecodePacket(t *testing.T) {
+	_, nodes := createTestPath(t, 3)
+	path := config.E2EPath{IngressProvider: nodes[0], Mixes: nodes[1:2], EgressProvider: nodes[2]}
+	packet, err := PackForwardMessage(path, []float64{0.1, 0.2, 0.3}, []byte("Message"))
+	assert.Nil(t, err)
+
+	packetBytes, err := EncodePacket(&packet)
+	assert.Nil(t, err)
+	assert.Len(t, packetBytes, PacketSize)
+	assert.Equal(t, byte(CurrentPacketVersion), packetBytes[0])
+
+	decoded, err := DecodePacket(packetBytes)
+	assert.Nil(t, err)
+	assert.True(t, proto.Equal(&packet, &decoded))
+
+	raw, err := ParseRawPacket(packetBytes)
+	assert.Nil(t, err)
+	assert.Equal(t, packet.Version, raw.Version())
+	assert.Equal(t, packet.Hdr.Alpha, raw.Alpha())
+	assert.Equal(t, packet.Hdr.Beta, raw.Beta())
+	assert.Equal(t, packet.Hdr.Mac, raw.Mac())
+	assert.Equal(t, packet.Pld, raw.Payload())
+
+	allocs := testing.AllocsPerRun(100, func() {
+		raw, _ := ParseRawPacket(packetBytes)
+		_ = raw.Header()
+		_ = raw.Payload()
+	})
+	assert.Zero(t, allocs)
+
+	allocs = testing.AllocsPerRun(100, func() {
+		_, _, _, _ = decodePacket(packetBytes)
+	})
+	assert.Zero(t, allocs)
+}
+
+func TestEncodePacketInvalid(t *testing.T) {
+	_, err := EncodePacket(&SphinxPacket{Hdr: &Header{}, Pld: make([]byte, PayloadSize)})
+	assert.Equal(t, ErrInvalidPacketEncoding, err)
+
+	_, err = EncodePacket(&SphinxPacket{Pld: make([]byte, PayloadSize)})
+	assert.Equal(t, ErrInvalidPacketEncoding, err)
+
+	_, err = ParseRawPacket(make([]byte, PacketSize+1))
+	assert.Equal(t, ErrInvalidPacketEncoding, err)
+
+	_, err = DecodePacket([]byte("not a packet"))
+	assert.Equal(t, ErrInvalidPacketEncoding, err)
+}
+
+func TestProcessSphinxPacketLegacyEncoding(t *testing.T) {
+	privs, nodes := createTestPath(t, 3)
+	path := config.E2EPath{IngressProvider: nodes[0], Mixes: nodes[1:2], EgressProvider: nodes[2]}
+	packet, err := PackForwardMessage(path, []float64{0.1, 0.2, 0.3}, []byte("Message"))
+	assert.Nil(t, err)
+
+	packetBytes, err := proto.Marshal(&packet)
+	assert.Nil(t, err)
+	assert.Len(t, packetBytes, LegacyPacketSize)
+
+	// the processed packet is always sent further in the binary format
+	_, _, packetBytes, err = ProcessSphinxPacket(packetBytes, privs[0])
+	assert.Nil(t, err)
+	assert.Len(t, packetBytes, PacketSize)
+}
+
+func TestCompactRoutingInfo(t *testing.T) {
+	routingInfo := RoutingInfo{
+		NextHop:         &Hop{Id: "Node", Address: "localhost:3333", PubKey: make([]byte, PublicKeySize)},
+		RoutingCommands: &Commands{Delay: 1.25, Flag: flags.LastHopFlag.Bytes(), Reply: true},
+	}
+
+	encoded, err := compactLayout.encode(&routingInfo)
+	assert.Nil(t, err)
+	assert.Len(t, encoded, RoutingInfoSize)
+
+	decoded, err := compactLayout.decode(encoded)
+	assert.Nil(t, err)
+	assert.True(t, proto.Equal(&routingInfo, &decoded))
+
+	routingInfo.NextHop.Id = strings.Repeat("x", compactLayout.idSize)
+	_, err = compactLayout.encode(&routingInfo)
+	assert.Equal(t, ErrRoutingInfoTooLong, err)
+}
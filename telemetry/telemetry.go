@@ -0,0 +1,299 @@
+// Copyright 2019 The Nym Mixnet Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package telemetry implements the counters, gauges and histograms describing the operation of the nodes
+// and clients, which are exposed over HTTP in the Prometheus text exposition format.
+package telemetry
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// ContentType is the content type of the Prometheus text exposition format.
+	ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+	// MetricsPath is the path under which the metrics are served.
+	MetricsPath = "/metrics"
+
+	shutdownTimeout = 5 * time.Second
+)
+
+// DefaultLatencyBuckets are the upper bounds, in seconds, of the buckets of the histograms measuring
+// the time of the operations taking from tens of microseconds to a second.
+var DefaultLatencyBuckets = []float64{0.00005, 0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.05, 0.1, 1}
+
+// metric is a single metric family written by the registry.
+type metric interface {
+	write(w io.Writer, name string)
+}
+
+type registeredMetric struct {
+	name   string
+	help   string
+	kind   string
+	metric metric
+}
+
+// Registry holds the metrics of a single node or client and writes them in the Prometheus text format.
+// Registering two metrics with the same name is a programming error, on which the registry panics.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []registeredMetric
+	names   map[string]struct{}
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]struct{})}
+}
+
+func (r *Registry) register(name string, help string, kind string, m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.names[name]; ok {
+		panic(fmt.Sprintf("telemetry: metric %v registered twice", name))
+	}
+	r.names[name] = struct{}{}
+	r.metrics = append(r.metrics, registeredMetric{name: name, help: help, kind: kind, metric: m})
+}
+
+// NewCounter registers a new counter with the given name and description.
+func (r *Registry) NewCounter(name string, help string) *Counter {
+	c := new(Counter)
+	r.register(name, help, "counter", c)
+	return c
+}
+
+// NewCounterVec registers a new family of counters, which are distinguished by the value of the given label.
+func (r *Registry) NewCounterVec(name string, help string, label string) *CounterVec {
+	v := &CounterVec{label: label, counters: make(map[string]*Counter)}
+	r.register(name, help, "counter", v)
+	return v
+}
+
+// NewCounterFunc registers a counter, whose value is obtained by calling f whenever the metrics are written.
+// It allows to expose the counters already maintained by other components.
+func (r *Registry) NewCounterFunc(name string, help string, f func() float64) {
+	r.register(name, help, "counter", valueFunc(f))
+}
+
+// NewGaugeFunc registers a gauge, whose value is obtained by calling f whenever the metrics are written.
+func (r *Registry) NewGaugeFunc(name string, help string, f func() float64) {
+	r.register(name, help, "gauge", valueFunc(f))
+}
+
+// NewHistogram registers a new histogram with the given upper bounds of its buckets, in ascending order.
+func (r *Registry) NewHistogram(name string, help string, buckets []float64) *Histogram {
+	h := &Histogram{
+		buckets: append([]float64{}, buckets...),
+		counts:  make([]uint64, len(buckets)),
+	}
+	r.register(name, help, "histogram", h)
+	return h
+}
+
+// Write writes all the registered metrics, in the order of their registration, in the Prometheus text format.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	metrics := append([]registeredMetric{}, r.metrics...)
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		fmt.Fprintf(bw, "# HELP %s %s\n", m.name, escapeHelp(m.help))
+		fmt.Fprintf(bw, "# TYPE %s %s\n", m.name, m.kind)
+		m.metric.write(bw, m.name)
+	}
+	return bw.Flush()
+}
+
+// ServeHTTP writes the metrics in response to the scrape request.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	_ = r.Write(w)
+}
+
+// Server serves the metrics of the registry over HTTP.
+type Server struct {
+	server   *http.Server
+	listener net.Listener
+}
+
+// ListenAndServe starts serving the metrics of the registry at MetricsPath on the given address.
+// It returns once the address is bound, while the requests are handled in the background.
+func ListenAndServe(address string, r *Registry) (*Server, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(MetricsPath, r)
+	s := &Server{
+		server:   &http.Server{Handler: mux, ReadHeaderTimeout: shutdownTimeout},
+		listener: listener,
+	}
+	go func() {
+		_ = s.server.Serve(listener)
+	}()
+	return s, nil
+}
+
+// Addr returns the address on which the metrics are served.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Close stops serving the metrics, waiting a short while for the requests in progress.
+func (s *Server) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return s.server.Shutdown(ctx)
+}
+
+// Counter is a monotonically increasing count of events.
+type Counter struct {
+	value uint64
+}
+
+// Inc increments the counter by one.
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+// Add increments the counter by n.
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.value, n)
+}
+
+// Value returns the current value of the counter.
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+func (c *Counter) write(w io.Writer, name string) {
+	fmt.Fprintf(w, "%s %d\n", name, c.Value())
+}
+
+// CounterVec is a family of counters distinguished by the value of a single label.
+type CounterVec struct {
+	mu       sync.Mutex
+	label    string
+	counters map[string]*Counter
+}
+
+// WithLabel returns the counter of the given label value, creating it on the first use.
+func (v *CounterVec) WithLabel(value string) *Counter {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	c, ok := v.counters[value]
+	if !ok {
+		c = new(Counter)
+		v.counters[value] = c
+	}
+	return c
+}
+
+func (v *CounterVec) write(w io.Writer, name string) {
+	v.mu.Lock()
+	values := make([]string, 0, len(v.counters))
+	for value := range v.counters {
+		values = append(values, value)
+	}
+	v.mu.Unlock()
+
+	sort.Strings(values)
+	for _, value := range values {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", name, v.label, escapeLabelValue(value), v.WithLabel(value).Value())
+	}
+}
+
+type valueFunc func() float64
+
+func (f valueFunc) write(w io.Writer, name string) {
+	fmt.Fprintf(w, "%s %s\n", name, formatFloat(f()))
+}
+
+// Histogram counts the observed values in buckets of the configured upper bounds.
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	// counts holds the numbers of observations falling into each bucket, without the ones of the lower buckets
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Observe adds the value to the histogram.
+func (h *Histogram) Observe(value float64) {
+	i := sort.SearchFloat64s(h.buckets, value)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += value
+}
+
+// ObserveSince adds the time elapsed since start, in seconds, to the histogram.
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+func (h *Histogram) write(w io.Writer, name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	cumulative := uint64(0)
+	for i, bound := range h.buckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(bound), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func escapeHelp(help string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(value)
+}
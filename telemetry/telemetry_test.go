@@ -0,0 +1,85 @@
+// Copyright 2019 The Nym Mixnet Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package telemetry
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryWrite(t *testing.T) {
+	r := NewRegistry()
+	received := r.NewCounter("test_received_total", "Number of received packets.")
+	dropped := r.NewCounterVec("test_dropped_total", "Number of dropped packets.", "reason")
+	r.NewGaugeFunc("test_queue_packets", "Number of queued packets.", func() float64 { return 3 })
+	latency := r.NewHistogram("test_latency_seconds", "Processing time.", []float64{0.1, 1})
+
+	received.Inc()
+	received.Add(2)
+	dropped.WithLabel("replayed").Inc()
+	dropped.WithLabel("invalid \"size\"").Inc()
+	latency.Observe(0.05)
+	latency.Observe(0.1)
+	latency.Observe(5)
+
+	var b bytes.Buffer
+	assert.Nil(t, r.Write(&b))
+	assert.Equal(t, `# HELP test_received_total Number of received packets.
+# TYPE test_received_total counter
+test_received_total 3
+# HELP test_dropped_total Number of dropped packets.
+# TYPE test_dropped_total counter
+test_dropped_total{reason="invalid \"size\""} 1
+test_dropped_total{reason="replayed"} 1
+# HELP test_queue_packets Number of queued packets.
+# TYPE test_queue_packets gauge
+test_queue_packets 3
+# HELP test_latency_seconds Processing time.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{le="0.1"} 2
+test_latency_seconds_bucket{le="1"} 2
+test_latency_seconds_bucket{le="+Inf"} 3
+test_latency_seconds_sum 5.15
+test_latency_seconds_count 3
+`, b.String())
+}
+
+func TestRegistryDuplicateName(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("test_total", "")
+	assert.Panics(t, func() { r.NewGaugeFunc("test_total", "", func() float64 { return 0 }) })
+}
+
+func TestListenAndServe(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("test_total", "Test counter.").Inc()
+
+	s, err := ListenAndServe("127.0.0.1:0", r)
+	assert.Nil(t, err)
+	defer s.Close()
+
+	resp, err := http.Get("http://" + s.Addr().String() + MetricsPath)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+
+	assert.Equal(t, ContentType, resp.Header.Get("Content-Type"))
+	assert.Contains(t, string(body), "test_total 1\n")
+}